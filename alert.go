@@ -1,8 +1,8 @@
 package mqttGather
 
 import (
+	"database/sql"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -38,6 +38,19 @@ type Notifier interface {
 	SendAlert(msg, signifier, phone string) (*Alert, error)
 }
 
+// Notifiers may implement `Channel` to name the channel they use in
+// metrics.
+type namedNotifier interface {
+	Channel() string
+}
+
+func notifierChannel(n Notifier) string {
+	if named, ok := n.(namedNotifier); ok {
+		return named.Channel()
+	}
+	return "unknown"
+}
+
 // Configuration information for SMS notifier:
 // `Phone` : target MSISDN
 // `Key`   : API key
@@ -46,6 +59,8 @@ type SMS struct {
 	Key string
 }
 
+func (s *SMS) Channel() string { return "sms" }
+
 func normalizePhone(phoneNr string) (string, error) {
 	switch {
 	case strings.HasPrefix(phoneNr, "01"):
@@ -76,14 +91,15 @@ func (s *SMS) SendAlert(msg, signifier, phone string) (*Alert, error) {
 
 		resp, err = http.Get(target)
 	} else {
-		log.Printf("not sending alert, no SMS key set.")
+		logger("alert").Warn("not sending alert, no SMS key set", "device", signifier)
 		status = "not sent, no sms key"
 	}
 	if err != nil {
 		status = err.Error()
-		log.Printf("could not send alert: %v", err)
-	} else {
+		logger("alert").Error("could not send alert", "device", signifier, "err", err)
+	} else if resp != nil {
 		status = resp.Status
+		resp.Body.Close()
 	}
 	return &Alert{
 		signifier,
@@ -93,3 +109,59 @@ func (s *SMS) SendAlert(msg, signifier, phone string) (*Alert, error) {
 		status,
 	}, err
 }
+
+// Load the alerts sent in the period, newest first. Alerts of all devices
+// are loaded if `signifier` is empty.
+func (s *SqliteDB) LoadAlerts(signifier string, begin, end time.Time, limit int) ([]Alert, error) {
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query(signifier, signifier, begin.Unix(), end.Unix(), limit)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var alerts []Alert
+		for rows.Next() {
+			var alert Alert
+			var phone, message, status sql.NullString
+			if err := rows.Scan(
+				&alert.DeviceSignifier,
+				&alert.Timestamp,
+				&phone,
+				&message,
+				&status,
+			); err != nil {
+				return nil, err
+			}
+			alert.AlertPhone, alert.Message, alert.Status = phone.String, message.String, status.String
+			alerts = append(alerts, alert)
+		}
+		return alerts, rows.Err()
+	}
+
+	sql := `
+SELECT
+	d.device_signifier,
+	ts,
+	alert_phone,
+	message,
+	status
+FROM
+	alert a
+JOIN
+	device d
+ON
+	d.device_id = a.device_id
+WHERE
+	(:SIGNIFIER = '' OR d.device_signifier = :SIGNIFIER2)
+AND
+	ts >= :BEGIN AND ts < :END
+ORDER BY
+	ts DESC, alert_id DESC
+LIMIT :LIMIT
+`
+	alerts_, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	return alerts_.([]Alert), nil
+}
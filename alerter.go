@@ -1,8 +1,10 @@
 package mqttGather
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 	//	"time"
 )
@@ -15,70 +17,247 @@ import (
 //     -     in the past `DelayMS` ms
 //     - AND no previous Alert has been send in the past DeadTime
 // - an SMS Alert is send and persisted.
+//
+// After each evaluation the alert state of the device is passed to
+// `OnState`, e.g. to republish it (see republish.go), sent alerts are
+// passed to `OnAlert`. Without a `Notifier` (no SMS key) only the alert
+// states are evaluated.
+
+const (
+	ALERT_STATE_OK       = "ok"       // below the threshold
+	ALERT_STATE_EXCEEDED = "exceeded" // threshold exceeded, no alert (yet)
+	ALERT_STATE_ALERT    = "alert"    // exceeded and alerted within the dead time
+)
+
+// Alert state of a device after evaluating stats.
+type AlertState struct {
+	Device    string
+	State     string
+	Max       float64 // of the evaluated stats
+	Threshold float64
+	Timestamp time.Time
+	Info      *DeviceInfo
+}
 
 type Alerter struct {
 	DB           *SqliteDB
-	Notifier     Notifier
+	Notifier     Notifier // nil: no alerts are sent
 	StatsChannel <-chan DBAStats
-	Done         chan<- bool
+	OnState      func(AlertState)          // optional, must not block
+	OnAlert      func(*Alert, *DeviceInfo) // optional, must not block
+
+	errCount   int           // used to throttle logging of configuration errors
+	running    int32         // accessed atomically
+	evaluating int64         // start of the current evaluation (unix ns), 0 if idle, accessed atomically
+	done       chan struct{} // closed when the alerter goroutine exits
+	quit       chan struct{} // closed to stop the alerter without closing the stats channel
+	mu         sync.Mutex    // held while evaluating, guards DB and Notifier
+}
+
+// Replaces the notifier, e.g. after the SMS key changed.
+func (a *Alerter) SetNotifier(n Notifier) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Notifier = n
+}
+
+// Replaces the database once the current evaluation is finished.
+func (a *Alerter) setDB(db *SqliteDB) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.DB = db
+}
+
+// Whether the alerter goroutine is processing stats.
+func (a *Alerter) Running() bool {
+	return atomic.LoadInt32(&a.running) == 1
+}
+
+// Evaluations taking longer than this (e.g. a notifier that doesn't
+// return) are considered stuck.
+const ALERTER_MAX_EVALUATION = 2 * time.Minute
+
+// Returns an error if the alerter isn't running or is stuck evaluating
+// stats, in both cases no alerts are sent.
+func (a *Alerter) Check() error {
+	if !a.Running() {
+		return fmt.Errorf("alerter not running")
+	}
+	if start := atomic.LoadInt64(&a.evaluating); start != 0 {
+		if d := time.Since(time.Unix(0, start)); d > ALERTER_MAX_EVALUATION {
+			return fmt.Errorf("alerter stuck evaluating stats for %v", d.Round(time.Second))
+		}
+	}
+	return nil
 }
 
-func NewAlerter(cfg *RunConfig, mqtt *Mqtt, done chan<- bool) *Alerter {
-	return &Alerter{
-		mqtt.db.(*SqliteDB),
-		&SMS{cfg.SMSKey},
-		mqtt.statsChannel,
-		done,
+// Creates an alerter evaluating the stats received by `mqtt`, which
+// only passes stats on once an alerter was created.
+func NewAlerter(cfg *RunConfig, mqtt *Mqtt) *Alerter {
+	a := &Alerter{
+		DB:           mqtt.db.(*SqliteDB),
+		Notifier:     newNotifier(cfg),
+		StatsChannel: mqtt.statsChannel,
+		OnState:      mqtt.forwardAlertState,
+		OnAlert:      mqtt.forwardAlert,
 	}
+	mqtt.mu.Lock()
+	mqtt.alerter = a
+	mqtt.mu.Unlock()
+	return a
+}
+
+// The notifier as configured, nil if there is no SMS key.
+func newNotifier(cfg *RunConfig) Notifier {
+	if cfg.SMSKey == "" {
+		return nil
+	}
+	return &SMS{cfg.SMSKey}
 }
 
 func (a *Alerter) Start() {
 
+	atomic.StoreInt32(&a.running, 1)
+	a.done = make(chan struct{})
+	a.quit = make(chan struct{})
 	go func() {
-		i := 0
-		log.Printf("started alerter.")
-		for stats := range a.StatsChannel {
-			cfg, err := a.DB.LoadDeviceInfo(stats.Signifier)
-
-			if err != nil {
-				if i%30 == 0 {
-					log.Printf("E: could not load configuration for device: %s (%v)", stats.Signifier, err)
+		logger("alerter").Info("started alerter")
+		a.run()
+		atomic.StoreInt32(&a.running, 0)
+		logger("alerter").Info("stopped alerter")
+		close(a.done)
+	}()
+}
+
+// Evaluates stats until the stats channel is closed or the alerter is
+// stopped.
+func (a *Alerter) run() {
+	for {
+		select {
+		case stats, ok := <-a.StatsChannel:
+			if !ok {
+				return
+			}
+			a.evaluate(stats)
+		case <-a.quit:
+			// evaluate the stats passed on before stopping
+			for {
+				select {
+				case stats, ok := <-a.StatsChannel:
+					if !ok {
+						return
+					}
+					a.evaluate(stats)
+				default:
+					return
 				}
-				i += 1
-				continue
 			}
+		}
+	}
+}
 
-			if stats.Max < cfg.AlertThreshold {
-				continue
-			}
-			// TODO check alerts activated ...
-			lastAlert, err := a.DB.LoadLastAlert(stats.Signifier)
+// Stops the alerter once the stats already passed on are evaluated, e.g.
+// after the SMS key was removed. The stats channel stays open, `mqtt` must
+// no longer pass stats on to this alerter.
+func (a *Alerter) stop(ctx context.Context) error {
+	if a.done == nil {
+		return nil // never started
+	}
+	close(a.quit)
+	return a.Shutdown(ctx)
+}
 
-			if lastAlert.Timestamp+cfg.AlertDeadtime > time.Now().Unix() {
-				continue
-			}
+// Waits for the alerter to evaluate the remaining stats and exit, which
+// it does once the stats channel is closed (see `Mqtt.Shutdown`).
+func (a *Alerter) Shutdown(ctx context.Context) error {
+	if a.done == nil {
+		return nil // never started
+	}
+	return waitContext(ctx, func() { <-a.done })
+}
 
-			cnt, err := a.DB.GetCountThresholdExceeded(stats.Signifier, cfg.AlertDuration, cfg.AlertThreshold)
-			if err != nil {
-				log.Printf("E: could not retrieve count for: %s (%#v): %v", stats.Signifier, a, err)
-				continue
-			}
+// Checks whether `stats` leads to an alert and sends it.
+func (a *Alerter) evaluate(stats DBAStats) {
+	atomic.StoreInt64(&a.evaluating, time.Now().UnixNano())
+	defer atomic.StoreInt64(&a.evaluating, 0)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if state := a.check(stats); state != nil && a.OnState != nil {
+		a.OnState(*state)
+	}
+}
 
-			log.Printf("D: %d threshold violations in %d for %s", cnt, cfg.AlertDuration, stats.Signifier)
+// Evaluates `stats`, sending an alert if necessary. Returns the alert
+// state of the device, nil if it can't be determined.
+func (a *Alerter) check(stats DBAStats) *AlertState {
+	log := logger("alerter").With("device", stats.Signifier)
 
-			if cnt >= cfg.AlertCount {
-				log.Printf("D: %d threshold violations, sending SMS to %s", cnt, cfg.AlertPhone)
-				msg := fmt.Sprintf("Lautstaerkeueberschreitung an Strassenmusik-Messgeraet %s", cfg.Description)
+	cfg, err := a.DB.LoadDeviceInfo(stats.Signifier)
 
-				// no need to handle error, sendAlert either takes down system
-				// or logs failure. There's nothing more we can do at the moment.
-				alert, err := a.Notifier.SendAlert(msg, stats.Signifier, cfg.AlertPhone)
+	if err != nil {
+		if a.errCount%30 == 0 {
+			log.Error("could not load configuration for device", "err", err)
+		}
+		a.errCount += 1
+		return nil
+	}
+	// only counted for configured devices, see metrics.go
+	metricAlertEvaluations.Inc(stats.Signifier)
+	state := &AlertState{
+		Device:    stats.Signifier,
+		State:     ALERT_STATE_OK,
+		Max:       stats.Max,
+		Threshold: cfg.AlertThreshold,
+		Timestamp: time.Now(),
+		Info:      cfg,
+	}
 
-				if _, err = a.DB.SaveAlert(alert); err != nil {
-					log.Printf("E: could no save alert: %#v (%v)", alert, err)
-				}
-			}
+	if stats.Max < cfg.AlertThreshold {
+		return state
+	}
+	state.State = ALERT_STATE_EXCEEDED
+	// TODO check alerts activated ...
+	lastAlert, err := a.DB.LoadLastAlert(stats.Signifier)
+
+	if lastAlert.Timestamp+cfg.AlertDeadtime > time.Now().Unix() {
+		state.State = ALERT_STATE_ALERT
+		return state
+	}
+	if a.Notifier == nil {
+		return state
+	}
+
+	cnt, err := a.DB.GetCountThresholdExceeded(stats.Signifier, cfg.AlertDuration, cfg.AlertThreshold)
+	if err != nil {
+		log.Error("could not retrieve threshold count", "err", err)
+		return nil
+	}
+
+	log.Debug("threshold violations", "count", cnt, "duration", cfg.AlertDuration)
+
+	if cnt >= cfg.AlertCount {
+		log.Info("threshold violations, sending alert", "count", cnt, "phone", cfg.AlertPhone)
+		msg := fmt.Sprintf("Lautstaerkeueberschreitung an Strassenmusik-Messgeraet %s", cfg.Description)
+
+		// no need to handle error, sendAlert either takes down system
+		// or logs failure. There's nothing more we can do at the moment.
+		alert, err := a.Notifier.SendAlert(msg, stats.Signifier, cfg.AlertPhone)
+		if err != nil {
+			metricNotificationsFailed.Inc(notifierChannel(a.Notifier))
+		} else {
+			metricNotificationsSent.Inc(notifierChannel(a.Notifier))
 		}
-		a.Done <- true
-	}()
+		if alert == nil {
+			return state
+		}
+		state.State = ALERT_STATE_ALERT
+
+		if _, err = a.DB.SaveAlert(alert); err != nil {
+			log.Error("could not save alert", "alert", alert, "err", err)
+		}
+		if a.OnAlert != nil {
+			a.OnAlert(alert, cfg)
+		}
+	}
+	return state
 }
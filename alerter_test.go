@@ -2,8 +2,10 @@ package mqttGather
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -39,17 +41,19 @@ func TestAlerter(t *testing.T) {
 		return nil
 	})
 	channel := make(chan DBAStats)
-	done := make(chan bool)
 
+	var states []string
+	var alerts []*Alert
 	alerter := Alerter{
 		DB:           db,
 		Notifier:     notifier,
 		StatsChannel: channel,
-		Done:         done,
+		OnState:      func(state AlertState) { states = append(states, state.State) },
+		OnAlert:      func(alert *Alert, info *DeviceInfo) { alerts = append(alerts, alert) },
 	}
 
-	alerter.Start()
-
+	// stats are evaluated synchronously to avoid racing the alerter
+	// goroutine, `Start` is checked below.
 	// insert 5 Stats below threshold
 	for i := 0; i != 5; i++ {
 		s := DBAStats{
@@ -59,7 +63,7 @@ func TestAlerter(t *testing.T) {
 		if _, err := db.SaveNow(&s); err != nil {
 			t.Fatalf("%v", err)
 		}
-		channel <- s
+		alerter.evaluate(s)
 	}
 	// send stats, check
 	if m_is != "" || s_is != "" {
@@ -72,7 +76,7 @@ func TestAlerter(t *testing.T) {
 			Max:       102.0,
 		}
 		db.SaveNow(&s)
-		channel <- s
+		alerter.evaluate(s)
 	}
 	// aend stats, check
 	if m_is != "" || s_is != "" {
@@ -84,7 +88,7 @@ func TestAlerter(t *testing.T) {
 		Max:       102.5,
 	}
 	db.SaveNow(&s)
-	channel <- s
+	alerter.evaluate(s)
 
 	if m_is != "Lautstaerkeueberschreitung an Strassenmusik-Messgeraet bla" || s_is != TEST_SIGNIFIER {
 		t.Fatalf("no notification! >%v< >%v<", m_is, s_is == TEST_SIGNIFIER)
@@ -93,13 +97,75 @@ func TestAlerter(t *testing.T) {
 	m_is = "nothing"
 
 	db.SaveNow(&s)
-	channel <- s
+	alerter.evaluate(s)
 
 	if m_is != "nothing" {
 		t.Fatalf("received unwarranted alert (3:deadtime) %s", m_is)
 	}
 
+	if sent := metricNotificationsSent.Value("unknown"); sent < 1 {
+		t.Fatalf("notification not counted: %f", sent)
+	}
+	should := "ok ok ok ok ok exceeded exceeded alert alert"
+	if is := strings.Join(states, " "); is != should {
+		t.Fatalf("unexpected alert states: %s, should: %s", is, should)
+	}
+	if len(alerts) != 1 || alerts[0].DeviceSignifier != TEST_SIGNIFIER {
+		t.Fatalf("unexpected alerts: %#v", alerts)
+	}
+
+	alerter.Start()
+	channel <- s
 	close(channel)
-	<-done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := alerter.Shutdown(ctx); err != nil || alerter.Running() {
+		t.Fatalf("alerter not stopped: %v", err)
+	}
 
 }
+
+func TestAlerterWithoutNotifier(t *testing.T) {
+	db, _ := getTestDBWithDeviceInfo(t)
+	defer db.Close()
+
+	var states []string
+	alerter := Alerter{
+		DB:      db,
+		OnState: func(state AlertState) { states = append(states, state.State) },
+	}
+	for _, max := range []float64{1.5, 102.0, 102.0, 102.5, 102.5} {
+		s := DBAStats{Signifier: TEST_SIGNIFIER, Max: max}
+		db.SaveNow(&s)
+		alerter.evaluate(s)
+	}
+	should := "ok exceeded exceeded exceeded exceeded"
+	if is := strings.Join(states, " "); is != should {
+		t.Fatalf("unexpected alert states: %s, should: %s", is, should)
+	}
+	if n := count(t, db, "alert"); n != 0 {
+		t.Fatalf("alerts saved without notifier: %d", n)
+	}
+}
+
+func TestNotifyAlerterBusy(t *testing.T) {
+	mqtt := &Mqtt{statsChannel: make(chan DBAStats, STATS_QUEUE_SIZE), alerter: &Alerter{}}
+	dropped := metricAlertDropped.Value()
+
+	// nothing consumes the stats, the handlers must not block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i != STATS_QUEUE_SIZE+1; i++ {
+			mqtt.notify(DBAStats{Signifier: TEST_SIGNIFIER})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notify blocked")
+	}
+	if len(mqtt.statsChannel) != STATS_QUEUE_SIZE || metricAlertDropped.Value() != dropped+1 {
+		t.Fatalf("unexpected queue: %d, dropped %f", len(mqtt.statsChannel), metricAlertDropped.Value()-dropped)
+	}
+}
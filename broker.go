@@ -0,0 +1,155 @@
+package mqttGather
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Embedded MQTT broker (https://github.com/mochi-mqtt/server) for
+// installations without a separate broker and for integration tests.
+// Devices connect to the embedded broker directly and the gatherer
+// subscribes to it via the loopback interface like it would to any other
+// broker.
+//
+// The broker listens on `broker_addr`, on the loopback interface unless
+// a host is given (e.g. `0.0.0.0:1883` to accept devices from the
+// network). If `broker_user` is set, clients have to authenticate using
+// `broker_user` and `broker_password`. If `broker_tls_cert` and
+// `broker_tls_key` are set, `broker_addr` only accepts TLS connections and
+// the gatherer connects via an additional plain listener on the loopback
+// interface (which requires authentication as well).
+//
+// Sessions are kept in memory only, they don't survive a restart.
+
+// Maximum size of a packet accepted by the broker.
+const BROKER_MAX_PACKET = 1 << 20
+
+type Broker struct {
+	server *mochi.Server
+	addr   string // devices listener
+	local  string // listener the gatherer connects to
+}
+
+// Starts the broker configured by the `broker_*` settings.
+func StartBroker(cfg *RunConfig) (*Broker, error) {
+	addr, err := brokerListenAddr(cfg.BrokerAddr)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if cfg.BrokerTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.BrokerTLSCert, cfg.BrokerTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load broker certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	server := mochi.New(&mochi.Options{Logger: logger("broker")})
+	server.Options.Capabilities.MaximumPacketSize = BROKER_MAX_PACKET
+	hook := &brokerHook{user: []byte(cfg.BrokerUser), password: []byte(cfg.BrokerPassword)}
+	if err := server.AddHook(hook, nil); err != nil {
+		return nil, err
+	}
+
+	devices := listeners.NewTCP(listeners.Config{ID: "devices", Address: addr, TLSConfig: tlsConfig})
+	if err := server.AddListener(devices); err != nil {
+		return nil, err
+	}
+	b := &Broker{server: server, addr: devices.Address(), local: devices.Address()}
+	if tlsConfig != nil {
+		local := listeners.NewTCP(listeners.Config{ID: "local", Address: "127.0.0.1:0"})
+		if err := server.AddListener(local); err != nil {
+			server.Close()
+			return nil, err
+		}
+		b.local = local.Address()
+	}
+	if err := server.Serve(); err != nil {
+		server.Close()
+		return nil, err
+	}
+	logger("broker").Info("started broker", "addr", b.addr, "tls", tlsConfig != nil, "authentication", cfg.BrokerUser != "")
+	return b, nil
+}
+
+// Listen address for `broker_addr`, the loopback interface if no host
+// is given.
+func brokerListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker_addr: %v", err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Address devices connect to.
+func (b *Broker) Addr() string {
+	return b.addr
+}
+
+// URL to connect to the broker from the same host.
+func (b *Broker) LocalURL() string {
+	_, port, _ := net.SplitHostPort(b.local)
+	return fmt.Sprintf("tcp://127.0.0.1:%s", port)
+}
+
+// Stops accepting connections and disconnects all clients.
+func (b *Broker) Close() error {
+	return b.server.Close()
+}
+
+// Authenticates clients and counts connected clients.
+type brokerHook struct {
+	mochi.HookBase
+	user     []byte // no authentication if empty
+	password []byte
+}
+
+func (h *brokerHook) ID() string {
+	return "mqttgather"
+}
+
+func (h *brokerHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mochi.OnConnectAuthenticate,
+		mochi.OnACLCheck,
+		mochi.OnSessionEstablished,
+		mochi.OnDisconnect,
+	}, []byte{b})
+}
+
+func (h *brokerHook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	if len(h.user) == 0 {
+		return true
+	}
+	user := subtle.ConstantTimeCompare(pk.Connect.Username, h.user)
+	password := subtle.ConstantTimeCompare(pk.Connect.Password, h.password)
+	if user&password != 1 {
+		logger("broker").Warn("authentication failed", "client_id", cl.ID, "remote", cl.Net.Remote)
+		return false
+	}
+	return true
+}
+
+func (h *brokerHook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	return true
+}
+
+func (h *brokerHook) OnSessionEstablished(cl *mochi.Client, pk packets.Packet) {
+	metricBrokerClients.Add(1)
+}
+
+func (h *brokerHook) OnDisconnect(cl *mochi.Client, err error, expire bool) {
+	metricBrokerClients.Add(-1)
+}
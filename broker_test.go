@@ -0,0 +1,290 @@
+package mqttGather
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func startTestBroker(t *testing.T) *Broker {
+	return startTestBrokerConfig(t, &RunConfig{BrokerAddr: "127.0.0.1:0"})
+}
+
+func startTestBrokerConfig(t *testing.T, cfg *RunConfig) *Broker {
+	b, err := StartBroker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func testClient(t *testing.T, b *Broker, id string, configure func(*MQTT.ClientOptions)) MQTT.Client {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(b.LocalURL())
+	opts.SetClientID(id)
+	opts.SetAutoReconnect(false)
+	if configure != nil {
+		configure(opts)
+	}
+	c := MQTT.NewClient(opts)
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("could not connect: %v", token.Error())
+	}
+	return c
+}
+
+func testSubscribe(t *testing.T, c MQTT.Client, filter string, qos byte) <-chan MQTT.Message {
+	msgs := make(chan MQTT.Message, 10)
+	token := c.Subscribe(filter, qos, func(c MQTT.Client, msg MQTT.Message) {
+		msgs <- msg
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("could not subscribe: %v", token.Error())
+	}
+	return msgs
+}
+
+func expectMessage(t *testing.T, msgs <-chan MQTT.Message, topic, payload string) MQTT.Message {
+	select {
+	case msg := <-msgs:
+		if msg.Topic() != topic || string(msg.Payload()) != payload {
+			t.Fatalf("unexpected message: %s %s", msg.Topic(), msg.Payload())
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message received on %s", topic)
+	}
+	return nil
+}
+
+func TestBrokerPublishSubscribe(t *testing.T) {
+	b := startTestBroker(t)
+	sub := testClient(t, b, "sub", nil)
+	defer sub.Disconnect(100)
+	pub := testClient(t, b, "pub", nil)
+	defer pub.Disconnect(100)
+
+	stats := testSubscribe(t, sub, "/opennoise/+/dba_stats", 1)
+	all := testSubscribe(t, sub, "/opennoise/#", 0)
+
+	topic := "/opennoise/" + TEST_SIGNIFIER + "/dba_stats"
+	pub.Publish(topic, 1, false, "1,2,3").Wait()
+	if msg := expectMessage(t, stats, topic, "1,2,3"); msg.Qos() != 1 {
+		t.Fatalf("incorrect qos: %d", msg.Qos())
+	}
+	expectMessage(t, all, topic, "1,2,3")
+
+	pub.Publish("/opennoise/"+TEST_SIGNIFIER+"/telemetry", 0, false, "esp:1").Wait()
+	expectMessage(t, all, "/opennoise/"+TEST_SIGNIFIER+"/telemetry", "esp:1")
+	select {
+	case msg := <-stats:
+		t.Fatalf("unexpected message: %s", msg.Topic())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBrokerRetainedAndWill(t *testing.T) {
+	b := startTestBroker(t)
+	pub := testClient(t, b, "pub", func(opts *MQTT.ClientOptions) {
+		opts.SetWill("/status/pub", "offline", 0, true)
+	})
+	pub.Publish("/status/pub", 0, true, "online").Wait()
+
+	sub := testClient(t, b, "sub", nil)
+	defer sub.Disconnect(100)
+	msgs := testSubscribe(t, sub, "/status/+", 0)
+	if msg := expectMessage(t, msgs, "/status/pub", "online"); !msg.Retained() {
+		t.Fatalf("expected retained message")
+	}
+
+	// dropping the connection without DISCONNECT triggers the will.
+	cl, ok := b.server.Clients.Get("pub")
+	if !ok {
+		t.Fatalf("pub not connected")
+	}
+	cl.Stop(errors.New("dropped"))
+	expectMessage(t, msgs, "/status/pub", "offline")
+}
+
+func TestBrokerSharedSubscription(t *testing.T) {
+	b := startTestBroker(t)
+	pub := testClient(t, b, "pub", nil)
+	defer pub.Disconnect(100)
+	var shared []<-chan MQTT.Message
+	for _, id := range []string{"sub-1", "sub-2"} {
+		sub := testClient(t, b, id, nil)
+		defer sub.Disconnect(100)
+		shared = append(shared, testSubscribe(t, sub, "$share/group/sensors/+", 1))
+	}
+	other := testClient(t, b, "other", nil)
+	defer other.Disconnect(100)
+	all := testSubscribe(t, other, "sensors/+", 1)
+
+	// each message goes to one member of the group, non-shared
+	// subscriptions receive every message.
+	for i := 0; i != 4; i++ {
+		payload := fmt.Sprintf("%d", i)
+		pub.Publish("sensors/a", 1, false, payload).Wait()
+		expectMessage(t, all, "sensors/a", payload)
+		var msg MQTT.Message
+		select {
+		case msg = <-shared[0]:
+		case msg = <-shared[1]:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no member received %s", payload)
+		}
+		if msg.Topic() != "sensors/a" || string(msg.Payload()) != payload {
+			t.Fatalf("unexpected message: %s %s", msg.Topic(), msg.Payload())
+		}
+	}
+	for _, msgs := range shared {
+		select {
+		case msg := <-msgs:
+			t.Fatalf("message delivered twice: %s %s", msg.Topic(), msg.Payload())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestBrokerQoS2(t *testing.T) {
+	b := startTestBroker(t)
+	sub := testClient(t, b, "sub", nil)
+	defer sub.Disconnect(100)
+	pub := testClient(t, b, "pub", nil)
+	defer pub.Disconnect(100)
+	msgs := testSubscribe(t, sub, "sensors/+", 2)
+
+	if token := pub.Publish("sensors/a", 2, false, "once"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("could not publish: %v", token.Error())
+	}
+	if msg := expectMessage(t, msgs, "sensors/a", "once"); msg.Qos() != 2 {
+		t.Fatalf("incorrect qos: %d", msg.Qos())
+	}
+	select {
+	case msg := <-msgs:
+		t.Fatalf("message delivered twice: %s %s", msg.Topic(), msg.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBrokerAuthentication(t *testing.T) {
+	b := startTestBrokerConfig(t, &RunConfig{BrokerAddr: "127.0.0.1:0", BrokerUser: "noise", BrokerPassword: "secret"})
+	for _, credentials := range [][2]string{{"", ""}, {"noise", "wrong"}, {"other", "secret"}} {
+		opts := MQTT.NewClientOptions()
+		opts.AddBroker(b.LocalURL())
+		opts.SetClientID("device")
+		opts.SetAutoReconnect(false)
+		opts.SetUsername(credentials[0])
+		opts.SetPassword(credentials[1])
+		c := MQTT.NewClient(opts)
+		if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() == nil {
+			t.Fatalf("expected error for %v", credentials)
+		}
+	}
+	c := testClient(t, b, "device", func(opts *MQTT.ClientOptions) {
+		opts.SetUsername("noise")
+		opts.SetPassword("secret")
+	})
+	c.Disconnect(100)
+}
+
+// Writes a self-signed certificate for 127.0.0.1 to a temporary
+// directory.
+func testCertificate(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mqttgather test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, pool
+}
+
+func TestBrokerTLS(t *testing.T) {
+	cert, key, pool := testCertificate(t)
+	b := startTestBrokerConfig(t, &RunConfig{BrokerAddr: "127.0.0.1:0", BrokerTLSCert: cert, BrokerTLSKey: key})
+	if b.LocalURL() == "tcp://"+b.Addr() {
+		t.Fatalf("gatherer connects to the TLS listener")
+	}
+
+	// devices connect via TLS, the gatherer via the local listener
+	device := testClient(t, b, "device", func(opts *MQTT.ClientOptions) {
+		opts.Servers = nil
+		opts.AddBroker("ssl://" + b.Addr())
+		opts.SetTLSConfig(&tls.Config{RootCAs: pool})
+	})
+	defer device.Disconnect(100)
+	gatherer := testClient(t, b, "gatherer", nil)
+	defer gatherer.Disconnect(100)
+	msgs := testSubscribe(t, gatherer, "sensors/+", 1)
+	device.Publish("sensors/a", 1, false, "encrypted").Wait()
+	expectMessage(t, msgs, "sensors/a", "encrypted")
+
+	// no plain connections on the devices listener
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker("tcp://" + b.Addr())
+	opts.SetAutoReconnect(false)
+	opts.SetConnectTimeout(time.Second)
+	if token := MQTT.NewClient(opts).Connect(); token.WaitTimeout(5*time.Second) && token.Error() == nil {
+		t.Fatalf("expected error for plain connection")
+	}
+}
+
+func TestBrokerListenAddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		":1883":        "127.0.0.1:1883",
+		"0.0.0.0:1883": "0.0.0.0:1883",
+		"[::1]:1883":   "[::1]:1883",
+	} {
+		if is, err := brokerListenAddr(addr); err != nil || is != expected {
+			t.Fatalf("listen address of %q is: %q should: %q (%v)", addr, is, expected, err)
+		}
+	}
+	if _, err := brokerListenAddr("1883"); err == nil {
+		t.Fatalf("expected error for missing port")
+	}
+}
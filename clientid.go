@@ -0,0 +1,186 @@
+package mqttGather
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Generation of MQTT client ids. Two clients connecting with the same id
+// kick each other off the broker, so unless a `client_id` is configured
+// explicitly, ids are generated according to `client_id_strategy`:
+//
+//	static : use `client_id` as is (default if `client_id` is set)
+//	random : `client_id` (or "mqttgather") with a random suffix, differs
+//	         on each start (default if `client_id` is not set)
+//	mac    : `client_id` (or "mqttgather") with the MAC address of the
+//	         host as suffix
+//	uuid   : `client_id` (or "mqttgather") with a UUID generated once and
+//	         stored in `client_id_file` as suffix, shortened to fit
+//
+// Persistent sessions require a stable id, i.e. any strategy but random.
+// MQTT 3.1.1 brokers are only required to accept ids of up to 23 bytes,
+// the generated ids aren't longer with the default prefix.
+
+const (
+	CLIENT_ID_STATIC = "static"
+	CLIENT_ID_RANDOM = "random"
+	CLIENT_ID_MAC    = "mac"
+	CLIENT_ID_UUID   = "uuid"
+)
+
+const DEFAULT_CLIENT_ID_PREFIX = "mqttgather"
+
+// Length of client ids all brokers accept.
+const MAX_CLIENT_ID_LEN = 23
+
+// If the connection is lost this soon after connecting several times in
+// a row, the client id is likely used by another client.
+const (
+	CLIENT_ID_COLLISION_WINDOW = 10 * time.Second
+	CLIENT_ID_COLLISION_COUNT  = 3
+)
+
+func clientIdStrategy(cfg *RunConfig) string {
+	switch {
+	case cfg.ClientIdStrategy != "":
+		return cfg.ClientIdStrategy
+	case cfg.ClientId != "":
+		return CLIENT_ID_STATIC
+	default:
+		return CLIENT_ID_RANDOM
+	}
+}
+
+// Determines the client id according to the configured strategy, see
+// above.
+func ResolveClientId(cfg *RunConfig) (string, error) {
+	prefix := cfg.ClientId
+	if prefix == "" {
+		prefix = DEFAULT_CLIENT_ID_PREFIX
+	}
+
+	strategy := clientIdStrategy(cfg)
+	if cfg.PersistentSession && strategy == CLIENT_ID_RANDOM {
+		return "", fmt.Errorf("persistent sessions require a stable client id")
+	}
+
+	switch strategy {
+	case CLIENT_ID_STATIC:
+		if cfg.ClientId == "" {
+			return "", fmt.Errorf("no client id configured")
+		}
+		return cfg.ClientId, nil
+	case CLIENT_ID_RANDOM:
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		return prefix + "-" + hex.EncodeToString(b), nil
+	case CLIENT_ID_MAC:
+		mac, err := hostMAC()
+		if err != nil {
+			return "", err
+		}
+		return prefix + "-" + strings.ReplaceAll(mac.String(), ":", ""), nil
+	case CLIENT_ID_UUID:
+		if cfg.ClientIdFile == "" {
+			return "", fmt.Errorf("client id strategy uuid requires a client_id_file")
+		}
+		uuid, err := loadOrCreateUUID(cfg.ClientIdFile)
+		if err != nil {
+			return "", err
+		}
+		return uuidClientId(prefix, uuid)
+	default:
+		return "", fmt.Errorf("unknown client id strategy: %s", strategy)
+	}
+}
+
+// Hardware address of the first non-loopback interface that has one.
+func hostMAC() (net.HardwareAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) != 0 {
+			return iface.HardwareAddr, nil
+		}
+	}
+	return nil, fmt.Errorf("no network interface with MAC address found")
+}
+
+// Random (version 4) UUID.
+func newUUID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(u)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32]), nil
+}
+
+// Client id of `prefix` and as many hex digits of `uuid` as fit into
+// MAX_CLIENT_ID_LEN bytes, at least 8.
+func uuidClientId(prefix, uuid string) (string, error) {
+	h := strings.ReplaceAll(uuid, "-", "")
+	n := MAX_CLIENT_ID_LEN - len(prefix) - 1
+	if n < 8 {
+		return "", fmt.Errorf("client_id %s too long for client id strategy uuid (at most %d bytes)", prefix, MAX_CLIENT_ID_LEN-9)
+	}
+	if n > len(h) {
+		n = len(h)
+	}
+	return prefix + "-" + h[:n], nil
+}
+
+// Reads the UUID stored in `fn`, creates the file if it doesn't exist.
+func loadOrCreateUUID(fn string) (string, error) {
+	if b, err := os.ReadFile(fn); err == nil {
+		id := strings.TrimSpace(string(b))
+		if id == "" {
+			return "", fmt.Errorf("empty client id file: %s", fn)
+		}
+		return id, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return "", err
+	}
+	return id, os.WriteFile(fn, []byte(id+"\n"), 0644)
+}
+
+// Tracks connections lost shortly after connecting, see
+// `CLIENT_ID_COLLISION_WINDOW`
+type collisionDetector struct {
+	connected  time.Time
+	shortLived int
+}
+
+func (c *collisionDetector) connect(now time.Time) {
+	c.connected = now
+}
+
+// Returns true if the client id is likely used by another client.
+func (c *collisionDetector) connectionLost(now time.Time) bool {
+	if c.connected.IsZero() || now.Sub(c.connected) > CLIENT_ID_COLLISION_WINDOW {
+		c.shortLived = 0
+		return false
+	}
+	c.shortLived += 1
+	return c.shortLived >= CLIENT_ID_COLLISION_COUNT
+}
@@ -0,0 +1,82 @@
+package mqttGather
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveClientId(t *testing.T) {
+	if id, err := ResolveClientId(&RunConfig{ClientId: "gatherer"}); err != nil || id != "gatherer" {
+		t.Fatalf("static: %s (%v)", id, err)
+	}
+
+	id1, err := ResolveClientId(&RunConfig{})
+	if err != nil || !strings.HasPrefix(id1, DEFAULT_CLIENT_ID_PREFIX+"-") {
+		t.Fatalf("random: %s (%v)", id1, err)
+	}
+	id2, _ := ResolveClientId(&RunConfig{})
+	if id1 == id2 {
+		t.Fatalf("random ids not random: %s", id1)
+	}
+	if _, err := ResolveClientId(&RunConfig{PersistentSession: true}); err == nil {
+		t.Fatalf("expected error for random id with persistent session")
+	}
+	if _, err := ResolveClientId(&RunConfig{ClientIdStrategy: "fancy"}); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
+
+func TestClientIdUUID(t *testing.T) {
+	cfg := &RunConfig{
+		ClientIdStrategy:  CLIENT_ID_UUID,
+		ClientIdFile:      filepath.Join(t.TempDir(), "state", "client_id"),
+		PersistentSession: true,
+	}
+	id, err := ResolveClientId(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^mqttgather-[0-9a-f]{12}$`).MatchString(id) || len(id) > MAX_CLIENT_ID_LEN {
+		t.Fatalf("invalid uuid client id: %s", id)
+	}
+	if id2, err := ResolveClientId(cfg); err != nil || id2 != id {
+		t.Fatalf("uuid not stable: %s %s (%v)", id, id2, err)
+	}
+	b, err := os.ReadFile(cfg.ClientIdFile)
+	if err != nil || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\n$`).Match(b) {
+		t.Fatalf("invalid uuid: %q (%v)", b, err)
+	}
+
+	cfg.ClientId = "gw"
+	if id, err := ResolveClientId(cfg); err != nil || len(id) != MAX_CLIENT_ID_LEN || !strings.HasPrefix(id, "gw-") {
+		t.Fatalf("unexpected id with prefix: %s (%v)", id, err)
+	}
+	cfg.ClientId = "opennoise-gatherer"
+	if id, err := ResolveClientId(cfg); err == nil {
+		t.Fatalf("expected error for long prefix: %s", id)
+	}
+}
+
+func TestCollisionDetector(t *testing.T) {
+	var c collisionDetector
+	now := time.Now()
+	if c.connectionLost(now) {
+		t.Fatalf("collision before connecting")
+	}
+	for i := 1; i <= CLIENT_ID_COLLISION_COUNT; i++ {
+		c.connect(now)
+		now = now.Add(time.Second)
+		if collision := c.connectionLost(now); collision != (i == CLIENT_ID_COLLISION_COUNT) {
+			t.Fatalf("%d: unexpected collision: %v", i, collision)
+		}
+	}
+	// a long lived connection resets the count
+	c.connect(now)
+	if c.connectionLost(now.Add(time.Hour)) {
+		t.Fatalf("long lived connection reported as collision")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+const alertsUsage = `usage: %s alerts list [flags]
+
+  list : list the alerts sent in a period, newest first
+
+`
+
+// `alerts` subcommand: inspect sent alerts.
+func alertsCmd(args []string) int {
+	flags := flag.NewFlagSet("alerts", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	device := flags.String("device", "", "signifier (MAC) of the device, all devices if not set")
+	from := flags.String("from", "", "begin of period (YYYY-MM-DD), default: 24h ago")
+	to := flags.String("to", "", "end of period (YYYY-MM-DD), default: now")
+	limit := flags.Int("limit", 100, "maximum number of alerts to list")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), alertsUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+	if action != "list" {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	begin, end, err := parseRange(*from, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+
+	db, code := cf.openDB()
+	if code != EXIT_OK {
+		return code
+	}
+	defer db.Close()
+
+	alerts, err := db.LoadAlerts(*device, begin, end, *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load alerts: %v\n", err)
+		return EXIT_FAILURE
+	}
+	for _, a := range alerts {
+		fmt.Printf("%s %s %s %q (%s)\n",
+			time.Unix(a.Timestamp, 0).Format(time.RFC3339), a.DeviceSignifier, a.AlertPhone, a.Message, a.Status)
+	}
+	return EXIT_OK
+}
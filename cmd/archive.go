@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+const archiveUsage = `usage: %s archive expire|import [flags] [archive files]
+
+  expire : delete (and archive) rows of a table older than -days
+  import : import archive files into the database, e.g. a scratch db
+
+`
+
+// `archive` subcommand: manually expire data and re-import archives.
+func archiveCmd(args []string) int {
+	flags := flag.NewFlagSet("archive", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	table := flags.String("table", "dba_stats", "table to expire")
+	days := flags.Int("days", 0, "expire rows older than this many days")
+	archiveDir := flags.String("archive-dir", "", "directory to write archives to, expired rows are not archived if not set")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), archiveUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+
+	db, code := cf.openDB()
+	if code != EXIT_OK {
+		return code
+	}
+	defer db.Close()
+
+	switch action {
+	case "expire":
+		if *days <= 0 {
+			fmt.Fprintf(os.Stderr, "-days must be positive\n")
+			return EXIT_USAGE
+		}
+		before := time.Now().Add(-time.Duration(*days) * 24 * time.Hour)
+		cnt, err := db.Expire(*table, before, *archiveDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not expire: %v\n", err)
+			return EXIT_FAILURE
+		}
+		fmt.Printf("expired %d rows from %s\n", cnt, *table)
+		return EXIT_OK
+	case "import":
+		if flags.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "no archive files provided\n")
+			return EXIT_USAGE
+		}
+		for _, fn := range flags.Args() {
+			cnt, err := db.ImportArchive(fn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not import %s: %v\n", fn, err)
+				return EXIT_FAILURE
+			}
+			fmt.Printf("imported %d rows from %s\n", cnt, fn)
+		}
+		return EXIT_OK
+	default:
+		flags.Usage()
+		return EXIT_USAGE
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+// Flags shared by the subcommands to load the configuration: the config
+// file (-c), `MQTTGATHER_*` environment variables and flags overriding
+// individual settings, in increasing order of precedence.
+type configFlags struct {
+	file      *string
+	overrides []func(*mqttGather.RunConfig)
+}
+
+// Registers -c and -sqlite, used by the subcommands working on the
+// database.
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	cf := &configFlags{
+		file: flags.String("c", "", "name of (optional) config file, JSON, YAML or TOML"),
+	}
+	cf.string(flags, "sqlite", "connect string to use for sqlite, when in doubt: provide a filename",
+		func(rc *mqttGather.RunConfig, v string) { rc.SqlLiteConnect = v })
+	return cf
+}
+
+// Registers the flags of the collector (`run`).
+func addCollectorFlags(flags *flag.FlagSet) *configFlags {
+	cf := addConfigFlags(flags)
+	cf.string(flags, "topic", "topic to subscribe to", // todo, this should later be a plugin for sensors
+		func(rc *mqttGather.RunConfig, v string) { rc.Topic = v })
+	cf.string(flags, "telemetry-topic", "topic to subscribe to for telemetry data",
+		func(rc *mqttGather.RunConfig, v string) { rc.TelemetryTopic = v })
+	cf.string(flags, "host", "host to connect to",
+		func(rc *mqttGather.RunConfig, v string) { rc.Host = v })
+	cf.string(flags, "broker", "address to run an embedded MQTT broker on (e.g. :1883 on the loopback interface, 0.0.0.0:1883 on all), connects to it if -host is not set",
+		func(rc *mqttGather.RunConfig, v string) { rc.BrokerAddr = v })
+	cf.string(flags, "clientID", "clientId to use for connection",
+		func(rc *mqttGather.RunConfig, v string) { rc.ClientId = v })
+	cf.string(flags, "log-dir", "where to write logs, writes to stdout if not set",
+		func(rc *mqttGather.RunConfig, v string) { rc.LogDir = v })
+	cf.string(flags, "sms-key", "api key for SMS",
+		func(rc *mqttGather.RunConfig, v string) { rc.SMSKey = v })
+	cf.string(flags, "record", "file to record all received messages to, see replay command",
+		func(rc *mqttGather.RunConfig, v string) { rc.RecordFile = v })
+	cf.string(flags, "http", "address to serve metrics and health checks on (e.g. :8080), disabled if not set",
+		func(rc *mqttGather.RunConfig, v string) { rc.HTTPAddr = v })
+	cf.string(flags, "influx", "InfluxDB write URL to forward stats and telemetry to as line protocol, disabled if not set",
+		func(rc *mqttGather.RunConfig, v string) { rc.InfluxURL = v })
+	cf.string(flags, "republish", "topic prefix to republish stats, telemetry and alert states as JSON below (e.g. opennoise/json), disabled if not set",
+		func(rc *mqttGather.RunConfig, v string) { rc.RepublishPrefix = v })
+	cf.bool(flags, "homeassistant", "publish Home Assistant MQTT discovery config for the devices (requires -republish)",
+		func(rc *mqttGather.RunConfig) { rc.HomeAssistant = true })
+	cf.bool(flags, "dashboard", "serve a live dashboard at /dashboard/ (requires -http)",
+		func(rc *mqttGather.RunConfig) { rc.Dashboard = true })
+	cf.bool(flags, "stream", "stream live stats, telemetry and alerts at /stream (requires -http)",
+		func(rc *mqttGather.RunConfig) { rc.Stream = true })
+	cf.bool(flags, "sink-only", "only forward stats and telemetry to sinks (-influx, -republish), don't save them to the database",
+		func(rc *mqttGather.RunConfig) { rc.SinkOnly = true })
+	cf.bool(flags, "auto-migrate", "apply pending schema migrations on startup",
+		func(rc *mqttGather.RunConfig) { rc.AutoMigrate = true })
+	cf.string(flags, "log-format", "log format: text or json (default text)",
+		func(rc *mqttGather.RunConfig, v string) { rc.LogFormat = v })
+	// -v and -silent take precedence over -log-level
+	cf.string(flags, "log-level", "log level: debug, info, warn, error (default info)",
+		func(rc *mqttGather.RunConfig, v string) { rc.LogLevel = v })
+	cf.bool(flags, "v", "verbose, log debug messages",
+		func(rc *mqttGather.RunConfig) { rc.LogLevel = "debug" })
+	cf.bool(flags, "silent", "psssh! only log errors",
+		func(rc *mqttGather.RunConfig) { rc.LogLevel = "error" })
+	return cf
+}
+
+// Registers a string flag overriding a setting if it is not empty.
+func (cf *configFlags) string(flags *flag.FlagSet, name, usage string, apply func(*mqttGather.RunConfig, string)) *string {
+	value := flags.String(name, "", usage)
+	cf.overrides = append(cf.overrides, func(rc *mqttGather.RunConfig) {
+		if *value != "" {
+			apply(rc, *value)
+		}
+	})
+	return value
+}
+
+// Registers a bool flag overriding a setting if it is set.
+func (cf *configFlags) bool(flags *flag.FlagSet, name, usage string, apply func(*mqttGather.RunConfig)) *bool {
+	value := flags.Bool(name, false, usage)
+	cf.overrides = append(cf.overrides, func(rc *mqttGather.RunConfig) {
+		if *value {
+			apply(rc)
+		}
+	})
+	return value
+}
+
+// Loads the config file (if any) and applies environment variables and
+// the flags, in that order of precedence.
+func (cf *configFlags) load() (*mqttGather.RunConfig, error) {
+	rc := &mqttGather.RunConfig{}
+	if *cf.file != "" {
+		var err error
+		if rc, err = mqttGather.LoadFromFile(*cf.file); err != nil {
+			return nil, err
+		}
+	}
+	if err := rc.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	for _, override := range cf.overrides {
+		override(rc)
+	}
+	return rc, rc.ResolveSecrets()
+}
+
+// Loads the configuration of subcommands working on the database, returns
+// a non zero exit code if there is none.
+func (cf *configFlags) loadDB() (*mqttGather.RunConfig, int) {
+	rc, err := cf.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load configuration: %v\n", err)
+		return nil, EXIT_USAGE
+	}
+	if rc.SqlLiteConnect == "" {
+		fmt.Fprintf(os.Stderr, "no sqlite db provided\n")
+		return nil, EXIT_USAGE
+	}
+	return rc, EXIT_OK
+}
+
+// Like `loadDB`, additionally opens the database.
+func (cf *configFlags) openDB() (mqttGather.DB, int) {
+	rc, code := cf.loadDB()
+	if code != EXIT_OK {
+		return nil, code
+	}
+	db, err := mqttGather.NewDatabase(rc.SqlLiteConnect)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open db: %v\n", err)
+		return nil, EXIT_FAILURE
+	}
+	return db, EXIT_OK
+}
+
+const configUsage = `usage: %s config check [flags]
+
+  check : load the configuration like the collector does (config file,
+          MQTTGATHER_* environment variables and flags), validate it and
+          print the effective configuration with secrets masked
+
+accepts the flags of the run command.
+
+`
+
+// `config` subcommand: check the configuration.
+func configCmd(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	cf := addCollectorFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), configUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+	if action != "check" {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	rc, err := cf.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load configuration: %v\n", err)
+		return EXIT_FAILURE
+	}
+	bs, err := json.MarshalIndent(rc.Masked(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("%s\n", bs)
+
+	if err := rc.ValidateCollector(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return EXIT_FAILURE
+	}
+	fmt.Fprintf(os.Stderr, "configuration ok\n")
+	return EXIT_OK
+}
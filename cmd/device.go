@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const deviceUsage = `usage: %s device list|show [flags] [signifiers]
+
+  list : list all devices, when they were last seen and their description
+  show : print the configuration and last alert of the given devices
+
+`
+
+// `device` subcommand: inspect the known devices.
+func deviceCmd(args []string) int {
+	flags := flag.NewFlagSet("device", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), deviceUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+	switch action {
+	case "list", "show":
+	default:
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	if action == "show" && flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "no devices provided\n")
+		return EXIT_USAGE
+	}
+
+	db, code := cf.openDB()
+	if code != EXIT_OK {
+		return code
+	}
+	defer db.Close()
+
+	if action == "list" {
+		devices, err := db.LoadDevices()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load devices: %v\n", err)
+			return EXIT_FAILURE
+		}
+		for _, d := range devices {
+			lastSeen := "never"
+			if d.LastSeen != 0 {
+				lastSeen = time.Unix(d.LastSeen, 0).Format(time.RFC3339)
+			}
+			description := "(no device info)"
+			if d.Info != nil {
+				description = d.Info.Description
+			}
+			fmt.Printf("%s  last seen: %-25s %s\n", d.DeviceSignifier, lastSeen, description)
+		}
+		return EXIT_OK
+	}
+
+	for _, signifier := range flags.Args() {
+		info, err := db.LoadDeviceInfo(signifier)
+		if err == sql.ErrNoRows {
+			fmt.Fprintf(os.Stderr, "no device info for %s\n", signifier)
+			return EXIT_FAILURE
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load device info for %s: %v\n", signifier, err)
+			return EXIT_FAILURE
+		}
+		alert, err := db.LoadLastAlert(signifier)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load last alert for %s: %v\n", signifier, err)
+			return EXIT_FAILURE
+		}
+		printDeviceInfo(info, alert)
+	}
+	return EXIT_OK
+}
+
+func printDeviceInfo(info *mqttGather.DeviceInfo, last *mqttGather.Alert) {
+	fmt.Printf("device          : %s\n", info.DeviceSignifier)
+	fmt.Printf("description     : %s\n", info.Description)
+	fmt.Printf("location        : %f, %f\n", info.Latitude, info.Longitude)
+	fmt.Printf("alert active    : %v\n", info.AlertActive)
+	fmt.Printf("alert threshold : %.1f dB(A)\n", info.AlertThreshold)
+	fmt.Printf("alert duration  : %ds\n", info.AlertDuration)
+	fmt.Printf("alert count     : %d\n", info.AlertCount)
+	fmt.Printf("alert deadtime  : %ds\n", info.AlertDeadtime)
+	fmt.Printf("alert phone     : %s\n", info.AlertPhone)
+	if last.Timestamp != 0 {
+		fmt.Printf("last alert      : %s %s\n", time.Unix(last.Timestamp, 0).Format(time.RFC3339), last.Status)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const exportUsage = `usage: %s export [flags]
+
+  writes noise stats or telemetry of the selected devices and period,
+  with the devices' description and location, as CSV, JSON Lines or
+  Parquet to stdout or a file
+
+`
+
+// `export` subcommand: export noise stats and telemetry for analysis.
+func exportCmd(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	devices := flags.String("device", "", "comma separated signifiers (MAC) of the devices to export, all devices if not set")
+	table := flags.String("table", "stats", "data to export: stats or telemetry")
+	format := flags.String("format", "", "csv, jsonl or parquet, default: determined by the -o extension or csv")
+	output := flags.String("o", "", "file to write to, stdout if not set")
+	interval := flags.Duration("interval", 0, "aggregate stats into intervals (e.g. 15m, 1h, 24h), raw stats if not set")
+	tz := flags.String("tz", "UTC", "time zone of timestamps, intervals and -from/-to (e.g. Europe/Berlin)")
+	from := flags.String("from", "", "begin of export (YYYY-MM-DD), default: 24h ago")
+	to := flags.String("to", "", "end of export (YYYY-MM-DD), default: now")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), exportUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(args) != 0 && isHelp(args[0]) {
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+		return EXIT_OK
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	opts := &mqttGather.ExportOptions{
+		Format:   *format,
+		Interval: *interval,
+	}
+	switch *table {
+	case "stats", mqttGather.EXPORT_STATS:
+		opts.Table = mqttGather.EXPORT_STATS
+	case mqttGather.EXPORT_TELEMETRY:
+		opts.Table = mqttGather.EXPORT_TELEMETRY
+	default:
+		fmt.Fprintf(os.Stderr, "unknown table: %s\n", *table)
+		return EXIT_USAGE
+	}
+	if opts.Format == "" {
+		switch strings.ToLower(filepath.Ext(*output)) {
+		case ".jsonl", ".json":
+			opts.Format = mqttGather.EXPORT_JSONL
+		case ".parquet":
+			opts.Format = mqttGather.EXPORT_PARQUET
+		default:
+			opts.Format = mqttGather.EXPORT_CSV
+		}
+	}
+	for _, d := range strings.Split(*devices, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			opts.Devices = append(opts.Devices, d)
+		}
+	}
+	var err error
+	if opts.Location, err = time.LoadLocation(*tz); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid time zone: %v\n", err)
+		return EXIT_USAGE
+	}
+	if opts.Begin, opts.End, err = parseRangeIn(*from, *to, opts.Location); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+
+	db, code := cf.openDB()
+	if code != EXIT_OK {
+		return code
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "could not create output: %v\n", err)
+			return EXIT_FAILURE
+		}
+	}
+	cnt, err := db.Export(out, opts)
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+	fmt.Fprintf(os.Stderr, "exported %d rows\n", cnt)
+	return EXIT_OK
+}
@@ -4,134 +4,170 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 	"time"
+)
 
-	"github.com/a2800276/logrotation"
+var version string /* left for the linker to fill */
 
-	"github.com/openaircgn/mqttGather"
+// Exit codes of all subcommands.
+const (
+	EXIT_OK      = 0 // success
+	EXIT_FAILURE = 1 // the command failed, e.g. the database couldn't be opened
+	EXIT_USAGE   = 2 // invalid arguments or configuration
 )
 
-var (
-	version        string /* left for the linker to fill */
-	sqliteDBName   = flag.String("sqlite", "", "connect string to use for sqlite, when in doubt: provide a filename")
-	topic          = flag.String("topic", "", "topic to subscribe to") // todo, this should later be a plugin for sensors
-	telemetryTopic = flag.String("telemetry-topic", "", "topic to subscribe to for telemetry data")
-	host           = flag.String("host", "", "host to connect to")
-	clientId       = flag.String("clientID", "", "clientId to use for connection")
-	silent         = flag.Bool("silent", false, "psssh!")
-	config         = flag.String("c", "", "name of (optional) config file")
-	logDir         = flag.String("log-dir", "", "where to write logs, writes to stdout if not set")
-	smsKey         = flag.String("sms-key", "", "api key for SMS")
-	_version       = flag.Bool("version", false, "display version information and exit")
-)
+const usage = `usage: %s <command> [arguments]
 
-func banner(w io.Writer) {
-	fmt.Fprintf(w, "%s ver %s\n", os.Args[0], version)
-}
-func summary(rc mqttGather.RunConfig, w io.Writer) {
-	banner(w)
-	fmt.Fprintf(w, "sqlite connect: %s\n", rc.SqlLiteConnect)
-	fmt.Fprintf(w, "subscribing to: %s\n", rc.Topic)
-	fmt.Fprintf(w, "host          : %s\n", rc.Host)
-	fmt.Fprintf(w, "clientId      : %s\n", rc.ClientId)
-	fmt.Fprintf(w, "logDir        : %s\n", rc.LogDir)
-	if rc.SMSKey != "" {
-		fmt.Fprintf(w, "smsKey        : %s\n", "***")
-	} else {
-		fmt.Fprintf(w, "smsKey        : %s\n", "not set!")
-	}
+commands:
 
-	if *config != "" {
-		fmt.Fprintf(w, "config file   : %s\n", *config)
-	}
-}
+%s
+Without a command, or if the first argument is a flag, the collector is
+started (run). Use "%[1]s help <command>" or "%[1]s <command> -h" for the
+arguments of a command.
 
-func startAlert(cfg *mqttGather.RunConfig, mqtt *mqttGather.Mqtt) {
-	done := make(chan bool)
-	alert := mqttGather.NewAlerter(cfg, mqtt, done)
-	alert.Start()
-}
+The configuration is shared by all commands: the config file (-c),
+MQTTGATHER_* environment variables and flags, in increasing order of
+precedence.
 
-func main() {
-	keepAlive := make(chan os.Signal)
-	signal.Notify(keepAlive, os.Interrupt, syscall.SIGTERM)
+exit codes: 0 success, 1 failure, 2 invalid arguments or configuration.
 
-	flag.Parse()
+`
 
-	if *_version {
-		banner(os.Stderr)
-		os.Exit(0)
+type command struct {
+	name    string
+	summary string
+	run     func([]string) int // called with the remaining arguments, returns the exit code
+}
+
+// subcommands, in the order they are listed in the usage.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "run the collector", runCmd},
+		{"device", "list devices and show their configuration", deviceCmd},
+		{"alerts", "list sent alerts", alertsCmd},
+		{"export", "export noise stats and telemetry as CSV, JSON Lines or Parquet", exportCmd},
+		{"report", "generate a noise report of a device as HTML or PDF", reportCmd},
+		{"weather", "import DWD weather data, export noise data with weather", weatherCmd},
+		{"stats", "show noise aggregates, rebuild rollups", statsCmd},
+		{"archive", "expire old data, import archives", archiveCmd},
+		{"migrate", "show and apply schema migrations", migrateCmd},
+		{"raw", "inspect and re-process messages that could not be handled", rawCmd},
+		{"replay", "feed a recording through the collector", replayCmd},
+		{"config", "check the configuration", configCmd},
+		{"version", "print version information", versionCmd},
+		{"help", "print help for a command", helpCmd},
 	}
+}
 
-	var rc *mqttGather.RunConfig
-	var err error
-	if *config != "" {
-		if rc, err = mqttGather.LoadFromFile(*config); err != nil {
-			panic(err)
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
 		}
-	} else {
-		rc = &mqttGather.RunConfig{}
-	}
-	if *sqliteDBName != "" {
-		rc.SqlLiteConnect = *sqliteDBName
 	}
-	if *host != "" {
-		rc.Host = *host
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	var list strings.Builder
+	for _, cmd := range commands {
+		fmt.Fprintf(&list, "  %-8s %s\n", cmd.name, cmd.summary)
 	}
-	if *topic != "" {
-		rc.Topic = *topic
+	fmt.Fprintf(w, usage, os.Args[0], list.String())
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || (strings.HasPrefix(args[0], "-") && !isHelp(args[0])) {
+		// collector flags without `run`, as before subcommands were introduced.
+		os.Exit(runCmd(args))
 	}
-	if *telemetryTopic != "" {
-		rc.TelemetryTopic = *telemetryTopic
+	if isHelp(args[0]) {
+		printUsage(os.Stdout)
+		os.Exit(EXIT_OK)
 	}
-	if *clientId != "" {
-		rc.ClientId = *clientId
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", args[0])
+		printUsage(os.Stderr)
+		os.Exit(EXIT_USAGE)
 	}
+	os.Exit(cmd.run(args[1:]))
+}
 
-	if !*silent {
-		summary(*rc, os.Stderr)
+func isHelp(arg string) bool {
+	switch arg {
+	case "-h", "-help", "--help":
+		return true
 	}
+	return false
+}
 
-	if *logDir != "" {
-		rc.LogDir = *logDir
+// Parses the arguments of subcommands taking an action as their first
+// argument, e.g. `stats show -device ...`. Returns false and the exit code
+// if the command should not continue, e.g. after printing the usage.
+func parseAction(flags *flag.FlagSet, args []string) (string, int, bool) {
+	if len(args) == 0 {
+		flags.Usage()
+		return "", EXIT_USAGE, false
 	}
-
-	if *smsKey != "" {
-		rc.SMSKey = *smsKey
+	if isHelp(args[0]) {
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+		return "", EXIT_OK, false
 	}
+	flags.Parse(args[1:])
+	return args[0], EXIT_OK, true
+}
 
-	var logWriter io.Writer
-
-	if rc.LogDir != "" {
-		logWriter = &logrotation.Logrotation{
-			BaseFilename: "opennoise",
-			Suffix:       "log",
-			BaseDir:      rc.LogDir,
-			Interval:     24 * time.Hour,
-		}
-	} else {
-		logWriter = os.Stdout
-	}
-	log.SetOutput(logWriter)
+func banner(w io.Writer) {
+	fmt.Fprintf(w, "%s ver %s\n", os.Args[0], version)
+}
 
-	summary(*rc, logWriter)
+// `version` subcommand.
+func versionCmd(args []string) int {
+	banner(os.Stdout)
+	return EXIT_OK
+}
 
-	// Start Collecting
-	mqtt, err := mqttGather.NewMQTT(rc)
-	if err != nil {
-		panic(err)
+// `help` subcommand: print the usage of a command.
+func helpCmd(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return EXIT_OK
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil || cmd.name == "help" {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+		return EXIT_USAGE
 	}
-	defer mqtt.Disconnect()
+	return cmd.run([]string{"-h"})
+}
 
-	// start alerting
+// Parses the -from and -to flags (YYYY-MM-DD) of subcommands, defaults
+// to the last 24h.
+func parseRange(from, to string) (time.Time, time.Time, error) {
+	return parseRangeIn(from, to, time.UTC)
+}
 
-	if rc.SMSKey != "" {
-		startAlert(rc, mqtt)
+// Like `parseRange`, dates are midnight in the given time zone.
+func parseRangeIn(from, to string, loc *time.Location) (time.Time, time.Time, error) {
+	end := time.Now()
+	begin := end.Add(-24 * time.Hour)
+	var err error
+	if from != "" {
+		if begin, err = time.ParseInLocation("2006-01-02", from, loc); err != nil {
+			return begin, end, fmt.Errorf("invalid from: %v", err)
+		}
 	}
-
-	<-keepAlive
+	if to != "" {
+		if end, err = time.ParseInLocation("2006-01-02", to, loc); err != nil {
+			return begin, end, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	return begin, end, nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const migrateUsage = `usage: %s migrate status|up [flags]
+
+  status : print the current schema version and pending migrations
+  up     : apply all pending migrations
+
+`
+
+// `migrate` subcommand: bring the database schema up to date.
+func migrateCmd(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	dryRun := flags.Bool("dry-run", false, "execute migrations but roll back afterwards")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), migrateUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+	rc, code := cf.loadDB()
+	if code != EXIT_OK {
+		return code
+	}
+
+	switch action {
+	case "status":
+		version, pending, err := mqttGather.MigrationStatus(rc.SqlLiteConnect)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not determine status: %v\n", err)
+			return EXIT_FAILURE
+		}
+		fmt.Printf("schema version: %d\n", version)
+		if len(pending) == 0 {
+			fmt.Printf("up to date\n")
+		}
+		for _, m := range pending {
+			fmt.Printf("pending: %v\n", &m)
+		}
+		return EXIT_OK
+	case "up":
+		results, err := mqttGather.Migrate(rc.SqlLiteConnect, *dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migration failed, nothing applied: %v\n", err)
+			return EXIT_FAILURE
+		}
+		verb := "applied"
+		if *dryRun {
+			verb = "would apply"
+		}
+		if len(results) == 0 {
+			fmt.Printf("up to date\n")
+		}
+		for _, r := range results {
+			if r.Skipped {
+				fmt.Printf("%s: %v (condition not met, recorded only)\n", verb, &r.Migration)
+			} else {
+				fmt.Printf("%s: %v\n", verb, &r.Migration)
+			}
+		}
+		return EXIT_OK
+	default:
+		flags.Usage()
+		return EXIT_USAGE
+	}
+}
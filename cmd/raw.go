@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const rawUsage = `usage: %s raw list|show|reprocess [flags] [message ids]
+
+  list      : list messages that could not be handled
+  show      : print the messages with the given ids in detail
+  reprocess : handle the messages with the given ids (or all pending
+              messages with -all) again, e.g. after a parser fix: they
+              are saved and forwarded to influx_url, but not evaluated
+              for alerts
+
+`
+
+// `raw` subcommand: inspect and re-process dead letter messages.
+func rawCmd(args []string) int {
+	flags := flag.NewFlagSet("raw", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	all := flags.Bool("all", false, "list: include re-processed messages, reprocess: all pending messages")
+	limit := flags.Int("limit", 100, "maximum number of messages to list or reprocess")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), rawUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+
+	var ids []int64
+	for _, arg := range flags.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid message id: %s\n", arg)
+			return EXIT_USAGE
+		}
+		ids = append(ids, id)
+	}
+
+	rc, code := cf.loadDB()
+	if code != EXIT_OK {
+		return code
+	}
+	if action == "reprocess" {
+		return reprocessRaw(rc, ids, *all, *limit)
+	}
+	db, err := mqttGather.NewDatabase(rc.SqlLiteConnect)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open db: %v\n", err)
+		return EXIT_FAILURE
+	}
+	defer db.Close()
+
+	switch action {
+	case "list":
+		msgs, err := db.LoadRawMessages(*all, *limit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load messages: %v\n", err)
+			return EXIT_FAILURE
+		}
+		for _, msg := range msgs {
+			fmt.Println(&msg)
+		}
+		return EXIT_OK
+	case "show":
+		if len(ids) == 0 {
+			fmt.Fprintf(os.Stderr, "no message ids provided\n")
+			return EXIT_USAGE
+		}
+		for _, id := range ids {
+			msg, err := db.LoadRawMessage(id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "could not load message %d: %v\n", id, err)
+				return EXIT_FAILURE
+			}
+			printRawMessage(msg)
+		}
+		return EXIT_OK
+	default:
+		flags.Usage()
+		return EXIT_USAGE
+	}
+}
+
+// Re-processes messages through the handlers of the collector, using
+// the database and the sinks of its configuration that don't require the
+// broker.
+func reprocessRaw(loaded *mqttGather.RunConfig, ids []int64, all bool, limit int) int {
+	rc := &mqttGather.RunConfig{
+		SqlLiteConnect:      loaded.SqlLiteConnect,
+		AutoMigrate:         loaded.AutoMigrate,
+		InfluxURL:           loaded.InfluxURL,
+		InfluxToken:         loaded.InfluxToken,
+		InfluxBatchSize:     loaded.InfluxBatchSize,
+		InfluxFlushInterval: loaded.InfluxFlushInterval,
+	}
+	r, err := mqttGather.NewReprocessor(rc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not start reprocessing: %v\n", err)
+		return EXIT_FAILURE
+	}
+	defer r.Close()
+
+	if all {
+		msgs, err := r.DB().LoadRawMessages(false, limit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load messages: %v\n", err)
+			return EXIT_FAILURE
+		}
+		for _, msg := range msgs {
+			ids = append(ids, msg.Id)
+		}
+	}
+	if len(ids) == 0 {
+		fmt.Fprintf(os.Stderr, "no message ids provided\n")
+		return EXIT_USAGE
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := r.Reprocess(id); err != nil {
+			fmt.Fprintf(os.Stderr, "could not reprocess %d: %v\n", id, err)
+			failed += 1
+		}
+	}
+	fmt.Printf("reprocessed %d of %d messages\n", len(ids)-failed, len(ids))
+	if failed != 0 {
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+func printRawMessage(msg *mqttGather.RawMessage) {
+	fmt.Printf("id          : %d\n", msg.Id)
+	fmt.Printf("received    : %s\n", time.Unix(msg.Timestamp, 0).Format(time.RFC3339))
+	fmt.Printf("topic       : %s\n", msg.Topic)
+	fmt.Printf("qos         : %d\n", msg.QoS)
+	fmt.Printf("retained    : %v\n", msg.Retained)
+	fmt.Printf("error       : %s\n", msg.Error)
+	if msg.Reprocessed != 0 {
+		fmt.Printf("reprocessed : %s\n", time.Unix(msg.Reprocessed, 0).Format(time.RFC3339))
+	}
+	if p := msg.Properties; p != nil {
+		for _, u := range p.User {
+			fmt.Printf("property    : %s=%s\n", u.Key, u.Value)
+		}
+		if p.MessageExpiry != nil {
+			fmt.Printf("expiry      : %ds\n", *p.MessageExpiry)
+		}
+	}
+	fmt.Printf("payload     : %q\n\n", msg.Payload)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const replayUsage = `usage: %s replay [flags] recording
+
+  feeds a recording (see -record) through the message handlers into a
+  database, using the recorded times. Alerts are not evaluated.
+
+`
+
+// `replay` subcommand: replay recorded messages without a broker.
+func replayCmd(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	cf.string(flags, "topic", "topic noise stats were subscribed to (default from config or /opennoise/+/dba_stats)",
+		func(rc *mqttGather.RunConfig, v string) { rc.Topic = v })
+	cf.string(flags, "telemetry-topic", "topic telemetry was subscribed to (default from config or /opennoise/+/telemetry)",
+		func(rc *mqttGather.RunConfig, v string) { rc.TelemetryTopic = v })
+	cf.bool(flags, "auto-migrate", "apply pending schema migrations",
+		func(rc *mqttGather.RunConfig) { rc.AutoMigrate = true })
+	speed := flags.Float64("speed", 0, "1: original pace, 10: ten times as fast, 0: as fast as possible")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), replayUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(args) != 0 && isHelp(args[0]) {
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+		return EXIT_OK
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *speed < 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+	loaded, code := cf.loadDB()
+	if code != EXIT_OK {
+		return code
+	}
+	// only the database and topics of the collector's configuration apply.
+	rc := &mqttGather.RunConfig{
+		SqlLiteConnect: loaded.SqlLiteConnect,
+		Topic:          loaded.Topic,
+		TelemetryTopic: loaded.TelemetryTopic,
+		AutoMigrate:    loaded.AutoMigrate,
+	}
+	if rc.Topic == "" {
+		rc.Topic = "/opennoise/+/dba_stats"
+	}
+	if rc.TelemetryTopic == "" {
+		rc.TelemetryTopic = "/opennoise/+/telemetry"
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open recording: %v\n", err)
+		return EXIT_FAILURE
+	}
+	defer file.Close()
+
+	replay, err := mqttGather.NewReplay(rc, *speed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not start replay: %v\n", err)
+		return EXIT_FAILURE
+	}
+	cnt, err := replay.Run(file)
+	replay.Close()
+	fmt.Printf("replayed %d messages\n", cnt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const reportUsage = `usage: %s report [flags]
+
+  writes the noise report of a device (Lden, Lday, Levening, Lnight,
+  hourly profile, threshold exceedances, sent alerts and weather) as HTML
+  or PDF to stdout or a file, and optionally mails it to report_mail_to.
+  Report days run from 06:00 to 06:00, -to is the day after the last
+  report day.
+
+`
+
+// `report` subcommand: generate a noise report.
+func reportCmd(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	device := flags.String("device", "", "signifier (MAC) of the device")
+	from := flags.String("from", "", "first day of the report (YYYY-MM-DD), default: yesterday")
+	to := flags.String("to", "", "day after the last day of the report (YYYY-MM-DD), default: today")
+	tz := flags.String("tz", "", "time zone of the report (e.g. Europe/Berlin), default: report_timezone or local time")
+	format := flags.String("format", "", "html or pdf, default: determined by the -o extension or html")
+	output := flags.String("o", "", "file to write to, stdout if not set")
+	mail := flags.Bool("mail", false, "mail the report to report_mail_to")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), reportUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(args) != 0 && isHelp(args[0]) {
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+		return EXIT_OK
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 || *device == "" {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	rc, code := cf.loadDB()
+	if code != EXIT_OK {
+		return code
+	}
+	if *tz != "" {
+		rc.ReportTimezone = *tz
+	}
+	opts := &mqttGather.ReportOptions{Device: *device}
+	var err error
+	if opts.Location, err = mqttGather.ReportLocation(rc); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+	now := time.Now().In(opts.Location)
+	opts.From, opts.To = now.AddDate(0, 0, -1), now
+	if *from != "" {
+		if opts.From, err = time.ParseInLocation("2006-01-02", *from, opts.Location); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid from: %v\n", err)
+			return EXIT_USAGE
+		}
+	}
+	if *to != "" {
+		if opts.To, err = time.ParseInLocation("2006-01-02", *to, opts.Location); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid to: %v\n", err)
+			return EXIT_USAGE
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+	if *format == "" {
+		*format = mqttGather.REPORT_HTML
+		if strings.ToLower(filepath.Ext(*output)) == ".pdf" {
+			*format = mqttGather.REPORT_PDF
+		}
+	}
+	var reportMail *mqttGather.ReportMail
+	if *mail {
+		if reportMail = mqttGather.NewReportMail(rc); reportMail == nil || rc.SMTPAddr == "" || rc.ReportMailFrom == "" {
+			fmt.Fprintf(os.Stderr, "-mail requires report_mail_to, report_mail_from and smtp_addr\n")
+			return EXIT_USAGE
+		}
+	}
+
+	db, err := mqttGather.NewDatabase(rc.SqlLiteConnect)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open db: %v\n", err)
+		return EXIT_FAILURE
+	}
+	defer db.Close()
+
+	report, err := db.Report(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate report: %v\n", err)
+		return EXIT_FAILURE
+	}
+	var buf bytes.Buffer
+	if err := report.Write(&buf, *format); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+
+	if reportMail != nil {
+		name := *output
+		if name == "" {
+			name = fmt.Sprintf("report-%s-%s.%s", opts.From.Format("2006-01-02"), strings.ReplaceAll(*device, ":", "-"), *format)
+		}
+		subject := fmt.Sprintf("Noise report %s", report.DeviceName())
+		body := fmt.Sprintf("Noise report of %s for %s - %s (06:00 to 06:00, %s).\n",
+			report.DeviceName(), report.From.Format("2006-01-02"), report.LastDay().Format("2006-01-02"), opts.Location)
+		files := []mqttGather.ReportFile{{Name: filepath.Base(name), Data: buf.Bytes()}}
+		if err := reportMail.Send(subject, body, files, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "could not mail report: %v\n", err)
+			return EXIT_FAILURE
+		}
+		fmt.Fprintf(os.Stderr, "mailed report to %s\n", strings.Join(reportMail.To, ", "))
+		if *output == "" {
+			return EXIT_OK
+		}
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = os.WriteFile(*output, buf.Bytes(), 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write report: %v\n", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/a2800276/logrotation"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const runUsage = `usage: %s run [flags]
+
+  runs the collector: subscribes to the noise stats and telemetry topics
+  and saves the messages to the database until terminated (SIGINT,
+  SIGTERM). The configuration is reloaded on SIGHUP and when the config
+  file changes.
+
+exit codes: 0 shut down cleanly, 1 shutdown incomplete, 2 invalid
+configuration.
+
+`
+
+func summary(rc mqttGather.RunConfig, configFile string, w io.Writer) {
+	banner(w)
+	fmt.Fprintf(w, "sqlite connect: %s\n", rc.SqlLiteConnect)
+	fmt.Fprintf(w, "subscribing to: %s\n", rc.Topic)
+	fmt.Fprintf(w, "host          : %s\n", rc.Host)
+	fmt.Fprintf(w, "clientId      : %s\n", rc.ClientId)
+	fmt.Fprintf(w, "logDir        : %s\n", rc.LogDir)
+	if rc.SMSKey != "" {
+		fmt.Fprintf(w, "smsKey        : %s\n", "***")
+	} else {
+		fmt.Fprintf(w, "smsKey        : %s\n", "not set!")
+	}
+	if rc.InfluxURL != "" {
+		fmt.Fprintf(w, "influx        : %s\n", rc.InfluxURL)
+	}
+	if rc.RepublishPrefix != "" {
+		fmt.Fprintf(w, "republish     : %s\n", rc.RepublishPrefix)
+	}
+	if rc.HomeAssistant {
+		fmt.Fprintf(w, "homeassistant : discovery enabled\n")
+	}
+	if rc.Dashboard {
+		fmt.Fprintf(w, "dashboard     : http://%s/dashboard/\n", rc.HTTPAddr)
+	}
+	if rc.Stream {
+		fmt.Fprintf(w, "stream        : http://%s/stream\n", rc.HTTPAddr)
+	}
+	if rc.ReportSchedule != "" {
+		fmt.Fprintf(w, "reports       : %s to %s\n", rc.ReportSchedule, rc.ReportDir)
+	}
+	if rc.SinkOnly {
+		fmt.Fprintf(w, "sink only     : not saving stats and telemetry to sqlite\n")
+	}
+
+	if configFile != "" {
+		fmt.Fprintf(w, "config file   : %s\n", configFile)
+	}
+}
+
+// Handlers registering themselves, e.g. the dashboard.
+type registrar interface {
+	Register(mux *http.ServeMux)
+}
+
+// Serves metrics, health checks and the enabled handlers until the
+// server is shut down.
+func startHTTP(addr string, health *mqttGather.Health, handlers ...registrar) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", mqttGather.DefaultMetrics)
+	health.Register(mux)
+	for _, h := range handlers {
+		h.Register(mux)
+	}
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log := slog.Default().With("component", "http")
+		log.Info("serving http", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("http server failed", "err", err)
+		}
+	}()
+	return server
+}
+
+func startAlert(cfg *mqttGather.RunConfig, mqtt *mqttGather.Mqtt) {
+	mqttGather.NewAlerter(cfg, mqtt).Start()
+}
+
+// `run` subcommand, also used if no subcommand is given: run the
+// collector.
+func runCmd(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	cf := addCollectorFlags(flags)
+	silent := flags.Lookup("silent")
+	_version := flags.Bool("version", false, "display version information and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), runUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	if *_version {
+		banner(os.Stderr)
+		return EXIT_OK
+	}
+
+	keepAlive := make(chan os.Signal, 1)
+	signal.Notify(keepAlive, os.Interrupt, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	rc, err := cf.load()
+	if err == nil {
+		err = rc.ValidateCollector()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return EXIT_USAGE
+	}
+
+	if silent.Value.String() != "true" {
+		summary(*rc, *cf.file, os.Stderr)
+	}
+
+	logWriter := newLogWriter(rc)
+	if err := mqttGather.SetupLogging(rc, logWriter); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+
+	slog.Info("starting",
+		"version", version,
+		"sqlite", rc.SqlLiteConnect,
+		"topic", rc.Topic,
+		"host", rc.Host,
+		"client_id", rc.ClientId,
+		"log_dir", rc.LogDir,
+		"sms_key_set", rc.SMSKey != "",
+		"config", *cf.file,
+	)
+
+	g := &gatherer{flags: cf, rc: rc, logWriter: logWriter}
+
+	// Start embedded broker
+
+	if rc.BrokerAddr != "" {
+		if g.broker, err = mqttGather.StartBroker(rc); err != nil {
+			slog.Error("could not start broker", "err", err)
+			return EXIT_FAILURE
+		}
+		g.useBroker(rc)
+	}
+
+	// Start Collecting
+	if g.mqtt, err = mqttGather.NewMQTT(rc); err != nil {
+		slog.Error("could not start collecting", "err", err)
+		g.shutdown()
+		return EXIT_FAILURE
+	}
+
+	// start alerting
+
+	if rc.Alerting() {
+		startAlert(rc, g.mqtt)
+	}
+
+	if rc.HTTPAddr != "" {
+		var handlers []registrar
+		if rc.Dashboard {
+			handlers = append(handlers, mqttGather.NewDashboard(g.mqtt))
+		}
+		if rc.Stream {
+			handlers = append(handlers, mqttGather.NewStream(g.mqtt))
+		}
+		g.server = startHTTP(rc.HTTPAddr, mqttGather.NewHealth(rc, g.mqtt), handlers...)
+	}
+
+	// start retention and reports
+
+	if err := g.startRetention(); err != nil {
+		slog.Error("could not start retention", "err", err)
+		g.shutdown()
+		return EXIT_FAILURE
+	}
+	if err := g.startReports(); err != nil {
+		slog.Error("could not start reports", "err", err)
+		g.shutdown()
+		return EXIT_FAILURE
+	}
+
+	// reload on SIGHUP or config file changes
+
+	var changed <-chan struct{}
+	if *cf.file != "" {
+		watcher := mqttGather.NewConfigWatcher(*cf.file)
+		watcher.Start()
+		defer watcher.Stop()
+		changed = watcher.Changed
+	}
+
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case <-reload:
+			g.reload()
+		case <-changed:
+			g.reload()
+		case sig = <-keepAlive:
+		}
+	}
+	slog.Info("shutting down", "signal", sig.String(), "timeout", mqttGather.ShutdownTimeout(g.rc))
+	go func() {
+		<-keepAlive
+		slog.Error("second signal received, exiting immediately")
+		os.Exit(EXIT_FAILURE)
+	}()
+	return g.shutdown()
+}
+
+func newLogWriter(rc *mqttGather.RunConfig) io.Writer {
+	if rc.LogDir != "" {
+		return &logrotation.Logrotation{
+			BaseFilename: "opennoise",
+			Suffix:       "log",
+			BaseDir:      rc.LogDir,
+			Interval:     24 * time.Hour,
+		}
+	}
+	return os.Stdout
+}
+
+// The running components of the collector.
+type gatherer struct {
+	flags     *configFlags
+	rc        *mqttGather.RunConfig
+	logWriter io.Writer
+	broker    *mqttGather.Broker
+	mqtt      *mqttGather.Mqtt
+	server    *http.Server
+	retention *mqttGather.Retention
+	reports   *mqttGather.ReportJob
+}
+
+func (g *gatherer) startRetention() error {
+	if len(g.rc.RetentionDays) == 0 {
+		return nil
+	}
+	retention, err := mqttGather.NewRetention(g.rc, g.mqtt.DB)
+	if err != nil {
+		return err
+	}
+	retention.Start()
+	g.retention = retention
+	return nil
+}
+
+func (g *gatherer) startReports() error {
+	if g.rc.ReportSchedule == "" {
+		return nil
+	}
+	reports, err := mqttGather.NewReportJob(g.rc, g.mqtt.DB)
+	if err != nil {
+		return err
+	}
+	reports.Start()
+	g.reports = reports
+	return nil
+}
+
+// Connects to the embedded broker if no other broker is configured, using
+// the broker credentials unless mqtt_user is set.
+func (g *gatherer) useBroker(rc *mqttGather.RunConfig) {
+	if rc.Host != "" || g.broker == nil {
+		return
+	}
+	rc.Host = g.broker.LocalURL()
+	if rc.MQTTUser == "" {
+		rc.MQTTUser, rc.MQTTPassword = rc.BrokerUser, rc.BrokerPassword
+	}
+}
+
+// Reloads the configuration, see reload.go. The running configuration is
+// kept if the new one is rejected.
+func (g *gatherer) reload() {
+	slog.Info("reloading configuration", "config", *g.flags.file)
+	rc, err := g.flags.load()
+	if err == nil {
+		err = rc.ValidateCollector()
+	}
+	if err == nil {
+		g.useBroker(rc)
+		err = g.mqtt.Reload(rc)
+	}
+	if err != nil {
+		slog.Error("invalid configuration, keeping running configuration", "err", err)
+		return
+	}
+	old := g.rc
+	g.rc = rc
+
+	mqttGather.SetLogLevel(rc.LogLevel)
+	if rc.LogDir != old.LogDir {
+		previous := mqttGather.SetLogOutput(newLogWriter(rc))
+		if closer, ok := previous.(io.Closer); ok && previous != os.Stdout {
+			closer.Close()
+		}
+		slog.Info("reopened logs", "log_dir", rc.LogDir)
+	}
+
+	// a removed SMS key stops the alerter (see Mqtt.Reload)
+	if g.mqtt.Alerter() == nil && rc.Alerting() {
+		startAlert(rc, g.mqtt)
+	}
+
+	// the retention and report jobs are recreated, their database may
+	// have changed.
+	if g.retention != nil {
+		g.retention.Stop()
+		g.retention = nil
+	}
+	if err := g.startRetention(); err != nil {
+		slog.Error("could not restart retention", "err", err)
+	}
+	if g.reports != nil {
+		g.reports.Stop()
+		g.reports = nil
+	}
+	if err := g.startReports(); err != nil {
+		slog.Error("could not restart reports", "err", err)
+	}
+	slog.Info("reloaded configuration")
+}
+
+// Stops all components started so far, the gatherer in the order
+// described in shutdown.go. Returns the exit code.
+func (g *gatherer) shutdown() int {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttGather.ShutdownTimeout(g.rc))
+	defer cancel()
+
+	code := EXIT_OK
+	if g.retention != nil {
+		g.retention.Stop()
+	}
+	if g.reports != nil {
+		g.reports.Stop()
+	}
+	if g.mqtt != nil {
+		if err := g.mqtt.Shutdown(ctx); err != nil {
+			slog.Error("shutdown incomplete", "err", err)
+			code = EXIT_FAILURE
+		}
+	}
+	if g.server != nil {
+		g.server.Shutdown(ctx)
+	}
+	if g.broker != nil {
+		g.broker.Close()
+	}
+	return code
+}
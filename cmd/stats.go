@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const statsUsage = `usage: %s stats show|rebuild [flags]
+
+  show    : print aggregated noise levels of a device
+  rebuild : recalculate the rollup tables from the raw dba_stats
+
+`
+
+// `stats` subcommand: inspect and maintain the dba_stats rollups.
+func statsCmd(args []string) int {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	device := flags.String("device", "", "signifier (MAC) of the device to show")
+	resolution := flags.Duration("resolution", -1, "resolution (0, 1m, 10m, 1h, 24h), chosen automatically if not set")
+	from := flags.String("from", "", "begin of period (YYYY-MM-DD), default: 24h ago")
+	to := flags.String("to", "", "end of period (YYYY-MM-DD), default: now")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), statsUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+	begin, end, err := parseRange(*from, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return EXIT_USAGE
+	}
+
+	db, code := cf.openDB()
+	if code != EXIT_OK {
+		return code
+	}
+	defer db.Close()
+
+	switch action {
+	case "rebuild":
+		if err := db.RebuildRollups(begin, end); err != nil {
+			fmt.Fprintf(os.Stderr, "could not rebuild: %v\n", err)
+			return EXIT_FAILURE
+		}
+		return EXIT_OK
+	case "show":
+		if *device == "" {
+			fmt.Fprintf(os.Stderr, "no device provided\n")
+			return EXIT_USAGE
+		}
+		var stats []mqttGather.StatsAggregate
+		if *resolution < 0 {
+			stats, err = db.LoadStats(*device, begin, end)
+		} else {
+			r := mqttGather.Resolution(*resolution / time.Second)
+			stats, err = db.LoadStatsResolution(*device, r, begin, end)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load stats: %v\n", err)
+			return EXIT_FAILURE
+		}
+		for _, s := range stats {
+			fmt.Printf("%s %5s min: %6.2f max: %6.2f leq: %6.2f count: %d\n",
+				s.Timestamp.Format(time.RFC3339), s.Resolution, s.Min, s.Max, s.Leq, s.Count)
+		}
+		return EXIT_OK
+	default:
+		flags.Usage()
+		return EXIT_USAGE
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/openaircgn/mqttGather"
+)
+
+const weatherUsage = `usage: %s weather import|export [flags]
+
+  import : download current DWD observations and station list into the db
+  export : write noise aggregates joined with weather data as CSV to stdout
+
+`
+
+// `weather` subcommand: import DWD data and export noise data enriched
+// with weather observations.
+func weatherCmd(args []string) int {
+	flags := flag.NewFlagSet("weather", flag.ExitOnError)
+	cf := addConfigFlags(flags)
+	device := flags.String("device", "", "signifier (MAC) of the device to export")
+	station := flags.String("station", "", "DWD station id to import or export (default: the stations nearest to the devices)")
+	datasets := flags.String("datasets", "temperature,precipitation,solar,wind", "comma separated list of datasets to import")
+	from := flags.String("from", "", "begin of export (YYYY-MM-DD), default: 24h ago")
+	to := flags.String("to", "", "end of export (YYYY-MM-DD), default: now")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), weatherUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	action, code, ok := parseAction(flags, args)
+	if !ok {
+		return code
+	}
+	rc, code := cf.loadDB()
+	if code != EXIT_OK {
+		return code
+	}
+
+	switch action {
+	case "import":
+		var toImport []*mqttGather.DWDDataset
+		for _, name := range strings.Split(*datasets, ",") {
+			ds := mqttGather.FindDWDDataset(strings.TrimSpace(name))
+			if ds == nil {
+				fmt.Fprintf(os.Stderr, "unknown dataset: %s, available:\n", name)
+				for _, ds := range mqttGather.DWDDatasets {
+					fmt.Fprintf(os.Stderr, "\t%s\n", ds.Name)
+				}
+				return EXIT_USAGE
+			}
+			toImport = append(toImport, ds)
+		}
+		if err := mqttGather.ImportStations(rc.SqlLiteConnect); err != nil {
+			fmt.Fprintf(os.Stderr, "station import failed: %v\n", err)
+			return EXIT_FAILURE
+		}
+		stations := []mqttGather.Station{mqttGather.Station(*station)}
+		if *station == "" {
+			var err error
+			if stations, err = mqttGather.DeviceStations(rc.SqlLiteConnect); err != nil {
+				fmt.Fprintf(os.Stderr, "could not determine stations: %v\n", err)
+				return EXIT_FAILURE
+			}
+			if len(stations) == 0 {
+				fmt.Fprintf(os.Stderr, "no devices with a location in device_info, importing station %s\n", mqttGather.DEFAULT_STATION)
+				stations = []mqttGather.Station{mqttGather.DEFAULT_STATION}
+			}
+		}
+		for _, st := range stations {
+			for _, ds := range toImport {
+				if err := mqttGather.ImportDWD(rc.SqlLiteConnect, ds, st); err != nil {
+					fmt.Fprintf(os.Stderr, "import of %s for station %s failed: %v\n", ds.Name, st, err)
+					return EXIT_FAILURE
+				}
+			}
+		}
+		return EXIT_OK
+	case "export":
+		if *device == "" {
+			fmt.Fprintf(os.Stderr, "no device provided\n")
+			return EXIT_USAGE
+		}
+		begin, end, err := parseRange(*from, *to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return EXIT_USAGE
+		}
+		db, err := mqttGather.NewDatabase(rc.SqlLiteConnect)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not open db: %v\n", err)
+			return EXIT_FAILURE
+		}
+		defer db.Close()
+
+		rows, err := db.LoadNoiseWeather(*device, mqttGather.Station(*station), begin, end)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load data: %v\n", err)
+			return EXIT_FAILURE
+		}
+		w := csv.NewWriter(os.Stdout)
+		w.Write(mqttGather.NoiseWeatherCSVHeader())
+		for _, row := range rows {
+			w.Write(row.CSVRecord())
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write: %v\n", err)
+			return EXIT_FAILURE
+		}
+		return EXIT_OK
+	default:
+		flags.Usage()
+		return EXIT_USAGE
+	}
+}
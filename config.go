@@ -1,32 +1,480 @@
 package mqttGather
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 type RunConfig struct {
 	SqlLiteConnect string `json:"sqlite"`
 	Host           string `json:"host"`
+	BrokerAddr     string `json:"broker_addr"` // runs an embedded broker if set, see broker.go
+	BrokerUser     string `json:"broker_user"` // clients of the embedded broker have to authenticate if set
+	BrokerPassword string `json:"broker_password" secret:"true"`
+	BrokerTLSCert  string `json:"broker_tls_cert"` // PEM files, the embedded broker only accepts TLS if set
+	BrokerTLSKey   string `json:"broker_tls_key"`
+	MQTTUser       string `json:"mqtt_user"` // credentials to connect to the broker, if required
+	MQTTPassword   string `json:"mqtt_password" secret:"true"`
 	Topic          string `json:"topic"`
 	TelemetryTopic string `json:"telemetry_topic"`
 	ClientId       string `json:"client_id"`
 	LogDir         string `json:"log_dir"`
-	SMSKey         string `json:"sms_key"`
+	LogLevel       string `json:"log_level"`  // debug, info, warn, error (see logging.go)
+	LogFormat      string `json:"log_format"` // text or json
+	SMSKey         string `json:"sms_key" secret:"true"`
+	SMSKeyFile     string `json:"sms_key_file"` // read the SMS key from this file
+	AutoMigrate    bool   `json:"auto_migrate"`
+	RecordFile     string `json:"record_file"` // records all received messages, see recorder.go
+	HTTPAddr       string `json:"http_addr"`   // serves /metrics and health checks if set
+	MaxSilence     int    `json:"max_silence"` // seconds without messages before not ready
+
+	// QoS of the subscriptions, 0 (default), 1 or 2
+	TopicQoS     byte `json:"topic_qos"`
+	TelemetryQoS byte `json:"telemetry_qos"`
+	// Let the broker queue messages while disconnected, requires a
+	// client id and QoS > 0.
+	PersistentSession bool   `json:"persistent_session"`
+	StoreDir          string `json:"store_dir"` // keeps in-flight messages across restarts if set (MQTT 3.1.1 only)
+
+	// MQTT protocol: 4 (3.1.1, default) or 5, see mqtt5.go
+	ProtocolVersion int `json:"protocol_version"`
+	// subscribe as a member of a shared subscription group to distribute
+	// messages among several gatherers.
+	ShareGroup    string `json:"share_group"`
+	SessionExpiry int    `json:"session_expiry"` // seconds, persistent MQTT 5 sessions only
+
+	ShutdownTimeout int `json:"shutdown_timeout"` // seconds to drain handlers and alerts, see shutdown.go
+
+	// how to generate the client id if not set, see clientid.go
+	ClientIdStrategy string `json:"client_id_strategy"`
+	ClientIdFile     string `json:"client_id_file"`
+
+	// retention period in days per table, see retention.go
+	RetentionDays map[string]int `json:"retention_days"`
+	ArchiveDir    string         `json:"archive_dir"`
+
+	// forward stats and telemetry as InfluxDB line protocol, see influx.go
+	InfluxURL           string `json:"influx_url"` // e.g. http://localhost:8086/api/v2/write?org=..&bucket=..
+	InfluxToken         string `json:"influx_token" secret:"true"`
+	InfluxTokenFile     string `json:"influx_token_file"`     // read the token from this file
+	InfluxBatchSize     int    `json:"influx_batch_size"`     // lines per request
+	InfluxFlushInterval int    `json:"influx_flush_interval"` // seconds
+	// republish stats, telemetry and alert states as JSON below this
+	// topic, see republish.go
+	RepublishPrefix string `json:"republish_prefix"` // e.g. opennoise/json
+	RepublishQoS    byte   `json:"republish_qos"`
+	// publish Home Assistant MQTT discovery config for the devices, the
+	// states are republished (requires republish_prefix), see homeassistant.go
+	HomeAssistant       bool   `json:"homeassistant"`
+	HomeAssistantPrefix string `json:"homeassistant_prefix"` // discovery prefix, default homeassistant
+	// serve a live dashboard at /dashboard/ (requires http_addr), see
+	// dashboard.go
+	Dashboard bool `json:"dashboard"`
+	// stream live events at /stream (requires http_addr), see stream.go
+	Stream bool `json:"stream"`
+	// generate daily, weekly or monthly noise reports of all devices
+	// (requires report_dir), see report_schedule.go
+	ReportSchedule string `json:"report_schedule"`
+	ReportDir      string `json:"report_dir"`
+	ReportFormat   string `json:"report_format"`   // html (default) or pdf
+	ReportTimezone string `json:"report_timezone"` // e.g. Europe/Berlin, default local time
+	// mail scheduled reports to these comma separated addresses
+	ReportMailTo     string `json:"report_mail_to"`
+	ReportMailFrom   string `json:"report_mail_from"`
+	SMTPAddr         string `json:"smtp_addr"` // host:port
+	SMTPUser         string `json:"smtp_user"` // no authentication if empty
+	SMTPPassword     string `json:"smtp_password" secret:"true"`
+	SMTPPasswordFile string `json:"smtp_password_file"` // read the password from this file
+	// only forward stats and telemetry to the sinks, don't save them to
+	// the database, see sink.go
+	SinkOnly bool `json:"sink_only"`
+}
+
+// Checks the configuration for errors that can be detected without
+// connecting to the broker or database, all problems found are reported.
+func (cfg *RunConfig) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if cfg.Host != "" {
+		if u, err := url.Parse(cfg.Host); err != nil {
+			invalid("invalid host: %v", err)
+		} else if !validBrokerScheme(u.Scheme) || u.Host == "" {
+			invalid("invalid host: %s (expected e.g. tcp://localhost:1883)", cfg.Host)
+		}
+	}
+	for _, t := range []struct{ name, topic string }{
+		{"topic", cfg.Topic},
+		{"telemetry_topic", cfg.TelemetryTopic},
+	} {
+		if t.topic != "" && (!validFilter(t.topic)) {
+			invalid("invalid %s: %s", t.name, t.topic)
+		}
+	}
+	if cfg.TopicQoS > 2 || cfg.TelemetryQoS > 2 || cfg.RepublishQoS > 2 {
+		invalid("invalid QoS: %d, %d, %d", cfg.TopicQoS, cfg.TelemetryQoS, cfg.RepublishQoS)
+	}
+	// the broker doesn't queue QoS 0 messages for persistent sessions
+	if cfg.PersistentSession && (cfg.TopicQoS == 0 || (cfg.TelemetryTopic != "" && cfg.TelemetryQoS == 0)) {
+		invalid("persistent_session requires topic_qos and telemetry_qos > 0")
+	}
+	switch cfg.ProtocolVersion {
+	case 0, PROTOCOL_V311, PROTOCOL_V5:
+	default:
+		invalid("unsupported protocol version: %d", cfg.ProtocolVersion)
+	}
+	if strings.ContainsAny(cfg.ShareGroup, "/+#") {
+		invalid("invalid share_group: %s", cfg.ShareGroup)
+	}
+	switch cfg.ClientIdStrategy {
+	case "", CLIENT_ID_STATIC, CLIENT_ID_RANDOM, CLIENT_ID_MAC, CLIENT_ID_UUID:
+	default:
+		invalid("unknown client_id_strategy: %s", cfg.ClientIdStrategy)
+	}
+	if _, err := ParseLogLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	switch cfg.LogFormat {
+	case "", LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+	default:
+		invalid("invalid log format: %s", cfg.LogFormat)
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"max_silence", cfg.MaxSilence},
+		{"session_expiry", cfg.SessionExpiry},
+		{"shutdown_timeout", cfg.ShutdownTimeout},
+		{"influx_batch_size", cfg.InfluxBatchSize},
+		{"influx_flush_interval", cfg.InfluxFlushInterval},
+	} {
+		if n.value < 0 {
+			invalid("invalid %s: %d", n.name, n.value)
+		}
+	}
+	for table, days := range cfg.RetentionDays {
+		if !isRetentionTable(table) {
+			invalid("retention not supported for table: %s", table)
+		} else if days <= 0 {
+			invalid("invalid retention for %s: %d days", table, days)
+		}
+	}
+	if cfg.BrokerAddr != "" {
+		if _, err := brokerListenAddr(cfg.BrokerAddr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if (cfg.BrokerUser == "") != (cfg.BrokerPassword == "") {
+		invalid("broker_user and broker_password must be set together")
+	}
+	if (cfg.BrokerTLSCert == "") != (cfg.BrokerTLSKey == "") {
+		invalid("broker_tls_cert and broker_tls_key must be set together")
+	}
+	if cfg.MQTTPassword != "" && cfg.MQTTUser == "" {
+		invalid("mqtt_password requires mqtt_user")
+	}
+	if cfg.InfluxURL != "" {
+		if u, err := url.Parse(cfg.InfluxURL); err != nil {
+			invalid("invalid influx_url: %v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("invalid influx_url: %s (expected e.g. http://localhost:8086/api/v2/write?org=..&bucket=..)", cfg.InfluxURL)
+		}
+	}
+	if cfg.RepublishPrefix != "" {
+		if err := validRepublishPrefix(cfg.RepublishPrefix, cfg.Topic, cfg.TelemetryTopic); err != nil {
+			invalid("invalid republish_prefix: %v", err)
+		}
+	}
+	if cfg.HomeAssistant && cfg.RepublishPrefix == "" {
+		invalid("homeassistant requires republish_prefix")
+	}
+	if strings.ContainsAny(cfg.HomeAssistantPrefix, "+#") {
+		invalid("invalid homeassistant_prefix: %s", cfg.HomeAssistantPrefix)
+	}
+	if cfg.Dashboard && cfg.HTTPAddr == "" {
+		invalid("dashboard requires http_addr")
+	}
+	if cfg.Stream && cfg.HTTPAddr == "" {
+		invalid("stream requires http_addr")
+	}
+	if cfg.ReportSchedule != "" {
+		if _, _, _, err := reportPeriod(cfg.ReportSchedule, time.Now(), time.UTC); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.ReportDir == "" {
+			invalid("report_schedule requires report_dir")
+		}
+	}
+	switch cfg.ReportFormat {
+	case "", REPORT_HTML, REPORT_PDF:
+	default:
+		invalid("unknown report_format: %s (expected one of %s)", cfg.ReportFormat, strings.Join(ReportFormats, ", "))
+	}
+	if _, err := ReportLocation(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ReportMailTo != "" && (cfg.SMTPAddr == "" || cfg.ReportMailFrom == "") {
+		invalid("report_mail_to requires smtp_addr and report_mail_from")
+	}
+	if cfg.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddr); err != nil {
+			invalid("invalid smtp_addr: %v", err)
+		}
+	}
+	if cfg.SinkOnly {
+		if cfg.InfluxURL == "" && cfg.RepublishPrefix == "" {
+			invalid("sink_only requires a sink (influx_url, republish_prefix)")
+		}
+		if cfg.SMSKey != "" || cfg.SMSKeyFile != "" {
+			invalid("sink_only: alerts require saving stats to the database")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Whether alert states are evaluated for the republisher, which requires
+// the stats to be saved.
+func (cfg *RunConfig) AlertStates() bool {
+	return cfg.RepublishPrefix != "" && !cfg.SinkOnly
+}
+
+// Whether the alerter runs, to send alerts (with an SMS key) or to
+// evaluate alert states.
+func (cfg *RunConfig) Alerting() bool {
+	return cfg.SMSKey != "" || cfg.AlertStates()
+}
+
+// Like `Validate`, additionally checks the settings required to run the
+// collector.
+func (cfg *RunConfig) ValidateCollector() error {
+	var errs []error
+	if cfg.SqlLiteConnect == "" {
+		errs = append(errs, fmt.Errorf("sqlite is required"))
+	}
+	if cfg.Topic == "" {
+		errs = append(errs, fmt.Errorf("topic is required"))
+	}
+	if cfg.Host == "" && cfg.BrokerAddr == "" {
+		errs = append(errs, fmt.Errorf("host or broker_addr is required"))
+	}
+	return errors.Join(append(errs, cfg.Validate())...)
 }
 
+func validBrokerScheme(scheme string) bool {
+	switch scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps", "ws", "wss":
+		return true
+	}
+	return false
+}
+
+// Config file formats, see `LoadFromFile`
+const (
+	CONFIG_JSON = "json"
+	CONFIG_YAML = "yaml"
+	CONFIG_TOML = "toml"
+)
+
+// Decodes a JSON config, unknown keys are an error.
 func Load(reader io.Reader) (*RunConfig, error) {
+	return LoadFormat(reader, CONFIG_JSON)
+}
+
+// Decodes a config in the given format. YAML and TOML are converted to
+// JSON first so all formats use the same (json) keys and unknown keys are
+// an error for all of them.
+func LoadFormat(reader io.Reader, format string) (*RunConfig, error) {
+	switch format {
+	case CONFIG_JSON:
+	case CONFIG_YAML, CONFIG_TOML:
+		var values map[string]interface{}
+		var err error
+		if format == CONFIG_YAML {
+			err = yaml.NewDecoder(reader).Decode(&values)
+			if err == io.EOF {
+				err = nil // empty file
+			}
+		} else {
+			_, err = toml.NewDecoder(reader).Decode(&values)
+		}
+		if err != nil {
+			return nil, err
+		}
+		bs, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(bs)
+	default:
+		return nil, fmt.Errorf("unknown config format: %s", format)
+	}
+
 	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
 	var cfg RunConfig
 	err := decoder.Decode(&cfg)
 	return &cfg, err
 }
 
+// Loads a config file, the format is determined by the extension:
+// .yaml/.yml, .toml, JSON otherwise.
 func LoadFromFile(fn string) (*RunConfig, error) {
-	if file, err := os.Open(fn); err != nil {
+	format := CONFIG_JSON
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml":
+		format = CONFIG_YAML
+	case ".toml":
+		format = CONFIG_TOML
+	}
+	file, err := os.Open(fn)
+	if err != nil {
 		return nil, err
-	} else {
-		return Load(file)
 	}
+	defer file.Close()
+	cfg, err := LoadFormat(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return cfg, nil
+}
+
+// Prefix of environment variables overriding config settings: the json
+// key in upper case, e.g. MQTTGATHER_SMS_KEY. Appending _FILE (e.g.
+// MQTTGATHER_SMS_KEY_FILE) reads the value from a file instead, e.g. a
+// docker or systemd secret. Maps (`retention_days`) are given as JSON.
+const ENV_PREFIX = "MQTTGATHER_"
+
+// Overrides settings with environment variables, `lookup` is usually
+// `os.LookupEnv`.
+func (cfg *RunConfig) ApplyEnv(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i != v.NumField(); i++ {
+		key := jsonKey(v.Type().Field(i))
+		name := ENV_PREFIX + strings.ToUpper(key)
+		value, ok := lookup(name)
+		if fn, isFile := lookup(name + "_FILE"); isFile && !ok {
+			bs, err := os.ReadFile(fn)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %v", name, err)
+			}
+			value, ok = strings.TrimSpace(string(bs)), true
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func jsonKey(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("json"), ",")[0]
+}
+
+func setField(f reflect.Value, value string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case reflect.Uint8:
+		n, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Map:
+		m := reflect.New(f.Type())
+		if err := json.Unmarshal([]byte(value), m.Interface()); err != nil {
+			return err
+		}
+		f.Set(m.Elem())
+	default:
+		return fmt.Errorf("unsupported type: %s", f.Type())
+	}
+	return nil
+}
+
+// Reads secrets configured as files (`sms_key_file`,
+// `influx_token_file`, `smtp_password_file`) unless they are set
+// directly.
+func (cfg *RunConfig) ResolveSecrets() error {
+	for _, secret := range []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"sms_key_file", &cfg.SMSKey, cfg.SMSKeyFile},
+		{"influx_token_file", &cfg.InfluxToken, cfg.InfluxTokenFile},
+		{"smtp_password_file", &cfg.SMTPPassword, cfg.SMTPPasswordFile},
+	} {
+		if *secret.value != "" || secret.file == "" {
+			continue
+		}
+		bs, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", secret.name, err)
+		}
+		*secret.value = strings.TrimSpace(string(bs))
+	}
+	return nil
+}
+
+// Copy of the configuration with secrets (fields tagged `secret:"true"`)
+// replaced by "***", e.g. for printing.
+func (cfg *RunConfig) Masked() *RunConfig {
+	masked := *cfg
+	v := reflect.ValueOf(&masked).Elem()
+	for i := 0; i != v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString("***")
+		}
+	}
+	return &masked
+}
+
+// Whether a topic filter is valid, shared subscriptions are configured
+// by `share_group`.
+func validFilter(filter string) bool {
+	if filter == "" || strings.HasPrefix(filter, "$share/") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(l, "+") && l != "+" {
+			return false
+		}
+	}
+	return true
 }
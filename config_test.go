@@ -1,29 +1,205 @@
 package mqttGather
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestLoad(t *testing.T) {
-	rc, err := LoadFromFile("test_data/config.json")
-	if err != nil {
-		t.Fatal(err)
+	for _, fn := range []string{"test_data/config.json", "test_data/config.yaml", "test_data/config.toml"} {
+		rc, err := LoadFromFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc.SqlLiteConnect != ":memory:" {
+			t.Fatalf("%s: wrong connect string: %s", fn, rc.SqlLiteConnect)
+		}
+		if rc.Host != "tcp://test.mosquitto.org:1883" {
+			t.Fatalf("%s: wrong host: %s", fn, rc.Host)
+
+		}
+		if rc.Topic != "/opennoise/+/dba_stats" {
+			t.Fatalf("%s: wrong topic: %s", fn, rc.Topic)
+
+		}
+		if rc.TelemetryTopic != "/opennoise/+/telemetry" {
+			t.Fatalf("%s: wrong telemetry topic: %s", fn, rc.Topic)
+
+		}
+		if rc.ClientId != "mqttTest" {
+			t.Fatalf("%s: wrong clientId: %s", fn, rc.ClientId)
+
+		}
+		if err := rc.ValidateCollector(); err != nil {
+			t.Fatalf("%s: %v", fn, err)
+		}
 	}
-	if rc.SqlLiteConnect != ":memory:" {
-		t.Fatalf("wrong connect string: %s", rc.SqlLiteConnect)
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	for format, cfg := range map[string]string{
+		CONFIG_JSON: `{"telemetry-topic": "/opennoise/+/telemetry"}`,
+		CONFIG_YAML: "telemetry-topic: /opennoise/+/telemetry\n",
+		CONFIG_TOML: "telemetry-topic = \"/opennoise/+/telemetry\"\n",
+	} {
+		_, err := LoadFormat(strings.NewReader(cfg), format)
+		if err == nil || !strings.Contains(err.Error(), "telemetry-topic") {
+			t.Fatalf("%s: expected unknown key error, got: %v", format, err)
+		}
 	}
-	if rc.Host != "tcp://test.mosquitto.org:1883" {
-		t.Fatalf("wrong host: %s", rc.Host)
+}
 
+func TestValidate(t *testing.T) {
+	rc := &RunConfig{
+		Host:             "test.mosquitto.org:1883",
+		Topic:            "/opennoise/#/dba_stats",
+		TopicQoS:         3,
+		ClientIdStrategy: "hostname",
+		ShareGroup:       "a/b",
+		RetentionDays:    map[string]int{"dba_stats": 0},
+		InfluxURL:        "localhost:8086",
+		BrokerAddr:       "1883",
+		BrokerPassword:   "secret",
+		BrokerTLSCert:    "cert.pem",
+		MQTTPassword:     "secret",
+	}
+	err := rc.ValidateCollector()
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, expected := range []string{
+		"sqlite is required", "invalid host", "invalid topic", "invalid QoS",
+		"client_id_strategy", "share_group", "retention", "invalid influx_url",
+		"invalid broker_addr", "broker_user and broker_password", "broker_tls_cert and broker_tls_key",
+		"mqtt_password requires mqtt_user",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("missing error %q in: %v", expected, err)
+		}
 	}
-	if rc.Topic != "/opennoise/+/dba_stats" {
-		t.Fatalf("wrong topic: %s", rc.Topic)
 
+	rc = &RunConfig{SqlLiteConnect: ":memory:", Topic: "/opennoise/+/dba_stats", BrokerAddr: ":1883"}
+	if err := rc.ValidateCollector(); err != nil {
+		t.Fatal(err)
+	}
+	rc.PersistentSession = true
+	if err := rc.ValidateCollector(); err == nil || !strings.Contains(err.Error(), "persistent_session") {
+		t.Fatalf("expected error for persistent_session with QoS 0: %v", err)
+	}
+	rc.TopicQoS = 1
+	if err := rc.ValidateCollector(); err != nil {
+		t.Fatal(err)
+	}
+	rc.SinkOnly = true
+	if err := rc.ValidateCollector(); err == nil || !strings.Contains(err.Error(), "sink_only") {
+		t.Fatalf("expected error for sink_only without sink: %v", err)
+	}
+	rc.InfluxURL = "http://localhost:8086/write?db=noise"
+	if err := rc.ValidateCollector(); err != nil {
+		t.Fatal(err)
+	}
+	rc.HomeAssistant = true
+	if err := rc.ValidateCollector(); err == nil || !strings.Contains(err.Error(), "republish_prefix") {
+		t.Fatalf("expected error for homeassistant without republish_prefix: %v", err)
+	}
+	rc.HomeAssistant = false
+	rc.Dashboard = true
+	if err := rc.ValidateCollector(); err == nil || !strings.Contains(err.Error(), "http_addr") {
+		t.Fatalf("expected error for dashboard without http_addr: %v", err)
+	}
+	rc.Dashboard = false
+	rc.Stream = true
+	if err := rc.ValidateCollector(); err == nil || !strings.Contains(err.Error(), "stream requires http_addr") {
+		t.Fatalf("expected error for stream without http_addr: %v", err)
+	}
+	rc.Stream = false
+	rc.ReportSchedule = "yearly"
+	rc.ReportFormat = "docx"
+	rc.ReportTimezone = "Europe/Nowhere"
+	rc.ReportMailTo = "ordnungsamt@example.org"
+	err = rc.ValidateCollector()
+	if err == nil {
+		t.Fatalf("expected errors for reports")
+	}
+	for _, expected := range []string{
+		"unknown report_schedule", "report_schedule requires report_dir", "unknown report_format",
+		"invalid report_timezone", "report_mail_to requires smtp_addr",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("missing error %q in: %v", expected, err)
+		}
+	}
+	rc.ReportSchedule, rc.ReportDir, rc.ReportFormat, rc.ReportTimezone = REPORT_MONTHLY, "reports", REPORT_PDF, "Europe/Berlin"
+	rc.ReportMailFrom, rc.SMTPAddr = "noise@example.org", "mail.example.org:587"
+	if err := rc.ValidateCollector(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "sms_key")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"MQTTGATHER_TOPIC":          "/opennoise/+/stats",
+		"MQTTGATHER_AUTO_MIGRATE":   "true",
+		"MQTTGATHER_TOPIC_QOS":      "1",
+		"MQTTGATHER_MAX_SILENCE":    "60",
+		"MQTTGATHER_RETENTION_DAYS": `{"raw_message": 7}`,
+		"MQTTGATHER_SMS_KEY_FILE":   secret,
+	}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	rc := &RunConfig{Topic: "/opennoise/+/dba_stats", ClientId: "mqttTest"}
+	if err := rc.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if rc.Topic != "/opennoise/+/stats" || !rc.AutoMigrate || rc.TopicQoS != 1 || rc.MaxSilence != 60 {
+		t.Fatalf("not overridden: %#v", rc)
+	}
+	if rc.RetentionDays["raw_message"] != 7 || rc.ClientId != "mqttTest" {
+		t.Fatalf("not overridden: %#v", rc)
+	}
+	if rc.SMSKey != "from-file" {
+		t.Fatalf("secret not read from file: %q", rc.SMSKey)
 	}
-	if rc.TelemetryTopic != "/opennoise/+/telemetry" {
-		t.Fatalf("wrong telemetry topic: %s", rc.Topic)
 
+	env = map[string]string{"MQTTGATHER_TOPIC_QOS": "one"}
+	if err := rc.ApplyEnv(lookup); err == nil || !strings.Contains(err.Error(), "MQTTGATHER_TOPIC_QOS") {
+		t.Fatalf("expected error, got: %v", err)
 	}
-	if rc.ClientId != "mqttTest" {
-		t.Fatalf("wrong clientId: %s", rc.ClientId)
+}
 
+func TestSecrets(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "sms_key")
+	if err := os.WriteFile(secret, []byte("key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rc := &RunConfig{SMSKeyFile: secret}
+	if err := rc.ResolveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if rc.SMSKey != "key" {
+		t.Fatalf("secret not read: %q", rc.SMSKey)
+	}
+	if masked := rc.Masked(); masked.SMSKey != "***" || rc.SMSKey != "key" {
+		t.Fatalf("not masked: %q, %q", masked.SMSKey, rc.SMSKey)
+	}
+	// secrets set directly take priority over files
+	rc = &RunConfig{InfluxTokenFile: secret, SMTPPassword: "set", SMTPPasswordFile: secret}
+	if err := rc.ResolveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if rc.InfluxToken != "key" || rc.SMTPPassword != "set" {
+		t.Fatalf("unexpected secrets: %q, %q", rc.InfluxToken, rc.SMTPPassword)
+	}
+	rc = &RunConfig{SMSKeyFile: filepath.Join(t.TempDir(), "missing")}
+	if err := rc.ResolveSecrets(); err == nil {
+		t.Fatalf("expected error for missing secret file")
 	}
 }
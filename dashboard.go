@@ -0,0 +1,240 @@
+package mqttGather
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read-only live dashboard served with `"dashboard": true` below
+// `http_addr`:
+//
+//	/dashboard/                          map, charts, alerts and telemetry (web/dashboard)
+//	/dashboard/api/devices               devices with their current level and telemetry
+//	/dashboard/api/devices/<device>/stats?hours=1
+//	                                     aggregated stats of a device, see LoadStats
+//	/dashboard/api/alerts?limit=20       recently sent alerts
+//	/dashboard/api/events                live events, same as /stream (see stream.go)
+//
+// The frontend is embedded into the binary and doesn't load anything from
+// external sites. Devices are placed on the map by the latitude and
+// longitude of their device info. Phone numbers are never served.
+
+// Stats older than this are shown as stale.
+const DASHBOARD_STALE = 10 * time.Minute
+
+// Limits of the API parameters.
+const (
+	DASHBOARD_MAX_HOURS  = 7 * 24
+	DASHBOARD_MAX_ALERTS = 100
+	// alerts are loaded from this period
+	DASHBOARD_ALERT_PERIOD = 30 * 24 * time.Hour
+)
+
+//go:embed web/dashboard
+var dashboardFiles embed.FS
+
+type Dashboard struct {
+	db  func() DB
+	hub *Hub
+}
+
+// Current state of a device.
+type DashboardDevice struct {
+	ExportDevice
+	Threshold  float64                       `json:"threshold,omitempty"` // alert threshold, dBA
+	LastSeen   *time.Time                    `json:"last_seen,omitempty"` // of the latest stats
+	Level      *float32                      `json:"level,omitempty"`     // average of the latest stats
+	Max        *float32                      `json:"max,omitempty"`
+	AlertState string                        `json:"alert_state,omitempty"`
+	Telemetry  map[string]DashboardTelemetry `json:"telemetry,omitempty"` // by type
+}
+
+type DashboardTelemetry struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type DashboardStats struct {
+	Timestamp time.Time `json:"timestamp"`
+	Min       float32   `json:"min"`
+	Max       float32   `json:"max"`
+	Leq       float32   `json:"leq"`
+	Count     int64     `json:"count"`
+}
+
+type DashboardAlert struct {
+	Device    string    `json:"device"`
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+	Status    string    `json:"status"`
+}
+
+// Creates the dashboard of the gatherer, which needs to be configured with
+// `dashboard` to feed the events.
+func NewDashboard(mqtt *Mqtt) *Dashboard {
+	return &Dashboard{db: mqtt.DB, hub: mqtt.Hub()}
+}
+
+// Registers /dashboard/ and redirects / there.
+func (d *Dashboard) Register(mux *http.ServeMux) {
+	static, _ := fs.Sub(dashboardFiles, "web/dashboard")
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/dashboard/api/devices", d.serveDevices)
+	mux.HandleFunc("/dashboard/api/devices/", d.serveDeviceStats)
+	mux.HandleFunc("/dashboard/api/alerts", d.serveAlerts)
+	mux.Handle("/dashboard/api/events", &Stream{hub: d.hub})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/dashboard/", http.StatusFound)
+	})
+}
+
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+func serveError(w http.ResponseWriter, err error) {
+	logger("dashboard").Error("request failed", "err", err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// Integer query parameter `name` in [1, max], `def` if not set.
+func queryInt(r *http.Request, name string, def, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("invalid %s: %s (expected 1 to %d)", name, value, max)
+	}
+	return n, nil
+}
+
+func (d *Dashboard) serveDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := d.Devices(time.Now())
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	serveJSON(w, devices)
+}
+
+// Current state of all devices: the latest stats and alert state received
+// by the hub, or the levels saved during the last minutes if there were
+// no stats since starting.
+func (d *Dashboard) Devices(now time.Time) ([]DashboardDevice, error) {
+	db := d.db()
+	devices, err := db.LoadDevices()
+	if err != nil {
+		return nil, err
+	}
+	telemetry, err := db.LoadLatestTelemetry(now.Add(-24 * time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	var latest map[string]DeviceState
+	if d.hub != nil {
+		latest = d.hub.Latest()
+	}
+
+	result := make([]DashboardDevice, 0, len(devices))
+	index := make(map[string]int, len(devices))
+	for _, device := range devices {
+		dd := DashboardDevice{ExportDevice: republishedDevice(device.DeviceSignifier, device.Info)}
+		if device.Info != nil {
+			dd.Threshold = device.Info.AlertThreshold
+		}
+		state := latest[device.DeviceSignifier]
+		dd.AlertState = state.AlertState
+		if state.Stats != nil {
+			level, max := float32(state.Stats.Average), float32(state.Stats.Max)
+			dd.Level, dd.Max, dd.LastSeen = &level, &max, &state.Timestamp
+		} else if err := d.loadLevel(db, &dd, now); err != nil {
+			return nil, err
+		}
+		index[device.DeviceSignifier] = len(result)
+		result = append(result, dd)
+	}
+	for _, t := range telemetry {
+		i, ok := index[t.DeviceSignifier]
+		if !ok {
+			continue
+		}
+		if result[i].Telemetry == nil {
+			result[i].Telemetry = make(map[string]DashboardTelemetry)
+		}
+		result[i].Telemetry[string(t.Type)] = DashboardTelemetry{t.Type.String(), t.Value, t.Timestamp.UTC()}
+	}
+	return result, nil
+}
+
+// Sets the level of the latest saved minute within DASHBOARD_STALE.
+func (d *Dashboard) loadLevel(db DB, dd *DashboardDevice, now time.Time) error {
+	stats, err := db.LoadStatsResolution(dd.Device, RESOLUTION_MINUTE, now.Add(-DASHBOARD_STALE), now)
+	if err != nil || len(stats) == 0 {
+		return err
+	}
+	last := stats[len(stats)-1]
+	level, max, ts := float32(last.Leq), float32(last.Max), last.Timestamp.UTC()
+	dd.Level, dd.Max, dd.LastSeen = &level, &max, &ts
+	return nil
+}
+
+// /dashboard/api/devices/<device>/stats
+func (d *Dashboard) serveDeviceStats(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/dashboard/api/devices/")
+	signifier, ok := strings.CutSuffix(path, "/stats")
+	if !ok || signifier == "" || strings.Contains(signifier, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	hours, err := queryInt(r, "hours", 1, DASHBOARD_MAX_HOURS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := time.Now()
+	stats, err := d.db().LoadStats(signifier, to.Add(-time.Duration(hours)*time.Hour), to)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	result := make([]DashboardStats, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, DashboardStats{s.Timestamp.UTC(), float32(s.Min), float32(s.Max), float32(s.Leq), s.Count})
+	}
+	serveJSON(w, result)
+}
+
+func (d *Dashboard) serveAlerts(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", 20, DASHBOARD_MAX_ALERTS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// timestamps have second precision, include the current second
+	to := time.Now().Add(time.Second)
+	alerts, err := d.db().LoadAlerts("", to.Add(-DASHBOARD_ALERT_PERIOD), to, limit)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	result := make([]DashboardAlert, 0, len(alerts))
+	for _, a := range alerts {
+		result = append(result, DashboardAlert{a.DeviceSignifier, time.Unix(a.Timestamp, 0).UTC(), a.Message, a.Status})
+	}
+	serveJSON(w, result)
+}
@@ -0,0 +1,177 @@
+package mqttGather
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDashboard(t *testing.T) (*Dashboard, *SqliteDB) {
+	db, _ := getTestDBWithDeviceInfo(t)
+	t.Cleanup(db.Close)
+	hub := NewHub()
+	t.Cleanup(func() { hub.Close(context.Background()) })
+	return &Dashboard{db: func() DB { return db }, hub: hub}, db
+}
+
+func getDashboard(t *testing.T, mux *http.ServeMux, path string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestDashboardAPI(t *testing.T) {
+	d, db := testDashboard(t)
+	mux := http.NewServeMux()
+	d.Register(mux)
+
+	now := time.Now()
+	stats := DBAStats{Signifier: TEST_SIGNIFIER, Min: 50, Max: 70, Average: 60, Num: 10}
+	if _, err := db.Save(&stats, now.Add(-2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveTelemetry(&Telemetry{Client: TEST_SIGNIFIER, Type: ESP, Data: 139248}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveAlert(&Alert{DeviceSignifier: TEST_SIGNIFIER, Timestamp: now.Unix(), AlertPhone: "+49123", Message: "too loud", Status: "sent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// levels are loaded from the database until the hub received stats
+	var devices []DashboardDevice
+	if code := getDashboard(t, mux, "/dashboard/api/devices", &devices); code != http.StatusOK || len(devices) != 1 {
+		t.Fatalf("unexpected devices: %d %#v", code, devices)
+	}
+	device := devices[0]
+	if device.Device != TEST_SIGNIFIER || device.Description != "bla" || *device.Latitude != 1 ||
+		device.Level == nil || *device.Level != 60 || *device.Max != 70 || device.Telemetry["esp"].Value != "139248" {
+		t.Fatalf("unexpected device: %#v", device)
+	}
+	d.hub.WriteStats(&DBAStats{Signifier: TEST_SIGNIFIER, Max: 80, Average: 75}, now, nil)
+	d.hub.WriteAlertState(AlertState{Device: TEST_SIGNIFIER, State: ALERT_STATE_EXCEEDED})
+	getDashboard(t, mux, "/dashboard/api/devices", &devices)
+	if device := devices[0]; *device.Level != 75 || device.AlertState != ALERT_STATE_EXCEEDED {
+		t.Fatalf("unexpected device: %#v", device)
+	}
+
+	var aggregates []DashboardStats
+	if code := getDashboard(t, mux, "/dashboard/api/devices/"+TEST_SIGNIFIER+"/stats?hours=1", &aggregates); code != http.StatusOK || len(aggregates) != 1 || aggregates[0].Leq != 60 {
+		t.Fatalf("unexpected stats: %d %#v", code, aggregates)
+	}
+	if code := getDashboard(t, mux, "/dashboard/api/devices/"+TEST_SIGNIFIER+"/stats?hours=0", nil); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	if code := getDashboard(t, mux, "/dashboard/api/devices/"+TEST_SIGNIFIER, nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/dashboard/api/alerts", nil))
+	if !strings.Contains(rec.Body.String(), `"message":"too loud"`) || strings.Contains(rec.Body.String(), "+49123") {
+		t.Fatalf("unexpected alerts: %s", rec.Body)
+	}
+}
+
+func TestDashboardStatic(t *testing.T) {
+	d, _ := testDashboard(t)
+	mux := http.NewServeMux()
+	d.Register(mux)
+
+	for _, path := range []string{"/dashboard/", "/dashboard/dashboard.js", "/dashboard/dashboard.css"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Fatalf("%s: %d", path, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "https://") {
+			t.Fatalf("%s: external resource", path)
+		}
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/dashboard/" {
+		t.Fatalf("not redirected: %d", rec.Code)
+	}
+}
+
+func TestDashboardEvents(t *testing.T) {
+	d, _ := testDashboard(t)
+	mux := http.NewServeMux()
+	d.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/dashboard/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type: %s", res.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(res.Body)
+	if line, _ := r.ReadString('\n'); line != "retry: 5000\n" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+
+	stats := RandomDBAStats()
+	d.hub.WriteStats(&stats, time.Now(), nil)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "\n" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: stats\n" || !strings.HasPrefix(lines[1], `data: {"device":"`+stats.Signifier+`"`) || lines[2] != "\n" {
+		t.Fatalf("unexpected event: %q", lines)
+	}
+
+	// the stream ends when the hub is closed
+	d.hub.Close(context.Background())
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntegrationDashboard(t *testing.T) {
+	b := startTestBroker(t)
+	mqtt := connectTestGatherer(t, b, func(cfg *RunConfig) {
+		cfg.HTTPAddr = "localhost:0"
+		cfg.Dashboard = true
+	})
+	sub := mqtt.Hub().Subscribe(HubFilter{})
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+
+	select {
+	case event := <-sub.C:
+		if event.Type != EVENT_STATS || event.Device != TEST_SIGNIFIER {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	devices, err := NewDashboard(mqtt).Devices(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || *devices[0].Max != 57.619 {
+		t.Fatalf("unexpected devices: %#v", devices)
+	}
+}
@@ -1,15 +1,36 @@
 package mqttGather
 
-import "time"
+import (
+	"io"
+	"time"
+)
 
+// The Save methods store all or nothing: if they return an error, no
+// rows were written.
 type DB interface {
 	Save(*DBAStats, time.Time) (int64, error)
 	SaveNow(*DBAStats) (int64, error)
 	SaveTelemetry(*Telemetry, time.Time) (int64, error)
 	SaveTelemetryNow(*Telemetry) (int64, error)
+	LoadLatestTelemetry(time.Time) ([]TelemetryReading, error)
 	SaveAlert(*Alert) (int64, error)
 	LoadDeviceInfo(string) (*DeviceInfo, error)
+	LoadDevices() ([]Device, error)
 	LoadLastAlert(string) (*Alert, error)
+	LoadAlerts(string, time.Time, time.Time, int) ([]Alert, error)
 	GetCountThresholdExceeded(string, int64, float64) (int64, error)
+	LoadNoiseWeather(string, Station, time.Time, time.Time) ([]NoiseWeather, error)
+	LoadStats(string, time.Time, time.Time) ([]StatsAggregate, error)
+	LoadStatsResolution(string, Resolution, time.Time, time.Time) ([]StatsAggregate, error)
+	RebuildRollups(time.Time, time.Time) error
+	Export(io.Writer, *ExportOptions) (int64, error)
+	Report(*ReportOptions) (*Report, error)
+	Expire(string, time.Time, string) (int64, error)
+	ImportArchive(string) (int64, error)
+	Probe() error
+	SaveRawMessage(*RawMessage) (int64, error)
+	LoadRawMessages(bool, int) ([]RawMessage, error)
+	LoadRawMessage(int64) (*RawMessage, error)
+	SetRawMessageReprocessed(int64, time.Time) error
 	Close()
 }
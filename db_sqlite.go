@@ -2,25 +2,63 @@ package mqttGather
 
 import (
 	"database/sql"
-	"log"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// Name of the sqlite driver registered with additional functions:
+// - db_to_energy(level) : converts a sound level (dB) to sound energy
+// - energy_to_db(energy): converts sound energy to a level (dB)
+// see `rollup.go`
+const SQLITE_DRIVER = "sqlite3_mqttgather"
+
+func init() {
+	sql.Register(SQLITE_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("db_to_energy", dbToEnergy, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("energy_to_db", energyToDB, true)
+		},
+	})
+}
+
 type SqliteDB struct {
 	db          *sql.DB
 	deviceCache map[string]int64
 }
 
+// Opens the database, new databases are set up automatically. Fails if
+// the schema of an existing database is not up to date, see `migrate.go`
 func NewDatabase(connectString string) (DB, error) {
-	db, err := sql.Open("sqlite3", connectString)
+	return OpenDatabase(connectString, false)
+}
+
+// Same as `NewDatabase`, but applies pending migrations to existing
+// databases if `autoMigrate` is set.
+func OpenDatabase(connectString string, autoMigrate bool) (DB, error) {
+	db, err := openSqliteDB(connectString, autoMigrate)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
+	return db, nil
+}
 
-	if err := setupDB(db); err != nil {
+// Opens and checks the database like `OpenDatabase`, for imports working
+// on the tables directly.
+func openSqliteDB(connectString string, autoMigrate bool) (*SqliteDB, error) {
+	db, err := sql.Open(SQLITE_DRIVER, connectString)
+	if err != nil {
+		return nil, err
+	}
+	if isMemoryDB(connectString) {
+		// each connection would open a separate, empty database.
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := checkSchema(db, autoMigrate); err != nil {
 		db.Close()
 		return nil, err
 	}
@@ -29,7 +67,10 @@ func NewDatabase(connectString string) (DB, error) {
 		db,
 		make(map[string]int64),
 	}, nil
+}
 
+func isMemoryDB(connectString string) bool {
+	return strings.Contains(connectString, ":memory:") || strings.Contains(connectString, "mode=memory")
 }
 
 // SQL Helper functions
@@ -61,6 +102,7 @@ func (s *SqliteDB) execute(sql string, exec execFunc) (interface{}, error) {
 // Same as `execute, but assumes that each INSERT statement is assigned
 // an automated primary key which is retrieved via Result.LastInsertId()
 func (s *SqliteDB) insert(sqls string, exec execFunc) (int64, error) {
+	defer metricDBInsertDuration.ObserveSince(time.Now(), insertTable(sqls))
 	result_, err := s.execute(sqls, exec)
 
 	if err != nil {
@@ -71,6 +113,18 @@ func (s *SqliteDB) insert(sqls string, exec execFunc) (int64, error) {
 	return result.LastInsertId()
 }
 
+// Extracts the table name from an `INSERT INTO <table> ...` statement
+// for metrics.
+func insertTable(sqls string) string {
+	fields := strings.Fields(sqls)
+	for i := 0; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], "INTO") {
+			return strings.SplitN(fields[i+1], "(", 2)[0]
+		}
+	}
+	return "unknown"
+}
+
 // 'Public' laoding of DeviceId given a signifier. If no such mapping exists
 // this funciton returns an error.
 // TODO: creating device mappings needs to be rethought. Currently mappings
@@ -128,65 +182,58 @@ func (s *SqliteDB) insertDevice(signifier string) (int64, error) {
 	return s.insert(sql, exec)
 }
 
-// Persist Stats to DB.
+// Persist Stats to DB and update the rollups (see `rollup.go`). The stats
+// and the rollups are written in one transaction, if any of them fails
+// nothing is saved.
 func (s *SqliteDB) Save(stats *DBAStats, t time.Time) (int64, error) {
 	device_id, err := s.lookupDevice(stats.Signifier)
 	if err != nil {
 		return -1, err
 	}
 
-	exec := func(stmt *sql.Stmt) (interface{}, error) {
-		return stmt.Exec(
-			device_id,
-			stats.Min,
-			stats.Max,
-			stats.Average,
-			stats.AverageVar,
-			stats.Mean,
-			stats.Num,
-			t.Unix(),
-		)
-	}
-
 	sql := `INSERT INTO dba_stats (
 		device_id, min, max, average, averageVar, mean, num, ts
 	) VALUES (
 		:DEVICE_ID,:MIN,:MAX,:AVG, :AVG_VAR, :MEAN, :NUM, :TS
 	);`
 
-	return s.insert(sql, exec)
-
+	defer metricDBInsertDuration.ObserveSince(time.Now(), "dba_stats")
+	tx, err := s.db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	result, err := tx.Exec(
+		sql,
+		device_id,
+		stats.Min,
+		stats.Max,
+		stats.Average,
+		stats.AverageVar,
+		stats.Mean,
+		stats.Num,
+		t.Unix(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	if err := updateRollups(tx, device_id, stats, t); err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+	return id, tx.Commit()
 }
 
 // Persists Stats to DB using the current time as the timestamp.
 // This is the usual mode of saving as we have no idea when the sample originated
 // only when it was received.
 func (s *SqliteDB) SaveNow(stats *DBAStats) (int64, error) {
-	device_id, err := s.lookupDevice(stats.Signifier)
-	if err != nil {
-		return -1, err
-	}
-
-	exec := func(stmt *sql.Stmt) (interface{}, error) {
-		return stmt.Exec(
-			device_id,
-			stats.Min,
-			stats.Max,
-			stats.Average,
-			stats.AverageVar,
-			stats.Mean,
-			stats.Num,
-			// NOW is added as the deafult value
-		)
-	}
-	sql := `INSERT INTO dba_stats (
-		device_id, min, max, average, averageVar, mean, num
-	) VALUES (
-		:DEVICE_ID,:MIN,:MAX,:AVG, :AVG_VAR, :MEAN, :NUM
-	);`
-
-	return s.insert(sql, exec)
-
+	return s.Save(stats, time.Now())
 }
 
 func (s *SqliteDB) SaveTelemetryNow(t *Telemetry) (int64, error) {
@@ -435,88 +482,22 @@ AND
 
 	id_, err := s.execute(sql, exec)
 	if err != nil {
-		log.Printf("%v", err)
+		logger("db").Error("could not count threshold violations", "device", signifier, "err", err)
 	}
 	return id_.(int64), err
 }
 
+// Verifies the database is writable, used by health checks.
+func (s *SqliteDB) Probe() error {
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		return stmt.Exec(time.Now().Unix())
+	}
+	sql := `INSERT OR REPLACE INTO health_probe (health_probe_id, ts) VALUES (1, :TS)`
+	_, err := s.execute(sql, exec)
+	return err
+}
+
 // Closes the underlying database connection.
 func (s *SqliteDB) Close() {
 	s.db.Close()
 }
-
-// Creates all necessary database objects.
-func setupDB(db *sql.DB) error {
-	sql := `
-	CREATE TABLE IF NOT EXISTS device (
-		device_id        INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_signifier VARCHAR UNIQUE -- this is the MAC addr of the openoise device
-	);
-
-	CREATE TABLE IF NOT EXISTS device_info (
-		deviceinfo_id   INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_id       INTEGER NOT NULL UNIQUE REFERENCES device(device_id),
-		description     VARCHAR NOT NULL DEFAULT 'Unbekanntes Geraet',
-		latitude        FLOAT NOT NULL,
-		longitude       FLOAT NOT NULL,
-		alert_threshold  FLOAT NOT NULL DEFAULT 100,
-		alert_duration   FLOAT NOT NULL DEFAULT 60,
-		alert_count      INTEGER NOT NULL DEFAULT 3,
-		alert_deadtime   FLOAT NOT NULL DEFAULT 1800,
-		alert_phone      VARCHAR NOT NULL DEFAULT "",
-		alert_active     BOOLEAN NOT NULL DEFAULT FALSE,
-		turn_on_time      INTEGER NOT NULL DEFAULT 0
-	);
-
-
-	CREATE TABLE IF NOT EXISTS dba_stats (
-		dba_stats_id INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_id    INTEGER REFERENCES device(device_id),
-		min          FLOAT,
-		max          FLOAT,
-		average      FLOAT,
-		averageVar   FLOAT,
-		mean         FLOAT,
-		num          INTEGER,
-		ts           INTEGER DEFAULT (STRFTIME('%s','now'))
-	);
-
-	CREATE TABLE IF NOT EXISTS tele_mem (
-		tele_mem_id INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_id   INTEGER REFERENCES device(device_id),
-		type        VARCHAR,
-		free_mem    INTEGER,
-		ts          INTEGER DEFAULT (STRFTIME('%s','now'))
-
-	);
-
-	CREATE TABLE IF NOT EXISTS tele_ver (
-		tele_ver_id INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_id    INTEGER REFERENCES device(device_id),
-		type        VARCHAR,
-		info        VARCHAR,
-		ts          INTEGER DEFAULT (STRFTIME('%s','now'))
-
-	);
-
-	CREATE TABLE IF NOT EXISTS tele_misc (
-		tele_misc_id INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_id    INTEGER REFERENCES device(device_id),
-		type         VARCHAR,
-		data         VARCHAR,
-		ts           INTEGER DEFAULT (STRFTIME('%s','now'))
-	);
-
-	-- log of outgoing alerts
-	CREATE TABLE IF NOT EXISTS alert (
-		alert_id    INTEGER PRIMARY KEY AUTOINCREMENT,
-		device_id   INTEGER REFERENCES device(device_id),
-		ts          INTEGER DEFAULT (STRFTIME('%s','now')),
-		alert_phone  VARCHAR,
-		message     VARCHAR,
-		status      VARCHAR
-	);
-	`
-	_, err := db.Exec(sql)
-	return err
-}
@@ -29,7 +29,13 @@ func getTestDBWithDevice(t *testing.T) (*SqliteDB, int64) {
 }
 
 func getTestDBWithDeviceInfo(t *testing.T) (*SqliteDB, int64) {
-	db, id := getTestDBWithDevice(t)
+	db := getTestDB(t)
+	return db, insertTestDeviceInfo(t, db)
+}
+
+// Adds TEST_SIGNIFIER with description 'bla' at latitude 1, longitude 2.
+func insertTestDeviceInfo(t *testing.T, db *SqliteDB) int64 {
+	id, _ := db.lookupDevice(TEST_SIGNIFIER)
 	_, err := db.db.Exec(`INSERT INTO 
 				device_info (
 					device_id, description, latitude, longitude
@@ -39,7 +45,7 @@ func getTestDBWithDeviceInfo(t *testing.T) (*SqliteDB, int64) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	return db, id
+	return id
 }
 
 func TestInsert(t *testing.T) {
@@ -137,6 +143,30 @@ func TestLoadDeviceInfo(t *testing.T) {
 
 func TestLoadDeviceInfoFail(t *testing.T) {}
 
+func TestLoadDevices(t *testing.T) {
+	db, _ := getTestDBWithDeviceInfo(t)
+	defer db.Close()
+
+	stats := RandomDBAStats()
+	stats.Signifier = "00:00:00:00:00:01"
+	if _, err := db.Save(&stats, time.Unix(90, 0)); err != nil {
+		t.Fatal(err)
+	}
+	devices, err := db.LoadDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices: %#v", devices)
+	}
+	if d := devices[0]; d.DeviceSignifier != stats.Signifier || d.Info != nil || d.LastSeen != 60 {
+		t.Fatalf("unexpected device: %#v", d)
+	}
+	if d := devices[1]; d.DeviceSignifier != TEST_SIGNIFIER || d.Info == nil || d.Info.Description != "bla" || d.LastSeen != 0 {
+		t.Fatalf("unexpected device: %#v", d)
+	}
+}
+
 func TestLoadAlert(t *testing.T) {
 
 	db, id := getTestDBWithDevice(t)
@@ -165,6 +195,34 @@ func TestLoadAlert(t *testing.T) {
 	}
 }
 
+func TestLoadAlerts(t *testing.T) {
+	db, id := getTestDBWithDevice(t)
+	defer db.Close()
+	other, _ := db.lookupDevice("00:00:00:00:00:01")
+
+	for i, device := range []int64{id, other, id} {
+		_, err := db.db.Exec("INSERT INTO alert (device_id, ts, alert_phone, message, status) VALUES (:ID, :ts, '123', :MSG, 'ok' )", device, 100*i, fmt.Sprintf("MSG %d", i))
+		if err != nil {
+			t.Fatalf("sanity: %v", err)
+		}
+	}
+
+	alerts, err := db.LoadAlerts("", time.Unix(0, 0), time.Unix(1000, 0), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 3 || alerts[0].Message != "MSG 2" {
+		t.Fatalf("unexpected alerts: %#v", alerts)
+	}
+	alerts, err = db.LoadAlerts(TEST_SIGNIFIER, time.Unix(0, 0), time.Unix(200, 0), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Message != "MSG 0" || alerts[0].DeviceSignifier != TEST_SIGNIFIER {
+		t.Fatalf("unexpected alerts: %#v", alerts)
+	}
+}
+
 func testThresholdExceeded(t *testing.T, db *SqliteDB, windowsSeconds int64, threshold float64, countShould int64) {
 	cnt, err := db.getCountThresholdExceeded(TEST_SIGNIFIER, windowsSeconds, threshold)
 	if err != nil {
@@ -242,3 +300,18 @@ func TestSaveAlert(t *testing.T) {
 	}
 
 }
+
+func TestProbe(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	for i := 0; i != 2; i++ {
+		if err := db.Probe(); err != nil {
+			t.Fatalf("probe failed: %v", err)
+		}
+	}
+	var count int
+	if err := db.db.QueryRow(`SELECT count(*) FROM health_probe`).Scan(&count); err != nil || count != 1 {
+		t.Fatalf("probe not overwritten: %d (%v)", count, err)
+	}
+}
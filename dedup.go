@@ -0,0 +1,67 @@
+package mqttGather
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// De-duplication of redelivered QoS 1 messages. Brokers resend messages
+// they didn't receive an acknowledgement for with the DUP flag set, e.g.
+// after a reconnect. If the original message was already handled, the
+// redelivery is dropped before reaching the database.
+//
+// Messages are remembered in memory for `DEDUP_WINDOW`, so redeliveries
+// after a restart of the gatherer are not detected.
+
+const DEDUP_WINDOW = 15 * time.Minute
+
+type dedupKey struct {
+	id      uint16
+	topic   string
+	payload uint64 // hash
+}
+
+type dedup struct {
+	mu     sync.Mutex
+	seen   map[dedupKey]time.Time
+	purged time.Time
+}
+
+func newDedup() *dedup {
+	return &dedup{seen: make(map[dedupKey]time.Time)}
+}
+
+func (d *dedup) purge(now time.Time) {
+	for k, t := range d.seen {
+		if now.Sub(t) > DEDUP_WINDOW {
+			delete(d.seen, k)
+		}
+	}
+	d.purged = now
+}
+
+// Whether `msg` is a redelivery of a message already seen. QoS 0
+// messages are never redelivered. A nil dedup reports no duplicates.
+func (d *dedup) duplicate(msg MQTT.Message) bool {
+	if d == nil || msg.Qos() == 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write(msg.Payload())
+	key := dedupKey{msg.MessageID(), msg.Topic(), h.Sum64()}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.purged) > DEDUP_WINDOW {
+		d.purge(now)
+	}
+	if t, ok := d.seen[key]; ok && msg.Duplicate() && now.Sub(t) <= DEDUP_WINDOW {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
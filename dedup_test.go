@@ -0,0 +1,61 @@
+package mqttGather
+
+import (
+	"testing"
+)
+
+type qos1Message struct {
+	*testMessage
+	id  uint16
+	dup bool
+}
+
+func (m *qos1Message) Qos() byte         { return 1 }
+func (m *qos1Message) MessageID() uint16 { return m.id }
+func (m *qos1Message) Duplicate() bool   { return m.dup }
+
+// QoS 0 message with the DUP flag set, which brokers shouldn't send.
+type qos0Message struct {
+	*testMessage
+}
+
+func (m *qos0Message) Qos() byte       { return 0 }
+func (m *qos0Message) Duplicate() bool { return true }
+
+func TestDedup(t *testing.T) {
+	d := newDedup()
+	topic := "/opennoise/" + TEST_SIGNIFIER + "/dba_stats"
+	msg := &testMessage{topic, []byte("1,2,3")}
+
+	if d.duplicate(&qos1Message{msg, 1, false}) {
+		t.Fatalf("first delivery reported as duplicate")
+	}
+	if !d.duplicate(&qos1Message{msg, 1, true}) {
+		t.Fatalf("redelivery not detected")
+	}
+	// message ids are reused, without DUP flag this is a new message
+	if d.duplicate(&qos1Message{msg, 1, false}) {
+		t.Fatalf("reused message id reported as duplicate")
+	}
+	if d.duplicate(&qos1Message{&testMessage{topic, []byte("4,5,6")}, 1, true}) {
+		t.Fatalf("different payload reported as duplicate")
+	}
+	// QoS 0 messages have no message id, they are never duplicates
+	if d.duplicate(&qos0Message{msg}) || d.duplicate(&qos0Message{msg}) {
+		t.Fatalf("QoS 0 message reported as duplicate")
+	}
+}
+
+func TestDedupHandler(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	mqtt := &Mqtt{db: db, dedup: newDedup(), statsChannel: make(chan DBAStats, 2)}
+
+	msg := &testMessage{"/opennoise/" + TEST_SIGNIFIER + "/dba_stats", []byte("52.683,57.619,55.152,0.595,55.272,86")}
+	mqtt.msgHandler(nil, &qos1Message{msg, 7, false})
+	mqtt.msgHandler(nil, &qos1Message{msg, 7, true})
+
+	if cnt := count(t, db, "dba_stats"); cnt != 1 {
+		t.Fatalf("duplicate saved: %d rows", cnt)
+	}
+}
@@ -1,5 +1,7 @@
 package mqttGather
 
+import "database/sql"
+
 type DeviceInfo struct {
 	DeviceSignifier string
 	Description     string
@@ -13,3 +15,96 @@ type DeviceInfo struct {
 	AlertActive     bool
 	TurnOnTime      int
 }
+
+// A device known to the database, devices are created when their first
+// message is received. `Info` is nil unless device information was
+// entered for the device.
+type Device struct {
+	DeviceSignifier string
+	Info            *DeviceInfo
+	LastSeen        int64 // start of the minute of the latest noise stats, 0 if none
+}
+
+// Load all devices, ordered by signifier.
+func (s *SqliteDB) LoadDevices() ([]Device, error) {
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query()
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var devices []Device
+		for rows.Next() {
+			var d Device
+			var info DeviceInfo
+			var description, phone sql.NullString
+			var lat, lon, threshold, duration, count, deadtime sql.NullFloat64
+			var active sql.NullBool
+			var turnOn sql.NullInt64
+			err := rows.Scan(
+				&d.DeviceSignifier,
+				&d.LastSeen,
+				&description,
+				&lat,
+				&lon,
+				&threshold,
+				&duration,
+				&count,
+				&deadtime,
+				&phone,
+				&active,
+				&turnOn,
+			)
+			if err != nil {
+				return nil, err
+			}
+			if description.Valid {
+				info = DeviceInfo{
+					DeviceSignifier: d.DeviceSignifier,
+					Description:     description.String,
+					Latitude:        lat.Float64,
+					Longitude:       lon.Float64,
+					AlertThreshold:  threshold.Float64,
+					AlertDuration:   int64(duration.Float64),
+					AlertCount:      int64(count.Float64),
+					AlertDeadtime:   int64(deadtime.Float64),
+					AlertPhone:      phone.String,
+					AlertActive:     active.Bool,
+					TurnOnTime:      int(turnOn.Int64),
+				}
+				d.Info = &info
+			}
+			devices = append(devices, d)
+		}
+		return devices, rows.Err()
+	}
+
+	sql := `
+SELECT
+	d.device_signifier,
+	IFNULL((SELECT MAX(ts) FROM dba_stats_1m s WHERE s.device_id = d.device_id), 0),
+	description,
+	latitude,
+	longitude,
+	alert_threshold,
+	alert_duration,
+	alert_count,
+	alert_deadtime,
+	alert_phone,
+	alert_active,
+	turn_on_time
+FROM
+	device d
+LEFT JOIN
+	device_info di
+ON
+	di.device_id = d.device_id
+ORDER BY
+	d.device_signifier
+`
+	devices_, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	return devices_.([]Device), nil
+}
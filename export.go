@@ -0,0 +1,484 @@
+package mqttGather
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Export of noise stats and telemetry for analysis, e.g. in notebooks.
+// Rows of the selected devices and period are joined with the
+// description and location of the device (see `DeviceInfo`) and written
+// to CSV, JSON Lines or Parquet as they are read from the database, so
+// exports of long periods don't need to fit into memory. (Parquet files
+// are written in row groups of `PARQUET_ROW_GROUP_SIZE` bytes, which are
+// buffered.)
+//
+// Noise stats can be aggregated into intervals (e.g. 15m, 1h or 24h)
+// aligned to midnight in the export's time zone, the level of an interval
+// is the energy average of the rows' averages (like the rollups, see
+// rollup.go). Timestamps are given in the export's time zone, apart from
+// Parquet, which stores instants (UTC).
+
+// Tables that can be exported
+const (
+	EXPORT_STATS     = "dba_stats"
+	EXPORT_TELEMETRY = "telemetry" // tele_mem, tele_ver and tele_misc
+)
+
+// Export formats
+const (
+	EXPORT_CSV     = "csv"
+	EXPORT_JSONL   = "jsonl"
+	EXPORT_PARQUET = "parquet"
+)
+
+const PARQUET_ROW_GROUP_SIZE = 8 * 1024 * 1024
+
+type ExportOptions struct {
+	Table   string   // EXPORT_STATS or EXPORT_TELEMETRY
+	Format  string   // EXPORT_CSV, EXPORT_JSONL or EXPORT_PARQUET
+	Devices []string // signifiers of the devices to export, all devices if empty
+	Begin   time.Time
+	End     time.Time // exclusive
+	// Aggregate noise stats into intervals of this length, must divide a
+	// day evenly. Raw rows are exported if 0.
+	Interval time.Duration
+	// Time zone of timestamps and intervals, UTC if nil.
+	Location *time.Location
+}
+
+// Checks the options for errors, also done by `Export`.
+func (o *ExportOptions) Validate() error {
+	switch o.Table {
+	case EXPORT_STATS:
+	case EXPORT_TELEMETRY:
+		if o.Interval != 0 {
+			return fmt.Errorf("telemetry can't be aggregated")
+		}
+	default:
+		return fmt.Errorf("unknown export table: %s", o.Table)
+	}
+	switch o.Format {
+	case EXPORT_CSV, EXPORT_JSONL, EXPORT_PARQUET:
+	default:
+		return fmt.Errorf("unknown export format: %s", o.Format)
+	}
+	if o.Interval < 0 || (o.Interval != 0 && (o.Interval < time.Second || (24*time.Hour)%o.Interval != 0)) {
+		return fmt.Errorf("invalid interval: %v (must divide 24h)", o.Interval)
+	}
+	return nil
+}
+
+func (o *ExportOptions) location() *time.Location {
+	if o.Location == nil {
+		return time.UTC
+	}
+	return o.Location
+}
+
+// Start of the interval `t` falls into, intervals are aligned to
+// midnight in the time zone of `t`. Durations are counted from midnight,
+// so intervals remain `interval` long on days DST changes.
+func intervalStart(t time.Time, interval time.Duration) time.Time {
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	return midnight.Add(t.Sub(midnight) / interval * interval)
+}
+
+// The device of an exported row, its description and location are empty
+// if no device info exists.
+type ExportDevice struct {
+	Device      string   `json:"device"`
+	Description string   `json:"description,omitempty"`
+	Latitude    *float64 `json:"latitude,omitempty"`
+	Longitude   *float64 `json:"longitude,omitempty"`
+}
+
+func (d *ExportDevice) csvRecord() []string {
+	return []string{d.Device, d.Description, formatOptional(d.Latitude), formatOptional(d.Longitude)}
+}
+
+func formatOptional(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// An exported noise stats row, or the aggregate of an interval (in which
+// case `AverageVar` and `Mean` are nil, `Average` is the energy average
+// and `Count` the number of aggregated rows).
+type ExportedStats struct {
+	ExportDevice
+	Timestamp  time.Time `json:"timestamp"`
+	Min        float64   `json:"min"`
+	Max        float64   `json:"max"`
+	Average    float64   `json:"average"`
+	AverageVar *float64  `json:"average_var,omitempty"`
+	Mean       *float64  `json:"mean,omitempty"`
+	Num        int64     `json:"num"`
+	Count      int64     `json:"count"`
+}
+
+func ExportedStatsCSVHeader() []string {
+	return []string{"device", "description", "latitude", "longitude", "timestamp",
+		"min", "max", "average", "average_var", "mean", "num", "count"}
+}
+
+func (e *ExportedStats) CSVRecord() []string {
+	return append(e.csvRecord(),
+		e.Timestamp.Format(time.RFC3339),
+		strconv.FormatFloat(e.Min, 'f', -1, 64),
+		strconv.FormatFloat(e.Max, 'f', -1, 64),
+		strconv.FormatFloat(e.Average, 'f', -1, 64),
+		formatOptional(e.AverageVar),
+		formatOptional(e.Mean),
+		strconv.FormatInt(e.Num, 10),
+		strconv.FormatInt(e.Count, 10),
+	)
+}
+
+type parquetStats struct {
+	Device      string   `parquet:"name=device, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Description *string  `parquet:"name=description, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Latitude    *float64 `parquet:"name=latitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Longitude   *float64 `parquet:"name=longitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Timestamp   int64    `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Min         float64  `parquet:"name=min, type=DOUBLE"`
+	Max         float64  `parquet:"name=max, type=DOUBLE"`
+	Average     float64  `parquet:"name=average, type=DOUBLE"`
+	AverageVar  *float64 `parquet:"name=average_var, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Mean        *float64 `parquet:"name=mean, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Num         int64    `parquet:"name=num, type=INT64"`
+	Count       int64    `parquet:"name=count, type=INT64"`
+}
+
+func (e *ExportedStats) parquetRow() interface{} {
+	return &parquetStats{
+		Device:      e.Device,
+		Description: optionalString(e.Description),
+		Latitude:    e.Latitude,
+		Longitude:   e.Longitude,
+		Timestamp:   e.Timestamp.UnixMilli(),
+		Min:         e.Min,
+		Max:         e.Max,
+		Average:     e.Average,
+		AverageVar:  e.AverageVar,
+		Mean:        e.Mean,
+		Num:         e.Num,
+		Count:       e.Count,
+	}
+}
+
+// An exported telemetry row, `Value` is the free heap (esp, frt), version
+// information or other telemetry data depending on `Type`.
+type ExportedTelemetry struct {
+	ExportDevice
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Value     string    `json:"value"`
+}
+
+func ExportedTelemetryCSVHeader() []string {
+	return []string{"device", "description", "latitude", "longitude", "timestamp", "type", "value"}
+}
+
+func (e *ExportedTelemetry) CSVRecord() []string {
+	return append(e.csvRecord(), e.Timestamp.Format(time.RFC3339), e.Type, e.Value)
+}
+
+type parquetTelemetry struct {
+	Device      string   `parquet:"name=device, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Description *string  `parquet:"name=description, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Latitude    *float64 `parquet:"name=latitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Longitude   *float64 `parquet:"name=longitude, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Timestamp   int64    `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Type        string   `parquet:"name=type, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Value       string   `parquet:"name=value, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+func (e *ExportedTelemetry) parquetRow() interface{} {
+	return &parquetTelemetry{
+		Device:      e.Device,
+		Description: optionalString(e.Description),
+		Latitude:    e.Latitude,
+		Longitude:   e.Longitude,
+		Timestamp:   e.Timestamp.UnixMilli(),
+		Type:        e.Type,
+		Value:       e.Value,
+	}
+}
+
+type exportRow interface {
+	CSVRecord() []string
+	parquetRow() interface{}
+}
+
+// Writes rows in one of the export formats.
+type exportEncoder interface {
+	encode(exportRow) error
+	close() error
+}
+
+func newExportEncoder(w io.Writer, opts *ExportOptions) (exportEncoder, error) {
+	header, schema := ExportedStatsCSVHeader(), interface{}(new(parquetStats))
+	if opts.Table == EXPORT_TELEMETRY {
+		header, schema = ExportedTelemetryCSVHeader(), new(parquetTelemetry)
+	}
+	switch opts.Format {
+	case EXPORT_CSV:
+		enc := &csvEncoder{csv.NewWriter(w)}
+		return enc, enc.w.Write(header)
+	case EXPORT_JSONL:
+		return &jsonlEncoder{json.NewEncoder(w)}, nil
+	case EXPORT_PARQUET:
+		pw, err := writer.NewParquetWriterFromWriter(w, schema, 1)
+		if err != nil {
+			return nil, err
+		}
+		pw.RowGroupSize = PARQUET_ROW_GROUP_SIZE
+		return &parquetEncoder{pw}, nil
+	}
+	return nil, fmt.Errorf("unknown export format: %s", opts.Format)
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder) encode(row exportRow) error { return e.w.Write(row.CSVRecord()) }
+
+func (e *csvEncoder) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlEncoder) encode(row exportRow) error { return e.enc.Encode(row) }
+func (e *jsonlEncoder) close() error               { return nil }
+
+type parquetEncoder struct {
+	pw *writer.ParquetWriter
+}
+
+func (e *parquetEncoder) encode(row exportRow) error { return e.pw.Write(row.parquetRow()) }
+func (e *parquetEncoder) close() error               { return e.pw.WriteStop() }
+
+// Writes the rows selected by `opts` to `w`, returns the number of rows
+// written.
+func (s *SqliteDB) Export(w io.Writer, opts *ExportOptions) (int64, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+	enc, err := newExportEncoder(w, opts)
+	if err != nil {
+		return 0, err
+	}
+	var cnt int64
+	emit := func(row exportRow) error {
+		cnt += 1
+		return enc.encode(row)
+	}
+	if opts.Table == EXPORT_TELEMETRY {
+		err = s.exportTelemetry(opts, emit)
+	} else {
+		err = s.exportStats(opts, emit)
+	}
+	if cerr := enc.close(); err == nil {
+		err = cerr
+	}
+	return cnt, err
+}
+
+// Condition selecting the exported devices and period, and its arguments.
+func exportCondition(opts *ExportOptions) (string, []interface{}) {
+	cond := "t.ts >= ? AND t.ts < ?"
+	args := []interface{}{opts.Begin.Unix(), opts.End.Unix()}
+	if len(opts.Devices) != 0 {
+		cond += " AND d.device_signifier IN (?" + strings.Repeat(", ?", len(opts.Devices)-1) + ")"
+		for _, d := range opts.Devices {
+			args = append(args, d)
+		}
+	}
+	return cond, args
+}
+
+const exportDeviceColumns = `
+	d.device_signifier,
+	di.description,
+	di.latitude,
+	di.longitude,
+	t.ts,`
+
+const exportDeviceJoin = `
+JOIN
+	device d
+ON
+	t.device_id = d.device_id
+LEFT JOIN
+	device_info di
+ON
+	di.device_id = d.device_id`
+
+// Scans the columns in `exportDeviceColumns`, `dest` are the remaining
+// columns.
+func scanExportRow(rows *sql.Rows, loc *time.Location, dest ...interface{}) (ExportDevice, time.Time, error) {
+	var d ExportDevice
+	var description sql.NullString
+	var lat, lon sql.NullFloat64
+	var ts int64
+	err := rows.Scan(append([]interface{}{&d.Device, &description, &lat, &lon, &ts}, dest...)...)
+	d.Description = description.String
+	if lat.Valid && lon.Valid {
+		d.Latitude, d.Longitude = &lat.Float64, &lon.Float64
+	}
+	return d, time.Unix(ts, 0).In(loc), err
+}
+
+func nullFloat(f sql.NullFloat64) *float64 {
+	if !f.Valid {
+		return nil
+	}
+	return &f.Float64
+}
+
+func (s *SqliteDB) exportStats(opts *ExportOptions, emit func(exportRow) error) error {
+	cond, args := exportCondition(opts)
+	loc := opts.location()
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query(args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		// current interval when aggregating
+		var current *ExportedStats
+		var acc leqAccumulator
+		var num int64
+		flush := func() error {
+			if current == nil {
+				return nil
+			}
+			current.Min, current.Max, current.Average = acc.min, acc.max, acc.leq()
+			current.Num, current.Count = num, acc.count
+			return emit(current)
+		}
+
+		for rows.Next() {
+			var min, max, average float64
+			var averageVar, mean sql.NullFloat64
+			var n int64
+			device, t, err := scanExportRow(rows, loc, &min, &max, &average, &averageVar, &mean, &n)
+			if err != nil {
+				return nil, err
+			}
+			if opts.Interval == 0 {
+				err = emit(&ExportedStats{device, t, min, max, average, nullFloat(averageVar), nullFloat(mean), n, 1})
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			start := intervalStart(t, opts.Interval)
+			if current == nil || current.Device != device.Device || !current.Timestamp.Equal(start) {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				current = &ExportedStats{ExportDevice: device, Timestamp: start}
+				acc, num = leqAccumulator{}, 0
+			}
+			acc.add(min, max, average, n)
+			num += n
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, flush()
+	}
+
+	sql := `
+SELECT` + exportDeviceColumns + `
+	IFNULL(t.min, 0),
+	IFNULL(t.max, 0),
+	IFNULL(t.average, 0),
+	t.averageVar,
+	t.mean,
+	IFNULL(t.num, 0)
+FROM
+	dba_stats t` + exportDeviceJoin + `
+WHERE
+	` + cond + `
+ORDER BY
+	d.device_signifier, t.ts
+`
+	_, err := s.execute(sql, exec)
+	return err
+}
+
+func (s *SqliteDB) exportTelemetry(opts *ExportOptions, emit func(exportRow) error) error {
+	cond, args := exportCondition(opts)
+	loc := opts.location()
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		var all []interface{} // the condition is repeated for each table
+		for i := 0; i != 3; i++ {
+			all = append(all, args...)
+		}
+		rows, err := stmt.Query(all...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var typ, value sql.NullString
+			device, t, err := scanExportRow(rows, loc, &typ, &value)
+			if err != nil {
+				return nil, err
+			}
+			if err := emit(&ExportedTelemetry{device, t, typ.String, value.String}); err != nil {
+				return nil, err
+			}
+		}
+		return nil, rows.Err()
+	}
+
+	var selects []string
+	for _, table := range []struct{ name, value string }{
+		{"tele_mem", "CAST(t.free_mem AS TEXT)"},
+		{"tele_ver", "t.info"},
+		{"tele_misc", "t.data"},
+	} {
+		selects = append(selects, `
+SELECT`+exportDeviceColumns+`
+	t.type,
+	`+table.value+`
+FROM
+	`+table.name+` t`+exportDeviceJoin+`
+WHERE
+	`+cond)
+	}
+	sql := strings.Join(selects, "\nUNION ALL") + `
+ORDER BY
+	1, 5
+`
+	_, err := s.execute(sql, exec)
+	return err
+}
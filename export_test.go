@@ -0,0 +1,203 @@
+package mqttGather
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// Test db with stats of two devices, TEST_SIGNIFIER has device info.
+// TEST_SIGNIFIER: 4 rows, 15 minutes apart starting at 2021-10-31 00:00 UTC.
+func getTestDBForExport(t *testing.T) *SqliteDB {
+	db, _ := getTestDBWithDeviceInfo(t)
+	begin := time.Date(2021, 10, 31, 0, 0, 0, 0, time.UTC)
+	for i, average := range []float64{50, 60, 50, 60} {
+		stats := DBAStats{TEST_SIGNIFIER, 40, 70, average, 0.5, 55, 10}
+		if _, err := db.Save(&stats, begin.Add(time.Duration(i)*15*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := RandomDBAStats()
+	if _, err := db.Save(&stats, begin); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testExportOptions(format string) *ExportOptions {
+	begin := time.Date(2021, 10, 31, 0, 0, 0, 0, time.UTC)
+	return &ExportOptions{
+		Table:  EXPORT_STATS,
+		Format: format,
+		Begin:  begin,
+		End:    begin.Add(24 * time.Hour),
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	db := getTestDBForExport(t)
+	defer db.Close()
+
+	var buf bytes.Buffer
+	opts := testExportOptions(EXPORT_CSV)
+	opts.Devices = []string{TEST_SIGNIFIER}
+	cnt, err := db.Export(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 4 || len(records) != 5 {
+		t.Fatalf("unexpected export (%d rows): %v", cnt, records)
+	}
+	should := []string{TEST_SIGNIFIER, "bla", "1", "2", "2021-10-31T00:15:00Z", "40", "70", "60", "0.5", "55", "10", "1"}
+	for i, v := range should {
+		if records[2][i] != v {
+			t.Fatalf("unexpected %s: %s, should: %s", records[0][i], records[2][i], v)
+		}
+	}
+}
+
+func TestExportAggregated(t *testing.T) {
+	db := getTestDBForExport(t)
+	defer db.Close()
+
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	var buf bytes.Buffer
+	opts := testExportOptions(EXPORT_JSONL)
+	opts.Interval = 30 * time.Minute
+	opts.Location = loc
+	cnt, err := db.Export(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []ExportedStats
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var row ExportedStats
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if cnt != 3 || len(rows) != 3 || rows[2].Device != "c4:dd:57:66:95:60" || rows[2].Latitude != nil {
+		t.Fatalf("unexpected export: %#v", rows)
+	}
+	r := rows[0]
+	// 00:00 UTC is 02:00 CEST, the last night of DST in 2021
+	if r.Device != TEST_SIGNIFIER || r.Timestamp.Format(time.RFC3339) != "2021-10-31T02:00:00+02:00" || *r.Latitude != 1 {
+		t.Fatalf("unexpected interval: %#v", r)
+	}
+	if r.Count != 2 || r.Num != 20 || r.Min != 40 || r.Max != 70 || r.AverageVar != nil {
+		t.Fatalf("unexpected aggregate: %#v", r)
+	}
+	if leq := energyToDB((dbToEnergy(50) + dbToEnergy(60)) / 2); r.Average != leq {
+		t.Fatalf("unexpected average: %f, should: %f", r.Average, leq)
+	}
+	if rows[1].Timestamp.Format(time.RFC3339) != "2021-10-31T02:30:00+02:00" {
+		t.Fatalf("unexpected interval: %#v", rows[1])
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	db := getTestDBForExport(t)
+	defer db.Close()
+
+	var buf bytes.Buffer
+	cnt, err := db.Export(&buf, testExportOptions(EXPORT_PARQUET))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := buffer.NewBufferFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetReader(file, new(parquetStats), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	if cnt != 5 || pr.GetNumRows() != 5 {
+		t.Fatalf("unexpected number of rows: %d, %d", cnt, pr.GetNumRows())
+	}
+	rows := make([]parquetStats, 5)
+	if err := pr.Read(&rows); err != nil {
+		t.Fatal(err)
+	}
+	r := rows[0]
+	if r.Device != TEST_SIGNIFIER || r.Description == nil || *r.Description != "bla" || r.Timestamp != 1635638400000 {
+		t.Fatalf("unexpected row: %#v", r)
+	}
+	if rows[4].Description != nil || rows[4].Latitude != nil {
+		t.Fatalf("unexpected device info: %#v", rows[4])
+	}
+}
+
+func TestExportTelemetry(t *testing.T) {
+	db, _ := getTestDBWithDeviceInfo(t)
+	defer db.Close()
+	ts := time.Date(2021, 10, 31, 12, 0, 0, 0, time.UTC)
+	for i, payload := range []string{"esp:139248", "ver:1.2.3", "flg:0000000F"} {
+		tel, err := TelemetryFromPayload(payload, TEST_SIGNIFIER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.SaveTelemetry(tel, ts.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := testExportOptions(EXPORT_CSV)
+	opts.Table = EXPORT_TELEMETRY
+	cnt, err := db.Export(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 3 || len(records) != 4 {
+		t.Fatalf("unexpected export: %v", records)
+	}
+	if r := records[1]; r[4] != "2021-10-31T12:00:00Z" || r[5] != "esp" || r[6] != "139248" {
+		t.Fatalf("unexpected row: %v", r)
+	}
+	if r := records[2]; r[5] != "ver" || r[6] != "1.2.3" {
+		t.Fatalf("unexpected row: %v", r)
+	}
+
+	opts.Interval = time.Hour
+	if _, err := db.Export(&buf, opts); err == nil {
+		t.Fatalf("expected error aggregating telemetry")
+	}
+}
+
+func TestIntervalStart(t *testing.T) {
+	loc := time.FixedZone("test", 90*60)
+	for _, test := range []struct {
+		t        time.Time
+		interval time.Duration
+		should   time.Time
+	}{
+		{time.Date(2021, 1, 1, 13, 29, 0, 0, loc), time.Hour, time.Date(2021, 1, 1, 13, 0, 0, 0, loc)},
+		{time.Date(2021, 1, 1, 13, 29, 0, 0, loc), 15 * time.Minute, time.Date(2021, 1, 1, 13, 15, 0, 0, loc)},
+		{time.Date(2021, 1, 1, 0, 10, 0, 0, loc), 24 * time.Hour, time.Date(2021, 1, 1, 0, 0, 0, 0, loc)},
+	} {
+		if is := intervalStart(test.t, test.interval); !is.Equal(test.should) {
+			t.Fatalf("%v (%v): %v, should: %v", test.t, test.interval, is, test.should)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package mqttGather
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health and readiness reporting for supervisors (systemd, k8s, monit ...)
+// served at:
+//
+//	/livez  : the process is working and doesn't need to be restarted
+//	/readyz : the process is connected and data is flowing
+//	/healthz: detailed report of all checks
+//
+// The endpoints return 200 if all relevant checks pass and 503 otherwise,
+// along with a JSON report.
+//
+// Liveness only covers problems that won't resolve without a restart
+// (e.g. the alerter goroutine died). Readiness additionally includes
+// conditions that may recover on their own, e.g. the MQTT connection
+// which paho reestablishes automatically.
+
+// If no message was received for this long, the gatherer is not ready.
+const DEFAULT_MAX_SILENCE = 10 * time.Minute
+
+// The database probe writes a row, its result is reused for this long so
+// frequent polling doesn't add writes.
+const DB_PROBE_INTERVAL = 5 * time.Second
+
+type CheckKind string
+
+const (
+	LIVENESS  = CheckKind("liveness")  // affects liveness and readiness
+	READINESS = CheckKind("readiness") // only affects readiness
+)
+
+type HealthCheck struct {
+	Name  string
+	Kind  CheckKind
+	Check func() error
+}
+
+type Health struct {
+	mu     sync.Mutex
+	checks []HealthCheck
+}
+
+type CheckResult struct {
+	Kind  CheckKind `json:"kind"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+func (h *Health) Add(name string, kind CheckKind, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, HealthCheck{name, kind, check})
+}
+
+// Runs all checks, the report's status is "ok" if all checks of `kinds`
+// passed, "failed" otherwise.
+func (h *Health) Report(kinds ...CheckKind) HealthReport {
+	h.mu.Lock()
+	checks := append([]HealthCheck(nil), h.checks...)
+	h.mu.Unlock()
+
+	report := HealthReport{
+		Status: "ok",
+		Checks: make(map[string]CheckResult),
+	}
+	for _, c := range checks {
+		result := CheckResult{Kind: c.Kind, OK: true}
+		if err := c.Check(); err != nil {
+			result.OK = false
+			result.Error = err.Error()
+			for _, k := range kinds {
+				if k == c.Kind {
+					report.Status = "failed"
+				}
+			}
+		}
+		report.Checks[c.Name] = result
+	}
+	return report
+}
+
+func serveReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveReport(w, h.Report(LIVENESS))
+	})
+}
+
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveReport(w, h.Report(LIVENESS, READINESS))
+	})
+}
+
+// Runs `check` at most once per `interval`, returning the previous result
+// in between.
+func cachedCheck(interval time.Duration, check func() error) func() error {
+	var mu sync.Mutex
+	var checked time.Time
+	var result error
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if checked.IsZero() || time.Since(checked) >= interval {
+			result = check()
+			checked = time.Now()
+		}
+		return result
+	}
+}
+
+// Registers /livez, /readyz and /healthz (same as /readyz)
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.Handle("/livez", h.LivenessHandler())
+	mux.Handle("/readyz", h.ReadinessHandler())
+	mux.Handle("/healthz", h.ReadinessHandler())
+}
+
+// Creates the standard checks for the gatherer. The alerter is checked if
+// alerting is enabled, also if it is enabled or replaced on reload.
+func NewHealth(cfg *RunConfig, mqtt *Mqtt) *Health {
+	maxSilence := DEFAULT_MAX_SILENCE
+	if cfg.MaxSilence > 0 {
+		maxSilence = time.Duration(cfg.MaxSilence) * time.Second
+	}
+	started := time.Now()
+
+	h := &Health{}
+	h.Add("mqtt_connection", READINESS, func() error {
+		if !mqtt.IsConnected() {
+			return fmt.Errorf("not connected to %s", mqtt.Broker)
+		}
+		return nil
+	})
+	h.Add("mqtt_subscriptions", READINESS, func() error {
+		subs := mqtt.Subscriptions()
+		cfg := mqtt.config()
+		for _, topic := range []string{cfg.Topic, cfg.TelemetryTopic} {
+			if topic == "" {
+				continue
+			}
+			if err, ok := subs[topic]; !ok {
+				return fmt.Errorf("not subscribed to %s", topic)
+			} else if err != nil {
+				return fmt.Errorf("subscription to %s failed: %v", topic, err)
+			}
+		}
+		return nil
+	})
+	h.Add("db_writable", READINESS, cachedCheck(DB_PROBE_INTERVAL, func() error {
+		return mqtt.DB().Probe()
+	}))
+	h.Add("last_message", READINESS, func() error {
+		last := mqtt.LastMessage()
+		if last.IsZero() {
+			last = started
+		}
+		if silence := time.Since(last); silence > maxSilence {
+			return fmt.Errorf("no message received for %v", silence.Round(time.Second))
+		}
+		return nil
+	})
+	h.Add("alerter", LIVENESS, func() error {
+		if alerter := mqtt.Alerter(); alerter != nil {
+			return alerter.Check()
+		}
+		return nil
+	})
+	return h
+}
@@ -0,0 +1,108 @@
+package mqttGather
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthReport(t *testing.T) {
+	h := &Health{}
+	var connected bool
+	h.Add("live", LIVENESS, func() error { return nil })
+	h.Add("connected", READINESS, func() error {
+		if !connected {
+			return fmt.Errorf("not connected")
+		}
+		return nil
+	})
+
+	mux := http.NewServeMux()
+	h.Register(mux)
+
+	get := func(path string) (int, HealthReport) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var report HealthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, report
+	}
+
+	if code, report := get("/livez"); code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("expected live: %d %#v", code, report)
+	}
+	code, report := get("/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != "failed" {
+		t.Fatalf("expected not ready: %d %#v", code, report)
+	}
+	if c := report.Checks["connected"]; c.OK || c.Error != "not connected" {
+		t.Fatalf("incorrect check result: %#v", c)
+	}
+
+	connected = true
+	if code, report := get("/healthz"); code != http.StatusOK || len(report.Checks) != 2 {
+		t.Fatalf("expected ready: %d %#v", code, report)
+	}
+}
+
+func TestHealthAlerter(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	mqtt := &Mqtt{db: db, cfg: &RunConfig{}}
+
+	h := NewHealth(&RunConfig{}, mqtt)
+	if report := h.Report(LIVENESS); report.Status != "ok" || !report.Checks["alerter"].OK {
+		t.Fatalf("disabled alerter reported dead: %#v", report)
+	}
+
+	// alerters enabled after creating the checks (on reload) are checked
+	alerter := &Alerter{}
+	mqtt.alerter = alerter
+	report := h.Report(LIVENESS)
+	if report.Status != "failed" || report.Checks["alerter"].OK {
+		t.Fatalf("stopped alerter reported alive: %#v", report)
+	}
+	if !report.Checks["db_writable"].OK {
+		t.Fatalf("db not writable: %#v", report.Checks["db_writable"])
+	}
+	if report.Checks["mqtt_connection"].OK {
+		t.Fatalf("unconnected mqtt reported connected")
+	}
+
+	alerter.running = 1
+	if report := h.Report(LIVENESS); report.Status != "ok" {
+		t.Fatalf("running alerter reported dead: %#v", report)
+	}
+	alerter.evaluating = time.Now().Add(-ALERTER_MAX_EVALUATION - time.Second).UnixNano()
+	if report := h.Report(LIVENESS); report.Status != "failed" || report.Checks["alerter"].Error == "" {
+		t.Fatalf("stuck alerter reported alive: %#v", report)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := cachedCheck(time.Hour, func() error {
+		calls++
+		return fmt.Errorf("failed %d", calls)
+	})
+	for i := 0; i != 3; i++ {
+		if err := check(); err == nil || err.Error() != "failed 1" {
+			t.Fatalf("unexpected result: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("check not cached: %d calls", calls)
+	}
+
+	check = cachedCheck(0, func() error { calls++; return nil })
+	check()
+	check()
+	if calls != 3 {
+		t.Fatalf("check cached without interval: %d calls", calls)
+	}
+}
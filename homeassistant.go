@@ -0,0 +1,207 @@
+package mqttGather
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publishes Home Assistant MQTT discovery configuration for the devices,
+// so they show up in Home Assistant with sensors for max and average
+// noise level, free heap, firmware version and alert state. Configuration
+// is published (retained) for all devices in the database whenever the
+// gatherer connects, and for new devices or changed descriptions as
+// their messages arrive.
+//
+// The alert state sensor is left out with `sink_only`, as there are no
+// alert states then (see republish.go). The sensors' state topics are
+// the retained topics of the republisher
+// (see republish.go), which therefore needs to be enabled as well:
+//
+//	{
+//		"republish_prefix": "opennoise/json",
+//		"homeassistant": true
+//	}
+//
+// Discovery topics are `<homeassistant_prefix>/sensor/<node>/<sensor>/config`
+// with the default prefix `homeassistant` and node ids like
+// `mqttgather_c4dd57669560`.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+
+const HOMEASSISTANT_PREFIX = "homeassistant"
+
+type HomeAssistant struct {
+	Prefix      string // discovery prefix
+	StatePrefix string // republish prefix
+	AlertStates bool   // whether alert states are republished
+
+	*publishQueue
+	devices   func() ([]Device, error)
+	mu        sync.Mutex
+	announced map[string]string // description announced per device
+}
+
+// A sensor of a device, published as discovery config.
+type haSensor struct {
+	id          string
+	name        string
+	topic       string // below <republish_prefix>/<device>/
+	template    string
+	unit        string
+	deviceClass string
+	stateClass  string
+	category    string
+	options     []string
+	precision   int // digits, -1 if not set
+}
+
+var haSensors = []haSensor{
+	{"max", "Max", "stats/last", "{{ value_json.max }}", "dBA", "sound_pressure", "measurement", "", nil, 1},
+	{"average", "Average", "stats/last", "{{ value_json.average }}", "dBA", "sound_pressure", "measurement", "", nil, 1},
+	{"free_heap", "Free heap", "telemetry/esp", "{{ value_json.value }}", "B", "data_size", "measurement", "diagnostic", nil, -1},
+	{"version", "Firmware version", "telemetry/ver", "{{ value_json.value }}", "", "", "", "diagnostic", nil, -1},
+	{"alert", "Alert state", "alert", "{{ value_json.state }}", "", "enum", "", "",
+		[]string{ALERT_STATE_OK, ALERT_STATE_EXCEEDED, ALERT_STATE_ALERT}, -1},
+}
+
+// Discovery config of a sensor, see
+// https://www.home-assistant.io/integrations/sensor.mqtt/
+type HomeAssistantConfig struct {
+	Name               string              `json:"name"`
+	UniqueId           string              `json:"unique_id"`
+	StateTopic         string              `json:"state_topic"`
+	ValueTemplate      string              `json:"value_template"`
+	Unit               string              `json:"unit_of_measurement,omitempty"`
+	DeviceClass        string              `json:"device_class,omitempty"`
+	StateClass         string              `json:"state_class,omitempty"`
+	EntityCategory     string              `json:"entity_category,omitempty"`
+	Options            []string            `json:"options,omitempty"`
+	SuggestedPrecision *int                `json:"suggested_display_precision,omitempty"`
+	Device             HomeAssistantDevice `json:"device"`
+}
+
+type HomeAssistantDevice struct {
+	Identifiers  []string    `json:"identifiers"`
+	Connections  [][2]string `json:"connections,omitempty"`
+	Name         string      `json:"name"`
+	Manufacturer string      `json:"manufacturer"`
+	Model        string      `json:"model"`
+}
+
+// Creates the Home Assistant discovery publisher as configured, publishing
+// with `publish` (see `Mqtt.publish`) for the devices returned by
+// `devices`, and starts it.
+func NewHomeAssistant(cfg *RunConfig, publish publishFunc, devices func() ([]Device, error)) *HomeAssistant {
+	prefix := HOMEASSISTANT_PREFIX
+	if cfg.HomeAssistantPrefix != "" {
+		prefix = strings.TrimSuffix(cfg.HomeAssistantPrefix, "/")
+	}
+	return &HomeAssistant{
+		Prefix:       prefix,
+		StatePrefix:  strings.TrimSuffix(cfg.RepublishPrefix, "/"),
+		AlertStates:  cfg.AlertStates(),
+		publishQueue: newPublishQueue("homeassistant", 1, publish),
+		devices:      devices,
+		announced:    make(map[string]string),
+	}
+}
+
+func (h *HomeAssistant) Name() string { return h.name }
+
+func (h *HomeAssistant) WriteStats(stats *DBAStats, t time.Time, info *DeviceInfo) {
+	h.announceChanged(stats.Signifier, info)
+}
+
+func (h *HomeAssistant) WriteTelemetry(telemetry *Telemetry, t time.Time, info *DeviceInfo) {
+	h.announceChanged(telemetry.Client, info)
+}
+
+// Publishes the configuration of all devices, retained messages may have
+// been lost if the broker restarted.
+func (h *HomeAssistant) Connected() {
+	devices, err := h.devices()
+	if err != nil {
+		logger("sink").Error("could not load devices", "sink", h.Name(), "err", err)
+		return
+	}
+	for _, d := range devices {
+		h.announce(d.DeviceSignifier, d.Info)
+	}
+}
+
+// Publishes the configuration of a device unless it was published with
+// the same description.
+func (h *HomeAssistant) announceChanged(signifier string, info *DeviceInfo) {
+	h.mu.Lock()
+	announced, ok := h.announced[signifier]
+	h.mu.Unlock()
+	if !ok || announced != haDeviceName(signifier, info) {
+		h.announce(signifier, info)
+	}
+}
+
+func (h *HomeAssistant) announce(signifier string, info *DeviceInfo) {
+	device := haDevice(signifier, info)
+	h.mu.Lock()
+	h.announced[signifier] = device.Name
+	h.mu.Unlock()
+
+	node := haNodeId(signifier)
+	for _, s := range haSensors {
+		if s.id == "alert" && !h.AlertStates {
+			continue
+		}
+		config := HomeAssistantConfig{
+			Name:           s.name,
+			UniqueId:       node + "_" + s.id,
+			StateTopic:     fmt.Sprintf("%s/%s/%s", h.StatePrefix, signifier, s.topic),
+			ValueTemplate:  s.template,
+			Unit:           s.unit,
+			DeviceClass:    s.deviceClass,
+			StateClass:     s.stateClass,
+			EntityCategory: s.category,
+			Options:        s.options,
+			Device:         device,
+		}
+		if s.precision >= 0 {
+			precision := s.precision
+			config.SuggestedPrecision = &precision
+		}
+		payload, _ := json.Marshal(config)
+		h.enqueue(fmt.Sprintf("%s/sensor/%s/%s/config", h.Prefix, node, s.id), true, payload)
+	}
+}
+
+// Node id of a device, only [a-zA-Z0-9_-] are allowed.
+func haNodeId(signifier string) string {
+	return "mqttgather_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return -1
+	}, signifier)
+}
+
+func haDeviceName(signifier string, info *DeviceInfo) string {
+	if info != nil && info.Description != "" {
+		return info.Description
+	}
+	return "OpenNoise " + signifier
+}
+
+func haDevice(signifier string, info *DeviceInfo) HomeAssistantDevice {
+	device := HomeAssistantDevice{
+		Identifiers:  []string{haNodeId(signifier)},
+		Name:         haDeviceName(signifier, info),
+		Manufacturer: "OpenAir Cologne",
+		Model:        "OpenNoise",
+	}
+	if _, err := net.ParseMAC(signifier); err == nil {
+		device.Connections = [][2]string{{"mac", signifier}}
+	}
+	return device
+}
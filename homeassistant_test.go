@@ -0,0 +1,140 @@
+package mqttGather
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testHomeAssistant(t *testing.T, devices []Device) (*HomeAssistant, <-chan republishedMessage) {
+	published := make(chan republishedMessage, 100)
+	cfg := &RunConfig{RepublishPrefix: "opennoise/json", HomeAssistant: true}
+	h := NewHomeAssistant(cfg, func(topic string, qos byte, retained bool, payload []byte) error {
+		published <- republishedMessage{topic, retained, payload}
+		return nil
+	}, func() ([]Device, error) { return devices, nil })
+	t.Cleanup(func() { h.Close(context.Background()) })
+	return h, published
+}
+
+// Receives the discovery config published per sensor.
+func receiveDiscovery(t *testing.T, published <-chan republishedMessage, n int) map[string]HomeAssistantConfig {
+	configs := make(map[string]HomeAssistantConfig)
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-published:
+			var config HomeAssistantConfig
+			if err := json.Unmarshal(msg.payload, &config); err != nil {
+				t.Fatal(err)
+			}
+			if !msg.retained {
+				t.Fatalf("not retained: %s", msg.topic)
+			}
+			configs[msg.topic] = config
+		case <-time.After(5 * time.Second):
+			t.Fatalf("discovery config missing: %v", configs)
+		}
+	}
+	return configs
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	info := &DeviceInfo{Description: "Brüsseler Platz"}
+	h, published := testHomeAssistant(t, []Device{{DeviceSignifier: TEST_SIGNIFIER, Info: info}})
+
+	h.Connected()
+	configs := receiveDiscovery(t, published, len(haSensors))
+	max, ok := configs["homeassistant/sensor/mqttgather_aabbccddeeff/max/config"]
+	if !ok {
+		t.Fatalf("max sensor not published: %v", configs)
+	}
+	if max.StateTopic != "opennoise/json/"+TEST_SIGNIFIER+"/stats/last" || max.ValueTemplate != "{{ value_json.max }}" ||
+		max.UniqueId != "mqttgather_aabbccddeeff_max" || max.Unit != "dBA" || max.DeviceClass != "sound_pressure" {
+		t.Fatalf("unexpected config: %#v", max)
+	}
+	if d := max.Device; d.Name != "Brüsseler Platz" || d.Identifiers[0] != "mqttgather_aabbccddeeff" || d.Connections[0][1] != TEST_SIGNIFIER {
+		t.Fatalf("unexpected device: %#v", d)
+	}
+	alert := configs["homeassistant/sensor/mqttgather_aabbccddeeff/alert/config"]
+	if alert.StateTopic != "opennoise/json/"+TEST_SIGNIFIER+"/alert" || strings.Join(alert.Options, ",") != "ok,exceeded,alert" {
+		t.Fatalf("unexpected config: %#v", alert)
+	}
+
+	// known devices are only announced again if the description changed
+	stats := DBAStats{Signifier: TEST_SIGNIFIER}
+	h.WriteStats(&stats, time.Now(), info)
+	select {
+	case msg := <-published:
+		t.Fatalf("unchanged device announced: %s", msg.topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.WriteStats(&stats, time.Now(), &DeviceInfo{Description: "Zülpicher Platz"})
+	for _, config := range receiveDiscovery(t, published, len(haSensors)) {
+		if config.Device.Name != "Zülpicher Platz" {
+			t.Fatalf("description not updated: %#v", config.Device)
+		}
+	}
+
+	// new devices are announced as they appear
+	h.WriteTelemetry(&Telemetry{Client: "c4:dd:57:66:95:60", Type: ESP, Data: 1}, time.Now(), nil)
+	for topic, config := range receiveDiscovery(t, published, len(haSensors)) {
+		if !strings.Contains(topic, "mqttgather_c4dd57669560") || config.Device.Name != "OpenNoise c4:dd:57:66:95:60" {
+			t.Fatalf("unexpected config: %s %#v", topic, config)
+		}
+	}
+}
+
+func TestHomeAssistantSinkOnly(t *testing.T) {
+	published := make(chan republishedMessage, 100)
+	cfg := &RunConfig{RepublishPrefix: "opennoise/json", HomeAssistant: true, SinkOnly: true}
+	h := NewHomeAssistant(cfg, func(topic string, qos byte, retained bool, payload []byte) error {
+		published <- republishedMessage{topic, retained, payload}
+		return nil
+	}, nil)
+	defer h.Close(context.Background())
+
+	// there are no alert states without saved stats
+	h.WriteStats(&DBAStats{Signifier: TEST_SIGNIFIER}, time.Now(), nil)
+	configs := receiveDiscovery(t, published, len(haSensors)-1)
+	if _, ok := configs["homeassistant/sensor/mqttgather_aabbccddeeff/alert/config"]; ok {
+		t.Fatalf("alert state announced with sink_only")
+	}
+	select {
+	case msg := <-published:
+		t.Fatalf("unexpected config: %s", msg.topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestIntegrationHomeAssistant(t *testing.T) {
+	b := startTestBroker(t)
+	mqtt := connectTestGatherer(t, b, func(cfg *RunConfig) {
+		cfg.RepublishPrefix = "opennoise/json"
+		cfg.HomeAssistant = true
+	})
+	insertTestDeviceInfo(t, mqtt.DB().(*SqliteDB))
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+
+	ha := testClient(t, b, "homeassistant", nil)
+	defer ha.Disconnect(100)
+	var configs []string
+	waitFor(t, "discovery", func() bool {
+		configs = nil
+		msgs := testSubscribe(t, ha, "homeassistant/sensor/+/+/config", 0)
+		for {
+			select {
+			case msg := <-msgs:
+				if strings.Contains(string(msg.Payload()), `"name":"bla"`) {
+					configs = append(configs, msg.Topic())
+				}
+			case <-time.After(50 * time.Millisecond):
+				ha.Unsubscribe("homeassistant/sensor/+/+/config").Wait()
+				return len(configs) == len(haSensors)
+			}
+		}
+	})
+}
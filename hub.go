@@ -0,0 +1,206 @@
+package mqttGather
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pub/sub hub passing parsed stats, telemetry, alert states and sent
+// alerts to live consumers within the process, e.g. the dashboard and the
+// event stream (see dashboard.go, stream.go). It is fed by the message
+// handlers and the alerter as a sink (see sink.go). Events are marshalled
+// once and fanned out to the subscribers' buffered channels, optionally
+// filtered by device and event type. Publishing never blocks, unlike
+// passing stats to the alerter: if a subscriber's buffer is full, the
+// event is dropped for that subscriber and counted, see
+// `HubSubscription.Dropped`.
+//
+// The hub also keeps the latest stats and alert state of each device, to
+// show the current state without waiting for the next messages.
+
+// Buffered events per subscriber.
+const HUB_BUFFER_SIZE = 256
+
+const (
+	EVENT_STATS       = "stats"
+	EVENT_TELEMETRY   = "telemetry"
+	EVENT_ALERT_STATE = "alert_state"
+	EVENT_ALERT       = "alert" // an alert was sent
+)
+
+var eventTypes = []string{EVENT_STATS, EVENT_TELEMETRY, EVENT_ALERT_STATE, EVENT_ALERT}
+
+type HubEvent struct {
+	Type   string
+	Device string
+	Data   []byte // JSON, see RepublishedStats etc. and HubAlert
+}
+
+// Events a subscriber receives, empty lists match all devices or types.
+type HubFilter struct {
+	Devices []string
+	Types   []string
+}
+
+type HubSubscription struct {
+	C <-chan HubEvent // closed once unsubscribed or the hub is closed
+
+	c       chan HubEvent
+	devices map[string]bool
+	types   map[string]bool
+	dropped uint64 // accessed atomically
+}
+
+// A sent alert, without the phone number.
+type HubAlert struct {
+	ExportDevice
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+	Status    string    `json:"status"`
+}
+
+// Latest stats and alert state of a device.
+type DeviceState struct {
+	Stats      *DBAStats
+	Timestamp  time.Time // of the stats
+	AlertState string
+}
+
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*HubSubscription]struct{}
+	latest      map[string]DeviceState
+	closed      bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[*HubSubscription]struct{}),
+		latest:      make(map[string]DeviceState),
+	}
+}
+
+func (h *Hub) Name() string { return "hub" }
+
+func (h *Hub) Subscribe(filter HubFilter) *HubSubscription {
+	c := make(chan HubEvent, HUB_BUFFER_SIZE)
+	s := &HubSubscription{C: c, c: c, devices: stringSet(filter.Devices), types: stringSet(filter.Types)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(c)
+	} else {
+		h.subscribers[s] = struct{}{}
+	}
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *HubSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.c)
+	}
+}
+
+func stringSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+func (s *HubSubscription) matches(event HubEvent) bool {
+	return (s.devices == nil || s.devices[event.Device]) && (s.types == nil || s.types[event.Type])
+}
+
+// Returns the number of events dropped since the last call because the
+// subscriber didn't keep up.
+func (s *HubSubscription) Dropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Latest state of all devices seen since starting.
+func (h *Hub) Latest() map[string]DeviceState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	latest := make(map[string]DeviceState, len(h.latest))
+	for device, state := range h.latest {
+		latest[device] = state
+	}
+	return latest
+}
+
+func (h *Hub) publish(event HubEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		if !s.matches(event) {
+			continue
+		}
+		select {
+		case s.c <- event:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			metricSinkDropped.Inc(h.Name())
+		}
+	}
+}
+
+func (h *Hub) WriteStats(stats *DBAStats, t time.Time, info *DeviceInfo) {
+	h.mu.Lock()
+	state := h.latest[stats.Signifier]
+	s := *stats
+	state.Stats, state.Timestamp = &s, t
+	h.latest[stats.Signifier] = state
+	h.mu.Unlock()
+
+	data, _ := json.Marshal(newRepublishedStats(stats, t, info))
+	h.publish(HubEvent{EVENT_STATS, stats.Signifier, data})
+}
+
+func (h *Hub) WriteTelemetry(telemetry *Telemetry, t time.Time, info *DeviceInfo) {
+	data, _ := json.Marshal(newRepublishedTelemetry(telemetry, t, info))
+	h.publish(HubEvent{EVENT_TELEMETRY, telemetry.Client, data})
+}
+
+func (h *Hub) WriteAlertState(state AlertState) {
+	h.mu.Lock()
+	latest := h.latest[state.Device]
+	latest.AlertState = state.State
+	h.latest[state.Device] = latest
+	h.mu.Unlock()
+
+	data, _ := json.Marshal(newRepublishedAlertState(state))
+	h.publish(HubEvent{EVENT_ALERT_STATE, state.Device, data})
+}
+
+func (h *Hub) WriteAlert(alert *Alert, info *DeviceInfo) {
+	data, _ := json.Marshal(HubAlert{
+		ExportDevice: republishedDevice(alert.DeviceSignifier, info),
+		Timestamp:    time.Unix(alert.Timestamp, 0).UTC(),
+		Message:      alert.Message,
+		Status:       alert.Status,
+	})
+	h.publish(HubEvent{EVENT_ALERT, alert.DeviceSignifier, data})
+}
+
+// Ends all subscriptions.
+func (h *Hub) Close(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subscribers {
+		delete(h.subscribers, s)
+		close(s.c)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package mqttGather
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	sub := h.Subscribe(HubFilter{})
+	slow := h.Subscribe(HubFilter{})
+
+	stats := RandomDBAStats()
+	now := time.Now()
+	for i := 0; i < HUB_BUFFER_SIZE; i++ {
+		h.WriteStats(&stats, now, nil)
+		<-sub.C
+	}
+	h.WriteTelemetry(&Telemetry{Client: stats.Signifier, Type: ESP, Data: 1000}, now, nil)
+	h.WriteAlertState(AlertState{Device: stats.Signifier, State: ALERT_STATE_EXCEEDED, Timestamp: now})
+
+	// the slow subscriber's buffer is full, it misses the latest events
+	// without blocking the others.
+	if len(slow.C) != HUB_BUFFER_SIZE {
+		t.Fatalf("unexpected buffered events: %d", len(slow.C))
+	}
+	for _, should := range []string{EVENT_TELEMETRY, EVENT_ALERT_STATE} {
+		event := <-sub.C
+		if event.Type != should || event.Device != stats.Signifier {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+		if should == EVENT_ALERT_STATE {
+			var state RepublishedAlertState
+			if err := json.Unmarshal(event.Data, &state); err != nil || state.State != ALERT_STATE_EXCEEDED {
+				t.Fatalf("unexpected alert state: %s %v", event.Data, err)
+			}
+		}
+	}
+
+	latest := h.Latest()[stats.Signifier]
+	if latest.Stats == nil || latest.Stats.Max != stats.Max || !latest.Timestamp.Equal(now) || latest.AlertState != ALERT_STATE_EXCEEDED {
+		t.Fatalf("unexpected latest state: %#v", latest)
+	}
+
+	h.Unsubscribe(slow)
+	h.Close(context.Background())
+	if _, ok := <-sub.C; ok {
+		t.Fatal("subscription not closed")
+	}
+	if _, ok := <-h.Subscribe(HubFilter{}).C; ok {
+		t.Fatal("subscribed to closed hub")
+	}
+}
+
+func TestHubFilter(t *testing.T) {
+	h := NewHub()
+	defer h.Close(context.Background())
+	sub := h.Subscribe(HubFilter{Devices: []string{TEST_SIGNIFIER}, Types: []string{EVENT_STATS, EVENT_ALERT}})
+
+	stats := RandomDBAStats()
+	h.WriteStats(&stats, time.Now(), nil) // other device
+	stats.Signifier = TEST_SIGNIFIER
+	h.WriteTelemetry(&Telemetry{Client: TEST_SIGNIFIER, Type: ESP, Data: 1000}, time.Now(), nil)
+	h.WriteAlert(&Alert{DeviceSignifier: TEST_SIGNIFIER, Timestamp: 1635681600, AlertPhone: "+49123", Message: "too loud"}, nil)
+	h.WriteStats(&stats, time.Now(), nil)
+
+	alert := <-sub.C
+	if alert.Type != EVENT_ALERT || string(alert.Data) != `{"device":"aa:bb:cc:dd:ee:ff","timestamp":"2021-10-31T12:00:00Z","message":"too loud","status":""}` {
+		t.Fatalf("unexpected event: %s %s", alert.Type, alert.Data)
+	}
+	if event := <-sub.C; event.Type != EVENT_STATS || event.Device != TEST_SIGNIFIER {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if len(sub.C) != 0 || sub.Dropped() != 0 {
+		t.Fatal("unexpected events")
+	}
+
+	for i := 0; i < HUB_BUFFER_SIZE+3; i++ {
+		h.WriteStats(&stats, time.Now(), nil)
+	}
+	if dropped := sub.Dropped(); dropped != 3 {
+		t.Fatalf("unexpected dropped events: %d", dropped)
+	}
+	if dropped := sub.Dropped(); dropped != 0 {
+		t.Fatalf("dropped events not reset: %d", dropped)
+	}
+}
@@ -0,0 +1,332 @@
+package mqttGather
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink forwarding noise stats and telemetry as InfluxDB line protocol
+// over HTTP, e.g. to InfluxDB's (v1 or v2) write API or any other store
+// accepting line protocol.
+//
+// Noise stats are written as measurement `dba_stats` with the fields min,
+// max, average, average_var, mean and num. Telemetry is written as
+// measurement `telemetry` with the telemetry type as field key (e.g.
+// `esp=139248i`, `ver="1.2.3"`). Both are tagged with the device
+// signifier and, if there is device info, its description and location.
+// Timestamps have nanosecond precision, the default of the write APIs.
+//
+// Lines are written in batches of `BatchSize`, or after `FlushInterval`.
+// Failed writes (network errors, 429 and 5xx responses) are retried with
+// exponential backoff, meanwhile up to `INFLUX_MAX_PENDING` lines are
+// kept, the oldest are dropped beyond that. Batches rejected otherwise
+// (4xx, e.g. malformed lines) are dropped.
+
+const (
+	INFLUX_BATCH_SIZE     = 500
+	INFLUX_FLUSH_INTERVAL = 10 * time.Second
+	INFLUX_MAX_PENDING    = 100000
+	INFLUX_MAX_BACKOFF    = time.Minute
+	INFLUX_TIMEOUT        = 10 * time.Second
+)
+
+type InfluxSink struct {
+	URL           string
+	Token         string // sent as `Authorization: Token <token>` if set
+	BatchSize     int
+	FlushInterval time.Duration
+
+	client  *http.Client
+	lines   chan string
+	stop    chan context.Context
+	done    chan struct{}
+	stopped sync.Once
+	err     error // result of the final flush
+}
+
+// Creates an influx sink as configured and starts it.
+func NewInfluxSink(cfg *RunConfig) *InfluxSink {
+	s := &InfluxSink{
+		URL:           cfg.InfluxURL,
+		Token:         cfg.InfluxToken,
+		BatchSize:     INFLUX_BATCH_SIZE,
+		FlushInterval: INFLUX_FLUSH_INTERVAL,
+	}
+	if cfg.InfluxBatchSize > 0 {
+		s.BatchSize = cfg.InfluxBatchSize
+	}
+	if cfg.InfluxFlushInterval > 0 {
+		s.FlushInterval = time.Duration(cfg.InfluxFlushInterval) * time.Second
+	}
+	s.Start()
+	return s
+}
+
+func (s *InfluxSink) Name() string { return "influx" }
+
+// Starts writing in the background, call once `URL` etc. are set.
+func (s *InfluxSink) Start() {
+	s.client = &http.Client{Timeout: INFLUX_TIMEOUT}
+	s.lines = make(chan string, s.BatchSize*2)
+	s.stop = make(chan context.Context)
+	s.done = make(chan struct{})
+	go s.run()
+}
+
+func (s *InfluxSink) WriteStats(stats *DBAStats, t time.Time, info *DeviceInfo) {
+	// values are parsed with 32 bit precision (see DBAStatsFromString)
+	line := lineProtocol("dba_stats", deviceTags(stats.Signifier, info), []lineField{
+		{"min", float32(stats.Min)},
+		{"max", float32(stats.Max)},
+		{"average", float32(stats.Average)},
+		{"average_var", float32(stats.AverageVar)},
+		{"mean", float32(stats.Mean)},
+		{"num", stats.Num},
+	}, t)
+	s.write(line)
+}
+
+func (s *InfluxSink) WriteTelemetry(telemetry *Telemetry, t time.Time, info *DeviceInfo) {
+	line := lineProtocol("telemetry", deviceTags(telemetry.Client, info), []lineField{
+		{string(telemetry.Type), telemetry.Data},
+	}, t)
+	s.write(line)
+}
+
+// Queues a line without blocking, it is dropped if the queue is full.
+func (s *InfluxSink) write(line string) {
+	if line == "" {
+		return
+	}
+	select {
+	case s.lines <- line:
+	default:
+		metricSinkDropped.Inc(s.Name())
+	}
+}
+
+// Stops the sink, pending lines are written until the context is done.
+func (s *InfluxSink) Close(ctx context.Context) error {
+	s.stopped.Do(func() {
+		select {
+		case s.stop <- ctx:
+		case <-ctx.Done():
+		}
+	})
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *InfluxSink) run() {
+	log := logger("sink").With("sink", s.Name())
+	defer close(s.done)
+
+	var pending []string
+	var backoff time.Duration
+	var retry <-chan time.Time // set while waiting to retry
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	queue := func(line string) {
+		pending = append(pending, line)
+		if n := len(pending) - INFLUX_MAX_PENDING; n > 0 {
+			metricSinkDropped.Add(float64(n), s.Name())
+			pending = pending[n:]
+		}
+	}
+
+	for {
+		select {
+		case line := <-s.lines:
+			queue(line)
+			if len(pending) < s.BatchSize || retry != nil {
+				continue
+			}
+		case <-ticker.C:
+			if len(pending) == 0 || retry != nil {
+				continue
+			}
+		case <-retry:
+			retry = nil
+		case ctx := <-s.stop:
+			for len(s.lines) > 0 {
+				queue(<-s.lines)
+			}
+			s.err = s.flushAll(ctx, pending)
+			if s.err != nil {
+				log.Error("could not write pending lines", "lines", len(pending), "err", s.err)
+			}
+			return
+		}
+
+		var err error
+		if pending, err = s.flush(context.Background(), pending); err != nil {
+			backoff = min(max(2*backoff, time.Second), INFLUX_MAX_BACKOFF)
+			retry = time.After(backoff)
+			log.Warn("write failed, retrying", "lines", len(pending), "in", backoff, "err", err)
+		} else {
+			backoff = 0
+		}
+	}
+}
+
+// Writes the pending lines in batches, returns the lines not written if a
+// write fails and should be retried.
+func (s *InfluxSink) flush(ctx context.Context, pending []string) ([]string, error) {
+	for len(pending) > 0 {
+		n := min(len(pending), s.BatchSize)
+		if err := s.post(ctx, pending[:n]); err != nil {
+			if _, permanent := err.(*rejectedError); !permanent {
+				metricSinkFailed.Inc(s.Name())
+				return pending, err
+			}
+			logger("sink").Error("batch rejected", "sink", s.Name(), "lines", n, "err", err)
+			metricSinkDropped.Add(float64(n), s.Name())
+		} else {
+			metricSinkWritten.Add(float64(n), s.Name())
+		}
+		pending = pending[n:]
+	}
+	return pending, nil
+}
+
+// Writes all pending lines, retrying until the context is done.
+func (s *InfluxSink) flushAll(ctx context.Context, pending []string) error {
+	backoff := time.Second
+	for {
+		var err error
+		if pending, err = s.flush(ctx, pending); err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(backoff):
+			backoff = min(2*backoff, INFLUX_MAX_BACKOFF)
+		case <-ctx.Done():
+			metricSinkDropped.Add(float64(len(pending)), s.Name())
+			return fmt.Errorf("%d lines not written: %v", len(pending), err)
+		}
+	}
+}
+
+// A write rejected by the server, retrying won't help.
+type rejectedError struct {
+	status string
+	body   string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("rejected: %s %s", e.status, e.body)
+}
+
+func (s *InfluxSink) post(ctx context.Context, lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, strings.NewReader(body))
+	if err != nil {
+		return &rejectedError{"invalid request", err.Error()}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return fmt.Errorf("%s %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return &rejectedError{resp.Status, string(bytes.TrimSpace(msg))}
+}
+
+// Tags identifying a device in line protocol.
+func deviceTags(signifier string, info *DeviceInfo) map[string]string {
+	tags := map[string]string{"device": signifier}
+	if info != nil {
+		tags["description"] = info.Description
+		tags["latitude"] = strconv.FormatFloat(info.Latitude, 'f', -1, 64)
+		tags["longitude"] = strconv.FormatFloat(info.Longitude, 'f', -1, 64)
+	}
+	return tags
+}
+
+type lineField struct {
+	key   string
+	value interface{} // float64, float32, int or string
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", " ")
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", " ")
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", " ")
+)
+
+// Formats a line of InfluxDB line protocol:
+//
+//	measurement,tag=value field=1.5,count=2i,text="a" 1635638400000000000
+//
+// Tags are sorted, empty tags and fields that can't be represented (NaN,
+// infinity) are left out. Returns "" if no field remains.
+func lineProtocol(measurement string, tags map[string]string, fields []lineField, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(measurement))
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s=%s", tagEscaper.Replace(k), tagEscaper.Replace(tags[k]))
+	}
+
+	sep := " "
+	for _, f := range fields {
+		var value string
+		switch v := f.value.(type) {
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		case float32:
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				continue
+			}
+			value = strconv.FormatFloat(float64(v), 'f', -1, 32)
+		case int:
+			value = strconv.Itoa(v) + "i"
+		case string:
+			value = `"` + stringEscaper.Replace(v) + `"`
+		default:
+			value = `"` + stringEscaper.Replace(fmt.Sprint(v)) + `"`
+		}
+		b.WriteString(sep + tagEscaper.Replace(f.key) + "=" + value)
+		sep = ","
+	}
+	if sep == " " {
+		return ""
+	}
+	fmt.Fprintf(&b, " %d", t.UnixNano())
+	return b.String()
+}
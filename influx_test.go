@@ -0,0 +1,209 @@
+package mqttGather
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Local stand-in for the InfluxDB write API, records the lines written
+// and answers with the given status codes in turn (204 once exhausted).
+type testInflux struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+	auth     []string
+	statuses []int
+}
+
+func startTestInflux(t *testing.T, statuses ...int) *testInflux {
+	ti := &testInflux{statuses: statuses}
+	ti.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		status := http.StatusNoContent
+		if len(ti.statuses) > 0 {
+			status, ti.statuses = ti.statuses[0], ti.statuses[1:]
+		}
+		if status == http.StatusNoContent {
+			ti.requests = append(ti.requests, string(body))
+			ti.auth = append(ti.auth, r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ti.Close)
+	return ti
+}
+
+// Lines written successfully.
+func (ti *testInflux) lines() []string {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	var lines []string
+	for _, r := range ti.requests {
+		lines = append(lines, strings.Split(strings.TrimSuffix(r, "\n"), "\n")...)
+	}
+	return lines
+}
+
+func testInfluxSink(t *testing.T, url string, batchSize int, flushInterval time.Duration) *InfluxSink {
+	s := &InfluxSink{URL: url, Token: "secret", BatchSize: batchSize, FlushInterval: flushInterval}
+	s.Start()
+	t.Cleanup(func() { s.Close(context.Background()) })
+	return s
+}
+
+func TestLineProtocol(t *testing.T) {
+	ts := time.Unix(1635638400, 5)
+	for _, test := range []struct {
+		tags   map[string]string
+		fields []lineField
+		should string
+	}{
+		{
+			deviceTags(TEST_SIGNIFIER, nil),
+			[]lineField{{"min", 52.5}, {"num", 86}},
+			"m,device=aa:bb:cc:dd:ee:ff min=52.5,num=86i 1635638400000000005",
+		},
+		{
+			deviceTags(TEST_SIGNIFIER, &DeviceInfo{Description: "Venloer Str., 1=2", Latitude: 50.94, Longitude: 6.93}),
+			[]lineField{{"ver", `1.2 "beta"`}},
+			`m,description=Venloer\ Str.\,\ 1\=2,device=aa:bb:cc:dd:ee:ff,latitude=50.94,longitude=6.93 ver="1.2 \"beta\"" 1635638400000000005`,
+		},
+		{
+			map[string]string{"device": "x", "description": ""},
+			[]lineField{{"average_var", math.NaN()}, {"mean", 1.0}},
+			"m,device=x mean=1 1635638400000000005",
+		},
+		{
+			map[string]string{"device": "x"},
+			[]lineField{{"average", math.Inf(1)}},
+			"",
+		},
+	} {
+		if line := lineProtocol("m", test.tags, test.fields, ts); line != test.should {
+			t.Fatalf("unexpected line:\n%s\nshould:\n%s", line, test.should)
+		}
+	}
+}
+
+func TestInfluxSinkBatching(t *testing.T) {
+	ti := startTestInflux(t)
+	s := testInfluxSink(t, ti.URL, 2, time.Hour)
+	ts := time.Unix(1635638400, 0)
+
+	stats := RandomDBAStats()
+	s.WriteStats(&stats, ts, nil)
+	time.Sleep(50 * time.Millisecond)
+	if lines := ti.lines(); len(lines) != 0 {
+		t.Fatalf("incomplete batch written: %v", lines)
+	}
+	s.WriteTelemetry(&Telemetry{Client: TEST_SIGNIFIER, Type: "esp", Data: 139248}, ts, nil)
+	waitFor(t, "batch", func() bool { return len(ti.lines()) == 2 })
+
+	lines := ti.lines()
+	if !strings.HasPrefix(lines[0], "dba_stats,device=c4:dd:57:66:95:60 min=") || !strings.HasSuffix(lines[0], "i 1635638400000000000") {
+		t.Fatalf("unexpected stats: %s", lines[0])
+	}
+	if lines[1] != "telemetry,device=aa:bb:cc:dd:ee:ff esp=139248i 1635638400000000000" {
+		t.Fatalf("unexpected telemetry: %s", lines[1])
+	}
+	if ti.auth[0] != "Token secret" {
+		t.Fatalf("unexpected authorization: %s", ti.auth[0])
+	}
+}
+
+func TestInfluxSinkFlushInterval(t *testing.T) {
+	ti := startTestInflux(t)
+	s := testInfluxSink(t, ti.URL, 100, 50*time.Millisecond)
+
+	stats := RandomDBAStats()
+	s.WriteStats(&stats, time.Now(), nil)
+	waitFor(t, "flush", func() bool { return len(ti.lines()) == 1 })
+}
+
+func TestInfluxSinkRetry(t *testing.T) {
+	ti := startTestInflux(t, http.StatusServiceUnavailable)
+	s := testInfluxSink(t, ti.URL, 1, 50*time.Millisecond)
+
+	stats := RandomDBAStats()
+	s.WriteStats(&stats, time.Now(), nil)
+	waitFor(t, "retry", func() bool { return len(ti.lines()) == 1 })
+}
+
+func TestInfluxSinkRejected(t *testing.T) {
+	ti := startTestInflux(t, http.StatusBadRequest)
+	s := testInfluxSink(t, ti.URL, 1, 50*time.Millisecond)
+
+	stats := RandomDBAStats()
+	s.WriteStats(&stats, time.Now(), nil)
+	stats.Signifier = TEST_SIGNIFIER
+	s.WriteStats(&stats, time.Now(), nil)
+	waitFor(t, "second batch", func() bool { return len(ti.lines()) == 1 })
+	if line := ti.lines()[0]; !strings.Contains(line, TEST_SIGNIFIER) {
+		t.Fatalf("rejected batch retried: %s", line)
+	}
+}
+
+func TestInfluxSinkClose(t *testing.T) {
+	ti := startTestInflux(t)
+	s := testInfluxSink(t, ti.URL, 100, time.Hour)
+
+	stats := RandomDBAStats()
+	for i := 0; i < 3; i++ {
+		s.WriteStats(&stats, time.Now(), nil)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := ti.lines(); len(lines) != 3 {
+		t.Fatalf("pending lines not flushed: %v", lines)
+	}
+
+	// the server is gone, give up once the context is done
+	s = testInfluxSink(t, ti.URL, 100, 50*time.Millisecond)
+	ti.Close()
+	s.WriteStats(&stats, time.Now(), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Close(ctx); err == nil {
+		t.Fatalf("expected error for unwritten lines")
+	}
+}
+
+func TestIntegrationInfluxSink(t *testing.T) {
+	ti := startTestInflux(t)
+	b := startTestBroker(t)
+	mqtt := connectTestGatherer(t, b, func(cfg *RunConfig) {
+		cfg.InfluxURL = ti.URL
+		cfg.InfluxBatchSize = 2
+		cfg.SinkOnly = true
+	})
+	db := mqtt.DB().(*SqliteDB)
+	insertTestDeviceInfo(t, db)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/telemetry", 1, false, "ver:1.2.3").Wait()
+	waitFor(t, "lines", func() bool { return len(ti.lines()) == 2 })
+
+	lines := ti.lines()
+	tags := "description=bla,device=aa:bb:cc:dd:ee:ff,latitude=1,longitude=2"
+	if !strings.HasPrefix(lines[0], "dba_stats,"+tags+" min=52.683,max=57.619,average=55.152,average_var=0.595,mean=55.272,num=86i ") {
+		t.Fatalf("unexpected stats: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "telemetry,"+tags+` ver="1.2.3" `) {
+		t.Fatalf("unexpected telemetry: %s", lines[1])
+	}
+	if n := count(t, db, "dba_stats") + count(t, db, "tele_ver"); n != 0 {
+		t.Fatalf("saved although sink_only: %d", n)
+	}
+}
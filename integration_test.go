@@ -0,0 +1,181 @@
+package mqttGather
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// End to end tests: devices publish to the embedded broker, the gatherer
+// saves the messages to an in-memory database and raises alerts.
+
+func startTestGatherer(t *testing.T) (*Broker, *Mqtt, *SqliteDB) {
+	b := startTestBroker(t)
+	mqtt := connectTestGatherer(t, b, nil)
+	return b, mqtt, mqtt.db.(*SqliteDB)
+}
+
+// Configuration of a gatherer with its own in memory database.
+func testGathererConfig(b *Broker) *RunConfig {
+	return &RunConfig{
+		SqlLiteConnect: "file::memory:?cache=private",
+		Host:           b.LocalURL(),
+		Topic:          "/opennoise/+/dba_stats",
+		TelemetryTopic: "/opennoise/+/telemetry",
+		ClientId:       "gatherer",
+	}
+}
+
+// Connects a gatherer with its own in memory database and alerter to the
+// broker, `configure` may adjust the configuration.
+func connectTestGatherer(t *testing.T, b *Broker, configure func(*RunConfig)) *Mqtt {
+	cfg := testGathererConfig(b)
+	if configure != nil {
+		configure(cfg)
+	}
+	mqtt, err := NewMQTT(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mqtt.Disconnect() })
+	alerter := NewAlerter(cfg, mqtt)
+	alerter.Start()
+	waitSubscribed(t, mqtt)
+	return mqtt
+}
+
+// Subscriptions are made asynchronously after connecting, messages
+// published before are lost.
+func waitSubscribed(t *testing.T, mqtt *Mqtt) {
+	cfg := mqtt.config()
+	waitFor(t, "subscriptions", func() bool {
+		subs := mqtt.Subscriptions()
+		return len(subs) == 2 && subs[cfg.Topic] == nil && subs[cfg.TelemetryTopic] == nil
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func count(t *testing.T, db *SqliteDB, table string) int {
+	var cnt int
+	if err := db.db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&cnt); err != nil {
+		t.Fatal(err)
+	}
+	return cnt
+}
+
+func TestIntegrationStatsAndTelemetry(t *testing.T) {
+	b, _, db := startTestGatherer(t)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 0, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/telemetry", 0, false, "esp:1234").Wait()
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 0, false, "garbage").Wait()
+
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 1 })
+	waitFor(t, "tele_mem", func() bool { return count(t, db, "tele_mem") == 1 })
+	waitFor(t, "raw_message", func() bool { return count(t, db, "raw_message") == 1 })
+
+	stats, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_MINUTE, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil || len(stats) != 1 || stats[0].Count != 1 {
+		t.Fatalf("rollups not updated: %#v (%v)", stats, err)
+	}
+}
+
+func TestQoSConfig(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &RunConfig{
+		SqlLiteConnect:    "file::memory:?cache=private",
+		Host:              b.LocalURL(),
+		Topic:             "/opennoise/+/dba_stats",
+		TopicQoS:          1,
+		PersistentSession: true,
+	}
+	if _, err := NewMQTT(cfg); err == nil {
+		t.Fatalf("expected error for persistent session without client id")
+	}
+	cfg.ClientId = "gatherer"
+	cfg.TelemetryQoS = 3
+	if _, err := NewMQTT(cfg); err == nil {
+		t.Fatalf("expected error for invalid QoS")
+	}
+	cfg.TelemetryQoS = 0
+	cfg.StoreDir = t.TempDir()
+	mqtt, err := NewMQTT(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mqtt.Disconnect()
+	if opts := mqtt.client.OptionsReader(); opts.CleanSession() {
+		t.Fatalf("expected persistent session")
+	}
+}
+
+func TestIntegrationAlert(t *testing.T) {
+	b, mqtt, db := startTestGatherer(t)
+	phones := make(chan string, 1)
+	mqtt.Alerter().SetNotifier(notifyFunc(func(msg, signifier, phone string) error {
+		phones <- phone
+		return nil
+	}))
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	id, err := db.lookupDevice(TEST_SIGNIFIER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.db.Exec(`INSERT INTO device_info (
+		device_id, latitude, longitude, alert_threshold, alert_count, alert_phone
+	) VALUES (:ID, 1.0, 2.0, 80, 3, '01701234567')`, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i != 3; i++ {
+		device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 0, false, "70.0,95.5,80.0,0.5,80.0,86").Wait()
+	}
+	waitFor(t, "alert", func() bool { return count(t, db, "alert") == 1 })
+
+	alert, err := db.LoadLastAlert(TEST_SIGNIFIER)
+	if err != nil || alert.Status != "ok" || <-phones != "01701234567" {
+		t.Fatalf("unexpected alert: %#v (%v)", alert, err)
+	}
+}
+
+func TestConnectErrorClosesDB(t *testing.T) {
+	// a shared in memory database is discarded once its last connection
+	// is closed.
+	connect := "file:connect_error?mode=memory&cache=shared"
+	cfg := &RunConfig{
+		SqlLiteConnect: connect,
+		Host:           "tcp://127.0.0.1:1",
+		Topic:          "/opennoise/+/dba_stats",
+	}
+	if _, err := NewMQTT(cfg); err == nil {
+		t.Fatalf("expected error for unreachable broker")
+	}
+
+	db, err := sql.Open("sqlite3", connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var tables int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatalf("db not closed, %d tables left", tables)
+	}
+}
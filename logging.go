@@ -0,0 +1,105 @@
+package mqttGather
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Leveled, structured logging using log/slog. All components log via
+// `logger(component)` which adds a `component` field to the process
+// wide default logger configured by `SetupLogging`. Messages concerning
+// a device or topic carry `device` and `topic` fields.
+//
+// Levels (`log_level`, `-log-level`): debug, info (default), warn, error.
+// Formats (`log_format`, `-log-format`): text (default), json.
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// The current level, may be changed while running.
+var logLevel = new(slog.LevelVar)
+
+// Destination of the default logger, may be changed while running (e.g.
+// when `log_dir` is reloaded).
+type logOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (o *logOutput) Write(bs []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.w.Write(bs)
+}
+
+var output = &logOutput{w: os.Stderr}
+
+// Redirects the default logger to `w`, returns the previous writer.
+func SetLogOutput(w io.Writer) io.Writer {
+	output.mu.Lock()
+	defer output.mu.Unlock()
+	previous := output.w
+	output.w = w
+	return previous
+}
+
+func ParseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return l, fmt.Errorf("invalid log level: %s", level)
+	}
+	return l, nil
+}
+
+// Creates a logger writing to `w` in the given format (text or json),
+// its level is controlled by `SetLogLevel`.
+func NewLogger(w io.Writer, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "", LOG_FORMAT_TEXT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+}
+
+func SetLogLevel(level string) error {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// Configures the default logger to write to `w` according to the
+// configured level and format. This also applies to messages logged
+// using the standard `log` package. Level and output may be changed
+// later using `SetLogLevel` and `SetLogOutput`.
+func SetupLogging(cfg *RunConfig, w io.Writer) error {
+	if err := SetLogLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	l, err := NewLogger(output, cfg.LogFormat)
+	if err != nil {
+		return err
+	}
+	SetLogOutput(w)
+	slog.SetDefault(l)
+	return nil
+}
+
+func logger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
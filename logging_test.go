@@ -0,0 +1,57 @@
+package mqttGather
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		level  string
+		should slog.Level
+	}{
+		{"", slog.LevelInfo},
+		{"debug", slog.LevelDebug},
+		{"WARN", slog.LevelWarn},
+		{"error", slog.LevelError},
+	}
+	for _, test := range tests {
+		if l, err := ParseLogLevel(test.level); err != nil || l != test.should {
+			t.Fatalf("%s: is %v, should %v (%v)", test.level, l, test.should, err)
+		}
+	}
+	if _, err := ParseLogLevel("chatty"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	defer logLevel.Set(slog.LevelInfo)
+
+	var buf bytes.Buffer
+	if err := SetupLogging(&RunConfig{LogLevel: "warn", LogFormat: "json"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	logger("mqtt").Info("not logged")
+	logger("mqtt").Error("could not parse", "device", TEST_SIGNIFIER)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line: %q", buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "ERROR" || entry["component"] != "mqtt" || entry["device"] != TEST_SIGNIFIER {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+
+	if err := SetupLogging(&RunConfig{LogFormat: "xml"}, &buf); err == nil {
+		t.Fatalf("expected error for invalid format")
+	}
+}
@@ -0,0 +1,215 @@
+package mqttGather
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Prometheus metrics (counters, gauges and histograms with labels), a thin
+// layer over the client library that keeps call sites short and logs
+// (instead of panicking on) label values not matching a metric.
+//
+// The metrics collected by mqttGather are defined at the bottom of this
+// file and served by `DefaultMetrics` at `/metrics` if `http_addr` is
+// configured. Labels must have a bounded number of values: the message
+// counters have no device label, as any client can publish to any device
+// topic, per device metrics are only kept for messages that were parsed
+// (or, for the alerter, devices with device info).
+
+type Metrics struct {
+	registry *prometheus.Registry
+}
+
+// Default buckets for durations in seconds.
+var DurationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+type MetricFamily struct {
+	name string
+	vec  *prometheus.MetricVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{registry: prometheus.NewRegistry()}
+}
+
+func (m *Metrics) Counter(name, help string, labels ...string) *MetricFamily {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	m.registry.MustRegister(vec)
+	return &MetricFamily{name, vec.MetricVec}
+}
+
+func (m *Metrics) Gauge(name, help string, labels ...string) *MetricFamily {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	m.registry.MustRegister(vec)
+	return &MetricFamily{name, vec.MetricVec}
+}
+
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *MetricFamily {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	m.registry.MustRegister(vec)
+	return &MetricFamily{name, vec.MetricVec}
+}
+
+// The series of the label values, nil if their number doesn't match the
+// labels of the family.
+func (f *MetricFamily) get(labelValues []string) prometheus.Metric {
+	metric, err := f.vec.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		logger("metrics").Error("invalid label values", "metric", f.name, "err", err)
+		return nil
+	}
+	return metric
+}
+
+// Adds to a counter or gauge, counters can't decrease.
+func (f *MetricFamily) Add(v float64, labelValues ...string) {
+	switch metric := f.get(labelValues).(type) {
+	case prometheus.Gauge:
+		metric.Add(v)
+	case prometheus.Counter:
+		if v < 0 {
+			logger("metrics").Error("counter can't decrease", "metric", f.name, "value", v)
+			return
+		}
+		metric.Add(v)
+	}
+}
+
+func (f *MetricFamily) Inc(labelValues ...string) {
+	f.Add(1, labelValues...)
+}
+
+func (f *MetricFamily) Set(v float64, labelValues ...string) {
+	if gauge, ok := f.get(labelValues).(prometheus.Gauge); ok {
+		gauge.Set(v)
+	}
+}
+
+func (f *MetricFamily) Observe(v float64, labelValues ...string) {
+	if observer, ok := f.get(labelValues).(prometheus.Observer); ok {
+		observer.Observe(v)
+	}
+}
+
+// Observe the time passed since `start` in seconds.
+func (f *MetricFamily) ObserveSince(start time.Time, labelValues ...string) {
+	f.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Current value of a counter or gauge, sum of a histogram.
+func (f *MetricFamily) Value(labelValues ...string) float64 {
+	metric := f.get(labelValues)
+	if metric == nil {
+		return 0
+	}
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return 0
+	}
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Histogram != nil:
+		return m.Histogram.GetSampleSum()
+	}
+	return 0
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// Also exposes the Go runtime and process metrics.
+var DefaultMetrics = func() *Metrics {
+	m := NewMetrics()
+	m.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}()
+
+var (
+	metricMessagesReceived = DefaultMetrics.Counter(
+		"mqttgather_messages_received_total",
+		"MQTT messages received per subscribed topic.",
+		"topic")
+	metricMessagesParsed = DefaultMetrics.Counter(
+		"mqttgather_messages_parsed_total",
+		"MQTT messages successfully parsed per subscribed topic.",
+		"topic")
+	metricMessagesFailed = DefaultMetrics.Counter(
+		"mqttgather_messages_failed_total",
+		"MQTT messages that could not be handled per subscribed topic and reason (parse, save).",
+		"topic", "reason")
+	metricMessagesDuplicate = DefaultMetrics.Counter(
+		"mqttgather_messages_duplicate_total",
+		"Redelivered QoS 1 messages dropped because they were already handled.")
+	metricMessagesExpired = DefaultMetrics.Counter(
+		"mqttgather_messages_expired_total",
+		"MQTT 5 messages dropped because their message expiry passed before they were handled.")
+	metricMessagesUnexpected = DefaultMetrics.Counter(
+		"mqttgather_messages_unexpected_total",
+		"MQTT messages received on topics not subscribed to.")
+	metricLastSeen = DefaultMetrics.Gauge(
+		"mqttgather_device_last_seen_timestamp_seconds",
+		"Unix time of the last parsed message received from a device.",
+		"device")
+	metricDBInsertDuration = DefaultMetrics.Histogram(
+		"mqttgather_db_insert_duration_seconds",
+		"Duration of database inserts per table.",
+		DurationBuckets,
+		"table")
+	metricMQTTConnectionLost = DefaultMetrics.Counter(
+		"mqttgather_mqtt_connection_lost_total",
+		"Number of times the connection to the MQTT broker was lost.")
+	metricMQTTReconnects = DefaultMetrics.Counter(
+		"mqttgather_mqtt_reconnects_total",
+		"Number of attempts to reconnect to the MQTT broker.")
+	metricDBReconnects = DefaultMetrics.Counter(
+		"mqttgather_db_reconnects_total",
+		"Number of times the database connection was reestablished after an error.")
+	metricBrokerClients = DefaultMetrics.Gauge(
+		"mqttgather_broker_clients",
+		"Clients connected to the embedded broker.")
+	metricAlertEvaluations = DefaultMetrics.Counter(
+		"mqttgather_alert_evaluations_total",
+		"Number of stats evaluated by the alerter per device with device info.",
+		"device")
+	metricAlertDropped = DefaultMetrics.Counter(
+		"mqttgather_alert_dropped_total",
+		"Stats not evaluated by the alerter because its queue was full.")
+	metricNotificationsSent = DefaultMetrics.Counter(
+		"mqttgather_notifications_sent_total",
+		"Alert notifications sent per channel.",
+		"channel")
+	metricNotificationsFailed = DefaultMetrics.Counter(
+		"mqttgather_notifications_failed_total",
+		"Alert notifications that could not be sent per channel.",
+		"channel")
+	metricSinkWritten = DefaultMetrics.Counter(
+		"mqttgather_sink_written_total",
+		"Measurements written per output sink.",
+		"sink")
+	metricSinkFailed = DefaultMetrics.Counter(
+		"mqttgather_sink_failed_total",
+		"Failed write attempts per output sink.",
+		"sink")
+	metricSinkDropped = DefaultMetrics.Counter(
+		"mqttgather_sink_dropped_total",
+		"Measurements dropped per output sink, e.g. because its buffer was full.",
+		"sink")
+	metricStreamClients = DefaultMetrics.Gauge(
+		"mqttgather_stream_clients",
+		"Clients connected to the live event streams.")
+	metricReportsGenerated = DefaultMetrics.Counter(
+		"mqttgather_reports_generated_total",
+		"Scheduled reports written.")
+	metricReportsFailed = DefaultMetrics.Counter(
+		"mqttgather_reports_failed_total",
+		"Scheduled report runs that failed, e.g. because mailing failed.")
+)
@@ -0,0 +1,111 @@
+package mqttGather
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	c := m.Counter("test_total", "A counter.", "topic", "device")
+	g := m.Gauge("test_gauge", "A gauge.")
+	h := m.Histogram("test_seconds", "A histogram.", []float64{0.1, 1}, "table")
+
+	c.Inc("/opennoise/+/dba_stats", "aa")
+	c.Add(2, "/opennoise/+/dba_stats", "aa")
+	c.Inc("/opennoise/+/dba_stats", `b"b`)
+	g.Set(42)
+	g.Add(-2)
+	h.Observe(0.05, "dba_stats")
+	h.Observe(0.5, "dba_stats")
+	h.Observe(5, "dba_stats")
+
+	if v := c.Value("/opennoise/+/dba_stats", "aa"); v != 3 {
+		t.Fatalf("incorrect counter: %f", v)
+	}
+	if v := h.Value("dba_stats"); v != 5.55 {
+		t.Fatalf("incorrect histogram sum: %f", v)
+	}
+
+	// incorrect labels and decreasing counters are ignored
+	c.Inc("aa")
+	c.Add(-1, "/opennoise/+/dba_stats", "aa")
+	g.Set(1, "unexpected")
+
+	body := scrape(t, m)
+	for _, should := range []string{
+		"# HELP test_total A counter.\n# TYPE test_total counter\n",
+		`test_total{device="aa",topic="/opennoise/+/dba_stats"} 3`,
+		`test_total{device="b\"b",topic="/opennoise/+/dba_stats"} 1`,
+		"# TYPE test_gauge gauge\ntest_gauge 40\n",
+		`test_seconds_bucket{table="dba_stats",le="0.1"} 1`,
+		`test_seconds_bucket{table="dba_stats",le="1"} 2`,
+		`test_seconds_bucket{table="dba_stats",le="+Inf"} 3`,
+		`test_seconds_sum{table="dba_stats"} 5.55`,
+		`test_seconds_count{table="dba_stats"} 3`,
+	} {
+		if !strings.Contains(body, should) {
+			t.Fatalf("missing %q in:\n%s", should, body)
+		}
+	}
+}
+
+func TestInsertTable(t *testing.T) {
+	for sql, should := range map[string]string{
+		"INSERT INTO dba_stats (\n\tdevice_id) VALUES (1)": "dba_stats",
+		"INSERT INTO device ( device_signifier )":          "device",
+		"insert into alert(device_id)":                     "alert",
+		"SELECT 1":                                         "unknown",
+	} {
+		if is := insertTable(sql); is != should {
+			t.Fatalf("%s is: %s should: %s", sql, is, should)
+		}
+	}
+}
+
+func TestDBInsertMetrics(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	stats := RandomDBAStats()
+	if _, err := db.SaveNow(&stats); err != nil {
+		t.Fatal(err)
+	}
+	body := scrape(t, DefaultMetrics)
+	if !strings.Contains(body, `mqttgather_db_insert_duration_seconds_count{table="dba_stats"}`) {
+		t.Fatalf("insert not measured:\n%s", body)
+	}
+	if !strings.Contains(body, "go_goroutines") {
+		t.Fatalf("runtime metrics missing:\n%s", body)
+	}
+}
+
+func TestMessageMetricsLabels(t *testing.T) {
+	_, mqtt, _ := startTestGatherer(t)
+	received := metricMessagesReceived.Value(mqtt.Topic)
+
+	// garbage on arbitrary device topics doesn't create series
+	mqtt.msgHandler(nil, &testMessage{"/opennoise/ff:ff:ff:ff:ff:01/dba_stats", []byte("garbage")})
+	mqtt.msgHandler(nil, &testMessage{"/opennoise/x/dba_stats", []byte("52.683,57.619,55.152,0.595,55.272,86")})
+	mqtt.msgHandler(nil, &testMessage{"/opennoise/" + TEST_SIGNIFIER + "/dba_stats", []byte("52.683,57.619,55.152,0.595,55.272,86")})
+	if is := metricMessagesReceived.Value(mqtt.Topic); is != received+3 {
+		t.Fatalf("unexpected received count: %f", is-received)
+	}
+	body := scrape(t, DefaultMetrics)
+	if strings.Contains(body, "ff:ff:ff:ff:ff:01") || strings.Contains(body, "/opennoise/x/") {
+		t.Fatalf("series for invalid messages:\n%s", body)
+	}
+	if !strings.Contains(body, `mqttgather_device_last_seen_timestamp_seconds{device="`+TEST_SIGNIFIER+`"}`) {
+		t.Fatalf("last seen missing:\n%s", body)
+	}
+}
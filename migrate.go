@@ -0,0 +1,246 @@
+package mqttGather
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema migrations. The database schema is created and updated by the
+// ordered SQL scripts in `sql/migrations` which are embedded into the
+// binary. Scripts are named `<version>_<name>.sql`, applied migrations
+// are recorded in `schema_version`.
+//
+// A script may contain a line:
+//
+//	-- condition: SELECT count(*) FROM ...
+//
+// in which case the script is only executed if the query returns a
+// non-zero count. The migration is recorded as applied regardless.
+//
+// New databases are migrated automatically. Existing databases are only
+// migrated when requested (`auto_migrate`, `-auto-migrate` or the
+// `migrate` command), otherwise opening them fails if migrations are
+// pending.
+
+//go:embed sql/migrations/*.sql
+var migrationFS embed.FS
+
+const CONDITION_PREFIX = "-- condition:"
+
+type Migration struct {
+	Version   int
+	Name      string
+	Condition string
+	SQL       string
+}
+
+func (m *Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Result of applying a migration. `Skipped` migrations were recorded but
+// not executed because their condition wasn't met.
+type MigrationResult struct {
+	Migration
+	Skipped bool
+}
+
+func parseMigration(fn, content string) (Migration, error) {
+	base := strings.TrimSuffix(path.Base(fn), ".sql")
+	parts := strings.SplitN(base, "_", 2)
+	if len(parts) != 2 {
+		return Migration{}, fmt.Errorf("invalid migration name: %s", fn)
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Migration{}, fmt.Errorf("invalid migration version: %s", fn)
+	}
+	m := Migration{
+		Version: version,
+		Name:    parts[1],
+		SQL:     content,
+	}
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, CONDITION_PREFIX) {
+			m.Condition = strings.TrimSpace(line[len(CONDITION_PREFIX):])
+		}
+	}
+	return m, nil
+}
+
+// All migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	files, err := migrationFS.ReadDir("sql/migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, f := range files {
+		fn := "sql/migrations/" + f.Name()
+		content, err := migrationFS.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		m, err := parseMigration(fn, string(content))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version: %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// querier is implemented by *sql.DB and *sql.Tx
+type querier interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+func createSchemaVersion(q querier) error {
+	_, err := q.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name    VARCHAR,
+		applied INTEGER DEFAULT (STRFTIME('%s','now'))
+	)`)
+	return err
+}
+
+// Current schema version, 0 if no migrations were applied yet.
+func schemaVersion(q querier) (int, error) {
+	var exists int
+	err := q.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).Scan(&exists)
+	if err != nil || exists == 0 {
+		return 0, err
+	}
+	var version int
+	err = q.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// A database is considered new if it has neither been migrated nor
+// contains noise data.
+func isNewDB(q querier) (bool, error) {
+	var count int
+	err := q.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name IN ('schema_version', 'dba_stats')`).Scan(&count)
+	return count == 0, err
+}
+
+func pendingMigrations(q querier) (int, []Migration, error) {
+	version, err := schemaVersion(q)
+	if err != nil {
+		return 0, nil, err
+	}
+	all, err := Migrations()
+	if err != nil {
+		return 0, nil, err
+	}
+	var pending []Migration
+	for _, m := range all {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return version, pending, nil
+}
+
+// Applies all pending migrations in a single transaction. With `dryRun`
+// the transaction is rolled back after all migrations were executed.
+func migrate(db *sql.DB, dryRun bool) ([]MigrationResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op after commit
+
+	_, pending, err := pendingMigrations(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSchemaVersion(tx); err != nil {
+		return nil, err
+	}
+
+	var results []MigrationResult
+	for _, m := range pending {
+		result := MigrationResult{Migration: m}
+		if m.Condition != "" {
+			var count int
+			if err := tx.QueryRow(m.Condition).Scan(&count); err != nil {
+				return nil, fmt.Errorf("%v: condition failed: %v", &m, err)
+			}
+			result.Skipped = count == 0
+		}
+		if !result.Skipped {
+			if _, err := tx.Exec(m.SQL); err != nil {
+				return nil, fmt.Errorf("%v: %v", &m, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version, name) VALUES (:VERSION, :NAME)`, m.Version, m.Name); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if dryRun {
+		return results, nil
+	}
+	return results, tx.Commit()
+}
+
+// Ensures the schema is up to date when opening the database, see above.
+func checkSchema(db *sql.DB, autoMigrate bool) error {
+	isNew, err := isNewDB(db)
+	if err != nil {
+		return err
+	}
+	version, pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if !isNew && !autoMigrate {
+		return fmt.Errorf("database schema is at version %d, %d migration(s) pending: run `migrate` or enable auto migration", version, len(pending))
+	}
+	results, err := migrate(db, false)
+	for _, r := range results {
+		logger("db").Info("applied migration", "migration", r.Migration.String(), "skipped", r.Skipped)
+	}
+	return err
+}
+
+// Returns the current schema version of the database and the pending
+// migrations.
+func MigrationStatus(connectString string) (int, []Migration, error) {
+	db, err := sql.Open(SQLITE_DRIVER, connectString)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer db.Close()
+	return pendingMigrations(db)
+}
+
+// Applies all pending migrations to the database, see `migrate`.
+func Migrate(connectString string, dryRun bool) ([]MigrationResult, error) {
+	db, err := sql.Open(SQLITE_DRIVER, connectString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrate(db, dryRun)
+}
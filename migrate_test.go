@@ -0,0 +1,142 @@
+package mqttGather
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migrations not consecutive: %v", &m)
+		}
+	}
+	if migrations[1].Name != "device_signifier" || migrations[1].Condition == "" {
+		t.Fatalf("incorrect device migration: %#v", migrations[1])
+	}
+}
+
+func TestNewDatabaseIsMigrated(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	_, pending, err := pendingMigrations(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("pending migrations in new db: %v", pending)
+	}
+}
+
+// database as created before the introduction of `device`
+const legacySchema = `
+	CREATE TABLE dba_stats (
+		dba_stats_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		client       VARCHAR,
+		min          FLOAT,
+		max          FLOAT,
+		average      FLOAT,
+		averageVar   FLOAT,
+		mean         FLOAT,
+		num          INTEGER,
+		ts           INTEGER DEFAULT (STRFTIME('%s','now'))
+	);
+	CREATE TABLE tele_mem (tele_mem_id INTEGER PRIMARY KEY AUTOINCREMENT, client VARCHAR, type VARCHAR, free_mem INTEGER, ts INTEGER);
+	CREATE TABLE tele_ver (tele_ver_id INTEGER PRIMARY KEY AUTOINCREMENT, client VARCHAR, type VARCHAR, info VARCHAR, ts INTEGER);
+	CREATE TABLE tele_misc (tele_misc_id INTEGER PRIMARY KEY AUTOINCREMENT, client VARCHAR, type VARCHAR, data VARCHAR, ts INTEGER);
+	INSERT INTO dba_stats (client, min, max, average, num, ts) VALUES
+		('aa:bb:cc:dd:ee:ff', 40, 60, 50, 1, 10),
+		('aa:bb:cc:dd:ee:ff', 40, 70, 60, 1, 20);
+	INSERT INTO tele_mem (client, type, free_mem, ts) VALUES ('aa:bb:cc:dd:ee:ff', 'esp', 1234, 10);
+`
+
+func TestMigrateLegacy(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "legacy.sqlite3")
+	raw, err := sql.Open(SQLITE_DRIVER, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec(legacySchema); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	if _, err := NewDatabase(fn); err == nil {
+		t.Fatalf("expected error opening db with pending migrations")
+	}
+
+	migrations, _ := Migrations()
+	results, err := Migrate(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) || results[1].Skipped {
+		t.Fatalf("unexpected dry run: %#v", results)
+	}
+	if version, _, err := MigrationStatus(fn); err != nil || version != 0 {
+		t.Fatalf("dry run applied migrations: %d (%v)", version, err)
+	}
+
+	db_, err := OpenDatabase(fn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := db_.(*SqliteDB)
+	defer db.Close()
+
+	if version, pending, err := MigrationStatus(fn); err != nil || version != len(migrations) || len(pending) != 0 {
+		t.Fatalf("not migrated: %d %v (%v)", version, pending, err)
+	}
+
+	var free_mem int64
+	err = db.db.QueryRow(`
+		SELECT free_mem FROM tele_mem t JOIN device d ON t.device_id = d.device_id
+		WHERE d.device_signifier = :SIGNIFIER`, TEST_SIGNIFIER).Scan(&free_mem)
+	if err != nil || free_mem != 1234 {
+		t.Fatalf("telemetry not migrated: %d (%v)", free_mem, err)
+	}
+
+	// rollups were calculated from existing data.
+	stats, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_MINUTE, time.Unix(0, 0), time.Unix(60, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Count != 2 || stats[0].Max != 70 {
+		t.Fatalf("rollups not migrated: %#v", stats)
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	// database created by versions before migrations were introduced.
+	fn := filepath.Join(t.TempDir(), "unversioned.sqlite3")
+	raw, err := sql.Open(SQLITE_DRIVER, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, _ := Migrations()
+	if _, err := raw.Exec(migrations[0].SQL); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	results, err := Migrate(fn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) || !results[1].Skipped || results[2].Skipped {
+		t.Fatalf("unexpected migration: %#v", results)
+	}
+
+	db, err := NewDatabase(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
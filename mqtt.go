@@ -1,12 +1,16 @@
 package mqttGather
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -19,147 +23,501 @@ type Mqtt struct {
 	cfg          *RunConfig
 	db           DB
 	client       MQTT.Client
+	client5      *autopaho.ConnectionManager // MQTT 5, see mqtt5.go
 	statsChannel chan DBAStats
+	recorder     *Recorder // nil unless recording is enabled
+	dedup        *dedup
+	collisions   collisionDetector // guarded by mu
+	sinks        sinks             // see sink.go
+	hub          *Hub              // nil unless the dashboard or stream is enabled
+
+	mu            sync.Mutex
+	subscriptions map[string]error // subscription result per topic
+	lastMessage   time.Time
+	connected5    bool
+	alerter       *Alerter // consumes statsChannel if set, see NewAlerter
+	shutdown      bool     // set once Shutdown was called
+	closing       bool     // set once disconnected during shutdown, see shutdown.go
+	inflight      sync.WaitGroup
+	handling      sync.RWMutex // held by handlers, locked to pause them (reload.go)
+}
+
+// Whether the connection to the broker is currently established.
+func (m *Mqtt) IsConnected() bool {
+	if m.client5 != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.connected5
+	}
+	return m.client != nil && m.client.IsConnectionOpen()
+}
+
+// Result of the latest subscription attempt per topic, nil on success.
+func (m *Mqtt) Subscriptions() map[string]error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subs := make(map[string]error, len(m.subscriptions))
+	for topic, err := range m.subscriptions {
+		subs[topic] = err
+	}
+	return subs
+}
+
+// Time the last message was received, zero if none was received yet.
+func (m *Mqtt) LastMessage() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastMessage
+}
+
+func (m *Mqtt) received(msg MQTT.Message) {
+	now := time.Now()
+	m.mu.Lock()
+	m.lastMessage = now
+	m.mu.Unlock()
+	if m.recorder != nil {
+		if err := m.recorder.Record(now, msg.Topic(), msg.Payload()); err != nil {
+			logger("mqtt").Error("could not record message", "topic", msg.Topic(), "err", err)
+		}
+	}
+}
+
+// The current configuration, see reload.go
+func (m *Mqtt) config() *RunConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg
 }
 
+// (Re)subscribes to the stats and telemetry topics.
+func (m *Mqtt) subscribeAll() {
+	cfg := m.config()
+	if m.client5 != nil {
+		m.subscribe5(m.client5, cfg.Topic, cfg.TopicQoS)
+		m.subscribe5(m.client5, cfg.TelemetryTopic, cfg.TelemetryQoS)
+		return
+	}
+	m.subscribe(cfg.Topic, cfg.TopicQoS, m.msgHandler)
+	m.subscribe(cfg.TelemetryTopic, cfg.TelemetryQoS, m.msgHandlerTelemetry)
+}
+
+func (m *Mqtt) subscribe(topic string, qos byte, handler MQTT.MessageHandler) {
+	log := logger("mqtt")
+	token := m.client.Subscribe(m.subscription(topic), qos, m.track(handler))
+	// failed subscriptions are reported by the readiness check (see health.go)
+	if token.Wait() && token.Error() != nil {
+		log.Error("subscription failed", "topic", topic, "err", token.Error())
+	} else {
+		log.Debug("subscribed", "topic", topic)
+	}
+	m.subscribed(topic, token.Error())
+}
+
+func (m *Mqtt) subscribed(topic string, err error) {
+	m.mu.Lock()
+	m.subscriptions[topic] = err
+	m.mu.Unlock()
+}
+
+// The database messages are persisted to.
+func (m *Mqtt) DB() DB {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.db
+}
+
+// The current alerter, nil if alerting is disabled.
+func (m *Mqtt) Alerter() *Alerter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.alerter
+}
+
+// Live events for the dashboard and stream, nil unless enabled.
+func (m *Mqtt) Hub() *Hub {
+	return m.hub
+}
+
+// Shuts down using the configured shutdown timeout, see shutdown.go
 func (m *Mqtt) Disconnect() error {
-	m.db.Close()
-	m.client.Disconnect(1000)
-	close(m.statsChannel)
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout(m.config()))
+	defer cancel()
+	return m.Shutdown(ctx)
+}
+
+// Publishes a message using the gatherer's connection, see republish.go
+func (m *Mqtt) publish(topic string, qos byte, retained bool, payload []byte) error {
+	m.mu.Lock()
+	client, client5 := m.client, m.client5
+	m.mu.Unlock()
+	switch {
+	case client5 != nil:
+		ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+		defer cancel()
+		_, err := client5.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload})
+		return err
+	case client != nil:
+		token := client.Publish(topic, qos, retained, payload)
+		if !token.WaitTimeout(CONNECT_TIMEOUT) {
+			return fmt.Errorf("publish timed out")
+		}
+		return token.Error()
+	}
+	return fmt.Errorf("not connected")
 }
+
+// Stats queued for the alerter, handlers don't wait for it to evaluate
+// them (e.g. while it sends an SMS).
+const STATS_QUEUE_SIZE = 100
+
+// Passes stats to the alerter, if there is one. The stats are dropped if
+// the alerter's queue is full: the threshold violations are counted from
+// the database, the next stats evaluated still raise the alert.
+func (m *Mqtt) notify(stats DBAStats) {
+	m.mu.Lock()
+	alerter := m.alerter
+	m.mu.Unlock()
+	if alerter == nil {
+		return
+	}
+	select {
+	case m.statsChannel <- stats:
+	default:
+		logger("alerter").Warn("alerter busy, stats not evaluated", "device", stats.Signifier)
+		metricAlertDropped.Inc()
+	}
+}
+
 func retrieveClientId(topic string) string {
 	// /opennoise/c4:dd:57:66:95:60/dba_stats
 	// producer := msg.Topic()[11 : 11+17]
 	if len(topic) < 28 {
-		log.Printf("E: invalid topic: %s", topic)
+		logger("mqtt").Error("invalid topic", "topic", topic)
 		return fmt.Sprintf("?:%s", topic)
 	}
 	return topic[11 : 11+17]
 }
+
+// Records the last message of a device, unless its topic was invalid.
+func deviceSeen(producer string, t time.Time) {
+	if !strings.HasPrefix(producer, "?:") {
+		metricLastSeen.Set(float64(t.Unix()), producer)
+	}
+}
+
 func (m *Mqtt) msgHandler(c MQTT.Client, msg MQTT.Message) {
 
 	// /opennoise/c4:dd:57:66:95:60/dba_stats
 	producer := retrieveClientId(msg.Topic())
+	log := logger("mqtt").With("topic", msg.Topic(), "device", producer)
+	m.received(msg)
+	if m.dedup.duplicate(msg) {
+		log.Debug("dropped duplicate")
+		metricMessagesDuplicate.Inc()
+		return
+	}
+	t := receivedAt(msg)
+	metricMessagesReceived.Inc(m.Topic)
 
 	csv := string(msg.Payload())
 	stats, err := DBAStatsFromString(csv, producer)
 	if err != nil {
-		log.Printf("E: could not parse %s : %v", csv, err)
-	} else {
-		log.Printf("D: recv %s : %s", msg.Topic(), csv)
-		if _, err := m.db.SaveNow(stats); err != nil {
-			log.Printf("E: could not save %s (raw:%s) : %v", stats, csv, err)
-			if err := m.connectDB(); err != nil {
-				log.Printf("E: could not reconnect to db (%v)", err)
-			}
-		}
-		m.statsChannel <- *stats
+		log.Error("could not parse", "payload", csv, "err", err)
+		metricMessagesFailed.Inc(m.Topic, "parse")
+		m.deadLetter(msg, err)
+		return
+	}
+	log.Debug("recv", "payload", csv)
+	metricMessagesParsed.Inc(m.Topic)
+	deviceSeen(producer, t)
+	if err := m.handleStats(stats, t); err != nil {
+		log.Error("could not save", "payload", csv, "err", err)
+		metricMessagesFailed.Inc(m.Topic, "save")
+		m.saveFailed(msg, err)
 	}
+}
 
+// Saves stats received at `t` and passes them on to the sinks and the
+// alerter. Stats that couldn't be saved aren't passed on, they are
+// dead-lettered and passed on once re-processed (see raw_message.go).
+func (m *Mqtt) handleStats(stats *DBAStats, t time.Time) error {
+	if !m.sinkOnly() {
+		// not saved in sink only mode, see sink.go
+		if _, err := m.db.Save(stats, t); err != nil {
+			return err
+		}
+	}
+	m.forwardStats(stats, t)
+	m.notify(*stats)
+	return nil
 }
 
 func (m *Mqtt) msgHandlerTelemetry(c MQTT.Client, msg MQTT.Message) {
 
 	// /opennoise/c4:dd:57:66:95:60/telemetry
 	producer := retrieveClientId(msg.Topic())
+	log := logger("mqtt").With("topic", msg.Topic(), "device", producer)
+	m.received(msg)
+	if m.dedup.duplicate(msg) {
+		log.Debug("dropped duplicate")
+		metricMessagesDuplicate.Inc()
+		return
+	}
+	t := receivedAt(msg)
+	metricMessagesReceived.Inc(m.TelemetryTopic)
 
 	payload := string(msg.Payload())
 	telemetry, err := TelemetryFromPayload(payload, producer)
 	if err != nil {
-		log.Printf("E: could not parse %s : %v", payload, err)
-	} else {
-		log.Printf("D: recv %s : %s", msg.Topic(), payload)
-		if _, err := m.db.SaveTelemetryNow(telemetry); err != nil {
-			log.Printf("E: could not save %s (raw:%s) : %v", telemetry, payload, err)
-			if err := m.connectDB(); err != nil {
-				log.Printf("E: could not reconnect to db (%v)", err)
-			}
+		log.Error("could not parse", "payload", payload, "err", err)
+		metricMessagesFailed.Inc(m.TelemetryTopic, "parse")
+		m.deadLetter(msg, err)
+		return
+	}
+	log.Debug("recv", "payload", payload)
+	metricMessagesParsed.Inc(m.TelemetryTopic)
+	deviceSeen(producer, t)
+	if err := m.handleTelemetry(telemetry, t); err != nil {
+		log.Error("could not save", "payload", payload, "err", err)
+		metricMessagesFailed.Inc(m.TelemetryTopic, "save")
+		m.saveFailed(msg, err)
+	}
+}
+
+// Same as `handleStats` for telemetry.
+func (m *Mqtt) handleTelemetry(telemetry *Telemetry, t time.Time) error {
+	if !m.sinkOnly() {
+		if _, err := m.db.SaveTelemetry(telemetry, t); err != nil {
+			return err
 		}
 	}
+	m.forwardTelemetry(telemetry, t)
+	return nil
+}
+
+// Handles messages on topics that weren't subscribed to.
+func (m *Mqtt) msgHandlerUnexpected(c MQTT.Client, msg MQTT.Message) {
+	logger("mqtt").Info("unexpected message", "topic", msg.Topic(), "payload", string(msg.Payload()))
+	m.received(msg)
+	metricMessagesUnexpected.Inc()
+	m.deadLetter(msg, fmt.Errorf("unexpected topic"))
+}
+
+// Message carrying its original time of reception, e.g. replayed from a
+// recording.
+type timedMessage interface {
+	ReceivedAt() time.Time
+}
+
+// Time `msg` was received: now, unless it carries its original time.
+func receivedAt(msg MQTT.Message) time.Time {
+	if tm, ok := msg.(timedMessage); ok {
+		return tm.ReceivedAt()
+	}
+	return time.Now()
+}
+
+// Passes the message to the handler of the subscription it matches, for
+// clients without a router of their own (replay, MQTT 5).
+func (m *Mqtt) dispatch(msg MQTT.Message) {
+	switch {
+	case m.Topic != "" && topicMatches(m.Topic, msg.Topic()):
+		m.msgHandler(nil, msg)
+	case m.TelemetryTopic != "" && topicMatches(m.TelemetryTopic, msg.Topic()):
+		m.msgHandlerTelemetry(nil, msg)
+	default:
+		m.msgHandlerUnexpected(nil, msg)
+	}
+}
+
+// Stores a message that could not be handled, see raw_message.go
+func (m *Mqtt) deadLetter(msg MQTT.Message, reason error) error {
+	_, err := m.db.SaveRawMessage(NewRawMessage(msg, reason))
+	if err != nil {
+		logger("mqtt").Error("could not save raw message", "topic", msg.Topic(), "err", err)
+	}
+	return err
+}
 
+// Dead-letters a message that couldn't be saved and reconnects to the
+// database. Saving stores all or nothing (see `DB`), so re-processing the
+// message doesn't duplicate rows. If the message can't be dead-lettered
+// using the failed connection either, it is retried once reconnected.
+func (m *Mqtt) saveFailed(msg MQTT.Message, reason error) {
+	err := m.deadLetter(msg, reason)
+	if rerr := m.connectDB(); rerr != nil {
+		logger("mqtt").Error("could not reconnect to db", "err", rerr)
+		return
+	}
+	if err != nil {
+		m.deadLetter(msg, reason)
+	}
 }
 
 func (m *Mqtt) connectDB() error {
 	if m.db != nil {
-		log.Printf("D: closing existing connection")
+		logger("db").Debug("closing existing connection")
 		m.db.Close()
+		metricDBReconnects.Inc()
 	}
 
-	if db, err := NewDatabase(m.cfg.SqlLiteConnect); err != nil {
+	cfg := m.config()
+	if db, err := OpenDatabase(cfg.SqlLiteConnect, cfg.AutoMigrate); err != nil {
 		return err
 	} else {
-		m.db = db
+		m.setDB(db)
 	}
 	return nil
 }
 
-func NewMQTT(cfg *RunConfig) (*Mqtt, error) {
-	mqtt := Mqtt{
+// Replaces the database, also for the alerter.
+func (m *Mqtt) setDB(db DB) {
+	m.mu.Lock()
+	m.db = db
+	alerter := m.alerter
+	m.mu.Unlock()
+	if alerter != nil {
+		alerter.setDB(db.(*SqliteDB))
+	}
+}
+
+// Sets up everything but the connection to the broker.
+func newMqtt(cfg *RunConfig) (*Mqtt, error) {
+	mqtt := &Mqtt{
 		Broker:         cfg.Host,
 		Topic:          cfg.Topic,
 		TelemetryTopic: cfg.TelemetryTopic,
 		ClientId:       cfg.ClientId,
 
-		cfg: cfg,
+		cfg:           cfg,
+		subscriptions: make(map[string]error),
+		dedup:         newDedup(),
 	}
 
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	clientId, err := ResolveClientId(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mqtt.ClientId = clientId
+
 	if err := mqtt.connectDB(); err != nil {
-		log.Printf("E: could not connect to DB: %v", err)
+		logger("mqtt").Error("could not connect to DB", "err", err)
 		return nil, err
 	}
 
-	mqtt.statsChannel = make(chan DBAStats)
+	mqtt.statsChannel = make(chan DBAStats, STATS_QUEUE_SIZE)
+
+	if cfg.RecordFile != "" {
+		recorder, err := NewRecorder(cfg.RecordFile)
+		if err != nil {
+			mqtt.db.Close()
+			return nil, err
+		}
+		mqtt.recorder = recorder
+	}
+	if cfg.InfluxURL != "" {
+		mqtt.AddSink(NewInfluxSink(cfg))
+	}
+	if cfg.RepublishPrefix != "" {
+		mqtt.AddSink(NewRepublisher(cfg, mqtt.publish))
+	}
+	if cfg.HomeAssistant {
+		mqtt.AddSink(NewHomeAssistant(cfg, mqtt.publish, func() ([]Device, error) {
+			return mqtt.DB().LoadDevices()
+		}))
+	}
+	if cfg.Dashboard || cfg.Stream {
+		mqtt.hub = NewHub()
+		mqtt.AddSink(mqtt.hub)
+	}
+	return mqtt, nil
+}
+
+func NewMQTT(cfg *RunConfig) (*Mqtt, error) {
+	mqtt, err := newMqtt(cfg)
+	if err != nil {
+		return nil, err
+	}
+	log := logger("mqtt")
+	log.Info("connecting", "broker", mqtt.Broker, "client_id", mqtt.ClientId, "protocol_version", cfg.ProtocolVersion)
+
+	if cfg.ProtocolVersion == PROTOCOL_V5 {
+		if err := mqtt.connect5(); err != nil {
+			mqtt.closeUnconnected()
+			return nil, err
+		}
+		return mqtt, nil
+	}
 
 	opts := MQTT.NewClientOptions()
 	opts.AddBroker(mqtt.Broker)
 	opts.SetClientID(mqtt.ClientId)
+	if cfg.MQTTUser != "" {
+		opts.SetUsername(cfg.MQTTUser)
+		opts.SetPassword(cfg.MQTTPassword)
+	}
+	opts.SetCleanSession(!cfg.PersistentSession)
+	if cfg.StoreDir != "" {
+		opts.SetStore(MQTT.NewFileStore(cfg.StoreDir))
+	}
 
 	opts.SetConnectRetryInterval(10 * time.Second)
 	opts.SetConnectionAttemptHandler(func(u *url.URL, cfg *tls.Config) *tls.Config {
-		log.Printf("D: connection attempt: %v", u)
+		log.Debug("connection attempt", "broker", u.String())
 		return cfg // why!?
 	})
 	opts.SetConnectionLostHandler(func(c MQTT.Client, err error) {
-		log.Printf("E: connection lost: %v", err)
-	})
-	opts.SetDefaultPublishHandler(func(client MQTT.Client, msg MQTT.Message) {
-		log.Printf("I: unexpected message on topic: %s : %s", msg.Topic(), string(msg.Payload()))
-		// TODO log to db
+		log.Error("connection lost", "err", err)
+		metricMQTTConnectionLost.Inc()
+		mqtt.mu.Lock()
+		collision := mqtt.collisions.connectionLost(time.Now())
+		mqtt.mu.Unlock()
+		if collision {
+			log.Warn("connection repeatedly lost right after connecting, client id may be used by another client", "client_id", mqtt.ClientId)
+		}
 	})
+	opts.SetDefaultPublishHandler(mqtt.track(mqtt.msgHandlerUnexpected))
 	opts.SetOnConnectHandler(func(c MQTT.Client) {
 		opts := c.OptionsReader()
-		log.Printf("D: connect: %v", opts.ClientID())
-		token := mqtt.client.Subscribe(mqtt.Topic, byte(0), mqtt.msgHandler)
-
-		// Stats Topic
-		if token.Wait() && token.Error() != nil {
-			log.Printf("E: subscribtion failed: %s (%v)", mqtt.Topic, token.Error())
-			// TODO figure out what to do here: sit under a tree crying and waiting to die?
-		} else {
-			log.Printf("D: subscribed to: %s", mqtt.Topic)
-		}
-
-		// Telemetry Topic
-		token = mqtt.client.Subscribe(mqtt.TelemetryTopic, byte(0), mqtt.msgHandlerTelemetry)
-		if token.Wait() && token.Error() != nil {
-			log.Printf("E: subscription failed: %s (%v)", mqtt.TelemetryTopic, token.Error())
-		} else {
-			log.Printf("D: subscribed to: %s", mqtt.TelemetryTopic)
-		}
+		log.Debug("connect", "client_id", opts.ClientID())
+		mqtt.mu.Lock()
+		mqtt.collisions.connect(time.Now())
+		mqtt.mu.Unlock()
+		mqtt.subscribeAll()
+		mqtt.notifyConnected()
 	})
 	opts.SetReconnectingHandler(func(c MQTT.Client, o *MQTT.ClientOptions) {
 		opts := c.OptionsReader()
 		time.Sleep(2 * time.Second) // don't just hammer away at poor server.
-		log.Printf("I: reconnecting: %v", opts.ClientID())
+		log.Info("reconnecting", "client_id", opts.ClientID())
+		metricMQTTReconnects.Inc()
 	})
 
-	mqtt.client = MQTT.NewClient(opts)
+	client := MQTT.NewClient(opts)
+	mqtt.mu.Lock()
+	mqtt.client = client
+	mqtt.mu.Unlock()
 
-	token := mqtt.client.Connect()
+	token := client.Connect()
 	if token.Wait() && token.Error() != nil {
+		mqtt.closeUnconnected()
 		return nil, token.Error()
 	}
 
-	return &mqtt, nil
+	return mqtt, nil
+}
+
+// Releases the DB, recorder and sinks opened by `newMqtt` if the initial
+// connection fails.
+func (m *Mqtt) closeUnconnected() {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout(m.cfg))
+	defer cancel()
+	m.sinks.close(ctx)
+	if m.recorder != nil {
+		m.recorder.Close()
+	}
+	m.db.Close()
 }
@@ -0,0 +1,237 @@
+package mqttGather
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT 5 client, used instead of the (default) MQTT 3.1.1 client if
+// `protocol_version` is 5. Received messages are wrapped to look like
+// v3 messages and passed to the same handlers.
+//
+// MQTT 5 specifics:
+//   - user properties and the message expiry of received messages are
+//     logged (debug) and kept with dead letters (see raw_message.go)
+//   - messages whose expiry passes while they wait to be handled (e.g.
+//     while handlers are paused during a reload) are dropped
+//   - persistent sessions expire after `session_expiry` seconds
+//
+// Shared subscriptions (`share_group`) are not specific to MQTT 5, but
+// brokers only commonly support them for MQTT 5 clients.
+
+const (
+	PROTOCOL_V311 = 4
+	PROTOCOL_V5   = 5
+)
+
+// Session expiry of persistent MQTT 5 sessions unless configured.
+const DEFAULT_SESSION_EXPIRY = 24 * time.Hour
+
+// Time to wait for the initial connection.
+const CONNECT_TIMEOUT = 30 * time.Second
+
+// MQTT 5 properties of a received message.
+type MessageProperties struct {
+	User          []UserProperty `json:"user,omitempty"`
+	MessageExpiry *uint32        `json:"message_expiry,omitempty"` // seconds left when received
+	ContentType   string         `json:"content_type,omitempty"`
+}
+
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Properties of the message, nil for MQTT 3.1.1 messages.
+func messageProperties(msg MQTT.Message) *MessageProperties {
+	if m, ok := msg.(*v5Message); ok {
+		return m.properties()
+	}
+	return nil
+}
+
+// Adapts a received MQTT 5 message to the v3 message interface.
+type v5Message struct {
+	*paho.Publish
+	received time.Time
+}
+
+func (m *v5Message) Duplicate() bool   { return m.Publish.Duplicate() }
+func (m *v5Message) Qos() byte         { return m.QoS }
+func (m *v5Message) Retained() bool    { return m.Retain }
+func (m *v5Message) Topic() string     { return m.Publish.Topic }
+func (m *v5Message) MessageID() uint16 { return m.PacketID }
+func (m *v5Message) Payload() []byte   { return m.Publish.Payload }
+func (m *v5Message) Ack()              {} // acknowledged by paho
+
+func (m *v5Message) ReceivedAt() time.Time { return m.received }
+
+// Whether the message expiry passed since the message was received.
+func (m *v5Message) expired(now time.Time) bool {
+	if m.Properties == nil || m.Properties.MessageExpiry == nil {
+		return false
+	}
+	return now.Sub(m.received) >= time.Duration(*m.Properties.MessageExpiry)*time.Second
+}
+
+func (m *v5Message) properties() *MessageProperties {
+	p := m.Properties
+	if p == nil || (len(p.User) == 0 && p.MessageExpiry == nil && p.ContentType == "") {
+		return nil
+	}
+	props := &MessageProperties{
+		MessageExpiry: p.MessageExpiry,
+		ContentType:   p.ContentType,
+	}
+	for _, u := range p.User {
+		props.User = append(props.User, UserProperty{u.Key, u.Value})
+	}
+	return props
+}
+
+// Topic filter to subscribe to, `$share/<group>/<topic>` if a share group
+// is configured.
+func (m *Mqtt) subscription(topic string) string {
+	group := m.config().ShareGroup
+	if group == "" {
+		return topic
+	}
+	return fmt.Sprintf("$share/%s/%s", group, topic)
+}
+
+func (m *Mqtt) received5(pr paho.PublishReceived) (bool, error) {
+	m.track(m.handle5)(nil, &v5Message{pr.Packet, time.Now()})
+	return true, nil
+}
+
+func (m *Mqtt) handle5(c MQTT.Client, msg MQTT.Message) {
+	log := logger("mqtt").With("topic", msg.Topic())
+	if props := messageProperties(msg); props != nil {
+		log.Debug("properties", "user", props.User, "message_expiry", props.MessageExpiry, "content_type", props.ContentType)
+	}
+	if m5, ok := msg.(*v5Message); ok && m5.expired(time.Now()) {
+		log.Debug("dropped expired message", "received", m5.received)
+		metricMessagesExpired.Inc()
+		return
+	}
+	m.dispatch(msg)
+}
+
+func (m *Mqtt) setConnected5(connected bool) {
+	m.mu.Lock()
+	m.connected5 = connected
+	m.mu.Unlock()
+}
+
+// Connects using MQTT 5, the connection is reestablished automatically.
+func (m *Mqtt) connect5() error {
+	log := logger("mqtt")
+	u, err := url.Parse(m.Broker)
+	if err != nil {
+		return err
+	}
+	sessionExpiry := uint32(0)
+	if m.cfg.PersistentSession {
+		sessionExpiry = uint32(DEFAULT_SESSION_EXPIRY.Seconds())
+		if m.cfg.SessionExpiry > 0 {
+			sessionExpiry = uint32(m.cfg.SessionExpiry)
+		}
+	}
+
+	connectionLost := func(err error) {
+		m.setConnected5(false)
+		log.Error("connection lost", "err", err)
+		metricMQTTConnectionLost.Inc()
+		m.mu.Lock()
+		collision := m.collisions.connectionLost(time.Now())
+		m.mu.Unlock()
+		if collision {
+			log.Warn("connection repeatedly lost right after connecting, client id may be used by another client", "client_id", m.ClientId)
+		}
+	}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !m.cfg.PersistentSession,
+		SessionExpiryInterval:         sessionExpiry,
+		ConnectRetryDelay:             10 * time.Second,
+		ConnectUsername:               m.cfg.MQTTUser,
+		ConnectPassword:               []byte(m.cfg.MQTTPassword),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			log.Debug("connect", "client_id", m.ClientId, "session_present", connack.SessionPresent)
+			m.mu.Lock()
+			m.collisions.connect(time.Now())
+			m.mu.Unlock()
+			m.setConnected5(true)
+			cfg := m.config()
+			m.subscribe5(cm, cfg.Topic, cfg.TopicQoS)
+			m.subscribe5(cm, cfg.TelemetryTopic, cfg.TelemetryQoS)
+			m.notifyConnected()
+		},
+		OnConnectError: func(err error) {
+			log.Info("connection attempt failed", "broker", m.Broker, "err", err)
+			metricMQTTReconnects.Inc()
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          m.ClientId,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){m.received5},
+			OnClientError:     connectionLost,
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				connectionLost(fmt.Errorf("disconnected by server: 0x%02x", d.ReasonCode))
+			},
+		},
+	}
+
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	// set before connecting, sinks may publish once the connection is up
+	m.mu.Lock()
+	m.client5 = cm
+	m.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+	defer cancel()
+	if err := cm.AwaitConnection(ctx); err != nil {
+		cm.Disconnect(context.Background())
+		m.mu.Lock()
+		m.client5 = nil
+		m.mu.Unlock()
+		return fmt.Errorf("could not connect to %s: %v", m.Broker, err)
+	}
+	return nil
+}
+
+func (m *Mqtt) subscribe5(cm *autopaho.ConnectionManager, topic string, qos byte) {
+	log := logger("mqtt")
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+	defer cancel()
+	filter := m.subscription(topic)
+	suback, err := cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: qos}},
+	})
+	if err == nil && len(suback.Reasons) == 1 && suback.Reasons[0] >= 0x80 {
+		err = fmt.Errorf("subscription refused: 0x%02x", suback.Reasons[0])
+	}
+	// failed subscriptions are reported by the readiness check (see health.go)
+	if err != nil {
+		log.Error("subscription failed", "topic", filter, "err", err)
+	} else {
+		log.Debug("subscribed", "topic", filter)
+	}
+	m.subscribed(topic, err)
+}
+
+func (m *Mqtt) disconnect5() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m.client5.Disconnect(ctx)
+	m.setConnected5(false)
+}
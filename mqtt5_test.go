@@ -0,0 +1,173 @@
+package mqttGather
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// MQTT 5 client, e.g. a device publishing with properties.
+func testClient5(t *testing.T, b *Broker, id string) *paho.Client {
+	conn, err := net.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := paho.NewClient(paho.ClientConfig{ClientID: id, Conn: conn})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connack, err := c.Connect(ctx, &paho.Connect{ClientID: id, CleanStart: true, KeepAlive: 30})
+	if err != nil || connack.ReasonCode != 0 {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { c.Disconnect(&paho.Disconnect{}) })
+	return c
+}
+
+func testPublish5(t *testing.T, c *paho.Client, topic, payload string, props *paho.PublishProperties) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := c.Publish(ctx, &paho.Publish{Topic: topic, QoS: 1, Payload: []byte(payload), Properties: props})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageProperties(t *testing.T) {
+	msg := &v5Message{&paho.Publish{Topic: "/a", Properties: &paho.PublishProperties{}}, time.Now()}
+	if messageProperties(msg) != nil {
+		t.Fatalf("expected no properties")
+	}
+	expiry := uint32(60)
+	msg.Properties.MessageExpiry = &expiry
+	msg.Properties.User.Add("firmware", "1.2")
+	props := messageProperties(msg)
+	if props == nil || *props.MessageExpiry != 60 || len(props.User) != 1 || props.User[0] != (UserProperty{"firmware", "1.2"}) {
+		t.Fatalf("unexpected properties: %#v", props)
+	}
+	if messageProperties(&testMessage{"/a", nil}) != nil {
+		t.Fatalf("v3 message with properties")
+	}
+}
+
+func TestMessageExpired(t *testing.T) {
+	_, mqtt, db := startTestGatherer(t)
+	expiry := uint32(1)
+	publish := &paho.Publish{
+		Topic:      "/opennoise/" + TEST_SIGNIFIER + "/dba_stats",
+		Payload:    []byte("52.683,57.619,55.152,0.595,55.272,86"),
+		Properties: &paho.PublishProperties{MessageExpiry: &expiry},
+	}
+	expired := metricMessagesExpired.Value()
+
+	// expired while waiting to be handled
+	mqtt.handle5(nil, &v5Message{publish, time.Now().Add(-2 * time.Second)})
+	if count(t, db, "dba_stats") != 0 || metricMessagesExpired.Value() != expired+1 {
+		t.Fatalf("expired message not dropped")
+	}
+	mqtt.handle5(nil, &v5Message{publish, time.Now()})
+	if count(t, db, "dba_stats") != 1 {
+		t.Fatalf("message not saved")
+	}
+}
+
+func TestProtocolVersionConfig(t *testing.T) {
+	b := startTestBroker(t)
+	cfg := &RunConfig{
+		SqlLiteConnect:  "file::memory:?cache=private",
+		Host:            b.LocalURL(),
+		Topic:           "/opennoise/+/dba_stats",
+		ProtocolVersion: 3,
+	}
+	if _, err := NewMQTT(cfg); err == nil {
+		t.Fatalf("expected error for unsupported protocol version")
+	}
+}
+
+func TestIntegrationMQTT5(t *testing.T) {
+	b := startTestBroker(t)
+	mqtt := connectTestGatherer(t, b, func(cfg *RunConfig) {
+		cfg.ProtocolVersion = PROTOCOL_V5
+		cfg.TopicQoS = 1
+	})
+	db := mqtt.db.(*SqliteDB)
+	if !mqtt.IsConnected() {
+		t.Fatalf("not connected")
+	}
+	device := testClient5(t, b, "device")
+
+	topic := "/opennoise/" + TEST_SIGNIFIER + "/dba_stats"
+	testPublish5(t, device, topic, "52.683,57.619,55.152,0.595,55.272,86", nil)
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 1 })
+
+	// properties are kept with dead letters
+	props := &paho.PublishProperties{}
+	props.User.Add("firmware", "1.2")
+	testPublish5(t, device, topic, "garbage", props)
+	waitFor(t, "raw_message", func() bool { return count(t, db, "raw_message") == 1 })
+	msgs, err := db.LoadRawMessages(false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := msgs[0].Properties; p == nil || len(p.User) != 1 || p.User[0].Value != "1.2" {
+		t.Fatalf("properties not saved: %#v", p)
+	}
+
+	// expired messages are dropped, the broker forwards queued messages
+	// with the time left
+	expired := uint32(0)
+	mqtt.received5(paho.PublishReceived{Packet: &paho.Publish{
+		Topic: topic, QoS: 1, Payload: []byte("52.683,57.619,55.152,0.595,55.272,86"),
+		Properties: &paho.PublishProperties{MessageExpiry: &expired},
+	}})
+	testPublish5(t, device, "/opennoise/"+TEST_SIGNIFIER+"/telemetry", "esp:1234", nil)
+	waitFor(t, "tele_mem", func() bool { return count(t, db, "tele_mem") == 1 })
+	if n := count(t, db, "dba_stats"); n != 1 {
+		t.Fatalf("expired message saved: %d", n)
+	}
+}
+
+func TestIntegrationSharedSubscription(t *testing.T) {
+	b := startTestBroker(t)
+	var gatherers []*Mqtt
+	for i := 1; i <= 2; i++ {
+		id := fmt.Sprintf("gatherer-%d", i)
+		gatherers = append(gatherers, connectTestGatherer(t, b, func(cfg *RunConfig) {
+			cfg.ProtocolVersion = PROTOCOL_V5
+			cfg.ClientId = id
+			cfg.ShareGroup = "gatherers"
+		}))
+	}
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	counts := func() (n []int) {
+		for _, g := range gatherers {
+			n = append(n, count(t, g.db.(*SqliteDB), "dba_stats"))
+		}
+		return n
+	}
+	total := func() int {
+		c := counts()
+		return c[0] + c[1]
+	}
+
+	// the broker picks a random member of the group for each message,
+	// publish until both gatherers received messages.
+	published := 0
+	for c := counts(); c[0] == 0 || c[1] == 0; c = counts() {
+		if published == 100 {
+			t.Fatalf("messages not shared: %v", c)
+		}
+		device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+		published++
+		waitFor(t, "dba_stats", func() bool { return total() == published })
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := total(); n != published {
+		t.Fatalf("messages handled more than once: %d of %d", n, published)
+	}
+}
@@ -0,0 +1,569 @@
+package mqttGather
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file contains functionality to relate the gathered noise data to
+// the DWD weather observations imported by `weather_data.go`. Noise
+// measurements are aggregated to the 10 minute intervals of the nearest
+// weather station so that noise caused by wind and rain can be told apart
+// from noise worth complaining about.
+
+// Length of DWD "10 minute" observation intervals in seconds.
+const WEATHER_INTERVAL = 600
+
+// DWD marks missing values with -999
+const DWD_MISSING = -999
+
+// One row of noise data joined with weather data. `Timestamp` is the
+// end of the 10 minute interval, this matches DWD's MESS_DATUM semantics.
+// Weather values are invalid (NULL) if the station had no (valid)
+// observation for the interval.
+type NoiseWeather struct {
+	DeviceSignifier string
+	Station         Station
+	Timestamp       time.Time
+	Min             float64
+	Max             float64
+	Leq             float64 // energy average of the `average` values in the interval
+	Count           int64   // number of dba_stats rows in the interval
+	WindSpeed       sql.NullFloat64
+	WindDirection   sql.NullInt64
+	Precipitation   sql.NullFloat64
+	Temperature     sql.NullFloat64
+}
+
+// Header line matching `CSVRecord`
+func NoiseWeatherCSVHeader() []string {
+	return []string{
+		"device", "station", "ts", "min", "max", "leq", "count",
+		"wind_speed", "wind_direction", "precipitation", "temperature",
+	}
+}
+
+// Format the row for CSV output, invalid weather values are empty.
+func (n *NoiseWeather) CSVRecord() []string {
+	nullFloat := func(f sql.NullFloat64) string {
+		if !f.Valid {
+			return ""
+		}
+		return strconv.FormatFloat(f.Float64, 'f', 1, 64)
+	}
+	direction := ""
+	if n.WindDirection.Valid {
+		direction = strconv.FormatInt(n.WindDirection.Int64, 10)
+	}
+	return []string{
+		n.DeviceSignifier,
+		string(n.Station),
+		n.Timestamp.UTC().Format(time.RFC3339),
+		strconv.FormatFloat(n.Min, 'f', 3, 64),
+		strconv.FormatFloat(n.Max, 'f', 3, 64),
+		strconv.FormatFloat(n.Leq, 'f', 3, 64),
+		strconv.FormatInt(n.Count, 10),
+		nullFloat(n.WindSpeed),
+		direction,
+		nullFloat(n.Precipitation),
+		nullFloat(n.Temperature),
+	}
+}
+
+// Returns the end of the weather interval the unix timestamp `ts` falls into.
+// Intervals are left open: (12:00, 12:10]
+func weatherInterval(ts int64) int64 {
+	return ((ts + WEATHER_INTERVAL - 1) / WEATHER_INTERVAL) * WEATHER_INTERVAL
+}
+
+// Accumulates dba_stats rows of a single interval.
+type leqAccumulator struct {
+	min    float64
+	max    float64
+	energy float64
+	weight float64
+	count  int64
+}
+
+func (a *leqAccumulator) add(min, max, average float64, num int64) {
+	if a.count == 0 || min < a.min {
+		a.min = min
+	}
+	if a.count == 0 || max > a.max {
+		a.max = max
+	}
+	// each row's average is calculated over `num` samples, weigh accordingly.
+	w := float64(num)
+	if w <= 0 {
+		w = 1
+	}
+	a.energy += w * math.Pow(10, average/10)
+	a.weight += w
+	a.count += 1
+}
+
+func (a *leqAccumulator) leq() float64 {
+	if a.weight == 0 {
+		return 0
+	}
+	return 10 * math.Log10(a.energy/a.weight)
+}
+
+// Distance in km between two coordinates (haversine).
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371.0
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(lat2 - lat1)
+	dLon := rad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Determine the weather station (see `ImportStations`) closest to the
+// location configured in the `device_info` of device `signifier`.
+// Returns the station and its distance in km.
+func (s *SqliteDB) NearestStation(signifier string) (Station, float64, error) {
+	info, err := s.LoadDeviceInfo(signifier)
+	if err != nil {
+		return "", -1, err
+	}
+
+	type station struct {
+		id       Station
+		lat, lon float64
+	}
+
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query()
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var stations []station
+		for rows.Next() {
+			var st station
+			if err := rows.Scan(&st.id, &st.lat, &st.lon); err != nil {
+				return nil, err
+			}
+			stations = append(stations, st)
+		}
+		return stations, rows.Err()
+	}
+
+	sql := `SELECT station, latitude, longitude FROM weather_station`
+
+	stations_, err := s.execute(sql, exec)
+	if err != nil {
+		return "", -1, err
+	}
+
+	var nearest Station
+	dist := math.MaxFloat64
+	for _, st := range stations_.([]station) {
+		if d := distanceKm(info.Latitude, info.Longitude, st.lat, st.lon); d < dist {
+			nearest = st.id
+			dist = d
+		}
+	}
+	if nearest == "" {
+		return "", -1, fmt.Errorf("no weather stations available, import stations first")
+	}
+	return nearest, dist, nil
+}
+
+// Stations closest to the devices with a location in `device_info`, the
+// stations used by default by the export and reports.
+func (s *SqliteDB) deviceStations() ([]Station, error) {
+	devices, err := s.LoadDevices()
+	if err != nil {
+		return nil, err
+	}
+	var stations []Station
+	seen := make(map[Station]bool)
+	for _, d := range devices {
+		if d.Info == nil || (d.Info.Latitude == 0 && d.Info.Longitude == 0) {
+			continue // location unknown
+		}
+		st, _, err := s.NearestStation(d.DeviceSignifier)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[st] {
+			seen[st] = true
+			stations = append(stations, st)
+		}
+	}
+	return stations, nil
+}
+
+// Stations closest to the devices in the database, see
+// `ImportStations` to import the station list first.
+func DeviceStations(db_fn string) ([]Station, error) {
+	db, err := openSqliteDB(db_fn, false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.deviceStations()
+}
+
+// Load noise aggregates of device `signifier` between `from` and `to`
+// aligned to the 10 minute weather observations of `station`. If `station`
+// is empty, the station closest to the device is used.
+// Intervals without noise data are not returned.
+func (s *SqliteDB) LoadNoiseWeather(signifier string, station Station, from, to time.Time) ([]NoiseWeather, error) {
+	if station == "" {
+		var err error
+		if station, _, err = s.NearestStation(signifier); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []NoiseWeather
+	byTs := make(map[int64]*leqAccumulator)
+
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query(signifier, from.Unix(), to.Unix())
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var order []int64
+		for rows.Next() {
+			var ts, num int64
+			var min, max, average float64
+			if err := rows.Scan(&ts, &min, &max, &average, &num); err != nil {
+				return nil, err
+			}
+			interval := weatherInterval(ts)
+			acc, ok := byTs[interval]
+			if !ok {
+				acc = &leqAccumulator{}
+				byTs[interval] = acc
+				order = append(order, interval)
+			}
+			acc.add(min, max, average, num)
+		}
+		return order, rows.Err()
+	}
+
+	sql := `
+SELECT
+	s.ts,
+	IFNULL(s.min, 0),
+	IFNULL(s.max, 0),
+	IFNULL(s.average, 0),
+	IFNULL(s.num, 0)
+FROM
+	dba_stats s
+JOIN
+	device d
+ON
+	s.device_id = d.device_id
+WHERE
+	d.device_signifier = :SIGNIFIER
+AND
+	s.ts >= :FROM
+AND
+	s.ts < :TO
+ORDER BY
+	s.ts
+`
+	order_, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	order := order_.([]int64)
+	if len(order) == 0 {
+		return result, nil
+	}
+
+	weather, err := s.loadWeather(station, order[0], order[len(order)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ts := range order {
+		acc := byTs[ts]
+		nw := NoiseWeather{
+			DeviceSignifier: signifier,
+			Station:         station,
+			Timestamp:       time.Unix(ts, 0),
+			Min:             acc.min,
+			Max:             acc.max,
+			Leq:             acc.leq(),
+			Count:           acc.count,
+		}
+		if w, ok := weather[ts]; ok {
+			nw.WindSpeed = w.WindSpeed
+			nw.WindDirection = w.WindDirection
+			nw.Precipitation = w.Precipitation
+			nw.Temperature = w.Temperature
+		}
+		result = append(result, nw)
+	}
+	return result, nil
+}
+
+// Loads the wind, precipitation and temperature values of `station`
+// with timestamps in [fromTs, toTs] keyed by timestamp. Only the
+// weather fields of the returned `NoiseWeather` are filled in.
+func (s *SqliteDB) loadWeather(station Station, fromTs, toTs int64) (map[int64]*NoiseWeather, error) {
+	weather := make(map[int64]*NoiseWeather)
+	get := func(ts int64) *NoiseWeather {
+		if w, ok := weather[ts]; ok {
+			return w
+		}
+		w := &NoiseWeather{}
+		weather[ts] = w
+		return w
+	}
+	// valid unless DWD marked the value missing
+	valid := func(f sql.NullFloat64) sql.NullFloat64 {
+		f.Valid = f.Valid && f.Float64 != DWD_MISSING
+		return f
+	}
+
+	queries := []struct {
+		sql  string
+		scan func(*sql.Rows) error
+	}{
+		{
+			`SELECT ts, wind_speed, direction FROM wind WHERE station = :STATION AND ts >= :FROM AND ts <= :TO`,
+			func(rows *sql.Rows) error {
+				var ts int64
+				var speed sql.NullFloat64
+				var direction sql.NullInt64
+				if err := rows.Scan(&ts, &speed, &direction); err != nil {
+					return err
+				}
+				w := get(ts)
+				w.WindSpeed = valid(speed)
+				direction.Valid = direction.Valid && direction.Int64 != DWD_MISSING
+				w.WindDirection = direction
+				return nil
+			},
+		},
+		{
+			`SELECT ts, sum_10 FROM precipitation WHERE station = :STATION AND ts >= :FROM AND ts <= :TO`,
+			func(rows *sql.Rows) error {
+				var ts int64
+				var sum sql.NullFloat64
+				if err := rows.Scan(&ts, &sum); err != nil {
+					return err
+				}
+				get(ts).Precipitation = valid(sum)
+				return nil
+			},
+		},
+		{
+			`SELECT ts, temp2m FROM temperature WHERE station = :STATION AND ts >= :FROM AND ts <= :TO`,
+			func(rows *sql.Rows) error {
+				var ts int64
+				var temp sql.NullFloat64
+				if err := rows.Scan(&ts, &temp); err != nil {
+					return err
+				}
+				get(ts).Temperature = valid(temp)
+				return nil
+			},
+		},
+	}
+
+	for _, q := range queries {
+		scan := q.scan
+		exec := func(stmt *sql.Stmt) (interface{}, error) {
+			rows, err := stmt.Query(string(station), fromTs, toTs)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				if err := scan(rows); err != nil {
+					return nil, err
+				}
+			}
+			return nil, rows.Err()
+		}
+		if _, err := s.execute(q.sql, exec); err != nil {
+			return nil, err
+		}
+	}
+	return weather, nil
+}
+
+// Station descriptions, e.g.:
+// https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/wind/recent/zehn_min_ff_Beschreibung_Stationen.txt
+//
+// Stations_id von_datum bis_datum Stationshoehe geoBreite geoLaenge Stationsname Bundesland
+// ----------- --------- --------- ------------- --------- --------- ----------------------------------------- ----------
+// 02667 19930101 20211017             92     50.8646    7.1575 Köln-Bonn                                Nordrhein-Westfalen
+const STATIONS_URL = "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/wind/recent/zehn_min_ff_Beschreibung_Stationen.txt"
+
+type WeatherStation struct {
+	Station   Station
+	Altitude  int
+	Latitude  float64
+	Longitude float64
+	Name      string
+}
+
+const DB_TABLE_WEATHER_STATION = `
+	CREATE TABLE IF NOT EXISTS weather_station (
+		weather_station_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		station   VARCHAR UNIQUE,
+		altitude  INTEGER,
+		latitude  FLOAT,
+		longitude FLOAT,
+		name      VARCHAR
+	)`
+
+const DB_INSERT_WEATHER_STATION = `
+	INSERT INTO weather_station (
+		station, altitude, latitude, longitude, name
+	) VALUES (
+		:station, :altitude, :latitude, :longitude, :name
+	) ON CONFLICT (station) DO UPDATE SET
+		altitude  = excluded.altitude,
+		latitude  = excluded.latitude,
+		longitude = excluded.longitude,
+		name      = excluded.name`
+
+func (w *WeatherStation) Insert(stmt *sql.Stmt) error {
+	_, err := stmt.Exec(
+		w.Station,
+		w.Altitude,
+		w.Latitude,
+		w.Longitude,
+		w.Name,
+	)
+	return err
+}
+
+// Station ids are zero padded in the station list but not in the
+// observation data.
+func normalizeStation(id string) Station {
+	trimmed := strings.TrimLeft(strings.TrimSpace(id), "0")
+	if trimmed == "" {
+		return Station("0")
+	}
+	return Station(trimmed)
+}
+
+// Byte offsets of the name column in DWD's station lists, the name may
+// contain spaces and is followed by the Bundesland (and, in newer lists,
+// the "Abgabe" column).
+const (
+	STATION_NAME_START = 61
+	STATION_NAME_END   = 102
+)
+
+// Parse DWD's fixed width station description list. The file is latin1
+// encoded, which is only relevant for the name.
+func parseStations(r io.Reader) ([]WeatherStation, error) {
+	var stations []WeatherStation
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 7 || len(line) <= STATION_NAME_START {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue // header & separator
+		}
+		var st WeatherStation
+		var err error
+		st.Station = normalizeStation(fields[0])
+		if st.Altitude, err = strconv.Atoi(fields[3]); err != nil {
+			return nil, err
+		}
+		if st.Latitude, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return nil, err
+		}
+		if st.Longitude, err = strconv.ParseFloat(fields[5], 64); err != nil {
+			return nil, err
+		}
+		name := line[STATION_NAME_START:]
+		if len(name) > STATION_NAME_END-STATION_NAME_START {
+			name = name[:STATION_NAME_END-STATION_NAME_START]
+		}
+		st.Name = latin1ToUTF8(strings.TrimSpace(name))
+		stations = append(stations, st)
+	}
+	return stations, scanner.Err()
+}
+
+func latin1ToUTF8(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i != len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+// Inserts or updates the stations in one transaction, a failed import
+// leaves the previously imported stations in place.
+func importStations(db *sql.DB, r io.Reader) error {
+	stations, err := parseStations(r)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(DB_TABLE_WEATHER_STATION); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	stmt, err := tx.Prepare(DB_INSERT_WEATHER_STATION)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, st := range stations {
+		if err := st.Insert(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Import the list of DWD weather stations including their location into
+// table `weather_station`. Needed to determine the nearest station to a
+// device.
+func ImportStations(db_fn string) error {
+	db, err := openSqliteDB(db_fn, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	resp, err := http.Get(STATIONS_URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not retrieve station list: %s", resp.Status)
+	}
+
+	return importStations(db.db, resp.Body)
+}
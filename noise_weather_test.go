@@ -0,0 +1,192 @@
+package mqttGather
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStations(t *testing.T) {
+	f, err := os.Open("test_data/zehn_min_ff_Beschreibung_Stationen.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stations, err := parseStations(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 3 {
+		t.Fatalf("expected 3 stations, got %d", len(stations))
+	}
+	st := stations[1]
+	if st.Station != "2667" || st.Altitude != 92 || st.Latitude != 50.8646 || st.Longitude != 7.1575 {
+		t.Fatalf("incorrectly parsed: %#v", st)
+	}
+	if st.Name != "Köln-Bonn" {
+		t.Fatalf("incorrect name: %s", st.Name)
+	}
+
+	// names with spaces, older lists without the "Abgabe" column
+	line := "00232 19930101 20211017            462     48.4253   10.9417 Augsburg (Flugplatz)                     Bayern"
+	if stations, err = parseStations(strings.NewReader(line)); err != nil || len(stations) != 1 || stations[0].Name != "Augsburg (Flugplatz)" {
+		t.Fatalf("incorrectly parsed: %#v (%v)", stations, err)
+	}
+}
+
+func TestImportStationsAgain(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	importFile := func() {
+		f, err := os.Open("test_data/zehn_min_ff_Beschreibung_Stationen.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := importStations(db.db, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	importFile()
+	// stations no longer listed are kept, listed ones updated
+	if _, err := db.db.Exec(`UPDATE weather_station SET name = 'old' WHERE station = '2667';
+		INSERT INTO weather_station (station, altitude, latitude, longitude, name) VALUES ('1', 0, 0, 0, 'closed')`); err != nil {
+		t.Fatal(err)
+	}
+	importFile()
+
+	var count int
+	var name string
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM weather_station`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.QueryRow(`SELECT name FROM weather_station WHERE station = '2667'`).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || name != "Köln-Bonn" {
+		t.Fatalf("unexpected stations after re-import: %d, %s", count, name)
+	}
+}
+
+func TestWeatherInterval(t *testing.T) {
+	for _, tt := range [][2]int64{
+		{0, 0},
+		{1, 600},
+		{599, 600},
+		{600, 600},
+		{601, 1200},
+	} {
+		if is := weatherInterval(tt[0]); is != tt[1] {
+			t.Fatalf("interval(%d) is: %d should: %d", tt[0], is, tt[1])
+		}
+	}
+}
+
+func getTestDBWithWeather(t *testing.T) *SqliteDB {
+	db, id := getTestDBWithDeviceInfo(t) // located at 1.0, 2.0
+
+	f, err := os.Open("test_data/zehn_min_ff_Beschreibung_Stationen.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := importStations(db.db, f); err != nil {
+		t.Fatal(err)
+	}
+	// 5404 (Ulm) is closest to 1.0, 2.0
+	for _, sql := range []string{
+		FindDWDDataset("wind").createTable(),
+		FindDWDDataset("precipitation").createTable(),
+		FindDWDDataset("temperature").createTable(),
+		`INSERT INTO wind (station, ts, wind_speed, direction) VALUES ('5404', 600, 4.2, 150), ('5404', 1200, -999, -999)`,
+		`INSERT INTO precipitation (station, ts, sum_10) VALUES ('5404', 600, 0.1)`,
+		`INSERT INTO temperature (station, ts, temp2m) VALUES ('5404', 600, 12.5), ('2667', 600, 13.5)`,
+	} {
+		if _, err := db.db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert := `INSERT INTO dba_stats (device_id, ts, min, max, average, num) VALUES (:ID, :TS, :MIN, :MAX, :AVG, 1)`
+	for _, row := range [][4]float64{
+		{10, 40, 60, 50},
+		{600, 45, 70, 60},
+		{700, 30, 55, 50},
+	} {
+		if _, err := db.db.Exec(insert, id, row[0], row[1], row[2], row[3]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestDeviceStations(t *testing.T) {
+	db := getTestDBWithWeather(t)
+	defer db.Close()
+	stations, err := db.deviceStations()
+	if err != nil || len(stations) != 1 || stations[0] != "5404" {
+		t.Fatalf("unexpected stations: %v (%v)", stations, err)
+	}
+}
+
+func TestNearestStation(t *testing.T) {
+	db := getTestDBWithWeather(t)
+	defer db.Close()
+
+	station, dist, err := db.NearestStation(TEST_SIGNIFIER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if station != "5404" || dist <= 0 {
+		t.Fatalf("incorrect station: %s (%f km)", station, dist)
+	}
+}
+
+func TestLoadNoiseWeather(t *testing.T) {
+	db := getTestDBWithWeather(t)
+	defer db.Close()
+
+	nw, err := db.LoadNoiseWeather(TEST_SIGNIFIER, "", time.Unix(0, 0), time.Unix(3600, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nw) != 2 {
+		t.Fatalf("expected 2 intervals, got: %d", len(nw))
+	}
+
+	first := nw[0]
+	if first.Timestamp.Unix() != 600 || first.Count != 2 || first.Min != 40 || first.Max != 70 {
+		t.Fatalf("incorrect aggregate: %#v", first)
+	}
+	// energy average of 50 and 60 dB
+	if math.Abs(first.Leq-57.4036) > 0.001 {
+		t.Fatalf("incorrect leq: %f", first.Leq)
+	}
+	if !first.WindSpeed.Valid || first.WindSpeed.Float64 != 4.2 || first.WindDirection.Int64 != 150 {
+		t.Fatalf("incorrect wind: %#v", first)
+	}
+	if first.Temperature.Float64 != 12.5 || first.Precipitation.Float64 != 0.1 {
+		t.Fatalf("incorrect weather: %#v", first)
+	}
+
+	second := nw[1]
+	if second.Timestamp.Unix() != 1200 || second.Count != 1 {
+		t.Fatalf("incorrect aggregate: %#v", second)
+	}
+	if second.WindSpeed.Valid || second.WindDirection.Valid || second.Temperature.Valid {
+		t.Fatalf("expected missing weather: %#v", second)
+	}
+
+	// explicit station
+	nw, err = db.LoadNoiseWeather(TEST_SIGNIFIER, "2667", time.Unix(0, 0), time.Unix(3600, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nw[0].Temperature.Float64 != 13.5 || nw[0].WindSpeed.Valid {
+		t.Fatalf("incorrect weather for explicit station: %#v", nw[0])
+	}
+}
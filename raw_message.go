@@ -0,0 +1,227 @@
+package mqttGather
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Dead letter handling: MQTT messages that could not be handled (received
+// on unexpected topics, unparseable payloads or failure to save them) are
+// stored in `raw_message` along with the reason. They can be inspected and,
+// e.g. after fixing a parser, re-processed using the `raw` command.
+
+type RawMessage struct {
+	Id          int64
+	Topic       string
+	Payload     []byte
+	Timestamp   int64 // time received
+	QoS         byte
+	Retained    bool
+	Error       string
+	Reprocessed int64              // time of successful re-processing, 0 if pending
+	Properties  *MessageProperties // MQTT 5 only, nil otherwise
+}
+
+func NewRawMessage(msg MQTT.Message, reason error) *RawMessage {
+	raw := &RawMessage{
+		Topic:      msg.Topic(),
+		Payload:    append([]byte(nil), msg.Payload()...),
+		Timestamp:  receivedAt(msg).Unix(),
+		QoS:        msg.Qos(),
+		Retained:   msg.Retained(),
+		Properties: messageProperties(msg),
+	}
+	if reason != nil {
+		raw.Error = reason.Error()
+	}
+	return raw
+}
+
+func (r *RawMessage) String() string {
+	return fmt.Sprintf("%d %s %s %q (%s)", r.Id, time.Unix(r.Timestamp, 0).Format(time.RFC3339), r.Topic, r.Payload, r.Error)
+}
+
+func (s *SqliteDB) SaveRawMessage(r *RawMessage) (int64, error) {
+	var properties interface{} // NULL unless set
+	if r.Properties != nil {
+		bs, err := json.Marshal(r.Properties)
+		if err != nil {
+			return 0, err
+		}
+		properties = string(bs)
+	}
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		return stmt.Exec(
+			r.Topic,
+			r.Payload,
+			r.Timestamp,
+			r.QoS,
+			r.Retained,
+			r.Error,
+			properties,
+		)
+	}
+	sql := `INSERT INTO raw_message (
+		topic, payload, ts, qos, retained, error, properties
+	) VALUES (
+		:TOPIC, :PAYLOAD, :TS, :QOS, :RETAINED, :ERROR, :PROPERTIES
+	);`
+	return s.insert(sql, exec)
+}
+
+const rawMessageColumns = `
+	raw_message_id,
+	topic,
+	payload,
+	ts,
+	qos,
+	retained,
+	IFNULL(error, ''),
+	IFNULL(reprocessed, 0),
+	IFNULL(properties, '')
+`
+
+func scanRawMessage(scan func(...interface{}) error) (*RawMessage, error) {
+	var r RawMessage
+	var properties string
+	err := scan(
+		&r.Id,
+		&r.Topic,
+		&r.Payload,
+		&r.Timestamp,
+		&r.QoS,
+		&r.Retained,
+		&r.Error,
+		&r.Reprocessed,
+		&properties,
+	)
+	if err == nil && properties != "" {
+		err = json.Unmarshal([]byte(properties), &r.Properties)
+	}
+	return &r, err
+}
+
+// Load at most `limit` messages, oldest first. Messages that were already
+// re-processed are only included if `all` is set.
+func (s *SqliteDB) LoadRawMessages(all bool, limit int) ([]RawMessage, error) {
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query(all, limit)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var msgs []RawMessage
+		for rows.Next() {
+			r, err := scanRawMessage(rows.Scan)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, *r)
+		}
+		return msgs, rows.Err()
+	}
+	sql := `
+SELECT` + rawMessageColumns + `
+FROM
+	raw_message
+WHERE
+	:ALL OR reprocessed IS NULL
+ORDER BY
+	raw_message_id
+LIMIT :LIMIT
+`
+	msgs_, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	return msgs_.([]RawMessage), nil
+}
+
+func (s *SqliteDB) LoadRawMessage(id int64) (*RawMessage, error) {
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		return scanRawMessage(stmt.QueryRow(id).Scan)
+	}
+	sql := `SELECT` + rawMessageColumns + `FROM raw_message WHERE raw_message_id = :ID`
+	r_, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	return r_.(*RawMessage), nil
+}
+
+// Marks the message as successfully re-processed at `t`.
+func (s *SqliteDB) SetRawMessageReprocessed(id int64, t time.Time) error {
+	_, err := s.db.Exec(`UPDATE raw_message SET reprocessed = :TS WHERE raw_message_id = :ID`, t.Unix(), id)
+	return err
+}
+
+// Re-processes messages through the regular handlers (see mqtt.go), the
+// same way they are handled when received: they are saved and passed on
+// to the sinks. They aren't evaluated by the alerter: alerts would be
+// late, and saving them would suppress current alerts of the device.
+type Reprocessor struct {
+	mqtt *Mqtt
+}
+
+// Opens the database and sinks of `cfg`, see `NewReplay`.
+func NewReprocessor(cfg *RunConfig) (*Reprocessor, error) {
+	mqtt, err := newMqtt(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Reprocessor{mqtt}, nil
+}
+
+// Parses and handles the message using its original time of reception.
+// The message is marked as re-processed on success. Only noise stats and
+// telemetry messages can be re-processed, they are identified by the last
+// element of their topic.
+func (r *Reprocessor) Reprocess(id int64) error {
+	db := r.mqtt.DB()
+	msg, err := db.LoadRawMessage(id)
+	if err != nil {
+		return err
+	}
+	if msg.Reprocessed != 0 {
+		return fmt.Errorf("message %d already re-processed", id)
+	}
+
+	producer := retrieveClientId(msg.Topic)
+	t := time.Unix(msg.Timestamp, 0)
+	switch path.Base(msg.Topic) {
+	case "dba_stats":
+		stats, err := DBAStatsFromString(string(msg.Payload), producer)
+		if err != nil {
+			return err
+		}
+		if err := r.mqtt.handleStats(stats, t); err != nil {
+			return err
+		}
+	case "telemetry":
+		telemetry, err := TelemetryFromPayload(string(msg.Payload), producer)
+		if err != nil {
+			return err
+		}
+		if err := r.mqtt.handleTelemetry(telemetry, t); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("don't know how to process topic: %s", msg.Topic)
+	}
+	return db.SetRawMessageReprocessed(id, time.Now())
+}
+
+func (r *Reprocessor) DB() DB {
+	return r.mqtt.DB()
+}
+
+// Waits for the sinks to finish and closes the database.
+func (r *Reprocessor) Close() {
+	r.mqtt.Shutdown(context.Background())
+}
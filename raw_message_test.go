@@ -0,0 +1,152 @@
+package mqttGather
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// minimal MQTT.Message for tests
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 1 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+// Sink recording the stats written to it.
+type recordingSink struct {
+	stats []time.Time
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+func (s *recordingSink) WriteStats(stats *DBAStats, t time.Time, info *DeviceInfo) {
+	s.stats = append(s.stats, t)
+}
+func (s *recordingSink) WriteTelemetry(telemetry *Telemetry, t time.Time, info *DeviceInfo) {}
+func (s *recordingSink) Close(ctx context.Context) error                                    { return nil }
+
+func getTestReprocessor(t *testing.T) (*Reprocessor, *SqliteDB) {
+	r, err := NewReprocessor(&RunConfig{SqlLiteConnect: filepath.Join(t.TempDir(), "test.sqlite3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, r.DB().(*SqliteDB)
+}
+
+func TestDeadLetter(t *testing.T) {
+	r, db := getTestReprocessor(t)
+	defer r.Close()
+	mqtt := r.mqtt
+	mqtt.Topic = "/opennoise/+/dba_stats"
+	sink := &recordingSink{}
+	mqtt.AddSink(sink)
+
+	topic := "/opennoise/" + TEST_SIGNIFIER + "/dba_stats"
+	mqtt.msgHandler(nil, &testMessage{topic, []byte("52.683;57.619")})
+
+	msgs, err := db.LoadRawMessages(false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got: %v", msgs)
+	}
+	msg := msgs[0]
+	if msg.Topic != topic || string(msg.Payload) != "52.683;57.619" || msg.QoS != 1 || msg.Error == "" {
+		t.Fatalf("incorrect raw message: %#v", msg)
+	}
+
+	if err := r.Reprocess(msg.Id); err == nil {
+		t.Fatalf("expected reprocessing to fail")
+	}
+
+	// pretend the parser was fixed.
+	if _, err := db.db.Exec(`UPDATE raw_message SET payload = '52.683,57.619,55.152,0.595,55.272,86'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reprocess(msg.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reprocess(msg.Id); err == nil {
+		t.Fatalf("expected error reprocessing twice")
+	}
+
+	stats, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_RAW, time.Unix(msg.Timestamp-1, 0), time.Unix(msg.Timestamp+1, 0))
+	if err != nil || len(stats) != 1 || math.Abs(stats[0].Max-57.619) > 0.001 {
+		t.Fatalf("message not reprocessed: %#v (%v)", stats, err)
+	}
+	// passed on using the time of reception
+	if len(sink.stats) != 1 || sink.stats[0].Unix() != msg.Timestamp {
+		t.Fatalf("reprocessed stats not forwarded: %v", sink.stats)
+	}
+	// not evaluated, alerts would suppress current alerts
+	if r.mqtt.Alerter() != nil || count(t, db, "alert") != 0 {
+		t.Fatalf("reprocessed stats evaluated by the alerter")
+	}
+
+	if msgs, _ := db.LoadRawMessages(false, 10); len(msgs) != 0 {
+		t.Fatalf("reprocessed message still pending: %v", msgs)
+	}
+	if msgs, _ := db.LoadRawMessages(true, 10); len(msgs) != 1 || msgs[0].Reprocessed == 0 {
+		t.Fatalf("reprocessed message not listed: %v", msgs)
+	}
+}
+
+func TestDeadLetterSaveFailure(t *testing.T) {
+	r, db := getTestReprocessor(t)
+	defer r.Close()
+	mqtt := r.mqtt
+	sink := &recordingSink{}
+	mqtt.AddSink(sink)
+
+	last := Rollups[len(Rollups)-1]
+	if _, err := db.db.Exec("ALTER TABLE " + last.table() + " RENAME TO broken"); err != nil {
+		t.Fatal(err)
+	}
+	topic := "/opennoise/" + TEST_SIGNIFIER + "/dba_stats"
+	mqtt.msgHandler(nil, &testMessage{topic, []byte("52.683,57.619,55.152,0.595,55.272,86")})
+
+	// dead-lettered on the reconnected database, nothing saved or passed on
+	db = mqtt.DB().(*SqliteDB)
+	msgs, err := db.LoadRawMessages(false, 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got: %v (%v)", msgs, err)
+	}
+	stats, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_RAW, time.Unix(0, 0), time.Now().Add(time.Minute))
+	if err != nil || len(stats) != 0 || len(sink.stats) != 0 {
+		t.Fatalf("failed save stored or forwarded: %#v %v (%v)", stats, sink.stats, err)
+	}
+
+	if _, err := db.db.Exec("ALTER TABLE broken RENAME TO " + last.table()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reprocess(msgs[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_RAW, time.Unix(0, 0), time.Now().Add(time.Minute))
+	if err != nil || len(stats) != 1 || len(sink.stats) != 1 {
+		t.Fatalf("message not reprocessed once: %#v %v (%v)", stats, sink.stats, err)
+	}
+}
+
+func TestReprocessUnknownTopic(t *testing.T) {
+	r, db := getTestReprocessor(t)
+	defer r.Close()
+
+	id, err := db.SaveRawMessage(NewRawMessage(&testMessage{"/somewhere/else", []byte("hello")}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reprocess(id); err == nil {
+		t.Fatalf("expected error for unknown topic")
+	}
+}
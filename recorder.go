@@ -0,0 +1,127 @@
+package mqttGather
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recording of received MQTT messages to reproduce problems, see
+// `replay.go`. Recordings are append-only files starting with
+// `RECORDING_MAGIC` followed by records of:
+//
+//	varint  : time of reception (unix, milliseconds)
+//	uvarint : length of topic
+//	bytes   : topic
+//	uvarint : length of payload
+//	bytes   : payload
+//
+// Recording is enabled by `record_file` (or `-record`). Appending to an
+// existing recording continues it.
+
+const RECORDING_MAGIC = "MQTTREC1"
+
+type RecordedMessage struct {
+	Timestamp time.Time
+	Topic     string
+	Payload   []byte
+}
+
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	buf  [binary.MaxVarintLen64]byte
+}
+
+func NewRecorder(fn string) (*Recorder, error) {
+	file, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{file: file, w: bufio.NewWriter(file)}
+	if fi, err := file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	} else if fi.Size() == 0 {
+		r.w.WriteString(RECORDING_MAGIC)
+	}
+	return r, nil
+}
+
+func (r *Recorder) writeBytes(b []byte) {
+	n := binary.PutUvarint(r.buf[:], uint64(len(b)))
+	r.w.Write(r.buf[:n])
+	r.w.Write(b)
+}
+
+// Appends a message to the recording. Each message is flushed to the file
+// immediately so recordings remain usable if the process dies.
+func (r *Recorder) Record(t time.Time, topic string, payload []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := binary.PutVarint(r.buf[:], t.UnixNano()/int64(time.Millisecond))
+	r.w.Write(r.buf[:n])
+	r.writeBytes([]byte(topic))
+	r.writeBytes(payload)
+	return r.w.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.w.Flush()
+	if err2 := r.file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Reads recorded messages, see above.
+type RecordingReader struct {
+	r *bufio.Reader
+}
+
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(RECORDING_MAGIC))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != RECORDING_MAGIC {
+		return nil, fmt.Errorf("not a recording")
+	}
+	return &RecordingReader{br}, nil
+}
+
+func (rr *RecordingReader) readBytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(rr.r, b)
+	return b, err
+}
+
+// Returns the next message, io.EOF at the end of the recording.
+func (rr *RecordingReader) Next() (*RecordedMessage, error) {
+	ms, err := binary.ReadVarint(rr.r)
+	if err != nil {
+		return nil, err // io.EOF if there are no more records
+	}
+	topic, err := rr.readBytes()
+	if err != nil {
+		return nil, fmt.Errorf("truncated recording: %v", err)
+	}
+	payload, err := rr.readBytes()
+	if err != nil {
+		return nil, fmt.Errorf("truncated recording: %v", err)
+	}
+	return &RecordedMessage{
+		Timestamp: time.Unix(0, ms*int64(time.Millisecond)),
+		Topic:     string(topic),
+		Payload:   payload,
+	}, nil
+}
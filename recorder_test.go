@@ -0,0 +1,56 @@
+package mqttGather
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.rec")
+	t0 := time.Unix(1600000000, 123000000)
+
+	// recording is continued when reopened
+	for i := 0; i != 2; i++ {
+		r, err := NewRecorder(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := t0.Add(time.Duration(i) * time.Second)
+		if err := r.Record(ts, "/opennoise/"+TEST_SIGNIFIER+"/dba_stats", []byte{byte(i), 0, 1}); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+
+	file, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rr, err := NewRecordingReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i != 2; i++ {
+		msg, err := rr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Timestamp.Equal(t0.Add(time.Duration(i)*time.Second)) ||
+			msg.Topic != "/opennoise/"+TEST_SIGNIFIER+"/dba_stats" ||
+			!bytes.Equal(msg.Payload, []byte{byte(i), 0, 1}) {
+			t.Fatalf("incorrect message %d: %#v", i, msg)
+		}
+	}
+	if _, err := rr.Next(); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+
+	if _, err := NewRecordingReader(bytes.NewReader([]byte("nonsense"))); err == nil {
+		t.Fatalf("expected error for invalid recording")
+	}
+}
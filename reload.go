@@ -0,0 +1,219 @@
+package mqttGather
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Hot reload of the configuration (on SIGHUP or when the config file
+// changes, see `ConfigWatcher`). `Mqtt.Reload` applies:
+//
+//   - changed topics, QoS or share group: subscribes to the new topics,
+//     then unsubscribes from topics no longer configured
+//   - a changed SMS key: replaces the alerter's notifier, a removed one
+//     stops the alerter unless it evaluates alert states
+//   - a changed sqlite connect string: opens the new database before
+//     switching to it, message handlers are paused while switching
+//
+// Log level and directory and the retention and report jobs are reloaded
+// by `main`. Other settings (broker, client id, protocol ...) require a
+// restart, a warning is logged if they change. An invalid configuration, or one
+// whose database can't be opened, is rejected and the running
+// configuration kept.
+
+// How often the config file is checked for changes.
+const CONFIG_POLL_INTERVAL = 5 * time.Second
+
+// Settings that are only applied on start, returns the names of those
+// that differ.
+func restartRequired(old, cfg *RunConfig) []string {
+	var changed []string
+	for _, s := range []struct {
+		name    string
+		changed bool
+	}{
+		{"host", old.Host != cfg.Host},
+		{"broker_addr", old.BrokerAddr != cfg.BrokerAddr},
+		{"broker_user", old.BrokerUser != cfg.BrokerUser},
+		{"broker_password", old.BrokerPassword != cfg.BrokerPassword},
+		{"broker_tls_cert", old.BrokerTLSCert != cfg.BrokerTLSCert},
+		{"broker_tls_key", old.BrokerTLSKey != cfg.BrokerTLSKey},
+		{"mqtt_user", old.MQTTUser != cfg.MQTTUser},
+		{"mqtt_password", old.MQTTPassword != cfg.MQTTPassword},
+		{"client_id", old.ClientId != cfg.ClientId},
+		{"client_id_strategy", old.ClientIdStrategy != cfg.ClientIdStrategy},
+		{"client_id_file", old.ClientIdFile != cfg.ClientIdFile},
+		{"protocol_version", old.ProtocolVersion != cfg.ProtocolVersion},
+		{"persistent_session", old.PersistentSession != cfg.PersistentSession},
+		{"session_expiry", old.SessionExpiry != cfg.SessionExpiry},
+		{"store_dir", old.StoreDir != cfg.StoreDir},
+		{"record_file", old.RecordFile != cfg.RecordFile},
+		{"http_addr", old.HTTPAddr != cfg.HTTPAddr},
+		{"log_format", old.LogFormat != cfg.LogFormat},
+		{"influx_url", old.InfluxURL != cfg.InfluxURL},
+		{"influx_token", old.InfluxToken != cfg.InfluxToken},
+		{"influx_batch_size", old.InfluxBatchSize != cfg.InfluxBatchSize},
+		{"influx_flush_interval", old.InfluxFlushInterval != cfg.InfluxFlushInterval},
+		{"republish_prefix", old.RepublishPrefix != cfg.RepublishPrefix},
+		{"republish_qos", old.RepublishQoS != cfg.RepublishQoS},
+		{"homeassistant", old.HomeAssistant != cfg.HomeAssistant},
+		{"homeassistant_prefix", old.HomeAssistantPrefix != cfg.HomeAssistantPrefix},
+		{"dashboard", old.Dashboard != cfg.Dashboard},
+		{"stream", old.Stream != cfg.Stream},
+		{"sink_only", old.SinkOnly != cfg.SinkOnly},
+	} {
+		if s.changed {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
+
+func subscriptionsChanged(old, cfg *RunConfig) bool {
+	return old.Topic != cfg.Topic ||
+		old.TelemetryTopic != cfg.TelemetryTopic ||
+		old.TopicQoS != cfg.TopicQoS ||
+		old.TelemetryQoS != cfg.TelemetryQoS ||
+		old.ShareGroup != cfg.ShareGroup
+}
+
+// Applies a changed configuration, see above.
+func (m *Mqtt) Reload(cfg *RunConfig) error {
+	log := logger("mqtt")
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	old := m.config()
+	for _, name := range restartRequired(old, cfg) {
+		log.Warn("changed setting requires restart", "setting", name)
+	}
+
+	var db DB
+	if cfg.SqlLiteConnect != old.SqlLiteConnect {
+		var err error
+		if db, err = OpenDatabase(cfg.SqlLiteConnect, cfg.AutoMigrate); err != nil {
+			return fmt.Errorf("could not open database: %v", err)
+		}
+	}
+	oldFilters := m.subscribedFilters()
+
+	// pause handlers while switching
+	m.handling.Lock()
+	oldDB := m.DB()
+	if db != nil {
+		m.setDB(db)
+	}
+	m.mu.Lock()
+	m.cfg = cfg
+	m.Topic = cfg.Topic
+	m.TelemetryTopic = cfg.TelemetryTopic
+	for topic := range m.subscriptions {
+		if topic != cfg.Topic && topic != cfg.TelemetryTopic {
+			delete(m.subscriptions, topic)
+		}
+	}
+	alerter := m.alerter
+	smsRemoved := alerter != nil && !cfg.Alerting()
+	if smsRemoved {
+		m.alerter = nil // no more stats are passed on
+	}
+	m.mu.Unlock()
+	m.handling.Unlock()
+
+	if db != nil {
+		oldDB.Close()
+		log.Info("switched database", "sqlite", cfg.SqlLiteConnect)
+	}
+	if smsRemoved {
+		ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+		defer cancel()
+		if err := alerter.stop(ctx); err != nil {
+			log.Warn("alerter did not stop", "err", err)
+		}
+		log.Info("stopped alerter, sms_key removed")
+	} else if alerter != nil && cfg.SMSKey != old.SMSKey {
+		alerter.SetNotifier(newNotifier(cfg))
+		log.Info("replaced notifier")
+	}
+	if subscriptionsChanged(old, cfg) && (m.client != nil || m.client5 != nil) {
+		m.subscribeAll()
+		ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+		defer cancel()
+		if err := m.unsubscribe(ctx, removedFilters(oldFilters, m.subscribedFilters())); err != nil {
+			log.Warn("could not unsubscribe", "err", err)
+		}
+		log.Info("updated subscriptions", "topic", cfg.Topic, "telemetry_topic", cfg.TelemetryTopic)
+	}
+	return nil
+}
+
+// Filters in `old` that aren't in `current`.
+func removedFilters(old, current []string) []string {
+	var removed []string
+	for _, o := range old {
+		found := false
+		for _, c := range current {
+			found = found || o == c
+		}
+		if !found {
+			removed = append(removed, o)
+		}
+	}
+	return removed
+}
+
+// Watches the config file for changes by polling its modification time
+// and size, sending on `Changed` when they differ.
+type ConfigWatcher struct {
+	File     string
+	Interval time.Duration
+	Changed  chan struct{}
+
+	stop chan bool
+}
+
+func NewConfigWatcher(fn string) *ConfigWatcher {
+	return &ConfigWatcher{
+		File:     fn,
+		Interval: CONFIG_POLL_INTERVAL,
+		Changed:  make(chan struct{}, 1),
+	}
+}
+
+func (w *ConfigWatcher) Start() {
+	w.stop = make(chan bool)
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(w.File)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	go func() {
+		mtime, size := stat()
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.stop:
+				return
+			}
+			if t, s := stat(); !t.Equal(mtime) || s != size {
+				mtime, size = t, s
+				select {
+				case w.Changed <- struct{}{}:
+				default: // a reload is pending already
+				}
+			}
+		}
+	}()
+}
+
+func (w *ConfigWatcher) Stop() {
+	if w.stop != nil {
+		close(w.stop)
+	}
+}
@@ -0,0 +1,171 @@
+package mqttGather
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadSubscriptions(t *testing.T) {
+	b, mqtt, db := startTestGatherer(t)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	cfg := *mqtt.config()
+	cfg.Topic = "/opennoise/+/stats"
+	cfg.TopicQoS = 1
+	if err := mqtt.Reload(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	subs := mqtt.Subscriptions()
+	if err, ok := subs[cfg.Topic]; !ok || err != nil || len(subs) != 2 {
+		t.Fatalf("not resubscribed: %v", subs)
+	}
+
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if n := count(t, db, "dba_stats"); n != 1 {
+		t.Fatalf("still subscribed to old topic: %d", n)
+	}
+	if n := count(t, db, "raw_message"); n != 0 {
+		t.Fatalf("unexpected messages: %d", n)
+	}
+}
+
+func TestReloadDatabaseAndNotifier(t *testing.T) {
+	b, mqtt, old := startTestGatherer(t)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	cfg := *mqtt.config()
+	cfg.SqlLiteConnect = filepath.Join(t.TempDir(), "reloaded.sqlite3")
+	cfg.SMSKey = "key"
+	if err := mqtt.Reload(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Probe(); err == nil {
+		t.Fatalf("old database not closed")
+	}
+	db := mqtt.DB().(*SqliteDB)
+	if mqtt.alerter.DB != db {
+		t.Fatalf("alerter database not replaced")
+	}
+	if sms, ok := mqtt.alerter.Notifier.(*SMS); !ok || sms.Key != "key" {
+		t.Fatalf("notifier not replaced: %#v", mqtt.alerter.Notifier)
+	}
+
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 1 })
+}
+
+func TestReloadRemovedSMSKey(t *testing.T) {
+	b, mqtt, db := startTestGatherer(t)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	cfg := *mqtt.config()
+	cfg.SMSKey = "key"
+	if err := mqtt.Reload(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	alerter := mqtt.Alerter()
+	removed := cfg
+	removed.SMSKey = ""
+	if err := mqtt.Reload(&removed); err != nil {
+		t.Fatal(err)
+	}
+	if mqtt.Alerter() != nil || alerter.Running() {
+		t.Fatalf("alerter not stopped")
+	}
+
+	// stats are saved without an alerter to pass them on to
+	for i := 0; i != 2; i++ {
+		device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	}
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 2 })
+
+	// a new alerter takes over the stats channel
+	NewAlerter(&cfg, mqtt).Start()
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 3 })
+	if !mqtt.Alerter().Running() {
+		t.Fatalf("new alerter not running")
+	}
+}
+
+func TestReloadRemovedSMSKeyAlertStates(t *testing.T) {
+	_, mqtt, _ := startTestGatherer(t)
+
+	cfg := *mqtt.config()
+	cfg.SMSKey = "key"
+	cfg.RepublishPrefix = "opennoise/json"
+	if err := mqtt.Reload(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	NewAlerter(&cfg, mqtt).Start()
+	removed := cfg
+	removed.SMSKey = ""
+	if err := mqtt.Reload(&removed); err != nil {
+		t.Fatal(err)
+	}
+	// the alerter keeps evaluating alert states for the republisher
+	alerter := mqtt.Alerter()
+	if alerter == nil || !alerter.Running() {
+		t.Fatalf("alerter stopped")
+	}
+	alerter.mu.Lock()
+	defer alerter.mu.Unlock()
+	if alerter.Notifier != nil {
+		t.Fatalf("notifier not removed: %#v", alerter.Notifier)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	_, mqtt, db := startTestGatherer(t)
+	running := mqtt.config()
+
+	cfg := *running
+	cfg.TopicQoS = 3
+	if err := mqtt.Reload(&cfg); err == nil {
+		t.Fatalf("expected error for invalid QoS")
+	}
+	cfg = *running
+	cfg.SqlLiteConnect = filepath.Join(t.TempDir(), "missing", "db.sqlite3")
+	if err := mqtt.Reload(&cfg); err == nil {
+		t.Fatalf("expected error for unopenable database")
+	}
+	if mqtt.config() != running || mqtt.DB() != db {
+		t.Fatalf("running configuration not kept")
+	}
+	if err := db.Probe(); err != nil {
+		t.Fatalf("database closed: %v", err)
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(fn, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := NewConfigWatcher(fn)
+	w.Interval = 10 * time.Millisecond
+	w.Start()
+	defer w.Stop()
+
+	select {
+	case <-w.Changed:
+		t.Fatalf("unexpected change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := os.WriteFile(fn, []byte(`{"topic": "/opennoise/+/dba_stats"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.Changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("change not detected")
+	}
+}
@@ -0,0 +1,101 @@
+package mqttGather
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Replays recordings (see recorder.go) through the regular message
+// handlers against a database, no broker required. Messages are
+// dispatched to the handlers according to the configured `topic` and
+// `telemetry_topic`, other messages are treated as unexpected.
+//
+// Messages are saved using the time they were recorded, so rollups match
+// the recording regardless of the speed. The alerter doesn't run: alerts
+// would be evaluated against the current time, and saving them would
+// suppress current alerts of the devices.
+
+type Replay struct {
+	// 1 replays at the original pace, 10 ten times as fast, 0 as fast as
+	// possible.
+	Speed float64
+
+	mqtt *Mqtt
+}
+
+// Message delivered by a replay.
+type replayMessage struct {
+	*RecordedMessage
+}
+
+func (m replayMessage) Duplicate() bool   { return false }
+func (m replayMessage) Qos() byte         { return 0 }
+func (m replayMessage) Retained() bool    { return false }
+func (m replayMessage) Topic() string     { return m.RecordedMessage.Topic }
+func (m replayMessage) MessageID() uint16 { return 0 }
+func (m replayMessage) Payload() []byte   { return m.RecordedMessage.Payload }
+func (m replayMessage) Ack()              {}
+
+func (m replayMessage) ReceivedAt() time.Time { return m.RecordedMessage.Timestamp }
+
+func NewReplay(cfg *RunConfig, speed float64) (*Replay, error) {
+	if cfg.RecordFile != "" {
+		return nil, fmt.Errorf("recording while replaying is not supported")
+	}
+	mqtt, err := newMqtt(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Replay{Speed: speed, mqtt: mqtt}, nil
+}
+
+// Whether `topic` matches the subscription `filter` which may contain the
+// `+` and `#` wildcards.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i := range f {
+		switch {
+		case f[i] == "#":
+			return true
+		case i >= len(t):
+			return false
+		case f[i] != "+" && f[i] != t[i]:
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// Replays all messages of the recording, returns the number of replayed
+// messages.
+func (r *Replay) Run(recording io.Reader) (int, error) {
+	rr, err := NewRecordingReader(recording)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	var last time.Time
+	for {
+		msg, err := rr.Next()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		if r.Speed > 0 && !last.IsZero() {
+			time.Sleep(time.Duration(float64(msg.Timestamp.Sub(last)) / r.Speed))
+		}
+		last = msg.Timestamp
+		r.mqtt.dispatch(replayMessage{msg})
+		count += 1
+	}
+}
+
+// Waits for the sinks to finish and closes the database.
+func (r *Replay) Close() {
+	r.mqtt.Shutdown(context.Background())
+}
@@ -0,0 +1,80 @@
+package mqttGather
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		should        bool
+	}{
+		{"/opennoise/+/dba_stats", "/opennoise/" + TEST_SIGNIFIER + "/dba_stats", true},
+		{"/opennoise/+/dba_stats", "/opennoise/" + TEST_SIGNIFIER + "/telemetry", false},
+		{"/opennoise/+/dba_stats", "/opennoise/dba_stats", false},
+		{"/opennoise/#", "/opennoise/" + TEST_SIGNIFIER + "/telemetry", true},
+		{"/opennoise", "/opennoise/x", false},
+	}
+	for _, test := range tests {
+		if is := topicMatches(test.filter, test.topic); is != test.should {
+			t.Fatalf("%s %s: is %v, should %v", test.filter, test.topic, is, test.should)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	recording := filepath.Join(dir, "test.rec")
+	r, err := NewRecorder(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	r.Record(now, "/opennoise/"+TEST_SIGNIFIER+"/dba_stats", []byte("52.683,57.619,55.152,0.595,55.272,86"))
+	r.Record(now, "/opennoise/"+TEST_SIGNIFIER+"/telemetry", []byte("esp:1234"))
+	r.Record(now, "/elsewhere", []byte("hello"))
+	r.Close()
+
+	cfg := &RunConfig{
+		SqlLiteConnect: filepath.Join(dir, "test.sqlite3"),
+		Topic:          "/opennoise/+/dba_stats",
+		TelemetryTopic: "/opennoise/+/telemetry",
+	}
+	replay, err := NewReplay(cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.mqtt.Alerter() != nil {
+		t.Fatalf("replayed stats evaluated by the alerter")
+	}
+	rec, _ := os.ReadFile(recording)
+	cnt, err := replay.Run(bytes.NewReader(rec))
+	replay.Close()
+	if err != nil || cnt != 3 {
+		t.Fatalf("replayed %d messages (%v)", cnt, err)
+	}
+
+	db_, err := NewDatabase(cfg.SqlLiteConnect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := db_.(*SqliteDB)
+	defer db.Close()
+
+	// saved with the recorded time
+	stats, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_RAW, now, now.Add(time.Second))
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("stats not replayed: %#v (%v)", stats, err)
+	}
+	var free_mem int
+	if err := db.db.QueryRow(`SELECT free_mem FROM tele_mem`).Scan(&free_mem); err != nil || free_mem != 1234 {
+		t.Fatalf("telemetry not replayed: %d (%v)", free_mem, err)
+	}
+	if msgs, err := db.LoadRawMessages(false, 10); err != nil || len(msgs) != 1 || msgs[0].Topic != "/elsewhere" || msgs[0].Timestamp != now.Unix() {
+		t.Fatalf("unexpected message not stored: %v (%v)", msgs, err)
+	}
+}
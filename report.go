@@ -0,0 +1,389 @@
+package mqttGather
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Noise reports per device and period, e.g. the monthly summary of
+// violations for the Ordnungsamt. A report contains:
+//
+//   - Lday, Levening, Lnight and Lden following the 34. BImSchV: day
+//     06-18h, evening 18-22h, night 22-06h, Lden weights the evening with
+//     +5 dB and the night with +10 dB
+//   - the hourly Leq profile, the energy average per hour of the day
+//   - the number of stats exceeding the device's `AlertThreshold`
+//   - the alerts sent
+//   - weather context from the nearest DWD station (see noise_weather.go):
+//     temperature, wind, precipitation and the exceedances during wind or
+//     rain, which may have been caused by the weather
+//
+// Report days run from 06:00 to 06:00 in the report's time zone, so each
+// night is reported with the day before it. Levels are calculated from
+// the hourly rollups (see rollup.go) and remain available once raw stats
+// expired, exceedances need the raw stats.
+//
+// Reports are rendered as self-contained HTML or PDF (see
+// report_render.go) and can be generated on a schedule and mailed (see
+// report_schedule.go).
+
+const (
+	REPORT_DAY_START     = 6  // hour the day (and report days) begin
+	REPORT_EVENING_START = 18 // hour the evening begins
+	REPORT_NIGHT_START   = 22 // hour the night begins
+
+	REPORT_MAX_DAYS   = 366
+	REPORT_MAX_ALERTS = 1000
+	// weather of stations further away than this (km) isn't reported
+	REPORT_MAX_STATION_DISTANCE = 50.0
+	// exceedances with at least this wind speed (m/s) or precipitation
+	// are counted as possibly caused by the weather
+	REPORT_WINDY = 8.0
+)
+
+type ReportOptions struct {
+	Device string
+	// Dates of the first and last (exclusive) report day, the report
+	// covers From 06:00 to To 06:00.
+	From time.Time
+	To   time.Time
+	// Time zone of the report, UTC if nil.
+	Location *time.Location
+}
+
+type Report struct {
+	Device          ExportDevice
+	From            time.Time // 06:00 of the first day
+	To              time.Time // 06:00 after the last day
+	Threshold       float64   // alert threshold, 0 if not configured
+	Generated       time.Time
+	Total           ReportLevels
+	Days            []ReportDay
+	Hours           [24]ReportHour // by hour of day
+	Alerts          []ReportAlert  // oldest first
+	Station         Station        // weather station, empty if no weather
+	StationDistance float64        // km
+}
+
+// Levels and exceedances of a day or the whole period. Levels are not
+// valid if there is no data for (part of) the day.
+type ReportLevels struct {
+	Lday               sql.NullFloat64
+	Levening           sql.NullFloat64
+	Lnight             sql.NullFloat64
+	Lden               sql.NullFloat64
+	Max                sql.NullFloat64
+	Exceedances        int64
+	WeatherExceedances int64 // exceedances during wind or rain
+}
+
+type ReportDay struct {
+	Date time.Time // midnight of the day, the day starts at 06:00
+	ReportLevels
+	Temperature   sql.NullFloat64 // mean, °C
+	WindMax       sql.NullFloat64 // max 10 minute mean, m/s
+	Precipitation sql.NullFloat64 // sum, mm
+}
+
+type ReportHour struct {
+	Leq sql.NullFloat64
+	Max sql.NullFloat64
+}
+
+// A sent alert, without the phone number.
+type ReportAlert struct {
+	Timestamp time.Time
+	Message   string
+	Status    string
+}
+
+func (o *ReportOptions) location() *time.Location {
+	if o.Location == nil {
+		return time.UTC
+	}
+	return o.Location
+}
+
+// Start of the report day of `date` in the report's time zone.
+func (o *ReportOptions) dayStart(date time.Time) time.Time {
+	y, m, d := date.Date()
+	return time.Date(y, m, d, REPORT_DAY_START, 0, 0, 0, o.location())
+}
+
+// Checks the options for errors, also done by `Report`.
+func (o *ReportOptions) Validate() error {
+	if o.Device == "" {
+		return fmt.Errorf("no device")
+	}
+	from, to := o.dayStart(o.From), o.dayStart(o.To)
+	if !to.After(from) {
+		return fmt.Errorf("empty report period: %s - %s", o.From.Format("2006-01-02"), o.To.Format("2006-01-02"))
+	}
+	if to.Sub(from) > REPORT_MAX_DAYS*24*time.Hour {
+		return fmt.Errorf("report period too long: max %d days", REPORT_MAX_DAYS)
+	}
+	return nil
+}
+
+// Accumulates levels as sound energy, see rollup.go
+type energySum struct {
+	energy float64
+	n      int
+}
+
+func (e *energySum) add(level float64) {
+	e.energy += dbToEnergy(level)
+	e.n += 1
+}
+
+func (e *energySum) leq() sql.NullFloat64 {
+	if e.n == 0 {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: energyToDB(e.energy / float64(e.n)), Valid: true}
+}
+
+func maxLevel(max sql.NullFloat64, level float64) sql.NullFloat64 {
+	if !max.Valid || level > max.Float64 {
+		return sql.NullFloat64{Float64: level, Valid: true}
+	}
+	return max
+}
+
+// Day, evening and night levels accumulated separately.
+type denSums [3]energySum
+
+// Index into denSums of the (local) hour.
+func denPeriod(hour int) int {
+	switch {
+	case hour >= REPORT_DAY_START && hour < REPORT_EVENING_START:
+		return 0
+	case hour >= REPORT_EVENING_START && hour < REPORT_NIGHT_START:
+		return 1
+	}
+	return 2
+}
+
+// Sets Lday, Levening, Lnight and, if all of them are valid, Lden.
+func (s *denSums) levels(l *ReportLevels) {
+	l.Lday, l.Levening, l.Lnight = s[0].leq(), s[1].leq(), s[2].leq()
+	if l.Lday.Valid && l.Levening.Valid && l.Lnight.Valid {
+		l.Lden = sql.NullFloat64{Float64: lden(l.Lday.Float64, l.Levening.Float64, l.Lnight.Float64), Valid: true}
+	}
+}
+
+// Day-evening-night level, weighted by the length of the periods.
+func lden(day, evening, night float64) float64 {
+	dayHours := float64(REPORT_EVENING_START - REPORT_DAY_START)
+	eveningHours := float64(REPORT_NIGHT_START - REPORT_EVENING_START)
+	nightHours := 24 - dayHours - eveningHours
+	return 10 * math.Log10((dayHours*dbToEnergy(day)+eveningHours*dbToEnergy(evening+5)+nightHours*dbToEnergy(night+10))/24)
+}
+
+// Generates the report of a device.
+func (s *SqliteDB) Report(opts *ReportOptions) (*Report, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	info, err := s.LoadDeviceInfo(opts.Device)
+	if err == sql.ErrNoRows {
+		info, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{
+		Device:    republishedDevice(opts.Device, info),
+		From:      opts.dayStart(opts.From),
+		To:        opts.dayStart(opts.To),
+		Generated: time.Now().In(opts.location()),
+	}
+	if info != nil {
+		r.Threshold = info.AlertThreshold
+	}
+	days := make(map[time.Time]int) // index into r.Days by date
+	for date := opts.From; opts.dayStart(date).Before(r.To); date = date.AddDate(0, 0, 1) {
+		y, m, d := date.Date()
+		date = time.Date(y, m, d, 0, 0, 0, 0, opts.location())
+		days[date] = len(r.Days)
+		r.Days = append(r.Days, ReportDay{Date: date})
+	}
+	// the report day an instant falls into
+	day := func(t time.Time) *ReportDay {
+		y, m, d := t.In(opts.location()).Add(-REPORT_DAY_START * time.Hour).Date()
+		i, ok := days[time.Date(y, m, d, 0, 0, 0, 0, opts.location())]
+		if !ok {
+			return nil
+		}
+		return &r.Days[i]
+	}
+
+	// levels
+
+	hourly, err := s.LoadStatsResolution(opts.Device, RESOLUTION_HOUR, r.From, r.To)
+	if err != nil {
+		return nil, err
+	}
+	var total denSums
+	daySums := make([]denSums, len(r.Days))
+	var hourSums [24]energySum
+	for _, h := range hourly {
+		d := day(h.Timestamp)
+		if d == nil {
+			continue
+		}
+		hour := h.Timestamp.In(opts.location()).Hour()
+		period := denPeriod(hour)
+		total[period].add(h.Leq)
+		daySums[days[d.Date]][period].add(h.Leq)
+		hourSums[hour].add(h.Leq)
+		r.Hours[hour].Max = maxLevel(r.Hours[hour].Max, h.Max)
+		d.Max = maxLevel(d.Max, h.Max)
+		r.Total.Max = maxLevel(r.Total.Max, h.Max)
+	}
+	total.levels(&r.Total)
+	for i := range r.Days {
+		daySums[i].levels(&r.Days[i].ReportLevels)
+	}
+	for hour := range r.Hours {
+		r.Hours[hour].Leq = hourSums[hour].leq()
+	}
+
+	// weather
+
+	weatherHours := make(map[int64]bool) // hours with wind or rain
+	if info != nil {
+		station, distance, err := s.NearestStation(opts.Device)
+		if err != nil {
+			logger("report").Info("no weather context", "device", opts.Device, "err", err)
+		} else if distance <= REPORT_MAX_STATION_DISTANCE {
+			r.Station, r.StationDistance = station, distance
+			if err := s.reportWeather(r, station, day, weatherHours); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// exceedances
+
+	if r.Threshold > 0 {
+		exceedances, err := s.countExceedances(opts.Device, r.Threshold, r.From, r.To)
+		if err != nil {
+			return nil, err
+		}
+		for hour, count := range exceedances {
+			d := day(time.Unix(hour, 0))
+			if d == nil {
+				continue
+			}
+			d.Exceedances += count
+			r.Total.Exceedances += count
+			if weatherHours[hour] {
+				d.WeatherExceedances += count
+				r.Total.WeatherExceedances += count
+			}
+		}
+	}
+
+	// alerts
+
+	alerts, err := s.LoadAlerts(opts.Device, r.From, r.To, REPORT_MAX_ALERTS)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(alerts) - 1; i >= 0; i-- {
+		a := alerts[i]
+		r.Alerts = append(r.Alerts, ReportAlert{time.Unix(a.Timestamp, 0).In(opts.location()), a.Message, a.Status})
+	}
+	return r, nil
+}
+
+// Sets the weather of the report days and marks the hours (unix
+// timestamps of their start) with wind or rain in `weatherHours`.
+func (s *SqliteDB) reportWeather(r *Report, station Station, day func(time.Time) *ReportDay, weatherHours map[int64]bool) error {
+	weather, err := s.loadWeather(station, r.From.Unix()+WEATHER_INTERVAL, r.To.Unix())
+	if err != nil {
+		return err
+	}
+	temperatures := make(map[*ReportDay][]float64)
+	for ts, w := range weather {
+		// timestamps are the end of the interval
+		start := time.Unix(ts-WEATHER_INTERVAL, 0)
+		d := day(start)
+		if d == nil {
+			continue
+		}
+		if w.Temperature.Valid {
+			temperatures[d] = append(temperatures[d], w.Temperature.Float64)
+		}
+		if w.WindSpeed.Valid {
+			d.WindMax = maxLevel(d.WindMax, w.WindSpeed.Float64)
+		}
+		if w.Precipitation.Valid {
+			d.Precipitation.Float64 += w.Precipitation.Float64
+			d.Precipitation.Valid = true
+		}
+		if (w.WindSpeed.Valid && w.WindSpeed.Float64 >= REPORT_WINDY) || (w.Precipitation.Valid && w.Precipitation.Float64 > 0) {
+			weatherHours[RESOLUTION_HOUR.bucket(start.Unix())] = true
+		}
+	}
+	for d, temps := range temperatures {
+		var sum float64
+		for _, t := range temps {
+			sum += t
+		}
+		d.Temperature = sql.NullFloat64{Float64: sum / float64(len(temps)), Valid: true}
+	}
+	return nil
+}
+
+// Number of stats of the device with a max of at least `threshold`, by
+// hour (unix timestamp of the start).
+func (s *SqliteDB) countExceedances(signifier string, threshold float64, from, to time.Time) (map[int64]int64, error) {
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query(signifier, from.Unix(), to.Unix(), threshold)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		counts := make(map[int64]int64)
+		for rows.Next() {
+			var hour, count int64
+			if err := rows.Scan(&hour, &count); err != nil {
+				return nil, err
+			}
+			counts[hour] = count
+		}
+		return counts, rows.Err()
+	}
+
+	sql := `
+SELECT
+	(s.ts / 3600) * 3600 AS hour,
+	COUNT(*)
+FROM
+	dba_stats s
+JOIN
+	device d
+ON
+	s.device_id = d.device_id
+WHERE
+	d.device_signifier = :SIGNIFIER
+AND
+	s.ts >= :FROM
+AND
+	s.ts < :TO
+AND
+	s.max >= :THRESHOLD
+GROUP BY
+	hour
+`
+	counts, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	return counts.(map[int64]int64), nil
+}
@@ -0,0 +1,354 @@
+package mqttGather
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Rendering of reports (see report.go) as a single self-contained HTML
+// file (styles and the hourly chart inline, nothing loaded from external
+// sites) or as PDF (using https://github.com/go-pdf/fpdf).
+
+const (
+	REPORT_HTML = "html"
+	REPORT_PDF  = "pdf"
+)
+
+var ReportFormats = []string{REPORT_HTML, REPORT_PDF}
+
+//go:embed web/report/report.html
+var reportFiles embed.FS
+
+var reportTemplate = template.Must(template.New("report.html").Funcs(template.FuncMap{
+	"level": formatLevel,
+	"number": func(v sql.NullFloat64) string {
+		return formatNullFloat(v, 1)
+	},
+	"date": func(t time.Time) string { return t.Format("2006-01-02") },
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+}).ParseFS(reportFiles, "web/report/report.html"))
+
+// Writes the report in `format` (REPORT_HTML or REPORT_PDF).
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case REPORT_HTML:
+		return r.WriteHTML(w)
+	case REPORT_PDF:
+		return r.WritePDF(w)
+	}
+	return fmt.Errorf("unknown report format: %s (expected one of %s)", format, strings.Join(ReportFormats, ", "))
+}
+
+// Name of the device, its description if available.
+func (r *Report) DeviceName() string {
+	if r.Device.Description != "" {
+		return r.Device.Description
+	}
+	return r.Device.Device
+}
+
+// Last day of the report.
+func (r *Report) LastDay() time.Time {
+	return r.To.AddDate(0, 0, -1)
+}
+
+func formatNullFloat(v sql.NullFloat64, decimals int) string {
+	if !v.Valid {
+		return "–"
+	}
+	return fmt.Sprintf("%.*f", decimals, v.Float64)
+}
+
+func formatLevel(v sql.NullFloat64) string {
+	if !v.Valid {
+		return "–"
+	}
+	return fmt.Sprintf("%.1f dB(A)", v.Float64)
+}
+
+// Levels shown by the hourly chart, in steps of 10 dB.
+func (r *Report) chartRange() (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, h := range r.Hours {
+		if h.Leq.Valid {
+			lo = math.Min(lo, h.Leq.Float64)
+			hi = math.Max(hi, h.Leq.Float64)
+		}
+	}
+	if math.IsInf(lo, 1) {
+		return 30, 80
+	}
+	if r.Threshold > 0 {
+		hi = math.Max(hi, r.Threshold)
+	}
+	lo = math.Floor(lo/10)*10 - 10
+	hi = math.Ceil(hi/10) * 10
+	if hi <= lo {
+		hi = lo + 10
+	}
+	return lo, hi
+}
+
+// Bar of the hourly chart, in SVG user units.
+type reportBar struct {
+	X, Y, Width, Height float64
+	Hour                int
+	Leq                 sql.NullFloat64
+}
+
+type reportGridLine struct {
+	Y     float64
+	Label string
+}
+
+type reportChart struct {
+	Width, Height float64
+	Left, Bottom  float64 // of the plot area
+	Bars          []reportBar
+	Grid          []reportGridLine
+	Threshold     float64 // y, 0 if none
+}
+
+const (
+	REPORT_CHART_WIDTH  = 720
+	REPORT_CHART_HEIGHT = 240
+)
+
+func (r *Report) Chart() reportChart {
+	c := reportChart{Width: REPORT_CHART_WIDTH, Height: REPORT_CHART_HEIGHT, Left: 50, Bottom: REPORT_CHART_HEIGHT - 25}
+	lo, hi := r.chartRange()
+	top := 10.0
+	y := func(level float64) float64 {
+		return c.Bottom - (level-lo)/(hi-lo)*(c.Bottom-top)
+	}
+	for level := lo; level <= hi; level += 10 {
+		c.Grid = append(c.Grid, reportGridLine{y(level), fmt.Sprintf("%.0f dB", level)})
+	}
+	if r.Threshold > 0 {
+		c.Threshold = y(r.Threshold)
+	}
+	step := (c.Width - c.Left - 10) / 24
+	// report days start at REPORT_DAY_START, so does the chart
+	for i := 0; i < 24; i++ {
+		hour := (REPORT_DAY_START + i) % 24
+		bar := reportBar{X: c.Left + float64(i)*step + 2, Width: step - 4, Hour: hour, Leq: r.Hours[hour].Leq}
+		if bar.Leq.Valid {
+			bar.Y = y(math.Max(bar.Leq.Float64, lo))
+			bar.Height = c.Bottom - bar.Y
+		}
+		c.Bars = append(c.Bars, bar)
+	}
+	return c
+}
+
+// Writes the report as a self-contained HTML document.
+func (r *Report) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
+
+// A4 in points, PDF coordinates are in points from the top left corner.
+const (
+	PDF_PAGE_WIDTH  = 595.28
+	PDF_PAGE_HEIGHT = 841.89
+)
+
+type pdfColor [3]int // RGB
+
+var (
+	pdfBlack = pdfColor{0, 0, 0}
+	pdfGrey  = pdfColor{153, 153, 153}
+)
+
+// Report PDF, drawing with the standard Helvetica fonts. Text is encoded
+// as cp1252, characters it doesn't contain are replaced by '.'.
+type pdfDocument struct {
+	*fpdf.Fpdf
+	tr func(string) string
+}
+
+func newPDF() *pdfDocument {
+	f := fpdf.New("P", "pt", "A4", "")
+	f.SetAutoPageBreak(false, 0)
+	f.AddPage()
+	return &pdfDocument{Fpdf: f, tr: f.UnicodeTranslatorFromDescriptor("")}
+}
+
+func (d *pdfDocument) setFont(size float64, bold bool) {
+	style := ""
+	if bold {
+		style = "B"
+	}
+	d.SetFont("Helvetica", style, size)
+}
+
+// Writes `s` with its baseline at `y`.
+func (d *pdfDocument) text(x, y, size float64, bold bool, color pdfColor, s string) {
+	d.setFont(size, bold)
+	d.SetTextColor(color[0], color[1], color[2])
+	d.Text(x, y, d.tr(s))
+}
+
+// Writes `s` ending at `x`.
+func (d *pdfDocument) textRight(x, y, size float64, bold bool, color pdfColor, s string) {
+	d.setFont(size, bold)
+	d.text(x-d.GetStringWidth(d.tr(s)), y, size, bold, color, s)
+}
+
+func (d *pdfDocument) line(x1, y1, x2, y2, width float64, color pdfColor) {
+	d.SetDrawColor(color[0], color[1], color[2])
+	d.SetLineWidth(width)
+	d.Line(x1, y1, x2, y2)
+}
+
+// Filled rectangle with its top left corner at x, y.
+func (d *pdfDocument) rect(x, y, w, h float64, color pdfColor) {
+	d.SetFillColor(color[0], color[1], color[2])
+	d.Rect(x, y, w, h, "F")
+}
+
+// Writes the report as PDF, laid out like the HTML version.
+func (r *Report) WritePDF(w io.Writer) error {
+	const (
+		left   = 50.0
+		right  = PDF_PAGE_WIDTH - 50
+		bottom = PDF_PAGE_HEIGHT - 50
+		line   = 14.0
+	)
+	d := newPDF()
+	d.SetTitle("Noise report "+r.DeviceName(), true)
+	d.SetCreator("mqttGather", false)
+	d.SetCreationDate(r.Generated)
+	y := 60.0
+	// starts a new page if less than `height` is left
+	space := func(height float64) {
+		if y+height > bottom {
+			d.AddPage()
+			y = 60
+		}
+	}
+	heading := func(s string) {
+		space(3 * line)
+		y += line
+		d.text(left, y, 13, true, pdfBlack, s)
+		y += line
+	}
+
+	d.text(left, y, 18, true, pdfBlack, "Noise report "+r.DeviceName())
+	y += 1.5 * line
+	d.text(left, y, 10, false, pdfGrey, fmt.Sprintf("Device %s, %s 06:00 - %s 06:00, generated %s",
+		r.Device.Device, r.From.Format("2006-01-02"), r.To.Format("2006-01-02"), r.Generated.Format("2006-01-02 15:04")))
+	y += line
+
+	heading("Summary")
+	summary := [][2]string{
+		{"Lden", formatLevel(r.Total.Lden)},
+		{"Lday (06-18h)", formatLevel(r.Total.Lday)},
+		{"Levening (18-22h)", formatLevel(r.Total.Levening)},
+		{"Lnight (22-06h)", formatLevel(r.Total.Lnight)},
+		{"Max", formatLevel(r.Total.Max)},
+	}
+	if r.Threshold > 0 {
+		summary = append(summary,
+			[2]string{"Exceedances", fmt.Sprintf("%d above %.1f dB(A)", r.Total.Exceedances, r.Threshold)})
+		if r.Station != "" {
+			summary = append(summary,
+				[2]string{"During wind or rain", fmt.Sprintf("%d", r.Total.WeatherExceedances)})
+		}
+	}
+	summary = append(summary, [2]string{"Alerts sent", fmt.Sprintf("%d", len(r.Alerts))})
+	if r.Station != "" {
+		summary = append(summary, [2]string{"Weather station",
+			fmt.Sprintf("DWD %s, %.1f km away", r.Station, r.StationDistance)})
+	}
+	for _, s := range summary {
+		d.text(left, y, 10, false, pdfBlack, s[0])
+		d.text(left+130, y, 10, false, pdfBlack, s[1])
+		y += line
+	}
+
+	heading("Hourly Leq")
+	space(REPORT_CHART_HEIGHT * 0.66)
+	r.pdfChart(d, left, y, 0.66)
+	y += REPORT_CHART_HEIGHT*0.66 + line
+
+	heading("Days")
+	columns := []struct {
+		title string
+		x     float64 // right edge
+	}{
+		{"Date", left}, {"Lden", left + 135}, {"Lday", left + 185}, {"Levening", left + 235},
+		{"Lnight", left + 285}, {"Max", left + 330}, {"Exc.", left + 365},
+		{"Temp. °C", left + 410}, {"Wind m/s", left + 455}, {"Rain mm", right},
+	}
+	header := func() {
+		d.text(left, y, 9, true, pdfBlack, columns[0].title)
+		for _, c := range columns[1:] {
+			d.textRight(c.x, y, 9, true, pdfBlack, c.title)
+		}
+		d.line(left, y+4, right, y+4, 0.5, pdfGrey)
+		y += line
+	}
+	header()
+	for _, day := range r.Days {
+		if y+line > bottom {
+			d.AddPage()
+			y = 60
+			header()
+		}
+		values := []string{
+			formatNullFloat(day.Lden, 1), formatNullFloat(day.Lday, 1), formatNullFloat(day.Levening, 1),
+			formatNullFloat(day.Lnight, 1), formatNullFloat(day.Max, 1), fmt.Sprintf("%d", day.Exceedances),
+			formatNullFloat(day.Temperature, 1), formatNullFloat(day.WindMax, 1), formatNullFloat(day.Precipitation, 1),
+		}
+		d.text(left, y, 9, false, pdfBlack, day.Date.Format("Mon 2006-01-02"))
+		for i, v := range values {
+			d.textRight(columns[i+1].x, y, 9, false, pdfBlack, v)
+		}
+		y += line
+	}
+
+	heading("Alerts sent")
+	if len(r.Alerts) == 0 {
+		d.text(left, y, 9, false, pdfGrey, "No alerts were sent.")
+	}
+	for _, a := range r.Alerts {
+		space(line)
+		d.text(left, y, 9, false, pdfBlack, a.Timestamp.Format("2006-01-02 15:04"))
+		d.text(left+85, y, 9, false, pdfBlack, a.Status)
+		// messages are SMS, short enough for a line
+		d.text(left+150, y, 9, false, pdfBlack, a.Message)
+		y += line
+	}
+
+	return d.Output(w)
+}
+
+// Draws the hourly chart with its top left corner at x, y.
+func (r *Report) pdfChart(d *pdfDocument, x, y, scale float64) {
+	c := r.Chart()
+	px := func(v float64) float64 { return x + v*scale }
+	py := func(v float64) float64 { return y + v*scale }
+	for _, g := range c.Grid {
+		d.line(px(c.Left), py(g.Y), px(c.Width-10), py(g.Y), 0.3, pdfGrey)
+		d.textRight(px(c.Left-5), py(g.Y)+3, 7, false, pdfGrey, g.Label)
+	}
+	for _, b := range c.Bars {
+		if b.Leq.Valid {
+			d.rect(px(b.X), py(b.Y), b.Width*scale, b.Height*scale, pdfColor{31, 135, 230})
+		}
+		if b.Hour%3 == 0 {
+			d.text(px(b.X), py(c.Bottom)+10, 7, false, pdfGrey, fmt.Sprintf("%02d", b.Hour))
+		}
+	}
+	if c.Threshold > 0 {
+		d.line(px(c.Left), py(c.Threshold), px(c.Width-10), py(c.Threshold), 1, pdfColor{230, 56, 54})
+	}
+}
@@ -0,0 +1,347 @@
+package mqttGather
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Scheduled reports (see report.go), configured with `report_schedule`:
+// once a period is complete (at 06:00 after its last day), a report of
+// the period is written to `report_dir` for every device that sent stats
+// during the period:
+//
+//	daily    report-2024-05-01-<device>.html    the previous day
+//	weekly   report-2024-W18-<device>.html      the previous week, Monday to Sunday
+//	monthly  report-2024-05-<device>.html       the previous month
+//
+// If `report_mail_to` is set, the reports of a period are mailed as
+// attachments of one message via `smtp_addr` before they are written.
+// Periods whose reports exist aren't generated again, so reports missed
+// while the gatherer wasn't running, or whose mail couldn't be sent, are
+// generated on the next check.
+
+const (
+	REPORT_DAILY   = "daily"
+	REPORT_WEEKLY  = "weekly"
+	REPORT_MONTHLY = "monthly"
+
+	// how often the job checks for completed periods
+	REPORT_CHECK_INTERVAL = 15 * time.Minute
+)
+
+var ReportSchedules = []string{REPORT_DAILY, REPORT_WEEKLY, REPORT_MONTHLY}
+
+// Periodically generates reports, see `NewReportJob`
+type ReportJob struct {
+	DB       func() DB // current database, the gatherer reopens it after errors
+	Schedule string
+	Dir      string
+	Format   string
+	Location *time.Location
+	Mail     *ReportMail // reports aren't mailed if nil
+	Interval time.Duration
+
+	stop    chan bool
+	stopped chan bool
+}
+
+// Sends reports via SMTP.
+type ReportMail struct {
+	Addr     string // host:port
+	User     string // no authentication if empty
+	Password string
+	From     string
+	To       []string
+
+	// smtp.SendMail, replaced in tests
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// A rendered report.
+type ReportFile struct {
+	Name string
+	Data []byte
+}
+
+// Creates the report job from the `report_*` and `smtp_*` configuration.
+func NewReportJob(cfg *RunConfig, db func() DB) (*ReportJob, error) {
+	loc, err := ReportLocation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	j := &ReportJob{
+		DB:       db,
+		Schedule: cfg.ReportSchedule,
+		Dir:      cfg.ReportDir,
+		Format:   cfg.ReportFormat,
+		Location: loc,
+		Mail:     NewReportMail(cfg),
+		Interval: REPORT_CHECK_INTERVAL,
+	}
+	if j.Format == "" {
+		j.Format = REPORT_HTML
+	}
+	if _, _, _, err := reportPeriod(j.Schedule, time.Now(), loc); err != nil {
+		return nil, err
+	}
+	if j.Dir == "" {
+		return nil, fmt.Errorf("report_schedule requires report_dir")
+	}
+	return j, nil
+}
+
+// Time zone of the reports, `report_timezone` or local time.
+func ReportLocation(cfg *RunConfig) (*time.Location, error) {
+	if cfg.ReportTimezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(cfg.ReportTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid report_timezone: %v", err)
+	}
+	return loc, nil
+}
+
+// Mail settings from the configuration, nil if `report_mail_to` isn't
+// set.
+func NewReportMail(cfg *RunConfig) *ReportMail {
+	var to []string
+	for _, addr := range strings.Split(cfg.ReportMailTo, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	return &ReportMail{
+		Addr:     cfg.SMTPAddr,
+		User:     cfg.SMTPUser,
+		Password: cfg.SMTPPassword,
+		From:     cfg.ReportMailFrom,
+		To:       to,
+		send:     smtp.SendMail,
+	}
+}
+
+// The last period of `schedule` completed at `now`: the dates of its
+// first and last (exclusive) day, see `ReportOptions`, and its label.
+func reportPeriod(schedule string, now time.Time, loc *time.Location) (from, to time.Time, label string, err error) {
+	// periods end at REPORT_DAY_START after their last day
+	y, m, d := now.In(loc).Add(-REPORT_DAY_START * time.Hour).Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	switch schedule {
+	case REPORT_DAILY:
+		from, to = today.AddDate(0, 0, -1), today
+		label = from.Format("2006-01-02")
+	case REPORT_WEEKLY:
+		monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+		from, to = monday.AddDate(0, 0, -7), monday
+		year, week := from.ISOWeek()
+		label = fmt.Sprintf("%d-W%02d", year, week)
+	case REPORT_MONTHLY:
+		to = time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		from = to.AddDate(0, -1, 0)
+		label = from.Format("2006-01")
+	default:
+		err = fmt.Errorf("unknown report_schedule: %s (expected one of %s)", schedule, strings.Join(ReportSchedules, ", "))
+	}
+	return
+}
+
+// Name of the report file of a device, signifiers are MAC addresses.
+func reportFilename(label, device, format string) string {
+	device = strings.Map(func(r rune) rune {
+		if r == ':' || r == '/' || r == '\\' {
+			return '-'
+		}
+		return r
+	}, device)
+	return fmt.Sprintf("report-%s-%s.%s", label, device, format)
+}
+
+// Generates (and mails) the reports of the last period completed at `now`
+// that haven't been written yet.
+func (j *ReportJob) Run(now time.Time) error {
+	log := logger("report")
+	from, to, label, err := reportPeriod(j.Schedule, now, j.Location)
+	if err != nil {
+		return err
+	}
+	opts := ReportOptions{From: from, To: to, Location: j.Location}
+	db := j.DB()
+	devices, err := db.LoadDevices()
+	if err != nil {
+		return err
+	}
+
+	var files []ReportFile
+	var firstErr error
+	for _, device := range devices {
+		if device.LastSeen < opts.dayStart(from).Unix() {
+			continue // no stats during the period
+		}
+		name := reportFilename(label, device.DeviceSignifier, j.Format)
+		if _, err := os.Stat(filepath.Join(j.Dir, name)); err == nil {
+			continue
+		}
+		opts.Device = device.DeviceSignifier
+		var buf bytes.Buffer
+		report, err := db.Report(&opts)
+		if err == nil {
+			err = report.Write(&buf, j.Format)
+		}
+		if err != nil {
+			log.Error("could not generate report", "device", device.DeviceSignifier, "period", label, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		files = append(files, ReportFile{name, buf.Bytes()})
+	}
+	if len(files) == 0 {
+		return firstErr
+	}
+
+	if j.Mail != nil {
+		subject := fmt.Sprintf("Noise reports %s", label)
+		body := fmt.Sprintf("Noise reports of %d device(s) for %s - %s (06:00 to 06:00, %s).\n",
+			len(files), from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02"), j.Location)
+		if err := j.Mail.Send(subject, body, files, now); err != nil {
+			// nothing is written, the reports are retried on the next check
+			metricReportsFailed.Inc()
+			return fmt.Errorf("could not mail reports: %v", err)
+		}
+		log.Info("mailed reports", "period", label, "count", len(files), "to", strings.Join(j.Mail.To, ","))
+	}
+
+	if err := os.MkdirAll(j.Dir, 0o755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		// written completely or not at all, existing files mark the
+		// report as done
+		fn := filepath.Join(j.Dir, f.Name)
+		err := os.WriteFile(fn+".tmp", f.Data, 0o644)
+		if err == nil {
+			err = os.Rename(fn+".tmp", fn)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		metricReportsGenerated.Inc()
+		log.Info("wrote report", "file", fn)
+	}
+	if firstErr != nil {
+		metricReportsFailed.Inc()
+	}
+	return firstErr
+}
+
+// Checks for completed periods immediately and then every `Interval`
+// until `Stop` is called.
+func (j *ReportJob) Start() {
+	j.stop = make(chan bool)
+	j.stopped = make(chan bool)
+	go func() {
+		defer close(j.stopped)
+		logger("report").Info("started report job", "schedule", j.Schedule, "dir", j.Dir)
+		ticker := time.NewTicker(j.Interval)
+		defer ticker.Stop()
+		for {
+			if err := j.Run(time.Now()); err != nil {
+				logger("report").Error("report job failed", "err", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the report job, waits for a running job to finish.
+func (j *ReportJob) Stop() {
+	if j.stop != nil {
+		close(j.stop)
+		<-j.stopped
+	}
+}
+
+// Sends the files as attachments of one message.
+func (m *ReportMail) Send(subject, body string, files []ReportFile, now time.Time) error {
+	msg, err := m.message(subject, body, files, now)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.User != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid smtp_addr: %v", err)
+		}
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+	return m.send(m.Addr, auth, m.From, m.To, msg)
+}
+
+// MIME multipart message with a text body and the files attached.
+func (m *ReportMail) message(subject, body string, files []ReportFile, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+
+	for _, f := range files {
+		contentType := mime.TypeByExtension(filepath.Ext(f.Name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": f.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(f.Data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,203 @@
+package mqttGather
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportPeriod(t *testing.T) {
+	at := func(month, day, hour int) time.Time {
+		return time.Date(2024, time.Month(month), day, hour, 0, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		schedule string
+		now      time.Time
+		from, to time.Time
+		label    string
+	}{
+		{REPORT_DAILY, at(5, 2, 7), at(5, 1, 0), at(5, 2, 0), "2024-05-01"},
+		// the previous day is complete at 06:00
+		{REPORT_DAILY, at(5, 2, 5), at(4, 30, 0), at(5, 1, 0), "2024-04-30"},
+		{REPORT_WEEKLY, at(5, 6, 7), at(4, 29, 0), at(5, 6, 0), "2024-W18"},
+		{REPORT_WEEKLY, at(5, 6, 5), at(4, 22, 0), at(4, 29, 0), "2024-W17"},
+		{REPORT_WEEKLY, at(5, 12, 23), at(4, 29, 0), at(5, 6, 0), "2024-W18"},
+		{REPORT_MONTHLY, at(5, 1, 7), at(4, 1, 0), at(5, 1, 0), "2024-04"},
+		{REPORT_MONTHLY, at(5, 1, 5), at(3, 1, 0), at(4, 1, 0), "2024-03"},
+	} {
+		from, to, label, err := reportPeriod(tt.schedule, tt.now, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !from.Equal(tt.from) || !to.Equal(tt.to) || label != tt.label {
+			t.Fatalf("%s period at %v is: %v - %v (%s) should: %v - %v (%s)",
+				tt.schedule, tt.now, from, to, label, tt.from, tt.to, tt.label)
+		}
+	}
+	if _, _, _, err := reportPeriod("yearly", time.Now(), time.UTC); err == nil {
+		t.Fatalf("expected error for unknown schedule")
+	}
+}
+
+func TestNewReportJob(t *testing.T) {
+	for _, cfg := range []RunConfig{
+		{ReportSchedule: "yearly", ReportDir: "reports"},
+		{ReportSchedule: REPORT_DAILY},
+		{ReportSchedule: REPORT_DAILY, ReportDir: "reports", ReportTimezone: "Europe/Nowhere"},
+	} {
+		if _, err := NewReportJob(&cfg, nil); err == nil {
+			t.Fatalf("expected error for %#v", cfg)
+		}
+	}
+	cfg := &RunConfig{ReportSchedule: REPORT_WEEKLY, ReportDir: "reports", ReportMailTo: "a@example.org, b@example.org", SMTPAddr: "localhost:25"}
+	j, err := NewReportJob(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Format != REPORT_HTML || j.Location != time.Local || j.Mail == nil || len(j.Mail.To) != 2 || j.Mail.To[1] != "b@example.org" {
+		t.Fatalf("unexpected job: %#v", j)
+	}
+}
+
+type sentMail struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+	msg  []byte
+}
+
+func TestReportJob(t *testing.T) {
+	db := getTestDBWithReport(t)
+	defer db.Close()
+	current := getTestDB(t) // closed, replaced by db before the first run
+
+	var sent []sentMail
+	var sendErr error
+	j := &ReportJob{
+		DB:       func() DB { return current },
+		Schedule: REPORT_DAILY,
+		Dir:      filepath.Join(t.TempDir(), "reports"),
+		Format:   REPORT_HTML,
+		Location: time.UTC,
+		Mail: &ReportMail{
+			Addr: "localhost:25",
+			From: "noise@example.org",
+			To:   []string{"ordnungsamt@example.org"},
+			send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+				if sendErr != nil {
+					return sendErr
+				}
+				sent = append(sent, sentMail{addr, a, from, to, msg})
+				return nil
+			},
+		},
+	}
+	now := testReportDay.AddDate(0, 0, 1).Add(7 * time.Hour)
+	fn := filepath.Join(j.Dir, reportFilename("2024-05-01", TEST_SIGNIFIER, REPORT_HTML))
+
+	// the job uses the current database, e.g. after the gatherer
+	// reopened it
+	current.Close()
+	current = db
+
+	// reports aren't written if they can't be mailed
+	sendErr = fmt.Errorf("connection refused")
+	if err := j.Run(now); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected mail error, got: %v", err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Fatalf("report written without mail: %v", err)
+	}
+
+	sendErr = nil
+	if err := j.Run(now); err != nil {
+		t.Fatal(err)
+	}
+	report, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "Noise report bla") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+	if len(sent) != 1 || sent[0].addr != "localhost:25" || sent[0].auth != nil || sent[0].to[0] != "ordnungsamt@example.org" {
+		t.Fatalf("unexpected mails: %#v", sent)
+	}
+
+	// the mail has the report attached
+	msg, err := mail.ReadMessage(strings.NewReader(string(sent[0].msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "Noise reports 2024-05-01" {
+		t.Fatalf("unexpected subject: %s", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected content type: %s %v", mediaType, err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(text); !strings.Contains(string(body), "1 device(s) for 2024-05-01") {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	attachment, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.FileName() != filepath.Base(fn) || !strings.HasPrefix(attachment.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected attachment: %v", attachment.Header)
+	}
+	// the reader decodes quoted-printable only
+	data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, attachment))
+	if err != nil || string(data) != string(report) {
+		t.Fatalf("attachment differs from report: %v", err)
+	}
+
+	// existing reports aren't generated again
+	if err := j.Run(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("report mailed again")
+	}
+
+	// no reports for devices without stats in the period
+	if err := j.Run(now.AddDate(0, 0, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(j.Dir); len(entries) != 1 || len(sent) != 1 {
+		t.Fatalf("unexpected reports: %v", entries)
+	}
+}
+
+func TestReportMailAuth(t *testing.T) {
+	var auth smtp.Auth
+	m := &ReportMail{
+		Addr: "mail.example.org:587", User: "noise", Password: "secret",
+		From: "noise@example.org", To: []string{"a@example.org"},
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			auth = a
+			return nil
+		},
+	}
+	if err := m.Send("subject", "body", nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if auth == nil {
+		t.Fatalf("expected authentication")
+	}
+}
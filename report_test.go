@@ -0,0 +1,262 @@
+package mqttGather
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLden(t *testing.T) {
+	// constant levels, Lden is dominated by the night penalty
+	if l := lden(60, 60, 60); math.Abs(l-66.395) > 0.001 {
+		t.Fatalf("incorrect Lden: %f", l)
+	}
+	if l := lden(60, 50, 40); math.Abs(l-57.679) > 0.001 {
+		t.Fatalf("incorrect Lden: %f", l)
+	}
+	for hour, period := range map[int]int{0: 2, 5: 2, 6: 0, 17: 0, 18: 1, 21: 1, 22: 2, 23: 2} {
+		if p := denPeriod(hour); p != period {
+			t.Fatalf("period of %d is: %d should: %d", hour, p, period)
+		}
+	}
+}
+
+func TestReportOptionsValidate(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, opts := range []ReportOptions{
+		{From: day, To: day.AddDate(0, 0, 1)},
+		{Device: TEST_SIGNIFIER, From: day, To: day},
+		{Device: TEST_SIGNIFIER, From: day, To: day.AddDate(0, 0, REPORT_MAX_DAYS+1)},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Fatalf("expected error for %#v", opts)
+		}
+	}
+	opts := ReportOptions{Device: TEST_SIGNIFIER, From: day, To: day.AddDate(0, 0, 1)}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var testReportDay = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// Test device near the Ulm weather station with an alert threshold of 65
+// dB and stats, weather and alerts on 2024-05-01 and 02.
+func getTestDBWithReport(t *testing.T) *SqliteDB {
+	db, id := getTestDBWithDeviceInfo(t)
+	f, err := os.Open("test_data/zehn_min_ff_Beschreibung_Stationen.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := importStations(db.db, f); err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(day, hour, minute int) int64 {
+		return testReportDay.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute).Unix()
+	}
+	for _, s := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{`UPDATE device_info SET latitude = 48.4, longitude = 10.0, alert_threshold = 65 WHERE device_id = :ID`, []interface{}{id}},
+		{FindDWDDataset("wind").createTable(), nil},
+		{FindDWDDataset("precipitation").createTable(), nil},
+		{FindDWDDataset("temperature").createTable(), nil},
+		// timestamps are the end of the interval: wind at 10:00 - 10:10
+		{`INSERT INTO wind (station, ts, wind_speed, direction) VALUES ('5404', :TS, 9.0, 270)`, []interface{}{at(0, 10, 10)}},
+		{`INSERT INTO temperature (station, ts, temp2m) VALUES ('5404', :TS1, 10), ('5404', :TS2, 14)`, []interface{}{at(0, 10, 10), at(0, 19, 10)}},
+		{`INSERT INTO precipitation (station, ts, sum_10) VALUES ('5404', :TS, 0.5)`, []interface{}{at(1, 7, 10)}},
+		{`INSERT INTO alert (device_id, ts, alert_phone, message, status) VALUES (:ID, :TS, '+49123', 'too loud', 'sent')`, []interface{}{id, at(0, 23, 5)}},
+		{`INSERT INTO alert (device_id, ts, alert_phone, message, status) VALUES (:ID, :TS, '+49123', 'still too loud', 'sent')`, []interface{}{id, at(0, 10, 5)}},
+		{`INSERT INTO alert (device_id, ts, alert_phone, message, status) VALUES (:ID, :TS, '+49123', 'later', 'sent')`, []interface{}{id, at(3, 10, 5)}},
+	} {
+		if _, err := db.db.Exec(s.sql, s.args...); err != nil {
+			t.Fatal(s.sql, err)
+		}
+	}
+
+	for _, row := range []struct {
+		day, hour int
+		avg, max  float64
+	}{
+		{0, 10, 60, 70}, // exceeds, windy
+		{0, 19, 50, 55},
+		{0, 23, 40, 66}, // exceeds, night of 2024-05-01
+		{1, 3, 40, 50},  // night of 2024-05-01
+		{1, 7, 70, 80},  // exceeds, rainy
+		{2, 7, 90, 95},  // after the report
+	} {
+		stats := DBAStats{Signifier: TEST_SIGNIFIER, Min: row.avg - 5, Max: row.max, Average: row.avg, Num: 1}
+		if _, err := db.Save(&stats, time.Unix(at(row.day, row.hour, 0), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func getTestReport(t *testing.T) *Report {
+	db := getTestDBWithReport(t)
+	defer db.Close()
+	r, err := db.Report(&ReportOptions{Device: TEST_SIGNIFIER, From: testReportDay, To: testReportDay.AddDate(0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReport(t *testing.T) {
+	r := getTestReport(t)
+
+	if r.Device.Description != "bla" || r.Threshold != 65 || len(r.Days) != 2 {
+		t.Fatalf("unexpected report: %#v", r)
+	}
+	if !r.From.Equal(testReportDay.Add(6*time.Hour)) || !r.To.Equal(testReportDay.AddDate(0, 0, 2).Add(6*time.Hour)) {
+		t.Fatalf("unexpected period: %v - %v", r.From, r.To)
+	}
+	first, second := r.Days[0], r.Days[1]
+	if first.Lday.Float64 != 60 || first.Levening.Float64 != 50 || first.Lnight.Float64 != 40 || first.Max.Float64 != 70 {
+		t.Fatalf("unexpected levels: %#v", first.ReportLevels)
+	}
+	if math.Abs(first.Lden.Float64-57.679) > 0.001 {
+		t.Fatalf("unexpected Lden: %#v", first.Lden)
+	}
+	// no evening and night data, Lden can't be calculated
+	if second.Lday.Float64 != 70 || second.Levening.Valid || second.Lden.Valid {
+		t.Fatalf("unexpected levels: %#v", second.ReportLevels)
+	}
+	// energy average of the hourly levels 60 and 70
+	if math.Abs(r.Total.Lday.Float64-67.4036) > 0.001 || r.Total.Max.Float64 != 80 {
+		t.Fatalf("unexpected total: %#v", r.Total)
+	}
+	if r.Hours[10].Leq.Float64 != 60 || r.Hours[7].Leq.Float64 != 70 || r.Hours[12].Leq.Valid {
+		t.Fatalf("unexpected hourly profile: %#v", r.Hours)
+	}
+
+	if first.Exceedances != 2 || second.Exceedances != 1 || r.Total.Exceedances != 3 {
+		t.Fatalf("unexpected exceedances: %d %d %d", first.Exceedances, second.Exceedances, r.Total.Exceedances)
+	}
+	if first.WeatherExceedances != 1 || second.WeatherExceedances != 1 || r.Total.WeatherExceedances != 2 {
+		t.Fatalf("unexpected weather exceedances: %#v", r.Total)
+	}
+
+	if r.Station != "5404" || r.StationDistance > REPORT_MAX_STATION_DISTANCE {
+		t.Fatalf("unexpected station: %s %f", r.Station, r.StationDistance)
+	}
+	if first.Temperature.Float64 != 12 || first.WindMax.Float64 != 9 || first.Precipitation.Valid {
+		t.Fatalf("unexpected weather: %#v", first)
+	}
+	if second.Precipitation.Float64 != 0.5 || second.Temperature.Valid {
+		t.Fatalf("unexpected weather: %#v", second)
+	}
+
+	if len(r.Alerts) != 2 || r.Alerts[0].Message != "still too loud" || r.Alerts[1].Message != "too loud" {
+		t.Fatalf("unexpected alerts: %#v", r.Alerts)
+	}
+}
+
+func TestReportWithoutDeviceInfo(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+	stats := DBAStats{Signifier: TEST_SIGNIFIER, Min: 40, Max: 90, Average: 50, Num: 1}
+	if _, err := db.Save(&stats, testReportDay.Add(12*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := db.Report(&ReportOptions{Device: TEST_SIGNIFIER, From: testReportDay, To: testReportDay.AddDate(0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Device.Description != "" || r.Threshold != 0 || r.Total.Exceedances != 0 || r.Station != "" || r.Total.Lday.Float64 != 50 {
+		t.Fatalf("unexpected report: %#v", r)
+	}
+}
+
+func TestReportTimezone(t *testing.T) {
+	db := getTestDBWithReport(t)
+	defer db.Close()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, loc)
+	r, err := db.Report(&ReportOptions{Device: TEST_SIGNIFIER, From: day, To: day.AddDate(0, 0, 1), Location: loc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10:00 UTC is 12:00 CEST, 23:00 UTC is night
+	if r.Hours[12].Leq.Float64 != 60 || r.Hours[10].Leq.Valid || r.Days[0].Lnight.Float64 != 40 {
+		t.Fatalf("unexpected hours: %#v", r.Hours)
+	}
+}
+
+func TestReportRender(t *testing.T) {
+	r := getTestReport(t)
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf, REPORT_HTML); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, expected := range []string{
+		"<title>Noise report bla 2024-05-01 – 2024-05-02</title>",
+		"<th>Lden</th><td>64.5 dB(A)",    // of the period
+		"3 above 65.0 dB(A)",             // exceedances
+		"DWD 5404",                       // weather station
+		`<rect class="bar"`,              // hourly chart
+		`<line class="threshold"`,        // threshold in the chart
+		"Wed 2024-05-01",                 // days
+		"<td class=\"message\">too loud", // alerts
+	} {
+		if !strings.Contains(html, expected) {
+			t.Fatalf("missing %q in:\n%s", expected, html)
+		}
+	}
+	if strings.Contains(html, "+49123") || strings.Contains(html, "<script") || strings.Contains(html, "http") {
+		t.Fatalf("report not self-contained or containing phone numbers:\n%s", html)
+	}
+
+	buf.Reset()
+	if err := r.Write(&buf, REPORT_PDF); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")) || !bytes.HasSuffix(bytes.TrimSpace(buf.Bytes()), []byte("%%EOF")) {
+		t.Fatalf("unexpected pdf:\n%s", buf.String())
+	}
+	content := pdfContent(t, buf.Bytes())
+	for _, expected := range []string{
+		"(Noise report bla) Tj",
+		"(Wed 2024-05-01) Tj",
+		"(Temp. \260C) Tj", // cp1252
+		"(too loud) Tj",
+	} {
+		if !strings.Contains(content, expected) {
+			t.Fatalf("missing %q in:\n%s", expected, content)
+		}
+	}
+
+	if err := r.Write(&buf, "docx"); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+}
+
+// Inflated content streams of a PDF.
+func pdfContent(t *testing.T, pdf []byte) string {
+	var content strings.Builder
+	for _, m := range regexp.MustCompile(`(?s)/Filter /FlateDecode /Length \d+>>\nstream\n(.*?)\nendstream`).FindAllSubmatch(pdf, -1) {
+		r, err := zlib.NewReader(bytes.NewReader(m[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(&content, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return content.String()
+}
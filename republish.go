@@ -0,0 +1,254 @@
+package mqttGather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Republishes parsed noise stats, telemetry and alert states as JSON to
+// the broker, for consumers that don't want to parse the devices' CSV
+// payloads (dashboards, Node-RED, display boards). Below the configured
+// prefix (`republish_prefix`, e.g. `opennoise/json`) these topics are
+// used per device:
+//
+//	<prefix>/<device>/stats             each stats message
+//	<prefix>/<device>/stats/last        the latest stats, retained
+//	<prefix>/<device>/telemetry         each telemetry message
+//	<prefix>/<device>/telemetry/<type>  the latest telemetry of a type, retained
+//	<prefix>/<device>/alert             the alert state, retained, published on change
+//
+// Payloads include the device's description and location if there is
+// device info, e.g.:
+//
+//	{"device":"c4:dd:57:66:95:60","description":"Brüsseler Platz","latitude":50.93,
+//	 "longitude":6.93,"timestamp":"2021-10-31T12:00:00Z","min":52.683,"max":57.619,
+//	 "average":55.152,"average_var":0.595,"mean":55.272,"num":86}
+//
+// Alert states are "ok", "exceeded" (threshold exceeded, no alert sent)
+// and "alert" (alert sent within the dead time), see alerter.go. The
+// alerter evaluates them without an `sms_key` as well, but not with
+// `sink_only`, as it needs the saved stats.
+//
+// Messages are published by the gatherer's MQTT connection in the
+// background. Messages still queued when the gatherer shuts down are
+// dropped, as the connection is closed by then (see shutdown.go).
+
+const REPUBLISH_QUEUE_SIZE = 1000
+
+type Republisher struct {
+	Prefix string
+
+	*publishQueue
+	mu          sync.Mutex
+	alertStates map[string]string // last published alert state per device
+}
+
+// Function publishing a message, see `Mqtt.publish`.
+type publishFunc func(topic string, qos byte, retained bool, payload []byte) error
+
+// Publishes messages in the background for sinks publishing to the broker.
+type publishQueue struct {
+	name    string // of the sink, for logs and metrics
+	qos     byte
+	publish publishFunc
+	queue   chan republishedMessage
+	stop    chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+}
+
+type republishedMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+func newPublishQueue(name string, qos byte, publish publishFunc) *publishQueue {
+	q := &publishQueue{
+		name:    name,
+		qos:     qos,
+		publish: publish,
+		queue:   make(chan republishedMessage, REPUBLISH_QUEUE_SIZE),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// JSON payloads, stats are parsed with 32 bit precision (see
+// DBAStatsFromString) and published as such.
+type RepublishedStats struct {
+	ExportDevice
+	Timestamp  time.Time `json:"timestamp"`
+	Min        float32   `json:"min"`
+	Max        float32   `json:"max"`
+	Average    float32   `json:"average"`
+	AverageVar float32   `json:"average_var"`
+	Mean       float32   `json:"mean"`
+	Num        int       `json:"num"`
+}
+
+type RepublishedTelemetry struct {
+	ExportDevice
+	Timestamp time.Time   `json:"timestamp"`
+	Type      string      `json:"type"`
+	Name      string      `json:"name"` // description of the type
+	Value     interface{} `json:"value"`
+}
+
+type RepublishedAlertState struct {
+	ExportDevice
+	Timestamp time.Time `json:"timestamp"`
+	State     string    `json:"state"`
+	Max       float32   `json:"max"`
+	Threshold float32   `json:"threshold"`
+}
+
+// Creates a republisher as configured publishing with `publish` (see
+// `Mqtt.publish`) and starts it.
+func NewRepublisher(cfg *RunConfig, publish publishFunc) *Republisher {
+	return &Republisher{
+		Prefix:       strings.TrimSuffix(cfg.RepublishPrefix, "/"),
+		publishQueue: newPublishQueue("republish", cfg.RepublishQoS, publish),
+		alertStates:  make(map[string]string),
+	}
+}
+
+func (r *Republisher) Name() string { return r.name }
+
+func (r *Republisher) WriteStats(stats *DBAStats, t time.Time, info *DeviceInfo) {
+	payload, _ := json.Marshal(newRepublishedStats(stats, t, info))
+	topic := r.topic(stats.Signifier, "stats")
+	r.enqueue(topic, false, payload)
+	r.enqueue(topic+"/last", true, payload)
+}
+
+func (r *Republisher) WriteTelemetry(telemetry *Telemetry, t time.Time, info *DeviceInfo) {
+	payload, _ := json.Marshal(newRepublishedTelemetry(telemetry, t, info))
+	topic := r.topic(telemetry.Client, "telemetry")
+	r.enqueue(topic, false, payload)
+	r.enqueue(topic+"/"+string(telemetry.Type), true, payload)
+}
+
+// Publishes the alert state if it changed.
+func (r *Republisher) WriteAlertState(state AlertState) {
+	r.mu.Lock()
+	changed := r.alertStates[state.Device] != state.State
+	r.alertStates[state.Device] = state.State
+	r.mu.Unlock()
+	if !changed {
+		return
+	}
+	payload, _ := json.Marshal(newRepublishedAlertState(state))
+	r.enqueue(r.topic(state.Device, "alert"), true, payload)
+}
+
+func (r *Republisher) topic(device, kind string) string {
+	return fmt.Sprintf("%s/%s/%s", r.Prefix, device, kind)
+}
+
+// Stops publishing, queued messages are dropped.
+func (q *publishQueue) Close(ctx context.Context) error {
+	q.stopped.Do(func() { close(q.stop) })
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Queues a message without blocking, it is dropped if the queue is full.
+func (q *publishQueue) enqueue(topic string, retained bool, payload []byte) {
+	select {
+	case q.queue <- republishedMessage{topic, retained, payload}:
+	default:
+		metricSinkDropped.Inc(q.name)
+	}
+}
+
+func (q *publishQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case msg := <-q.queue:
+			if err := q.publish(msg.topic, q.qos, msg.retained, msg.payload); err != nil {
+				logger("sink").Warn("could not publish", "sink", q.name, "topic", msg.topic, "err", err)
+				metricSinkFailed.Inc(q.name)
+			} else {
+				metricSinkWritten.Inc(q.name)
+			}
+		case <-q.stop:
+			metricSinkDropped.Add(float64(len(q.queue)), q.name)
+			return
+		}
+	}
+}
+
+func newRepublishedStats(stats *DBAStats, t time.Time, info *DeviceInfo) RepublishedStats {
+	return RepublishedStats{
+		ExportDevice: republishedDevice(stats.Signifier, info),
+		Timestamp:    t.UTC(),
+		Min:          float32(stats.Min),
+		Max:          float32(stats.Max),
+		Average:      float32(stats.Average),
+		AverageVar:   float32(stats.AverageVar),
+		Mean:         float32(stats.Mean),
+		Num:          stats.Num,
+	}
+}
+
+func newRepublishedTelemetry(telemetry *Telemetry, t time.Time, info *DeviceInfo) RepublishedTelemetry {
+	return RepublishedTelemetry{
+		ExportDevice: republishedDevice(telemetry.Client, info),
+		Timestamp:    t.UTC(),
+		Type:         string(telemetry.Type),
+		Name:         telemetry.Type.String(),
+		Value:        telemetry.Data,
+	}
+}
+
+func newRepublishedAlertState(state AlertState) RepublishedAlertState {
+	return RepublishedAlertState{
+		ExportDevice: republishedDevice(state.Device, state.Info),
+		Timestamp:    state.Timestamp.UTC(),
+		State:        state.State,
+		Max:          float32(state.Max),
+		Threshold:    float32(state.Threshold),
+	}
+}
+
+func republishedDevice(signifier string, info *DeviceInfo) ExportDevice {
+	d := ExportDevice{Device: signifier}
+	if info != nil {
+		d.Description = info.Description
+		d.Latitude = &info.Latitude
+		d.Longitude = &info.Longitude
+	}
+	return d
+}
+
+// Checks the republish prefix is a valid topic that isn't matched by the
+// subscriptions, which would lead to republishing republished messages.
+func validRepublishPrefix(prefix string, subscriptions ...string) error {
+	if strings.ContainsAny(prefix, "+#") || strings.HasPrefix(prefix, "$") {
+		return fmt.Errorf("%s (wildcards and $ topics not allowed)", prefix)
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	for _, filter := range subscriptions {
+		if filter == "" {
+			continue
+		}
+		for _, kind := range []string{"stats", "stats/last", "telemetry", "telemetry/esp", "alert"} {
+			if topic := prefix + "/<device>/" + kind; topicMatches(filter, topic) {
+				return fmt.Errorf("%s is subscribed to (%s)", topic, filter)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package mqttGather
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRepublisherAlertState(t *testing.T) {
+	published := make(chan republishedMessage, 10)
+	r := NewRepublisher(&RunConfig{RepublishPrefix: "opennoise/json/"}, func(topic string, qos byte, retained bool, payload []byte) error {
+		published <- republishedMessage{topic, retained, payload}
+		return nil
+	})
+	defer r.Close(context.Background())
+
+	for _, state := range []string{ALERT_STATE_OK, ALERT_STATE_OK, ALERT_STATE_EXCEEDED, ALERT_STATE_ALERT, ALERT_STATE_ALERT} {
+		r.WriteAlertState(AlertState{Device: TEST_SIGNIFIER, State: state, Max: 102.5, Threshold: 100, Timestamp: time.Now()})
+	}
+	for _, should := range []string{ALERT_STATE_OK, ALERT_STATE_EXCEEDED, ALERT_STATE_ALERT} {
+		select {
+		case msg := <-published:
+			var state RepublishedAlertState
+			if err := json.Unmarshal(msg.payload, &state); err != nil {
+				t.Fatal(err)
+			}
+			if msg.topic != "opennoise/json/"+TEST_SIGNIFIER+"/alert" || !msg.retained || state.State != should || state.Max != 102.5 {
+				t.Fatalf("unexpected message: %s %s", msg.topic, msg.payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not published", should)
+		}
+	}
+	select {
+	case msg := <-published:
+		t.Fatalf("unchanged state published: %s", msg.payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestValidRepublishPrefix(t *testing.T) {
+	for _, test := range []struct {
+		prefix string
+		valid  bool
+	}{
+		{"opennoise/json", true},
+		{"/opennoise/json", true},
+		{"opennoise/+", false},
+		{"$SYS/json", false},
+		{"/opennoise", false}, // republished telemetry would match /opennoise/+/telemetry
+	} {
+		err := validRepublishPrefix(test.prefix, "/opennoise/+/dba_stats", "/opennoise/+/telemetry")
+		if (err == nil) != test.valid {
+			t.Fatalf("%s: unexpected result: %v", test.prefix, err)
+		}
+	}
+}
+
+func TestIntegrationRepublish(t *testing.T) {
+	b := startTestBroker(t)
+	mqtt := connectTestGatherer(t, b, func(cfg *RunConfig) {
+		cfg.RepublishPrefix = "opennoise/json"
+		cfg.RepublishQoS = 1
+	})
+	insertTestDeviceInfo(t, mqtt.DB().(*SqliteDB))
+	consumer := testClient(t, b, "consumer", nil)
+	defer consumer.Disconnect(100)
+	msgs := testSubscribe(t, consumer, "opennoise/json/#", 1)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/telemetry", 1, false, "esp:139248").Wait()
+
+	// stats, stats/last, telemetry, telemetry/esp and alert
+	published := receiveRepublished(t, msgs, 5)
+	var stats map[string]interface{}
+	if err := json.Unmarshal([]byte(published["stats"]), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["device"] != TEST_SIGNIFIER || stats["description"] != "bla" || stats["latitude"] != 1.0 {
+		t.Fatalf("unexpected stats: %s", published["stats"])
+	}
+	if !strings.Contains(published["stats"], `"min":52.683,"max":57.619,"average":55.152,"average_var":0.595,"mean":55.272,"num":86`) {
+		t.Fatalf("unexpected stats: %s", published["stats"])
+	}
+	if !strings.Contains(published["telemetry"], `"type":"esp","name":"ESP free heap","value":139248`) {
+		t.Fatalf("unexpected telemetry: %s", published["telemetry"])
+	}
+	if !strings.Contains(published["alert"], `"state":"ok"`) {
+		t.Fatalf("unexpected alert state: %s", published["alert"])
+	}
+
+	// retained messages are delivered to later subscribers
+	later := testClient(t, b, "later", nil)
+	defer later.Disconnect(100)
+	retained := testSubscribe(t, later, "opennoise/json/#", 1)
+	topics := receiveRepublished(t, retained, 3)
+	for topic := range topics {
+		if topic != "stats/last" && topic != "telemetry/esp" && topic != "alert" {
+			t.Fatalf("unexpected retained message: %s", topic)
+		}
+	}
+	if topics["stats/last"] != published["stats"] || topics["telemetry/esp"] != published["telemetry"] {
+		t.Fatalf("unexpected retained messages: %v", topics)
+	}
+}
+
+// Receives `n` republished messages, by topic below the device.
+func receiveRepublished(t *testing.T, msgs <-chan MQTT.Message, n int) map[string]string {
+	topics := map[string]string{}
+	for len(topics) < n {
+		select {
+		case msg := <-msgs:
+			topics[strings.TrimPrefix(msg.Topic(), "opennoise/json/"+TEST_SIGNIFIER+"/")] = string(msg.Payload())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("republished messages missing: %v", topics)
+		}
+	}
+	return topics
+}
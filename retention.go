@@ -0,0 +1,420 @@
+package mqttGather
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file contains functionality to limit the growth of the database:
+// - rows older than the retention period configured per table are deleted
+//   periodically
+// - optionally, expired rows are written to compressed, per month archive
+//   files (JSON lines, gzip) along with their deletion
+// - archives can be re-imported into a (scratch) database for investigations.
+//
+// Tables without a configured retention period are kept forever. Note that
+// `RebuildRollups` recalculates rollups from the raw data, so it must not be
+// used for periods in which raw data has already expired.
+
+// Tables retention may be configured for, all of them have a `ts` column.
+var RetentionTables = []string{
+	"dba_stats",
+	"dba_stats_1m",
+	"dba_stats_10m",
+	"dba_stats_1h",
+	"dba_stats_1d",
+	"tele_mem",
+	"tele_ver",
+	"tele_misc",
+	"alert",
+}
+
+// How often the retention job runs.
+const RETENTION_INTERVAL = time.Hour
+
+func isRetentionTable(table string) bool {
+	for _, t := range RetentionTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Periodically removes expired rows, see `NewRetention`
+type Retention struct {
+	DB         func() DB                // current database, the gatherer reopens it after errors
+	MaxAge     map[string]time.Duration // per table
+	ArchiveDir string                   // no archives are written if empty
+	Interval   time.Duration
+
+	stop    chan bool
+	stopped chan bool
+}
+
+// Creates a retention job from the `retention_days` and `archive_dir`
+// configuration. Returns an error for tables retention can't be configured
+// for.
+func NewRetention(cfg *RunConfig, db func() DB) (*Retention, error) {
+	r := &Retention{
+		DB:         db,
+		MaxAge:     make(map[string]time.Duration),
+		ArchiveDir: cfg.ArchiveDir,
+		Interval:   RETENTION_INTERVAL,
+	}
+	for table, days := range cfg.RetentionDays {
+		if !isRetentionTable(table) {
+			return nil, fmt.Errorf("retention not supported for table: %s", table)
+		}
+		if days <= 0 {
+			return nil, fmt.Errorf("invalid retention for %s: %d days", table, days)
+		}
+		r.MaxAge[table] = time.Duration(days) * 24 * time.Hour
+	}
+	return r, nil
+}
+
+// Remove (and archive) all expired rows once.
+func (r *Retention) Run() error {
+	tables := make([]string, 0, len(r.MaxAge))
+	for table := range r.MaxAge {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	db := r.DB()
+	var firstErr error
+	for _, table := range tables {
+		before := time.Now().Add(-r.MaxAge[table])
+		cnt, err := db.Expire(table, before, r.ArchiveDir)
+		if err != nil {
+			logger("retention").Error("could not expire", "table", table, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if cnt > 0 {
+			logger("retention").Info("expired rows", "table", table, "count", cnt, "before", before.Format(time.RFC3339))
+		}
+	}
+	return firstErr
+}
+
+// Run the retention job immediately and then every `Interval` until
+// `Stop` is called.
+func (r *Retention) Start() {
+	r.stop = make(chan bool)
+	r.stopped = make(chan bool)
+	go func() {
+		defer close(r.stopped)
+		logger("retention").Info("started retention")
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			r.Run()
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the retention job, waits for a running job to finish.
+func (r *Retention) Stop() {
+	if r.stop != nil {
+		close(r.stop)
+		<-r.stopped
+	}
+}
+
+// Name of the archive file for `table` and the month of `t`
+func archiveFilename(dir, table string, t time.Time) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl.gz", table, t.UTC().Format("2006-01")))
+}
+
+// Start of the month after `t`, rows are expired and archived one month
+// at a time.
+func nextMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Deletes the rows of `table` with a timestamp before `before`. Rows are
+// deleted one month per transaction, so expiring a large backlog doesn't
+// lock the database for long. If `archiveDir` is not empty, the rows of a
+// month are appended to a temporary copy of the monthly archive in that
+// directory, which replaces the archive once the rows are deleted: an
+// archive never contains rows that weren't expired. Rows are archived
+// along with their `device_signifier` so they can be imported into a
+// different database.
+// Returns the number of deleted rows.
+func (s *SqliteDB) Expire(table string, before time.Time, archiveDir string) (int64, error) {
+	if !isRetentionTable(table) {
+		return 0, fmt.Errorf("retention not supported for table: %s", table)
+	}
+
+	var count int64
+	for {
+		var first sql.NullInt64
+		sql := fmt.Sprintf("SELECT MIN(ts) FROM %s WHERE ts < :BEFORE", table)
+		if err := s.db.QueryRow(sql, before.Unix()).Scan(&first); err != nil {
+			return count, err
+		}
+		if !first.Valid {
+			return count, nil
+		}
+		end := nextMonth(time.Unix(first.Int64, 0))
+		if end.After(before) {
+			end = before
+		}
+		cnt, err := s.expireBatch(table, end, archiveDir)
+		count += cnt
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+// Expires the rows before `before`, all of them are in the same month.
+func (s *SqliteDB) expireBatch(table string, before time.Time, archiveDir string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var tmp string
+	if archiveDir != "" {
+		if tmp, err = archiveRows(tx, table, before, archiveDir); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	result, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE ts < :BEFORE", table), before.Unix())
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		return 0, err
+	}
+	count, _ := result.RowsAffected()
+	if tmp != "" {
+		if err := os.Rename(tmp, strings.TrimSuffix(tmp, ".tmp")); err != nil {
+			return count, fmt.Errorf("expired rows are archived in %s: %v", tmp, err)
+		}
+	}
+	return count, nil
+}
+
+// Writes the rows before `before` to a temporary copy of their monthly
+// archive with the rows appended as a new gzip member, which gzip readers
+// handle transparently. Returns the name of the temporary file, empty if
+// there are no rows.
+func archiveRows(tx *sql.Tx, table string, before time.Time, archiveDir string) (tmp string, err error) {
+	sql := fmt.Sprintf(`
+SELECT
+	d.device_signifier,
+	t.*
+FROM
+	%s t
+LEFT JOIN
+	device d
+ON
+	t.device_id = d.device_id
+WHERE
+	t.ts < :BEFORE
+ORDER BY
+	t.ts
+`, table)
+	rows, err := tx.Query(sql, before.Unix())
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	var file *os.File
+	var gz *gzip.Writer
+	var enc *json.Encoder
+	defer func() {
+		if file == nil {
+			return
+		}
+		if gzErr := gz.Close(); err == nil {
+			err = gzErr
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			tmp = ""
+		}
+	}()
+
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return tmp, err
+		}
+		record := make(map[string]interface{})
+		var ts int64
+		for i, col := range columns {
+			v := values[i]
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			if col == "ts" {
+				ts, _ = v.(int64)
+			}
+			record[col] = v
+		}
+		if file == nil {
+			fn := archiveFilename(archiveDir, table, time.Unix(ts, 0))
+			if file, err = copyArchive(fn, fn+".tmp"); err != nil {
+				return "", err
+			}
+			tmp = fn + ".tmp"
+			gz = gzip.NewWriter(file)
+			enc = json.NewEncoder(gz)
+		}
+		if err := enc.Encode(record); err != nil {
+			return tmp, err
+		}
+	}
+	return tmp, rows.Err()
+}
+
+// Creates `tmp` with the content of the archive `fn`, if it exists, and
+// returns it for appending.
+func copyArchive(fn, tmp string) (*os.File, error) {
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return file, nil
+	} else if err == nil {
+		defer archive.Close()
+		_, err = io.Copy(file, archive)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return file, nil
+}
+
+// Determine the table an archive file belongs to from its name, e.g.
+// `tele_mem-2021-10.jsonl.gz`
+func archiveTable(fn string) (string, error) {
+	base := filepath.Base(fn)
+	if !strings.HasSuffix(base, ".jsonl.gz") || len(base) < len("-2006-01.jsonl.gz")+1 {
+		return "", fmt.Errorf("not an archive file: %s", fn)
+	}
+	table := base[:len(base)-len("-2006-01.jsonl.gz")]
+	if !isRetentionTable(table) {
+		return "", fmt.Errorf("unknown table in archive name: %s", fn)
+	}
+	return table, nil
+}
+
+// Imports the archive file `fn` (see `Expire`) into the database. Devices
+// are mapped via their signifier, rows already present are skipped. Returns
+// the number of imported rows.
+// Rollups are not updated, use `RebuildRollups` after importing `dba_stats`.
+func (s *SqliteDB) ImportArchive(fn string) (int64, error) {
+	table, err := archiveTable(fn)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	columns, err := s.tableColumns(table)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	dec := json.NewDecoder(gz)
+	for {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return count, err
+		}
+
+		if signifier, ok := record["device_signifier"].(string); ok {
+			device_id, err := s.lookupDevice(signifier)
+			if err != nil {
+				return count, err
+			}
+			record["device_id"] = device_id
+		}
+
+		var cols, params []string
+		var values []interface{}
+		for _, col := range columns {
+			if v, ok := record[col]; ok {
+				cols = append(cols, col)
+				params = append(params, "?")
+				values = append(values, v)
+			}
+		}
+		sql := fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) VALUES (%s)",
+			table, strings.Join(cols, ", "), strings.Join(params, ", "))
+		result, err := s.db.Exec(sql, values...)
+		if err != nil {
+			return count, err
+		}
+		n, _ := result.RowsAffected()
+		count += n
+	}
+	return count, nil
+}
+
+func (s *SqliteDB) tableColumns(table string) ([]string, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 0", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
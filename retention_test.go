@@ -0,0 +1,199 @@
+package mqttGather
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewRetention(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	cfg := RunConfig{RetentionDays: map[string]int{"dba_stats": 90, "tele_mem": 30}}
+	r, err := NewRetention(&cfg, func() DB { return db })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MaxAge["dba_stats"] != 90*24*time.Hour {
+		t.Fatalf("incorrect max age: %v", r.MaxAge)
+	}
+
+	cfg.RetentionDays["device"] = 1
+	if _, err := NewRetention(&cfg, func() DB { return db }); err == nil {
+		t.Fatalf("expected error for unsupported table")
+	}
+}
+
+func TestRetentionCurrentDB(t *testing.T) {
+	old := getTestDB(t)
+	current := old
+	cfg := RunConfig{RetentionDays: map[string]int{"dba_stats": 90}}
+	r, err := NewRetention(&cfg, func() DB { return current })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the gatherer replaced the database, e.g. after a failed save
+	old.Close()
+	current = getTestDB(t)
+	defer current.Close()
+	if err := r.Run(); err != nil {
+		t.Fatalf("retention used the closed database: %v", err)
+	}
+}
+
+func TestArchiveTable(t *testing.T) {
+	if table, err := archiveTable("/tmp/tele_mem-2021-10.jsonl.gz"); err != nil || table != "tele_mem" {
+		t.Fatalf("incorrect table: %s (%v)", table, err)
+	}
+	for _, fn := range []string{"device-2021-10.jsonl.gz", "dba_stats-2021-10.csv", ".jsonl.gz"} {
+		if _, err := archiveTable(fn); err == nil {
+			t.Fatalf("expected error for: %s", fn)
+		}
+	}
+}
+
+func TestExpireAndImportArchive(t *testing.T) {
+	db, id := getTestDBWithDevice(t)
+	defer db.Close()
+
+	sept := time.Date(2021, 9, 30, 12, 0, 0, 0, time.UTC)
+	oct := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	now := time.Now()
+	for _, ts := range []time.Time{sept, oct, oct.Add(time.Hour), now} {
+		stats := RandomDBAStats()
+		stats.Signifier = TEST_SIGNIFIER
+		if _, err := db.Save(&stats, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	cnt, err := db.Expire("dba_stats", oct.Add(2*time.Hour), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 3 {
+		t.Fatalf("expected 3 expired rows, got %d", cnt)
+	}
+
+	var remaining int64
+	if err := db.db.QueryRow("SELECT count(*) FROM dba_stats WHERE device_id = :ID", id).Scan(&remaining); err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 1 {
+		t.Fatalf("expected 1 remaining row, got %d", remaining)
+	}
+
+	// rollups are kept
+	if err := db.db.QueryRow("SELECT count(*) FROM dba_stats_1d").Scan(&remaining); err != nil || remaining != 3 {
+		t.Fatalf("rollups modified: %d (%v)", remaining, err)
+	}
+
+	septFn := filepath.Join(dir, "dba_stats-2021-09.jsonl.gz")
+	octFn := filepath.Join(dir, "dba_stats-2021-10.jsonl.gz")
+	for _, fn := range []string{septFn, octFn} {
+		if _, err := os.Stat(fn); err != nil {
+			t.Fatalf("missing archive: %v", err)
+		}
+	}
+
+	// scratch db, create a different device first so ids differ.
+	scratch := getTestDB(t)
+	defer scratch.Close()
+	if _, err := scratch.lookupDevice("00:00:00:00:00:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	for fn, should := range map[string]int64{septFn: 1, octFn: 2} {
+		cnt, err := scratch.ImportArchive(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cnt != should {
+			t.Fatalf("%s: imported %d rows, should %d", fn, cnt, should)
+		}
+	}
+	// idempotent
+	if cnt, err := scratch.ImportArchive(octFn); err != nil || cnt != 0 {
+		t.Fatalf("reimport: %d (%v)", cnt, err)
+	}
+
+	stats, err := scratch.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_RAW, sept, oct.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	should := RandomDBAStats()
+	if len(stats) != 3 || stats[0].Timestamp.Unix() != sept.Unix() || stats[0].Max != should.Max {
+		t.Fatalf("incorrect import: %#v", stats)
+	}
+}
+
+func TestExpireAppendsToArchive(t *testing.T) {
+	db, _ := getTestDBWithDevice(t)
+	defer db.Close()
+
+	dir := t.TempDir()
+	ts := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i != 2; i++ {
+		stats := RandomDBAStats()
+		stats.Signifier = TEST_SIGNIFIER
+		if _, err := db.Save(&stats, ts.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Expire("dba_stats", ts.Add(time.Hour), dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scratch := getTestDB(t)
+	defer scratch.Close()
+	cnt, err := scratch.ImportArchive(filepath.Join(dir, "dba_stats-2021-10.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 2 {
+		t.Fatalf("expected 2 rows from appended archive, got %d", cnt)
+	}
+}
+
+func TestExpireFailureLeavesArchive(t *testing.T) {
+	db, _ := getTestDBWithDevice(t)
+	defer db.Close()
+
+	dir := t.TempDir()
+	ts := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	stats := RandomDBAStats()
+	stats.Signifier = TEST_SIGNIFIER
+	if _, err := db.Save(&stats, ts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Expire("dba_stats", ts.Add(time.Hour), dir); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "dba_stats-2021-10.jsonl.gz")
+	archived, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Save(&stats, ts.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec(`CREATE TRIGGER no_delete BEFORE DELETE ON dba_stats BEGIN SELECT RAISE(ABORT, 'locked'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Expire("dba_stats", ts.Add(time.Hour), dir); err == nil {
+		t.Fatalf("expected error for failing delete")
+	}
+
+	// the archive isn't modified if the rows weren't deleted
+	if is, err := os.ReadFile(fn); err != nil || string(is) != string(archived) {
+		t.Fatalf("archive modified: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temporary archive not removed: %v", entries)
+	}
+}
@@ -0,0 +1,282 @@
+package mqttGather
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Devices publish every few seconds, so queries over longer periods
+// of `dba_stats` need to scan millions of rows. This file contains
+// functionality to maintain downsampled copies ("rollups") of
+// `dba_stats` per device at fixed resolutions.
+//
+// Rollups are updated incrementally each time stats are saved and can be
+// rebuilt from the raw data using `RebuildRollups`, e.g. after importing
+// historic data.
+//
+// Levels can't be averaged arithmetically, rollups store the sum of the
+// sound energy (10^(L/10)) weighted by the number of samples, the
+// equivalent continuous level (Leq) is calculated from this when loading.
+
+// Resolution of rollups in seconds, buckets are aligned to multiples
+// of the resolution in UTC, i.e. daily rollups cover UTC days.
+type Resolution int64
+
+const (
+	RESOLUTION_RAW    = Resolution(0)
+	RESOLUTION_MINUTE = Resolution(60)
+	RESOLUTION_10MIN  = Resolution(600)
+	RESOLUTION_HOUR   = Resolution(3600)
+	RESOLUTION_DAY    = Resolution(86400)
+
+	// maximum number of values `LoadStats` returns before switching
+	// to a coarser resolution.
+	DEFAULT_MAX_POINTS = 1500
+)
+
+// Maintained rollups from finest to coarsest.
+var Rollups = []Resolution{
+	RESOLUTION_MINUTE,
+	RESOLUTION_10MIN,
+	RESOLUTION_HOUR,
+	RESOLUTION_DAY,
+}
+
+func (r Resolution) valid() bool {
+	if r == RESOLUTION_RAW {
+		return true
+	}
+	for _, rollup := range Rollups {
+		if r == rollup {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Resolution) table() string {
+	switch r {
+	case RESOLUTION_RAW:
+		return "dba_stats"
+	case RESOLUTION_MINUTE:
+		return "dba_stats_1m"
+	case RESOLUTION_10MIN:
+		return "dba_stats_10m"
+	case RESOLUTION_HOUR:
+		return "dba_stats_1h"
+	case RESOLUTION_DAY:
+		return "dba_stats_1d"
+	default:
+		panic(fmt.Sprintf("unknown resolution: %d", r))
+	}
+}
+
+func (r Resolution) String() string {
+	if r == RESOLUTION_RAW {
+		return "raw"
+	}
+	return (time.Duration(r) * time.Second).String()
+}
+
+// Start of the bucket `ts` falls into.
+func (r Resolution) bucket(ts int64) int64 {
+	if r == RESOLUTION_RAW {
+		return ts
+	}
+	return ts - ts%int64(r)
+}
+
+// Pick the finest rollup that covers [from, to) in at most `maxPoints`
+// buckets, falls back to daily rollups for very long ranges.
+func ChooseResolution(from, to time.Time, maxPoints int64) Resolution {
+	span := int64(to.Sub(from) / time.Second)
+	for _, r := range Rollups {
+		if span/int64(r) <= maxPoints {
+			return r
+		}
+	}
+	return RESOLUTION_DAY
+}
+
+// Aggregated noise values for a single bucket, `Timestamp` is the start of
+// the bucket.
+type StatsAggregate struct {
+	DeviceSignifier string
+	Resolution      Resolution
+	Timestamp       time.Time
+	Min             float64
+	Max             float64
+	Leq             float64 // energy average of the `average` values in the bucket
+	Count           int64   // number of dba_stats rows in the bucket
+}
+
+// Converts sound level (dB) to (relative) sound energy and back.
+// These are registered as sqlite functions `db_to_energy` and
+// `energy_to_db`, see `db_sqlite.go`
+func dbToEnergy(level float64) float64 {
+	return math.Pow(10, level/10)
+}
+
+func energyToDB(energy float64) float64 {
+	if energy <= 0 {
+		return 0
+	}
+	return 10 * math.Log10(energy)
+}
+
+// Weight of a `dba_stats` row, the average is calculated over `num` samples.
+func statsWeight(num int) float64 {
+	if num <= 0 {
+		return 1
+	}
+	return float64(num)
+}
+
+// Add a single stats row to all rollups in the transaction of `Save`.
+func updateRollups(tx *sql.Tx, device_id int64, stats *DBAStats, t time.Time) error {
+	weight := statsWeight(stats.Num)
+	energy := weight * dbToEnergy(stats.Average)
+
+	for _, r := range Rollups {
+		sql := fmt.Sprintf(`
+INSERT INTO %s (
+	device_id, ts, min, max, energy, weight, count
+) VALUES (
+	:DEVICE_ID, :TS, :MIN, :MAX, :ENERGY, :WEIGHT, 1
+)
+ON CONFLICT (device_id, ts) DO UPDATE SET
+	min    = MIN(min, excluded.min),
+	max    = MAX(max, excluded.max),
+	energy = energy + excluded.energy,
+	weight = weight + excluded.weight,
+	count  = count + 1
+`, r.table())
+
+		if _, err := tx.Exec(sql, device_id, r.bucket(t.Unix()), stats.Min, stats.Max, energy, weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recalculate all rollups for the period [from, to) from the raw data in
+// `dba_stats`. The period is extended to full days so that no partially
+// calculated buckets remain.
+func (s *SqliteDB) RebuildRollups(from, to time.Time) error {
+	fromTs := RESOLUTION_DAY.bucket(from.Unix())
+	toTs := RESOLUTION_DAY.bucket(to.Unix())
+	if toTs < to.Unix() {
+		toTs += int64(RESOLUTION_DAY)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range Rollups {
+		del := fmt.Sprintf(`DELETE FROM %s WHERE ts >= :FROM AND ts < :TO`, r.table())
+		if _, err := tx.Exec(del, fromTs, toTs); err != nil {
+			tx.Rollback()
+			return err
+		}
+		insert := fmt.Sprintf(`
+INSERT INTO %s (
+	device_id, ts, min, max, energy, weight, count
+)
+SELECT
+	device_id,
+	(ts / %[2]d) * %[2]d AS bucket,
+	MIN(IFNULL(min, 0)),
+	MAX(IFNULL(max, 0)),
+	SUM(MAX(IFNULL(num, 0), 1) * db_to_energy(IFNULL(average, 0))),
+	SUM(MAX(IFNULL(num, 0), 1)),
+	COUNT(*)
+FROM
+	dba_stats
+WHERE
+	ts >= :FROM
+AND
+	ts < :TO
+AND
+	device_id IS NOT NULL
+GROUP BY
+	device_id, bucket
+`, r.table(), int64(r))
+		if _, err := tx.Exec(insert, fromTs, toTs); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Load aggregated stats of device `signifier` in [from, to) using the
+// coarsest resolution needed to return no more than DEFAULT_MAX_POINTS values.
+func (s *SqliteDB) LoadStats(signifier string, from, to time.Time) ([]StatsAggregate, error) {
+	r := ChooseResolution(from, to, DEFAULT_MAX_POINTS)
+	return s.LoadStatsResolution(signifier, r, from, to)
+}
+
+// Load aggregated stats of device `signifier` in [from, to) at resolution
+// `r`. Buckets are included if their start lies within the period. With
+// RESOLUTION_RAW every `dba_stats` row is returned as an aggregate of one.
+func (s *SqliteDB) LoadStatsResolution(signifier string, r Resolution, from, to time.Time) ([]StatsAggregate, error) {
+	if !r.valid() {
+		return nil, fmt.Errorf("unsupported resolution: %v", r)
+	}
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query(signifier, from.Unix(), to.Unix())
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var result []StatsAggregate
+		for rows.Next() {
+			agg := StatsAggregate{
+				DeviceSignifier: signifier,
+				Resolution:      r,
+			}
+			var ts int64
+			if err := rows.Scan(&ts, &agg.Min, &agg.Max, &agg.Leq, &agg.Count); err != nil {
+				return nil, err
+			}
+			agg.Timestamp = time.Unix(ts, 0)
+			result = append(result, agg)
+		}
+		return result, rows.Err()
+	}
+
+	values := `s.min, s.max, energy_to_db(s.energy / s.weight), s.count`
+	if r == RESOLUTION_RAW {
+		values = `IFNULL(s.min, 0), IFNULL(s.max, 0), IFNULL(s.average, 0), 1`
+	}
+
+	sql := fmt.Sprintf(`
+SELECT
+	s.ts,
+	%s
+FROM
+	%s s
+JOIN
+	device d
+ON
+	s.device_id = d.device_id
+WHERE
+	d.device_signifier = :SIGNIFIER
+AND
+	s.ts >= :FROM
+AND
+	s.ts < :TO
+ORDER BY
+	s.ts
+`, values, r.table())
+
+	result_, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	return result_.([]StatsAggregate), nil
+}
@@ -0,0 +1,163 @@
+package mqttGather
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestChooseResolution(t *testing.T) {
+	from := time.Unix(0, 0)
+	for _, tt := range []struct {
+		span time.Duration
+		res  Resolution
+	}{
+		{time.Hour, RESOLUTION_MINUTE},
+		{24 * time.Hour, RESOLUTION_MINUTE},
+		{7 * 24 * time.Hour, RESOLUTION_10MIN},
+		{30 * 24 * time.Hour, RESOLUTION_HOUR},
+		{365 * 24 * time.Hour, RESOLUTION_DAY},
+		{50 * 365 * 24 * time.Hour, RESOLUTION_DAY},
+	} {
+		if r := ChooseResolution(from, from.Add(tt.span), DEFAULT_MAX_POINTS); r != tt.res {
+			t.Fatalf("span %v is: %v should: %v", tt.span, r, tt.res)
+		}
+	}
+}
+
+func saveTestStats(t *testing.T, db *SqliteDB) {
+	for _, row := range []struct {
+		ts  int64
+		avg float64
+		max float64
+		num int
+	}{
+		{10, 50, 55, 1},
+		{20, 60, 70, 1},
+		{70, 40, 45, 2},
+		{3700, 70, 80, 1},
+	} {
+		stats := DBAStats{
+			Signifier: TEST_SIGNIFIER,
+			Min:       row.avg - 5,
+			Max:       row.max,
+			Average:   row.avg,
+			Num:       row.num,
+		}
+		if _, err := db.Save(&stats, time.Unix(row.ts, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkRollups(t *testing.T, db *SqliteDB) {
+	from, to := time.Unix(0, 0), time.Unix(86400, 0)
+
+	minute, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_MINUTE, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minute) != 3 {
+		t.Fatalf("expected 3 minute buckets, got %d", len(minute))
+	}
+	first := minute[0]
+	if first.Timestamp.Unix() != 0 || first.Count != 2 || first.Min != 45 || first.Max != 70 {
+		t.Fatalf("incorrect minute rollup: %#v", first)
+	}
+	if math.Abs(first.Leq-57.4036) > 0.001 {
+		t.Fatalf("incorrect leq: %f", first.Leq)
+	}
+	if minute[1].Timestamp.Unix() != 60 || minute[1].Leq != 40 {
+		t.Fatalf("incorrect minute rollup: %#v", minute[1])
+	}
+
+	hour, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_HOUR, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hour) != 2 || hour[0].Count != 3 || hour[1].Timestamp.Unix() != 3600 {
+		t.Fatalf("incorrect hour rollup: %#v", hour)
+	}
+	// 50, 60, 2x40
+	should := 10 * math.Log10((math.Pow(10, 5)+math.Pow(10, 6)+2*math.Pow(10, 4))/4)
+	if math.Abs(hour[0].Leq-should) > 0.0001 {
+		t.Fatalf("incorrect hourly leq: %f should %f", hour[0].Leq, should)
+	}
+
+	day, err := db.LoadStats(TEST_SIGNIFIER, from, time.Unix(400*86400, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(day) != 1 || day[0].Resolution != RESOLUTION_DAY || day[0].Count != 4 || day[0].Max != 80 {
+		t.Fatalf("incorrect daily rollup: %#v", day)
+	}
+}
+
+func TestRollups(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	saveTestStats(t, db)
+	checkRollups(t, db)
+
+	raw, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_RAW, time.Unix(0, 0), time.Unix(60, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 2 || raw[1].Leq != 60 || raw[1].Count != 1 {
+		t.Fatalf("incorrect raw values: %#v", raw)
+	}
+}
+
+func TestRebuildRollups(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	saveTestStats(t, db)
+	for _, r := range Rollups {
+		if _, err := db.db.Exec("DELETE FROM " + r.table()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.RebuildRollups(time.Unix(0, 0), time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	checkRollups(t, db)
+
+	// rebuilding must not duplicate
+	if err := db.RebuildRollups(time.Unix(0, 0), time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	checkRollups(t, db)
+}
+
+func TestSaveRollupFailure(t *testing.T) {
+	db := getTestDB(t)
+	defer db.Close()
+
+	saveTestStats(t, db)
+	last := Rollups[len(Rollups)-1]
+	if _, err := db.db.Exec("DROP TABLE " + last.table()); err != nil {
+		t.Fatal(err)
+	}
+	stats := DBAStats{Signifier: TEST_SIGNIFIER, Min: 90, Max: 95, Average: 92, Num: 1}
+	if _, err := db.Save(&stats, time.Unix(80, 0)); err == nil {
+		t.Fatalf("expected error for missing rollup table")
+	}
+
+	// neither the raw row nor the other rollups are written
+	raw, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_RAW, time.Unix(0, 0), time.Unix(3600, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 3 {
+		t.Fatalf("incorrect raw values: %#v", raw)
+	}
+	minute, err := db.LoadStatsResolution(TEST_SIGNIFIER, RESOLUTION_MINUTE, time.Unix(0, 0), time.Unix(3600, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minute) != 2 || minute[1].Max != 45 {
+		t.Fatalf("incorrect minute rollup: %#v", minute)
+	}
+}
@@ -0,0 +1,159 @@
+package mqttGather
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Coordinated shutdown of the gatherer, in this order:
+//
+//  1. stop subscriptions (clean sessions only, the subscriptions of
+//     persistent sessions are kept so the broker queues messages for the
+//     next start)
+//  2. disconnect from the broker
+//  3. wait for in-flight message handlers to finish, messages arriving
+//     afterwards are dropped
+//  4. close the stats channel and wait for the alerter to evaluate the
+//     remaining stats and send pending alerts
+//  5. flush and close the output sinks, see sink.go
+//  6. close the recorder and the database
+//
+// Steps 3 to 5 are bounded by the context passed to `Shutdown`. If they
+// don't finish in time, the database is closed regardless and the context's
+// error is returned.
+
+// Used by `Disconnect` and by `main` unless `shutdown_timeout` is set.
+const DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// Shutdown timeout configured in `cfg`.
+func ShutdownTimeout(cfg *RunConfig) time.Duration {
+	if cfg.ShutdownTimeout > 0 {
+		return time.Duration(cfg.ShutdownTimeout) * time.Second
+	}
+	return DEFAULT_SHUTDOWN_TIMEOUT
+}
+
+// Calls `wait` and returns once it returns or the context is done.
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wraps a message handler to keep track of in-flight handlers, messages
+// arriving once shutdown began are dropped.
+func (m *Mqtt) track(handler MQTT.MessageHandler) MQTT.MessageHandler {
+	return func(c MQTT.Client, msg MQTT.Message) {
+		m.mu.Lock()
+		if m.closing {
+			m.mu.Unlock()
+			logger("mqtt").Warn("dropped message during shutdown", "topic", msg.Topic())
+			return
+		}
+		m.inflight.Add(1)
+		m.mu.Unlock()
+		defer m.inflight.Done()
+		m.handling.RLock()
+		defer m.handling.RUnlock()
+		handler(c, msg)
+	}
+}
+
+// Topic filters currently subscribed to.
+func (m *Mqtt) subscribedFilters() []string {
+	var filters []string
+	cfg := m.config()
+	for _, topic := range []string{cfg.Topic, cfg.TelemetryTopic} {
+		if topic != "" {
+			filters = append(filters, m.subscription(topic))
+		}
+	}
+	return filters
+}
+
+func (m *Mqtt) unsubscribe(ctx context.Context, filters []string) error {
+	if len(filters) == 0 {
+		return nil
+	}
+	if m.client5 != nil {
+		_, err := m.client5.Unsubscribe(ctx, &paho.Unsubscribe{Topics: filters})
+		return err
+	}
+	token := m.client.Unsubscribe(filters...)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shuts down the gatherer, see above. Returns an error if draining
+// handlers, the alerter or the sinks didn't finish before the context is
+// done.
+func (m *Mqtt) Shutdown(ctx context.Context) error {
+	log := logger("mqtt")
+	m.mu.Lock()
+	if m.shutdown {
+		m.mu.Unlock()
+		return fmt.Errorf("already shut down")
+	}
+	m.shutdown = true
+	m.mu.Unlock()
+
+	if m.client != nil || m.client5 != nil {
+		if !m.config().PersistentSession {
+			if err := m.unsubscribe(ctx, m.subscribedFilters()); err != nil {
+				log.Warn("could not unsubscribe", "err", err)
+			}
+		}
+		if m.client5 != nil {
+			m.disconnect5()
+		} else {
+			m.client.Disconnect(250)
+		}
+		log.Debug("disconnected")
+	}
+
+	m.mu.Lock()
+	m.closing = true
+	alerter := m.alerter
+	m.mu.Unlock()
+
+	err := waitContext(ctx, m.inflight.Wait)
+	if err != nil {
+		// handlers may still send stats, the channel can't be closed.
+		log.Error("in-flight messages not handled before shutdown timeout", "err", err)
+	} else {
+		close(m.statsChannel)
+		if alerter != nil {
+			if err = alerter.Shutdown(ctx); err != nil {
+				log.Error("alerter did not finish before shutdown timeout", "err", err)
+			}
+		}
+	}
+	if serr := m.sinks.close(ctx); serr != nil && err == nil {
+		err = serr
+	}
+
+	if m.recorder != nil {
+		if rerr := m.recorder.Close(); rerr != nil {
+			log.Error("could not close recorder", "err", rerr)
+		}
+	}
+	m.db.Close()
+	log.Info("shut down")
+	return err
+}
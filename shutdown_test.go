@@ -0,0 +1,96 @@
+package mqttGather
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	b, mqtt, db := startTestGatherer(t)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mqtt.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mqtt.IsConnected() || mqtt.alerter.Running() {
+		t.Fatalf("not shut down")
+	}
+	if err := db.Probe(); err == nil {
+		t.Fatalf("database not closed")
+	}
+	if err := mqtt.Shutdown(ctx); err == nil {
+		t.Fatalf("expected error shutting down twice")
+	}
+	waitFor(t, "disconnect", func() bool {
+		cl, ok := b.server.Clients.Get("gatherer")
+		return !ok || cl.Closed()
+	})
+}
+
+func TestShutdownConcurrent(t *testing.T) {
+	_, mqtt, _ := startTestGatherer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	for i := 0; i != 2; i++ {
+		go func() { errs <- mqtt.Shutdown(ctx) }()
+	}
+	// the stats channel is only closed once
+	if err1, err2 := <-errs, <-errs; (err1 == nil) == (err2 == nil) {
+		t.Fatalf("expected one shutdown to fail: %v, %v", err1, err2)
+	}
+}
+
+func TestShutdownWithoutAlerter(t *testing.T) {
+	b := startTestBroker(t)
+	mqtt, err := NewMQTT(testGathererConfig(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mqtt.db.(*SqliteDB)
+	waitSubscribed(t, mqtt)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	// stats are only passed on if there is an alerter to consume them.
+	for i := 0; i != 2; i++ {
+		device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	}
+	waitFor(t, "dba_stats", func() bool { return count(t, db, "dba_stats") == 2 })
+
+	if err := mqtt.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	b := startTestBroker(t)
+	mqtt, err := NewMQTT(testGathererConfig(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerter := NewAlerter(mqtt.cfg, mqtt)
+	alerter.Start()
+	alerter.mu.Lock() // the alerter blocks evaluating the stats
+	defer alerter.mu.Unlock()
+	waitSubscribed(t, mqtt)
+	device := testClient(t, b, "device", nil)
+	defer device.Disconnect(100)
+
+	device.Publish("/opennoise/"+TEST_SIGNIFIER+"/dba_stats", 1, false, "52.683,57.619,55.152,0.595,55.272,86").Wait()
+	waitFor(t, "dba_stats", func() bool { return count(t, mqtt.db.(*SqliteDB), "dba_stats") == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := mqtt.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package mqttGather
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Output sinks receive the parsed noise stats and telemetry in addition
+// to, or with `sink_only` instead of, the database. E.g. `InfluxSink`
+// forwards them to a time series database (see influx.go).
+//
+// Sinks are called by the message handlers and must not block them, i.e.
+// they need to buffer and write asynchronously. They are closed during
+// shutdown once the handlers finished (see shutdown.go) and should flush
+// pending writes until the context is done.
+
+type Sink interface {
+	Name() string // used in logs and metrics
+	// `info` is nil if there is no device info for the device.
+	WriteStats(stats *DBAStats, t time.Time, info *DeviceInfo)
+	WriteTelemetry(telemetry *Telemetry, t time.Time, info *DeviceInfo)
+	Close(ctx context.Context) error
+}
+
+// Sinks may implement `AlertStateSink` to receive the alert state of
+// devices evaluated by the alerter.
+type AlertStateSink interface {
+	WriteAlertState(state AlertState)
+}
+
+// Sinks may implement `AlertSink` to receive the alerts sent by the
+// alerter.
+type AlertSink interface {
+	WriteAlert(alert *Alert, info *DeviceInfo)
+}
+
+// Sinks may implement `ConnectSink` to be notified whenever the gatherer
+// (re)connected to the broker, e.g. to publish retained messages.
+type ConnectSink interface {
+	Connected()
+}
+
+// How long device info passed to sinks is cached.
+const DEVICE_INFO_CACHE_TTL = 5 * time.Minute
+
+// The sinks of a gatherer and the device info passed to them.
+type sinks struct {
+	mu    sync.Mutex
+	list  []Sink
+	infos map[string]cachedDeviceInfo
+}
+
+type cachedDeviceInfo struct {
+	info    *DeviceInfo
+	expires time.Time
+}
+
+func (s *sinks) add(sink Sink) {
+	s.mu.Lock()
+	s.list = append(s.list, sink)
+	s.mu.Unlock()
+}
+
+func (s *sinks) all() []Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list
+}
+
+// Device info of the device, nil if there is none or it can't be loaded.
+func (s *sinks) deviceInfo(db DB, signifier string) *DeviceInfo {
+	now := time.Now()
+	s.mu.Lock()
+	cached, ok := s.infos[signifier]
+	s.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.info
+	}
+
+	info, err := db.LoadDeviceInfo(signifier)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger("sink").Error("could not load device info", "device", signifier, "err", err)
+		}
+		info = nil
+	}
+	s.mu.Lock()
+	if s.infos == nil {
+		s.infos = make(map[string]cachedDeviceInfo)
+	}
+	s.infos[signifier] = cachedDeviceInfo{info, now.Add(DEVICE_INFO_CACHE_TTL)}
+	s.mu.Unlock()
+	return info
+}
+
+func (s *sinks) close(ctx context.Context) error {
+	var errs []error
+	for _, sink := range s.all() {
+		if err := sink.Close(ctx); err != nil {
+			logger("sink").Error("could not close sink", "sink", sink.Name(), "err", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Adds a sink, usually before connecting (see `newMqtt` for the sinks
+// created from the configuration).
+func (m *Mqtt) AddSink(sink Sink) {
+	m.sinks.add(sink)
+}
+
+// Whether stats and telemetry are only forwarded to the sinks.
+func (m *Mqtt) sinkOnly() bool {
+	cfg := m.config()
+	return cfg != nil && cfg.SinkOnly
+}
+
+func (m *Mqtt) forwardStats(stats *DBAStats, t time.Time) {
+	sinks := m.sinks.all()
+	if len(sinks) == 0 {
+		return
+	}
+	info := m.sinks.deviceInfo(m.DB(), stats.Signifier)
+	for _, sink := range sinks {
+		sink.WriteStats(stats, t, info)
+	}
+}
+
+func (m *Mqtt) forwardTelemetry(telemetry *Telemetry, t time.Time) {
+	sinks := m.sinks.all()
+	if len(sinks) == 0 {
+		return
+	}
+	info := m.sinks.deviceInfo(m.DB(), telemetry.Client)
+	for _, sink := range sinks {
+		sink.WriteTelemetry(telemetry, t, info)
+	}
+}
+
+func (m *Mqtt) forwardAlertState(state AlertState) {
+	for _, sink := range m.sinks.all() {
+		if s, ok := sink.(AlertStateSink); ok {
+			s.WriteAlertState(state)
+		}
+	}
+}
+
+func (m *Mqtt) forwardAlert(alert *Alert, info *DeviceInfo) {
+	for _, sink := range m.sinks.all() {
+		if s, ok := sink.(AlertSink); ok {
+			s.WriteAlert(alert, info)
+		}
+	}
+}
+
+func (m *Mqtt) notifyConnected() {
+	for _, sink := range m.sinks.all() {
+		if s, ok := sink.(ConnectSink); ok {
+			s.Connected()
+		}
+	}
+}
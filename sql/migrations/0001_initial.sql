@@ -0,0 +1,70 @@
+-- Schema as created by versions up to 0.4.0
+
+CREATE TABLE IF NOT EXISTS device (
+	device_id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_signifier VARCHAR UNIQUE -- this is the MAC addr of the openoise device
+);
+
+CREATE TABLE IF NOT EXISTS device_info (
+	deviceinfo_id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id       INTEGER NOT NULL UNIQUE REFERENCES device(device_id),
+	description     VARCHAR NOT NULL DEFAULT 'Unbekanntes Geraet',
+	latitude        FLOAT NOT NULL,
+	longitude       FLOAT NOT NULL,
+	alert_threshold  FLOAT NOT NULL DEFAULT 100,
+	alert_duration   FLOAT NOT NULL DEFAULT 60,
+	alert_count      INTEGER NOT NULL DEFAULT 3,
+	alert_deadtime   FLOAT NOT NULL DEFAULT 1800,
+	alert_phone      VARCHAR NOT NULL DEFAULT "",
+	alert_active     BOOLEAN NOT NULL DEFAULT FALSE,
+	turn_on_time      INTEGER NOT NULL DEFAULT 0
+);
+
+
+CREATE TABLE IF NOT EXISTS dba_stats (
+	dba_stats_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id    INTEGER REFERENCES device(device_id),
+	min          FLOAT,
+	max          FLOAT,
+	average      FLOAT,
+	averageVar   FLOAT,
+	mean         FLOAT,
+	num          INTEGER,
+	ts           INTEGER DEFAULT (STRFTIME('%s','now'))
+);
+
+CREATE TABLE IF NOT EXISTS tele_mem (
+	tele_mem_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id   INTEGER REFERENCES device(device_id),
+	type        VARCHAR,
+	free_mem    INTEGER,
+	ts          INTEGER DEFAULT (STRFTIME('%s','now'))
+
+);
+
+CREATE TABLE IF NOT EXISTS tele_ver (
+	tele_ver_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id    INTEGER REFERENCES device(device_id),
+	type        VARCHAR,
+	info        VARCHAR,
+	ts          INTEGER DEFAULT (STRFTIME('%s','now'))
+
+);
+
+CREATE TABLE IF NOT EXISTS tele_misc (
+	tele_misc_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id    INTEGER REFERENCES device(device_id),
+	type         VARCHAR,
+	data         VARCHAR,
+	ts           INTEGER DEFAULT (STRFTIME('%s','now'))
+);
+
+-- log of outgoing alerts
+CREATE TABLE IF NOT EXISTS alert (
+	alert_id    INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id   INTEGER REFERENCES device(device_id),
+	ts          INTEGER DEFAULT (STRFTIME('%s','now')),
+	alert_phone  VARCHAR,
+	message     VARCHAR,
+	status      VARCHAR
+);
@@ -1,3 +1,7 @@
+-- Replace the `client` column (MAC addr) in the data tables with a
+-- reference to `device`. Only necessary for databases created before
+-- devices were introduced.
+-- condition: SELECT count(*) FROM pragma_table_info('dba_stats') WHERE name = 'client'
 
 	CREATE TABLE IF NOT EXISTS device (
 		device_id        INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -16,7 +20,7 @@ UPDATE tele_mem  SET device_id = (SELECT device_id FROM device WHERE device_sign
 UPDATE tele_ver  SET device_id = (SELECT device_id FROM device WHERE device_signifier = tele_ver.client);
 UPDATE tele_misc SET device_id = (SELECT device_id FROM device WHERE device_signifier = tele_misc.client);
 
--- you'll need sqlite 3.35 or higher for this.
+-- needs sqlite 3.35 or higher, the sqlite bundled with the driver is recent enough.
 ALTER TABLE dba_stats DROP COLUMN client;
 ALTER TABLE tele_mem DROP COLUMN client;
 ALTER TABLE tele_ver DROP COLUMN client;
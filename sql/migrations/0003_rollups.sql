@@ -0,0 +1,119 @@
+-- Downsampled copies of dba_stats, see rollup.go
+-- Existing data is rolled up once, afterwards rollups are updated as data
+-- is saved. `db_to_energy` is provided by the driver (see db_sqlite.go)
+
+CREATE TABLE IF NOT EXISTS dba_stats_1m (
+	device_id INTEGER REFERENCES device(device_id),
+	ts        INTEGER, -- start of bucket
+	min       FLOAT,
+	max       FLOAT,
+	energy    FLOAT,   -- sum of weight * 10^(average/10)
+	weight    FLOAT,   -- sum of num
+	count     INTEGER, -- number of dba_stats rows
+	PRIMARY KEY (device_id, ts)
+);
+
+INSERT OR REPLACE INTO dba_stats_1m (
+	device_id, ts, min, max, energy, weight, count
+)
+SELECT
+	device_id,
+	(ts / 60) * 60 AS bucket,
+	MIN(IFNULL(min, 0)),
+	MAX(IFNULL(max, 0)),
+	SUM(MAX(IFNULL(num, 0), 1) * db_to_energy(IFNULL(average, 0))),
+	SUM(MAX(IFNULL(num, 0), 1)),
+	COUNT(*)
+FROM
+	dba_stats
+WHERE
+	device_id IS NOT NULL
+GROUP BY
+	device_id, bucket;
+
+CREATE TABLE IF NOT EXISTS dba_stats_10m (
+	device_id INTEGER REFERENCES device(device_id),
+	ts        INTEGER, -- start of bucket
+	min       FLOAT,
+	max       FLOAT,
+	energy    FLOAT,   -- sum of weight * 10^(average/10)
+	weight    FLOAT,   -- sum of num
+	count     INTEGER, -- number of dba_stats rows
+	PRIMARY KEY (device_id, ts)
+);
+
+INSERT OR REPLACE INTO dba_stats_10m (
+	device_id, ts, min, max, energy, weight, count
+)
+SELECT
+	device_id,
+	(ts / 600) * 600 AS bucket,
+	MIN(IFNULL(min, 0)),
+	MAX(IFNULL(max, 0)),
+	SUM(MAX(IFNULL(num, 0), 1) * db_to_energy(IFNULL(average, 0))),
+	SUM(MAX(IFNULL(num, 0), 1)),
+	COUNT(*)
+FROM
+	dba_stats
+WHERE
+	device_id IS NOT NULL
+GROUP BY
+	device_id, bucket;
+
+CREATE TABLE IF NOT EXISTS dba_stats_1h (
+	device_id INTEGER REFERENCES device(device_id),
+	ts        INTEGER, -- start of bucket
+	min       FLOAT,
+	max       FLOAT,
+	energy    FLOAT,   -- sum of weight * 10^(average/10)
+	weight    FLOAT,   -- sum of num
+	count     INTEGER, -- number of dba_stats rows
+	PRIMARY KEY (device_id, ts)
+);
+
+INSERT OR REPLACE INTO dba_stats_1h (
+	device_id, ts, min, max, energy, weight, count
+)
+SELECT
+	device_id,
+	(ts / 3600) * 3600 AS bucket,
+	MIN(IFNULL(min, 0)),
+	MAX(IFNULL(max, 0)),
+	SUM(MAX(IFNULL(num, 0), 1) * db_to_energy(IFNULL(average, 0))),
+	SUM(MAX(IFNULL(num, 0), 1)),
+	COUNT(*)
+FROM
+	dba_stats
+WHERE
+	device_id IS NOT NULL
+GROUP BY
+	device_id, bucket;
+
+CREATE TABLE IF NOT EXISTS dba_stats_1d (
+	device_id INTEGER REFERENCES device(device_id),
+	ts        INTEGER, -- start of bucket
+	min       FLOAT,
+	max       FLOAT,
+	energy    FLOAT,   -- sum of weight * 10^(average/10)
+	weight    FLOAT,   -- sum of num
+	count     INTEGER, -- number of dba_stats rows
+	PRIMARY KEY (device_id, ts)
+);
+
+INSERT OR REPLACE INTO dba_stats_1d (
+	device_id, ts, min, max, energy, weight, count
+)
+SELECT
+	device_id,
+	(ts / 86400) * 86400 AS bucket,
+	MIN(IFNULL(min, 0)),
+	MAX(IFNULL(max, 0)),
+	SUM(MAX(IFNULL(num, 0), 1) * db_to_energy(IFNULL(average, 0))),
+	SUM(MAX(IFNULL(num, 0), 1)),
+	COUNT(*)
+FROM
+	dba_stats
+WHERE
+	device_id IS NOT NULL
+GROUP BY
+	device_id, bucket;
@@ -0,0 +1,6 @@
+-- Single row table written to by the health check to verify the database
+-- is writable, see health.go
+CREATE TABLE IF NOT EXISTS health_probe (
+	health_probe_id INTEGER PRIMARY KEY,
+	ts              INTEGER
+);
@@ -0,0 +1,14 @@
+-- Dead letter table: MQTT messages that could not be handled, kept for
+-- forensics and re-processing, see raw_message.go
+CREATE TABLE IF NOT EXISTS raw_message (
+	raw_message_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic          VARCHAR,
+	payload        BLOB,
+	ts             INTEGER DEFAULT (STRFTIME('%s','now')),
+	qos            INTEGER,
+	retained       INTEGER,
+	error          VARCHAR,
+	reprocessed    INTEGER -- time of successful re-processing, NULL if pending
+);
+
+CREATE INDEX IF NOT EXISTS raw_message_reprocessed ON raw_message(reprocessed);
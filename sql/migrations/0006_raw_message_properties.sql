@@ -0,0 +1,3 @@
+-- MQTT 5 properties (user properties, message expiry ...) of dead letters
+-- as JSON, see mqtt5.go
+ALTER TABLE raw_message ADD COLUMN properties VARCHAR;
@@ -0,0 +1,202 @@
+package mqttGather
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live stream of the parsed stats, telemetry, alert states and sent
+// alerts for clients that don't speak MQTT, served with `"stream": true`
+// below `http_addr` at:
+//
+//	/stream?device=<device>&type=<type>
+//
+// `device` and `type` (stats, telemetry, alert_state, alert) are optional,
+// may be repeated or comma separated and restrict the events sent to the
+// client. Events are sent as Server-Sent Events, their data being the
+// JSON payloads also used for republishing (see republish.go):
+//
+//	event: stats
+//	data: {"device":"c4:dd:57:66:95:60","timestamp":"2021-10-31T12:00:00Z","min":52.683,...}
+//
+// or, if the client requests a WebSocket upgrade, as one JSON message per
+// event:
+//
+//	{"type":"stats","device":"c4:dd:57:66:95:60","data":{"device":"c4:dd:57:66:95:60",...}}
+//
+// Events are passed on by the hub (see hub.go). Clients not keeping up
+// miss events rather than delaying the gatherer, they are told how many
+// with a `dropped` event before the next event they receive, e.g.
+// `{"type":"dropped","data":{"dropped":12}}`. The stream ends when the
+// gatherer shuts down.
+
+const (
+	EVENT_DROPPED = "dropped"
+
+	// interval of comments (SSE) or pings (WebSocket), keeping proxies
+	// from closing idle connections.
+	STREAM_KEEPALIVE = 15 * time.Second
+	// clients not accepting a write for this long are disconnected
+	STREAM_WRITE_TIMEOUT = 10 * time.Second
+)
+
+// A streamed event, see above.
+type StreamMessage struct {
+	Type   string          `json:"type"`
+	Device string          `json:"device,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type StreamDropped struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+type Stream struct {
+	hub      *Hub
+	upgrader websocket.Upgrader
+}
+
+// Creates the event stream of the gatherer, which needs to be configured
+// with `stream` or `dashboard` to feed the events.
+func NewStream(mqtt *Mqtt) *Stream {
+	return &Stream{hub: mqtt.Hub()}
+}
+
+// Registers /stream.
+func (s *Stream) Register(mux *http.ServeMux) {
+	mux.Handle("/stream", s)
+}
+
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.hub == nil {
+		http.Error(w, "stream not enabled", http.StatusNotImplemented)
+		return
+	}
+	filter, err := parseHubFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub := s.hub.Subscribe(filter)
+	defer s.hub.Unsubscribe(sub)
+	metricStreamClients.Inc()
+	defer metricStreamClients.Add(-1)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveWebSocket(w, r, sub)
+	} else {
+		s.serveSSE(w, r, sub)
+	}
+}
+
+// Filter from the `device` and `type` query parameters.
+func parseHubFilter(r *http.Request) (HubFilter, error) {
+	values := func(name string) []string {
+		var result []string
+		for _, v := range r.URL.Query()[name] {
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					result = append(result, s)
+				}
+			}
+		}
+		return result
+	}
+	filter := HubFilter{Devices: values("device"), Types: values("type")}
+	for _, t := range filter.Types {
+		if !stringSet(eventTypes)[t] {
+			return filter, fmt.Errorf("unknown event type: %s (expected one of %s)", t, strings.Join(eventTypes, ", "))
+		}
+	}
+	return filter, nil
+}
+
+func (s *Stream) serveSSE(w http.ResponseWriter, r *http.Request, sub *HubSubscription) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	write := func(format string, args ...interface{}) error {
+		// not supported by all ResponseWriters, e.g. in tests
+		rc.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	pumpEvents(sub, r.Context().Done(), func(msg StreamMessage) error {
+		return write("event: %s\ndata: %s\n\n", msg.Type, msg.Data)
+	}, func() error {
+		return write(": keepalive\n\n")
+	})
+}
+
+func (s *Stream) serveWebSocket(w http.ResponseWriter, r *http.Request, sub *HubSubscription) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader replied with an error
+	}
+	defer conn.Close()
+
+	// clients aren't expected to send anything, reading processes the
+	// control messages and notices the connection closing.
+	conn.SetReadLimit(512)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pumpEvents(sub, closed, func(msg StreamMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+		return conn.WriteJSON(msg)
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(STREAM_WRITE_TIMEOUT))
+	})
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+}
+
+// Passes the subscription's events to `write` until writing fails, `done`
+// is closed or the subscription ends. `keepalive` is called every
+// STREAM_KEEPALIVE.
+func pumpEvents(sub *HubSubscription, done <-chan struct{}, write func(StreamMessage) error, keepalive func() error) {
+	ticker := time.NewTicker(STREAM_KEEPALIVE)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if n := sub.Dropped(); n > 0 {
+				data, _ := json.Marshal(StreamDropped{n})
+				err = write(StreamMessage{Type: EVENT_DROPPED, Data: data})
+			}
+			if err == nil {
+				err = write(StreamMessage{event.Type, event.Device, event.Data})
+			}
+		case <-ticker.C:
+			err = keepalive()
+		case <-done:
+			return
+		}
+		if err != nil {
+			logger("stream").Debug("client disconnected", "err", err)
+			return
+		}
+	}
+}
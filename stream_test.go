@@ -0,0 +1,121 @@
+package mqttGather
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startTestStream(t *testing.T) (*Hub, *httptest.Server) {
+	hub := NewHub()
+	t.Cleanup(func() { hub.Close(context.Background()) })
+	mux := http.NewServeMux()
+	(&Stream{hub: hub}).Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return hub, server
+}
+
+func TestStreamSSE(t *testing.T) {
+	hub, server := startTestStream(t)
+
+	res, err := http.Get(server.URL + "/stream?device=" + TEST_SIGNIFIER + "&type=stats,alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(res.Body)
+	if line, _ := r.ReadString('\n'); line != "retry: 5000\n" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+	r.ReadString('\n')
+
+	other := RandomDBAStats()
+	hub.WriteStats(&other, time.Now(), nil)
+	stats := DBAStats{Signifier: TEST_SIGNIFIER, Max: 57.619}
+	hub.WriteTelemetry(&Telemetry{Client: TEST_SIGNIFIER, Type: ESP, Data: 1000}, time.Now(), nil)
+	hub.WriteStats(&stats, time.Now(), nil)
+
+	var lines []string
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if lines[0] != "event: stats\n" || !strings.Contains(lines[1], `"device":"`+TEST_SIGNIFIER+`"`) ||
+		!strings.Contains(lines[1], `"max":57.619`) || lines[2] != "\n" {
+		t.Fatalf("unexpected event: %q", lines)
+	}
+
+	res, err = http.Get(server.URL + "/stream?type=stats,noise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown type accepted: %d", res.StatusCode)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	hub, server := startTestStream(t)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?type=" + EVENT_ALERT_STATE
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the subscription is set up before the upgrade completes
+	hub.WriteAlertState(AlertState{Device: TEST_SIGNIFIER, State: ALERT_STATE_ALERT, Max: 102.5, Threshold: 100})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg StreamMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	var state RepublishedAlertState
+	if err := json.Unmarshal(msg.Data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != EVENT_ALERT_STATE || msg.Device != TEST_SIGNIFIER || state.State != ALERT_STATE_ALERT || state.Max != 102.5 {
+		t.Fatalf("unexpected message: %#v %s", msg, msg.Data)
+	}
+
+	// closing the hub on shutdown closes the connection
+	hub.Close(context.Background())
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamDropped(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe(HubFilter{})
+	stats := RandomDBAStats()
+	for i := 0; i < HUB_BUFFER_SIZE+5; i++ {
+		hub.WriteStats(&stats, time.Now(), nil)
+	}
+	hub.Close(context.Background())
+
+	var msgs []StreamMessage
+	pumpEvents(sub, nil, func(msg StreamMessage) error {
+		msgs = append(msgs, msg)
+		return nil
+	}, func() error { return nil })
+	if len(msgs) != HUB_BUFFER_SIZE+1 || msgs[0].Type != EVENT_DROPPED || string(msgs[0].Data) != `{"dropped":5}` || msgs[1].Type != EVENT_STATS {
+		t.Fatalf("unexpected messages: %d %#v", len(msgs), msgs[0])
+	}
+}
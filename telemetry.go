@@ -1,10 +1,11 @@
 package mqttGather
 
 import (
+	"database/sql"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Open Noise devices currently (2021-10-18) provide some rudimentary telemetry data via MQTT.
@@ -84,14 +85,14 @@ func parseTelemetryData(t Type, data string) interface{} {
 		fallthrough
 	case "rst": // todo - reset reason semantics
 		if i, err := strconv.Atoi(data); err != nil {
-			log.Printf("E: invalid number in telemetry >%s< : %s", t, data)
+			logger("telemetry").Error("invalid number in telemetry", "type", t, "data", data)
 			return -1
 		} else {
 			return i
 		}
 	case "flg":
 		if i, err := strconv.ParseInt(data, 16, 32); err != nil {
-			log.Printf("E: invalid number in telemetry >flg< : %s", data)
+			logger("telemetry").Error("invalid number in telemetry", "type", t, "data", data)
 			return -1
 		} else {
 			return int(i)
@@ -131,3 +132,64 @@ func TelemetryFromPayload(payload string, client string) (*Telemetry, error) {
 
 	return &tel, nil
 }
+
+// The latest telemetry of a type received from a device.
+type TelemetryReading struct {
+	DeviceSignifier string
+	Type            Type
+	Value           string
+	Timestamp       time.Time
+}
+
+// Loads the latest telemetry per device and type received since `since`.
+func (s *SqliteDB) LoadLatestTelemetry(since time.Time) ([]TelemetryReading, error) {
+	exec := func(stmt *sql.Stmt) (interface{}, error) {
+		rows, err := stmt.Query(since.Unix())
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var readings []TelemetryReading
+		for rows.Next() {
+			var r TelemetryReading
+			var value sql.NullString
+			var ts int64
+			if err := rows.Scan(&r.DeviceSignifier, &r.Type, &value, &ts); err != nil {
+				return nil, err
+			}
+			r.Value = value.String
+			r.Timestamp = time.Unix(ts, 0)
+			readings = append(readings, r)
+		}
+		return readings, rows.Err()
+	}
+
+	// sqlite takes the values of bare columns from the row with MAX(ts)
+	sql := `
+SELECT
+	d.device_signifier,
+	t.type,
+	t.value,
+	MAX(t.ts)
+FROM (
+	SELECT device_id, type, CAST(free_mem AS TEXT) AS value, ts FROM tele_mem WHERE ts >= :SINCE
+	UNION ALL
+	SELECT device_id, type, info, ts FROM tele_ver WHERE ts >= :SINCE
+	UNION ALL
+	SELECT device_id, type, data, ts FROM tele_misc WHERE ts >= :SINCE
+) t
+JOIN
+	device d
+ON
+	t.device_id = d.device_id
+GROUP BY
+	d.device_signifier, t.type
+ORDER BY
+	1, 2
+`
+	readings, err := s.execute(sql, exec)
+	if err != nil {
+		return nil, err
+	}
+	return readings.([]TelemetryReading), nil
+}
@@ -1,6 +1,9 @@
 package mqttGather
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestTelemetryFromPayloadTime(t *testing.T) {
 	str := "tme:Jul 31 202119:24:44"
@@ -59,3 +62,37 @@ func TestSaveTelemetry(t *testing.T) {
 	}
 
 }
+
+func TestLoadLatestTelemetry(t *testing.T) {
+	db, _ := getTestDBWithDevice(t)
+	defer db.Close()
+	now := time.Now()
+	for i, payload := range []string{"esp:1000", "esp:2000", "ver:1.2.3", "rst:4"} {
+		tel, err := TelemetryFromPayload(payload, TEST_SIGNIFIER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.SaveTelemetry(tel, now.Add(time.Duration(i-3)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readings, err := db.LoadLatestTelemetry(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[Type]string{}
+	for _, r := range readings {
+		if r.DeviceSignifier != TEST_SIGNIFIER {
+			t.Fatalf("unexpected device: %#v", r)
+		}
+		values[r.Type] = r.Value
+	}
+	if len(values) != 3 || values[ESP] != "2000" || values[VER] != "1.2.3" || values[RST] != "4" {
+		t.Fatalf("unexpected readings: %#v", readings)
+	}
+
+	if readings, err := db.LoadLatestTelemetry(now.Add(time.Minute)); err != nil || len(readings) != 0 {
+		t.Fatalf("unexpected readings: %#v %v", readings, err)
+	}
+}
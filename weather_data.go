@@ -2,13 +2,13 @@ package mqttGather
 
 import (
 	"archive/zip"
+	"bytes"
 	"database/sql"
 	"encoding/csv"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -18,505 +18,462 @@ import (
 
 // utilities to enrich the gathered MQTT data with weather statistics
 // from DWD https://www.dwd.de/DE/leistungen/klimadatendeutschland/klimadatendeutschland.html
+//
+// Each supported DWD dataset is described declaratively by a `DWDDataset`,
+// i.e. where to download it, which columns to extract and which table to
+// store them in. `ImportDWD` handles the rest.
 
-const BASE_DWD_CDC_URL = "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/"
+const BASE_DWD_CDC_URL = "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/"
 
 // Station information here:
 // https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/
 // cologne is station_id 2667
 // KZ		ID	ICAO	NAME		alt	LAT	LONG	Automated since since
 // 10513	2667	EDDK	Köln-Bonn	92	50° 51'	07° 09'	01.12.1993	1957
+const DEFAULT_STATION = Station("2667")
 
 type Station string
 
-type Observation struct {
-	Station   Station
-	Timestamp time.Time
-}
-
-// https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/air_temperature/recent/10minutenwerte_TU_02667_akt.zip
-// STATIONS_ID;MESS_DATUM;  QN;PP_10;TT_10;TM5_10;RF_10;TD_10;eor
-//        617;201911290000;    3;   -999;   7.4;   6.6;  89.5;   5.8;eor
-// PP_10 Luftdruck -- apparently always inalid for 10 minute readings
-// TT_10 Lufttemperatur in 2m Hoehe
-// TM5_10 Temp in 5cm
-// RF_10 relative Feuchtigkeit in 2m
-// TD_10 Taupunkt
-
-const (
-	TEMP_STATIONS_ID_IDX = iota
-	TEMP_MESS_DATUM_IDX
-	TEMP_QN_IDX
-	TEMP_PP_10_IDX
-	TEMP_TT_10_IDX
-	TEMP_TM5_10_IDX
-	TEMP_RF_10_IDX
-	TEMP_TD_10_IDX
-	TEMP_eor_IDX
-
-	DATE_FMT      = "200601021504MST"
-	TEMP_DATE_FMT = DATE_FMT
-
-	TEMP_URL = "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/air_temperature/recent/10minutenwerte_TU_02667_akt.zip"
-)
-
-type Temperature struct {
-	Observation
-	Temp2m     float32
-	Temp5cm    float32
-	Humidity2m float32
-	DewPoint   float32
-}
-
-const DB_TABLE_TEMPERATURE = `
-	DROP TABLE IF EXISTS temperature;
-	CREATE TABLE IF NOT EXISTS temperature (
-		temperature_id INTEGER PRIMARY KEY AUTOINCREMENT,
-		station        VARCHAR,
-		ts             INTEGER,
-		temp2m         FLOAT,
-		temp5cm        FLOAT,
-		humidity2m     FLOAT,
-		dewPoint       FLOAT
-	)`
-
-const DB_INSERT_TEMPERATURE = `
-	INSERT INTO temperature (
-		station, ts, temp2m, temp5cm, humidity2m, dewPoint
-	) VALUES (
-		:station, :ts, :temp2m, :temp5cm, :humidity2m, :dewPoint
-	)`
-
-func (t *Temperature) Insert(stmt *sql.Stmt) error {
-	_, err := stmt.Exec(
-		t.Station,
-		t.Timestamp.Unix(),
-		t.Temp2m,
-		t.Temp5cm,
-		t.Humidity2m,
-		t.DewPoint,
-	)
-	return err
-}
-
-func ImportTemperature(db_fn string) error {
-	insert := func(record []string, stmt *sql.Stmt) error {
-		if record[0] == "STATIONS_ID" {
-			return nil // header
-		}
-
-		var temp Temperature
-		var err error
-		temp.Station = Station(record[TEMP_STATIONS_ID_IDX])
-
-		if temp.Timestamp, err = time.Parse(TEMP_DATE_FMT, record[TEMP_MESS_DATUM_IDX]+"MEZ"); err != nil {
-			return err
-		}
-		if temp2m, err := strconv.ParseFloat(record[TEMP_TT_10_IDX], 32); err != nil {
-			return err
-		} else {
-			temp.Temp2m = float32(temp2m)
-		}
-		if temp5cm, err := strconv.ParseFloat(record[TEMP_TM5_10_IDX], 32); err != nil {
-			return err
-		} else {
-			temp.Temp5cm = float32(temp5cm)
-		}
-		if hum, err := strconv.ParseFloat(record[TEMP_RF_10_IDX], 32); err != nil {
-			return err
-		} else {
-			temp.Humidity2m = float32(hum)
-		}
-		if dew, err := strconv.ParseFloat(record[TEMP_RF_10_IDX], 32); err != nil {
-			return err
-		} else {
-			temp.DewPoint = float32(dew)
-		}
-
-		return temp.Insert(stmt)
+// Station ids are zero padded to 5 digits in DWD file names.
+func (s Station) padded() string {
+	if len(s) >= 5 {
+		return string(s)
 	}
-
-	return importDWDData(
-		db_fn,
-		DB_TABLE_TEMPERATURE,
-		DB_INSERT_TEMPERATURE,
-		TEMP_URL,
-		insert,
-	)
+	return strings.Repeat("0", 5-len(s)) + string(s)
 }
 
-const PRECIPITATION_URL = "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/precipitation/recent/10minutenwerte_nieder_02667_akt.zip"
-
-// STATIONS_ID;MESS_DATUM;  QN;RWS_DAU_10;RWS_10;RWS_IND_10;eor
-//       2667;201911290000;    3;  10;   0.13;   1;eor
-// RWS_DAU_10 Niederschlagsdauer
-// RWS_10 Summe des Niedeschlags
-// RWS_IND_10 Niederschlagsindikator
-
 const (
-	PRECIP_STATIONS_ID_IDX = iota
-	PRECIP_MESS_DATUM_IDX
-	PRECIP_QN_IDX
-	PRECIP_RWS_DAU_10_IDX
-	PRECIP_RWS_10_IDX
-	PRECIP_RWS_IND_10_IDX
-	PRECIP_eor_IDX
-
-	PRECIP_DATE_FMT = DATE_FMT
+	DATE_FMT_10_MINUTES = "200601021504"
+	DATE_FMT_HOURLY     = "2006010215"
 )
 
-type Precipitation struct {
-	Observation
-	Duration10m int
-	Sum10m      float32
-	Indicator   bool
+// Maps a column of a DWD csv file to a database column.
+// `Type` is the SQL type of the column and determines how the
+// value is parsed: FLOAT, INTEGER or BOOLEAN
+type DWDColumn struct {
+	DWDName string
+	Column  string
+	Type    string
 }
 
-const DB_TABLE_PRECIPITATION = `
-	DROP TABLE IF EXISTS       precipitation;
-	CREATE TABLE IF NOT EXISTS precipitation (
-		precipitation_id INTEGER PRIMARY KEY AUTOINCREMENT,
-		station VARCHAR,
-		ts INTEGER,
-		duration INTEGER,
-		sum_10 FLOAT,
-		indicator BOOLEAN
-	)
-`
-const DB_INSERT_PRECIPITATION = `
-	INSERT INTO precipitation (
-		station, ts, duration, sum_10, indicator
-	) VALUES (
-		:station, :ts, :duration, :sum_10, :indicator
-	)
-`
-
-func (p *Precipitation) Insert(stmt *sql.Stmt) error {
-	_, err := stmt.Exec(
-		p.Station,
-		p.Timestamp.Unix(),
-		p.Duration10m,
-		p.Sum10m,
-		p.Indicator,
-	)
-	return err
+// Declarative description of a DWD dataset.
+// `URL` is relative to BASE_DWD_CDC_URL and contains a `%s` placeholder
+// for the (zero padded) station id.
+type DWDDataset struct {
+	Name    string
+	URL     string
+	Table   string
+	DateFmt string
+	Columns []DWDColumn
 }
-func ImportPrecipitation(db_fn string) error {
-	insert := func(record []string, stmt *sql.Stmt) error {
-		if record[0] == "STATIONS_ID" {
-			return nil // header
-		}
 
-		var precip Precipitation
-		var err error
-		precip.Station = Station(record[PRECIP_STATIONS_ID_IDX])
+// Supported DWD datasets, see:
+// https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/
+// https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/hourly/
+// The `DESCRIPTION_*.pdf` files in each directory explain the columns.
+// Missing values (-999) are stored as NULL.
+var DWDDatasets = []*DWDDataset{
+	// STATIONS_ID;MESS_DATUM;  QN;PP_10;TT_10;TM5_10;RF_10;TD_10;eor
+	//        617;201911290000;    3;   -999;   7.4;   6.6;  89.5;   5.8;eor
+	// PP_10 is ignored, it's apparently always invalid for 10 minute readings
+	{
+		Name:    "temperature",
+		URL:     "10_minutes/air_temperature/recent/10minutenwerte_TU_%s_akt.zip",
+		Table:   "temperature",
+		DateFmt: DATE_FMT_10_MINUTES,
+		Columns: []DWDColumn{
+			{"TT_10", "temp2m", "FLOAT"},     // Lufttemperatur in 2m Hoehe
+			{"TM5_10", "temp5cm", "FLOAT"},   // Temp in 5cm
+			{"RF_10", "humidity2m", "FLOAT"}, // relative Feuchtigkeit in 2m
+			{"TD_10", "dewPoint", "FLOAT"},   // Taupunkt
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;  QN;RWS_DAU_10;RWS_10;RWS_IND_10;eor
+	//       2667;201911290000;    3;  10;   0.13;   1;eor
+	{
+		Name:    "precipitation",
+		URL:     "10_minutes/precipitation/recent/10minutenwerte_nieder_%s_akt.zip",
+		Table:   "precipitation",
+		DateFmt: DATE_FMT_10_MINUTES,
+		Columns: []DWDColumn{
+			{"RWS_DAU_10", "duration", "INTEGER"},  // Niederschlagsdauer
+			{"RWS_10", "sum_10", "FLOAT"},          // Summe des Niedeschlags
+			{"RWS_IND_10", "indicator", "BOOLEAN"}, // Niederschlagsindikator
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;  QN;DS_10;GS_10;SD_10;LS_10;eor
+	//       2667;201911290000;    3;   0.0;   0.0;   0.000;-999;eor
+	{
+		Name:    "solar",
+		URL:     "10_minutes/solar/recent/10minutenwerte_SOLAR_%s_akt.zip",
+		Table:   "solar",
+		DateFmt: DATE_FMT_10_MINUTES,
+		Columns: []DWDColumn{
+			{"DS_10", "diffuse", "FLOAT"},  // diffuse Himmelstrahlung J/cm^2
+			{"GS_10", "global", "FLOAT"},   // Globalstrahlung J/cm^2
+			{"SD_10", "duration", "FLOAT"}, // Sonnenscheindauer h
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;  QN;FF_10;DD_10;eor
+	//       5404;201911300000;    3;   3.9; 250;eor
+	{
+		Name:    "wind",
+		URL:     "10_minutes/wind/recent/10minutenwerte_wind_%s_akt.zip",
+		Table:   "wind",
+		DateFmt: DATE_FMT_10_MINUTES,
+		Columns: []DWDColumn{
+			{"FF_10", "wind_speed", "FLOAT"},  // average windspeed m/s
+			{"DD_10", "direction", "INTEGER"}, // direction in degrees
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;  QN;FX_10;FNX_10;FMX_10;DX_10;eor
+	{
+		Name:    "extreme_wind",
+		URL:     "10_minutes/extreme_wind/recent/10minutenwerte_extrema_wind_%s_akt.zip",
+		Table:   "extreme_wind",
+		DateFmt: DATE_FMT_10_MINUTES,
+		Columns: []DWDColumn{
+			{"FX_10", "gust_max", "FLOAT"},         // maximum gust m/s
+			{"FNX_10", "wind_min", "FLOAT"},        // minimum 10 minute windspeed
+			{"FMX_10", "wind_max", "FLOAT"},        // maximum 10 minute windspeed
+			{"DX_10", "gust_direction", "INTEGER"}, // direction of maximum gust
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;QN_9;TT_TU;RF_TU;eor
+	{
+		Name:    "temperature_hourly",
+		URL:     "hourly/air_temperature/recent/stundenwerte_TU_%s_akt.zip",
+		Table:   "temperature_hourly",
+		DateFmt: DATE_FMT_HOURLY,
+		Columns: []DWDColumn{
+			{"TT_TU", "temp2m", "FLOAT"},
+			{"RF_TU", "humidity2m", "FLOAT"},
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;QN_8;  R1;RS_IND;WRTR;eor
+	{
+		Name:    "precipitation_hourly",
+		URL:     "hourly/precipitation/recent/stundenwerte_RR_%s_akt.zip",
+		Table:   "precipitation_hourly",
+		DateFmt: DATE_FMT_HOURLY,
+		Columns: []DWDColumn{
+			{"R1", "sum_60", "FLOAT"},
+			{"RS_IND", "indicator", "BOOLEAN"},
+			{"WRTR", "form", "INTEGER"}, // form of precipitation (WR-code)
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;QN_592;ATMO_LBERG;FD_LBERG;FG_LBERG;SD_LBERG;ZENIT;MESS_DATUM_WOZ;eor
+	//       2667;2019112700:00;    4;   -999;   0.00;   0.00;   0;  150.56;2019112700:00;eor
+	// hourly solar data is only available as a single ("row") file.
+	{
+		Name:    "solar_hourly",
+		URL:     "hourly/solar/stundenwerte_ST_%s_row.zip",
+		Table:   "solar_hourly",
+		DateFmt: DATE_FMT_HOURLY + ":04",
+		Columns: []DWDColumn{
+			{"ATMO_LBERG", "atmospheric", "FLOAT"},
+			{"FD_LBERG", "diffuse", "FLOAT"},
+			{"FG_LBERG", "global", "FLOAT"},
+			{"SD_LBERG", "duration", "INTEGER"}, // minutes
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;QN_3;   F;   D;eor
+	//       2667;2019112700;   10;   4.2; 150;eor
+	{
+		Name:    "wind_hourly",
+		URL:     "hourly/wind/recent/stundenwerte_FF_%s_akt.zip",
+		Table:   "wind_hourly",
+		DateFmt: DATE_FMT_HOURLY,
+		Columns: []DWDColumn{
+			{"F", "wind_speed", "FLOAT"},
+			{"D", "direction", "INTEGER"},
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;QN_8;FX_911;eor
+	{
+		Name:    "extreme_wind_hourly",
+		URL:     "hourly/extreme_wind/recent/stundenwerte_FX_%s_akt.zip",
+		Table:   "extreme_wind_hourly",
+		DateFmt: DATE_FMT_HOURLY,
+		Columns: []DWDColumn{
+			{"FX_911", "gust_max", "FLOAT"},
+		},
+	},
+	// STATIONS_ID;MESS_DATUM;QN_8;   P;  P0;eor
+	{
+		Name:    "pressure_hourly",
+		URL:     "hourly/pressure/recent/stundenwerte_P0_%s_akt.zip",
+		Table:   "pressure_hourly",
+		DateFmt: DATE_FMT_HOURLY,
+		Columns: []DWDColumn{
+			{"P", "pressure_sea_level", "FLOAT"},
+			{"P0", "pressure_station", "FLOAT"},
+		},
+	},
+}
 
-		if precip.Timestamp, err = time.Parse(PRECIP_DATE_FMT, record[PRECIP_MESS_DATUM_IDX]+"MEZ"); err != nil {
-			return err
+// Lookup dataset by `Name`, returns nil if no such dataset exists.
+func FindDWDDataset(name string) *DWDDataset {
+	for _, ds := range DWDDatasets {
+		if ds.Name == name {
+			return ds
 		}
-		if sum10m, err := strconv.ParseFloat(record[PRECIP_RWS_10_IDX], 32); err != nil {
-			return err
-		} else {
-			precip.Sum10m = float32(sum10m)
-		}
-
-		return precip.Insert(stmt)
 	}
-
-	return importDWDData(
-		db_fn,
-		DB_TABLE_PRECIPITATION,
-		DB_INSERT_PRECIPITATION,
-		PRECIPITATION_URL,
-		insert,
-	)
+	return nil
 }
 
-const SOLAR_URL = "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/solar/recent/10minutenwerte_SOLAR_02667_akt.zip"
-
-// STATIONS_ID;MESS_DATUM;  QN;DS_10;GS_10;SD_10;LS_10;eor
-//       2667;201911290000;    3;   0.0;   0.0;   0.000;-999;eor
-// DS_10 diffuse himmelstrahlung Joule
-// GS_10 Globalstrahlung Joule
-// SD_10 Sunshine duration
-
-const (
-	SOLAR_STATIONS_ID_IDX = iota
-	SOLAR_MESS_DATUM_IDX
-	SOLAR_QN_IDX
-	SOLAR_DS_10_IDX
-	SOLAR_GS_10_IDX
-	SOLAR_SD_10_IDX
-	SOLAR_LS_10_IDX
-	SOLAR_eor_IDX
-
-	SOLAR_DATEFMT = DATE_FMT
-)
-
-type Solar struct {
-	Observation
-	DiffuseIrradiation float32
-	GlobalIrradiation  float32
-	Duration10m        float32
+// Download URL of the dataset for `station`
+func (ds *DWDDataset) DownloadURL(station Station) string {
+	return BASE_DWD_CDC_URL + fmt.Sprintf(ds.URL, station.padded())
 }
 
-const DB_TABLE_SOLAR = `
-	DROP TABLE IF EXISTS solar;
-	CREATE TABLE IF NOT EXISTS solar (
-		solar_id INTEGER PRIMARY KEY AUTOINCREMENT,
+// CREATE TABLE statement for the dataset. Observations are unique per
+// station and timestamp, reimporting overwrites existing values.
+func (ds *DWDDataset) createTable() string {
+	var cols strings.Builder
+	for _, c := range ds.Columns {
+		fmt.Fprintf(&cols, "\t\t%s %s,\n", c.Column, c.Type)
+	}
+	return fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		%s_id INTEGER PRIMARY KEY AUTOINCREMENT,
 		station VARCHAR,
 		ts INTEGER,
-		diffuse FLOAT,
-		global FLOAT,
-		duration FLOAT
-	)
-`
-const DB_INSERT_SOLAR = `
-	INSERT INTO solar (
-		station, ts, diffuse, global, duration
-	) VALUES (
-		:station, :ts, :diffuse, :global, :duration
-	)
-`
-
-func (w *Solar) Insert(stmt *sql.Stmt) error {
-	_, err := stmt.Exec(
-		w.Station,
-		w.Timestamp.Unix(),
-		w.DiffuseIrradiation,
-		w.GlobalIrradiation,
-		w.Duration10m,
-	)
-	return err
+%s		UNIQUE (station, ts)
+	)`, ds.Table, ds.Table, cols.String())
 }
 
-func ImportSolar(db_fn string) error {
-	insert := func(record []string, stmt *sql.Stmt) error {
-		if record[0] == "STATIONS_ID" {
-			return nil // header
-		}
-
-		var solar Solar
-		var err error
-		solar.Station = Station(record[SOLAR_STATIONS_ID_IDX])
+// Removes duplicate observations, keeping the last imported, and adds the
+// unique index on station and timestamp that tables created by earlier
+// versions lack.
+func (ds *DWDDataset) uniqueIndex() string {
+	return fmt.Sprintf(`
+	DELETE FROM %[1]s WHERE %[1]s_id NOT IN (
+		SELECT MAX(%[1]s_id) FROM %[1]s GROUP BY station, ts
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_station_ts ON %[1]s (station, ts)`, ds.Table)
+}
 
-		if solar.Timestamp, err = time.Parse(SOLAR_DATEFMT, record[SOLAR_MESS_DATUM_IDX]+"MEZ"); err != nil {
-			return err
-		}
-		if diffuse, err := strconv.ParseFloat(record[SOLAR_DS_10_IDX], 32); err != nil {
-			return err
-		} else {
-			solar.DiffuseIrradiation = float32(diffuse)
+// Whether the dataset's table has a unique index on station and
+// timestamp, either from the UNIQUE constraint or `uniqueIndex`.
+func (ds *DWDDataset) hasUniqueIndex(tx *sql.Tx) (bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_index_list(:TABLE) WHERE "unique" = 1`, ds.Table)
+	if err != nil {
+		return false, err
+	}
+	var indexes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return false, err
 		}
-
-		if global, err := strconv.ParseFloat(record[SOLAR_GS_10_IDX], 32); err != nil {
-			return err
-		} else {
-			solar.GlobalIrradiation = float32(global)
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	for _, index := range indexes {
+		var columns string
+		err := tx.QueryRow(`SELECT group_concat(name) FROM (SELECT name FROM pragma_index_info(:INDEX) ORDER BY seqno)`, index).Scan(&columns)
+		if err != nil {
+			return false, err
 		}
-
-		if duration, err := strconv.ParseFloat(record[SOLAR_SD_10_IDX], 32); err != nil {
-			return err
-		} else {
-			solar.Duration10m = float32(duration)
+		if columns == "station,ts" {
+			return true, nil
 		}
-
-		return solar.Insert(stmt)
 	}
-
-	return importDWDData(
-		db_fn,
-		DB_TABLE_SOLAR,
-		DB_INSERT_SOLAR,
-		SOLAR_URL,
-		insert,
-	)
+	return false, nil
 }
 
-const WIND_URL = "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/wind/recent/10minutenwerte_wind_02667_akt.zip"
-
-// STATIONS_ID;MESS_DATUM;  QN;FF_10;DD_10;eor
-//       5404;201911300000;    3;   3.9; 250;eor
-// FF_10 average windspeed
-// DD_10 direction
-type Wind struct {
-	Observation
-	WindSpeed float32
-	Direction int
-}
-
-const (
-	WIND_STATIONS_ID_IDX = iota
-	WIND_MESS_DATUM_IDX  // YYYYMMDDHH
-	WIND_QN_3_IDX        // quality level ...
-	WIND_F_IDX           // f is for Force?
-	WIND_D_IDX           // Direction?
-	WIND_EOR_IDX         // no clue
-
-	WIND_DATE_FMT = DATE_FMT
-)
-
-const DB_TABLE_WIND = `
-	DROP TABLE IF EXISTS wind;
-	CREATE TABLE IF NOT EXISTS wind (
-		wind_id INTEGER PRIMARY KEY AUTOINCREMENT,
-		station VARCHAR,
-		ts INTEGER,
-		wind_speed FLOAT,
-		direction INTEGER
-	)`
-
-const DB_INSERT_WIND = `
-	INSERT INTO wind (
-		station, ts, wind_speed, direction
+func (ds *DWDDataset) insert() string {
+	cols := []string{"station", "ts"}
+	params := []string{":station", ":ts"}
+	for _, c := range ds.Columns {
+		cols = append(cols, c.Column)
+		params = append(params, ":"+c.Column)
+	}
+	return fmt.Sprintf(`
+	INSERT OR REPLACE INTO %s (
+		%s
 	) VALUES (
-		:station, :ts, :wind_speed, :direction
-	)
-`
-
-func (w *Wind) Insert(stmt *sql.Stmt) error {
-	_, err := stmt.Exec(
-		w.Station,
-		w.Timestamp.Unix(),
-		w.WindSpeed,
-		w.Direction,
-	)
-	return err
+		%s
+	)`, ds.Table, strings.Join(cols, ", "), strings.Join(params, ", "))
 }
 
-func ImportWind(db_fn string) error {
-	insert := func(record []string, stmt *sql.Stmt) error {
-		if record[0] == "STATIONS_ID" {
-			return nil // header
-		}
-
-		var wind Wind
-		var err error
-		wind.Station = Station(record[WIND_STATIONS_ID_IDX])
-
-		if wind.Timestamp, err = time.Parse(WIND_DATE_FMT, record[WIND_MESS_DATUM_IDX]+"MEZ"); err != nil {
-			return err
-		}
-		if windSpeed, err := strconv.ParseFloat(record[WIND_F_IDX], 32); err != nil {
-			return err
-		} else {
-			wind.WindSpeed = float32(windSpeed)
-		}
-		if direction, err := strconv.ParseInt(record[WIND_D_IDX], 10, 32); err != nil {
-			return err
-		} else {
-			wind.Direction = int(direction)
-		}
-
-		return wind.Insert(stmt)
+// Parses a single value according to `c.Type`, DWD's missing
+// value marker is converted to NULL.
+func (c *DWDColumn) parse(value string) (interface{}, error) {
+	if value == "-999" || value == "" {
+		return nil, nil
+	}
+	switch c.Type {
+	case "FLOAT":
+		return strconv.ParseFloat(value, 64)
+	case "INTEGER":
+		return strconv.ParseInt(value, 10, 64)
+	case "BOOLEAN":
+		i, err := strconv.ParseInt(value, 10, 64)
+		return i != 0, err
+	default:
+		return nil, fmt.Errorf("unknown column type %s for %s", c.Type, c.Column)
 	}
-
-	return importDWDData(
-		db_fn,
-		DB_TABLE_WIND,
-		DB_INSERT_WIND,
-		WIND_URL,
-		insert,
-	)
 }
 
-func importDWDData(
-	db_fn string,
-	db_create_stmt string,
-	db_insert_stmt string,
-	url string,
-	insert func(csvRecord []string, db *sql.Stmt) error) error {
-	db, err := sql.Open("sqlite3", db_fn)
+// Download the dataset `ds` for `station` and store it in the sqlite db
+// `db_fn`.
+func ImportDWD(db_fn string, ds *DWDDataset, station Station) error {
+	db, err := openSqliteDB(db_fn, false)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer db.Close()
 
-	_, err = db.Exec(db_create_stmt)
+	reader, err := getZippedAsReader(ds.DownloadURL(station))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	_, err = importDWDData(db.db, ds, reader)
+	return err
+}
+
+// Reads the `;` separated DWD data from `reader` and stores it according
+// to `ds`. Columns are located via the header line, so the order of
+// columns in the file is irrelevant. Returns the number of imported rows.
+func importDWDData(db *sql.DB, ds *DWDDataset, reader io.Reader) (int, error) {
+	if _, err := db.Exec(ds.createTable()); err != nil {
+		return 0, err
 	}
 
 	tx, err := db.Begin()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	defer tx.Commit()
 
-	stmt, err := tx.Prepare(db_insert_stmt)
+	// INSERT OR REPLACE relies on the unique index to deduplicate
+	unique, err := ds.hasUniqueIndex(tx)
+	if err == nil && !unique {
+		logger("weather").Info("adding unique index, removing duplicates", "table", ds.Table)
+		_, err = tx.Exec(ds.uniqueIndex())
+	}
 	if err != nil {
 		tx.Rollback()
-		panic(err)
+		return 0, err
 	}
-	defer stmt.Close()
 
-	reader, err := getZippedAsReader(url)
+	stmt, err := tx.Prepare(ds.insert())
 	if err != nil {
 		tx.Rollback()
-		panic(err)
-
+		return 0, err
 	}
+	defer stmt.Close()
 
 	csvReader := csv.NewReader(reader)
 	csvReader.Comma = ';'
-	i := 0
+
+	var stationIdx, dateIdx int
+	var colIdx []int
+	count := 0
 	for {
-		println(i)
-		i += 1
 		record, err := csvReader.Read()
-		if err != nil {
-			if err == io.EOF {
-				break // done
+		if err == io.EOF {
+			break // done
+		} else if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		if record[0] == "STATIONS_ID" { // header
+			if stationIdx, dateIdx, colIdx, err = ds.columnIndexes(record); err != nil {
+				tx.Rollback()
+				return 0, err
 			}
+			continue
+		}
+		if colIdx == nil {
 			tx.Rollback()
-			panic(err)
+			return 0, fmt.Errorf("%s: data before header", ds.Name)
 		}
-		var trimmed []string
-		for _, csv_entry := range record {
-			trimmed = append(trimmed, strings.TrimSpace(csv_entry))
+
+		ts, err := time.ParseInLocation(ds.DateFmt, record[dateIdx], time.UTC)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
 		}
-		if err := insert(trimmed, stmt); err != nil {
+		values := []interface{}{normalizeStation(record[stationIdx]), ts.Unix()}
+		for i, idx := range colIdx {
+			v, err := ds.Columns[i].parse(record[idx])
+			if err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("%s: invalid %s: %v", ds.Name, ds.Columns[i].DWDName, err)
+			}
+			values = append(values, v)
+		}
+		if _, err := stmt.Exec(values...); err != nil {
 			tx.Rollback()
-			panic(err)
+			return 0, err
 		}
+		count += 1
+	}
+	return count, tx.Commit()
+}
 
+// Determine the positions of the station, date and configured columns
+// in the header.
+func (ds *DWDDataset) columnIndexes(header []string) (station, date int, cols []int, err error) {
+	idx := make(map[string]int)
+	for i, name := range header {
+		idx[name] = i
 	}
-	return nil
+	var ok bool
+	if station, ok = idx["STATIONS_ID"]; !ok {
+		return 0, 0, nil, fmt.Errorf("%s: missing STATIONS_ID", ds.Name)
+	}
+	if date, ok = idx["MESS_DATUM"]; !ok {
+		return 0, 0, nil, fmt.Errorf("%s: missing MESS_DATUM", ds.Name)
+	}
+	for _, c := range ds.Columns {
+		i, ok := idx[c.DWDName]
+		if !ok {
+			return 0, 0, nil, fmt.Errorf("%s: missing column %s", ds.Name, c.DWDName)
+		}
+		cols = append(cols, i)
+	}
+	return station, date, cols, nil
 }
 
-// TODO figure out how to close all the intermediate readers.
+// Retrieves the zip file at `url` and returns a reader for the contained
+// data file (`produkt_*`). The zip files also contain various metadata
+// files which are ignored.
 func getZippedAsReader(url string) (io.Reader, error) {
 	resp, err := http.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not retrieve %s: %s", url, resp.Status)
+	}
 
-	tmpFile, err := ioutil.TempFile(os.TempDir(), "dwd-")
+	// DWD files are a couple of MB at most.
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	defer os.Remove(tmpFile.Name())
-
-	size, err := io.Copy(tmpFile, resp.Body)
+	zipreader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
 		return nil, err
 	}
 
-	// go docs are very cavalier about what the size parameter is meant to mean.
-	// Do I have to check the lenght before decoding? Or can I just put something random in?
-
-	zipreader, err := zip.NewReader(tmpFile, size)
-
 	for _, f := range zipreader.File {
-		fmt.Printf("reading: %s\n", f.Name)
-		if fileReader, err := f.Open(); err != nil {
-			return nil, err
-		} else {
-			return fileReader, nil
+		if strings.HasPrefix(f.Name, "produkt") {
+			return f.Open()
 		}
 	}
-	return nil, nil // can't happen
-
+	return nil, fmt.Errorf("no data file in %s", url)
 }
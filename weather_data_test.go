@@ -1,49 +1,169 @@
 package mqttGather
 
-/*
 import (
-	"io"
+	"database/sql"
 	"os"
 	"testing"
 )
-*/
 
-/*
-func TestWeatherDataDownload(t *testing.T) {
+func TestDWDDatasets(t *testing.T) {
+	names := make(map[string]bool)
+	for _, ds := range DWDDatasets {
+		if ds.Name == "" || ds.Table == "" || ds.URL == "" || ds.DateFmt == "" || len(ds.Columns) == 0 {
+			t.Fatalf("incomplete dataset: %#v", ds)
+		}
+		if names[ds.Name] {
+			t.Fatalf("duplicate dataset: %s", ds.Name)
+		}
+		names[ds.Name] = true
+	}
 
-	url := "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/air_temperature/recent/10minutenwerte_TU_02667_akt.zip"
+	db := getTestDB(t)
+	defer db.Close()
+	for _, ds := range DWDDatasets {
+		if _, err := db.db.Exec(ds.createTable()); err != nil {
+			t.Fatalf("%s: %v", ds.Name, err)
+		}
+	}
+}
 
-	reader, err := getZippedAsReader(url)
+func TestDownloadURL(t *testing.T) {
+	url := FindDWDDataset("temperature").DownloadURL(DEFAULT_STATION)
+	should := "https://opendata.dwd.de/climate_environment/CDC/observations_germany/climate/10_minutes/air_temperature/recent/10minutenwerte_TU_02667_akt.zip"
+	if url != should {
+		t.Fatalf("is: %s should: %s", url, should)
+	}
+}
+
+func TestImportHourlyWind(t *testing.T) {
+	f, err := os.Open("test_data/produkt_ff_stunde_20191127_20210529_02667.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
-	//defer reader.Close()
-	io.Copy(os.Stdout, reader)
+	defer f.Close()
 
-}
+	db := getTestDB(t)
+	defer db.Close()
 
-func TestImportWind(t *testing.T) {
-	err := ImportWind("weather.sqlite3")
+	count, err := importDWDData(db.db, FindDWDDataset("wind_hourly"), f)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
-func TestImportSolar(t *testing.T) {
-	err := ImportSolar("weather.sqlite3")
+	if count != 13200 {
+		t.Fatalf("imported %d rows", count)
+	}
+
+	var speed float64
+	var direction int64
+	// 2021052923 -> 2021-05-29T23:00:00Z
+	err = db.db.QueryRow(`SELECT wind_speed, direction FROM wind_hourly WHERE station = '2667' AND ts = 1622329200`).Scan(&speed, &direction)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if speed != 1.0 || direction != 150 {
+		t.Fatalf("incorrect values: %f %d", speed, direction)
+	}
+
+	var missing int64
+	if err := db.db.QueryRow(`SELECT count(*) FROM wind_hourly WHERE wind_speed IS NULL OR direction IS NULL`).Scan(&missing); err != nil {
+		t.Fatal(err)
+	}
+	if missing == 0 {
+		t.Fatalf("expected missing values to be NULL")
+	}
+
+	// reimport replaces existing rows.
+	f.Seek(0, 0)
+	if _, err := importDWDData(db.db, FindDWDDataset("wind_hourly"), f); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	if err := db.db.QueryRow(`SELECT count(*) FROM wind_hourly`).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if total != 13200 {
+		t.Fatalf("reimport duplicated rows: %d", total)
+	}
 }
-func TestImportTemperature(t *testing.T) {
-	err := ImportTemperature("weather.sqlite3")
+
+func TestImportDeduplicatesOldTables(t *testing.T) {
+	f, err := os.Open("test_data/produkt_ff_stunde_20191127_20210529_02667.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer f.Close()
+
+	db := getTestDB(t)
+	defer db.Close()
+
+	// table as created by earlier versions, without UNIQUE (station, ts)
+	for _, sql := range []string{
+		`CREATE TABLE wind_hourly (wind_hourly_id INTEGER PRIMARY KEY AUTOINCREMENT, station VARCHAR, ts INTEGER, wind_speed FLOAT, direction INTEGER)`,
+		`INSERT INTO wind_hourly (station, ts, wind_speed, direction) VALUES ('2667', 1622329200, 5, 10), ('2667', 1622329200, 6, 20), ('2667', 1, 7, 30), ('2667', 1, 8, 40)`,
+	} {
+		if _, err := db.db.Exec(sql); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := importDWDData(db.db, FindDWDDataset("wind_hourly"), f); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	if err := db.db.QueryRow(`SELECT count(*) FROM wind_hourly`).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	// the imported rows and the last of the duplicates not in the file
+	if total != 13200+1 {
+		t.Fatalf("duplicate rows: %d", total)
+	}
+	var speed float64
+	if err := db.db.QueryRow(`SELECT wind_speed FROM wind_hourly WHERE ts = 1`).Scan(&speed); err != nil || speed != 8 {
+		t.Fatalf("expected the last duplicate to be kept: %f %v", speed, err)
+	}
+
+	// tables with the UNIQUE constraint don't need the index
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if unique, err := FindDWDDataset("wind").hasUniqueIndex(tx); err != nil || unique {
+		t.Fatalf("missing table reported as indexed: %v", err)
+	}
+	if _, err := tx.Exec(FindDWDDataset("wind").createTable()); err != nil {
+		t.Fatal(err)
+	}
+	if unique, err := FindDWDDataset("wind").hasUniqueIndex(tx); err != nil || !unique {
+		t.Fatalf("UNIQUE constraint not detected: %v", err)
+	}
 }
-func TestImportPrecipitation(t *testing.T) {
-	err := ImportPrecipitation("weather.sqlite3")
+
+func TestImportMissingColumn(t *testing.T) {
+	f, err := os.Open("test_data/produkt_ff_stunde_20191127_20210529_02667.txt")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer f.Close()
+
+	db := getTestDB(t)
+	defer db.Close()
+
+	// 10 minute wind expects FF_10 and DD_10
+	if _, err := importDWDData(db.db, FindDWDDataset("wind"), f); err == nil {
+		t.Fatalf("expected error")
+	}
+	var dummy sql.NullInt64
+	if err := db.db.QueryRow(`SELECT count(*) FROM wind`).Scan(&dummy); err != nil || dummy.Int64 != 0 {
+		t.Fatalf("expected empty table: %v %v", dummy, err)
+	}
+}
+
+/*
+func TestImportDWD(t *testing.T) {
+	for _, ds := range DWDDatasets {
+		if err := ImportDWD("weather.sqlite3", ds, DEFAULT_STATION); err != nil {
+			t.Fatalf("%s: %v", ds.Name, err)
+		}
+	}
 }
 */
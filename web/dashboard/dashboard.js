@@ -0,0 +1,317 @@
+// OpenNoise dashboard, see dashboard.go for the API.
+"use strict";
+
+const STALE_MS = 10 * 60 * 1000;
+const QUIET = 55;
+const MODERATE = 65;
+const DEVICES_INTERVAL_MS = 60 * 1000;
+
+const devices = new Map(); // by signifier, see DashboardDevice
+let selected = null;
+let series = []; // {t: Date, average, max} of the selected device
+
+function el(tag, attrs, text) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    e.setAttribute(k, v);
+  }
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+function svg(tag, attrs) {
+  const e = document.createElementNS("http://www.w3.org/2000/svg", tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    e.setAttribute(k, v);
+  }
+  return e;
+}
+
+function name(d) {
+  return d.description || d.device;
+}
+
+function fmtTime(ts) {
+  return ts ? new Date(ts).toLocaleString() : "–";
+}
+
+function fmtLevel(v) {
+  return v === undefined || v === null ? "–" : v.toFixed(1) + " dBA";
+}
+
+function isStale(ts) {
+  return !ts || Date.now() - new Date(ts).getTime() > STALE_MS;
+}
+
+// CSS class of a device's marker, see the legend.
+function levelClass(d) {
+  if (isStale(d.last_seen)) {
+    return "stale";
+  }
+  if (d.alert_state === "alert" || d.alert_state === "exceeded" ||
+      (d.threshold && d.max >= d.threshold)) {
+    return "exceeded";
+  }
+  if (d.level < QUIET) {
+    return "quiet";
+  }
+  if (d.level < MODERATE) {
+    return "moderate";
+  }
+  return "loud";
+}
+
+async function getJSON(path) {
+  const res = await fetch(path, {cache: "no-store"});
+  if (!res.ok) {
+    throw new Error(path + ": " + res.status);
+  }
+  return res.json();
+}
+
+// Map
+
+function renderMap() {
+  const map = document.getElementById("map");
+  map.replaceChildren();
+  const located = [...devices.values()].filter(d => d.latitude !== undefined && d.longitude !== undefined);
+  if (located.length === 0) {
+    const t = svg("text", {x: 20, y: 30});
+    t.textContent = "No device info with locations.";
+    map.append(t);
+    return;
+  }
+  const lats = located.map(d => d.latitude);
+  const lons = located.map(d => d.longitude);
+  const pad = 0.005;
+  const minLat = Math.min(...lats) - pad, maxLat = Math.max(...lats) + pad;
+  const minLon = Math.min(...lons) - pad, maxLon = Math.max(...lons) + pad;
+  // equirectangular, longitudes shortened by the latitude
+  const kx = Math.cos((minLat + maxLat) / 2 * Math.PI / 180);
+  const w = 600, h = 400, margin = 30;
+  const scale = Math.min((w - 2 * margin) / ((maxLon - minLon) * kx), (h - 2 * margin) / (maxLat - minLat));
+  const x0 = (w - (maxLon - minLon) * kx * scale) / 2;
+  const y0 = (h - (maxLat - minLat) * scale) / 2;
+
+  for (const d of located) {
+    const x = x0 + (d.longitude - minLon) * kx * scale;
+    const y = h - y0 - (d.latitude - minLat) * scale;
+    const c = svg("circle", {cx: x, cy: y, r: 9, class: levelClass(d) + (d.device === selected ? " selected" : "")});
+    const title = svg("title");
+    title.textContent = name(d) + "\n" + fmtLevel(d.level) + "\n" + fmtTime(d.last_seen);
+    c.append(title);
+    c.addEventListener("click", () => select(d.device));
+    const label = svg("text", {x: x + 12, y: y + 4});
+    label.textContent = name(d);
+    map.append(c, label);
+  }
+}
+
+// Chart
+
+function renderChart() {
+  const canvas = document.getElementById("chart");
+  const ctx = canvas.getContext("2d");
+  const w = canvas.width, h = canvas.height;
+  const left = 45, right = 10, top = 10, bottom = 25;
+  ctx.clearRect(0, 0, w, h);
+  if (series.length === 0) {
+    ctx.fillStyle = "#666";
+    ctx.fillText(selected ? "No data." : "", left, h / 2);
+    return;
+  }
+  const t0 = series[0].t.getTime(), t1 = Math.max(series[series.length - 1].t.getTime(), t0 + 1);
+  const values = series.flatMap(p => [p.average, p.max]);
+  const device = devices.get(selected);
+  if (device && device.threshold) {
+    values.push(device.threshold);
+  }
+  const lo = Math.floor(Math.min(...values) / 10) * 10;
+  const hi = Math.ceil(Math.max(...values) / 10) * 10 || lo + 10;
+  const x = t => left + (t - t0) / (t1 - t0) * (w - left - right);
+  const y = v => h - bottom - (v - lo) / (hi - lo) * (h - top - bottom);
+
+  ctx.strokeStyle = "#ddd";
+  ctx.fillStyle = "#666";
+  ctx.lineWidth = 1;
+  ctx.textAlign = "right";
+  for (let v = lo; v <= hi; v += 10) {
+    ctx.beginPath();
+    ctx.moveTo(left, y(v));
+    ctx.lineTo(w - right, y(v));
+    ctx.stroke();
+    ctx.fillText(v + " dB", left - 5, y(v) + 4);
+  }
+  ctx.textAlign = "center";
+  for (let i = 0; i <= 4; i++) {
+    const t = t0 + (t1 - t0) * i / 4;
+    ctx.fillText(new Date(t).toLocaleTimeString([], {hour: "2-digit", minute: "2-digit"}), x(t), h - 8);
+  }
+
+  if (device && device.threshold) {
+    ctx.strokeStyle = "#e53935";
+    ctx.setLineDash([4, 4]);
+    ctx.beginPath();
+    ctx.moveTo(left, y(device.threshold));
+    ctx.lineTo(w - right, y(device.threshold));
+    ctx.stroke();
+    ctx.setLineDash([]);
+  }
+
+  for (const [key, color] of [["max", "#e53935"], ["average", "#1e88e5"]]) {
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 1.5;
+    ctx.beginPath();
+    series.forEach((p, i) => {
+      const px = x(p.t.getTime()), py = y(p[key]);
+      i === 0 ? ctx.moveTo(px, py) : ctx.lineTo(px, py);
+    });
+    ctx.stroke();
+  }
+}
+
+async function loadSeries() {
+  if (!selected) {
+    return;
+  }
+  const hours = document.getElementById("hours").value;
+  const stats = await getJSON("api/devices/" + encodeURIComponent(selected) + "/stats?hours=" + hours);
+  series = stats.map(s => ({t: new Date(s.timestamp), average: s.leq, max: s.max}));
+  renderChart();
+}
+
+function select(device) {
+  selected = device;
+  const d = devices.get(device);
+  document.getElementById("chart-title").textContent = d ? name(d) : device;
+  series = [];
+  renderMap();
+  renderChart();
+  loadSeries().catch(showError);
+}
+
+// Tables
+
+function renderHealth() {
+  const body = document.getElementById("health");
+  body.replaceChildren();
+  for (const d of devices.values()) {
+    const tel = d.telemetry || {};
+    const esp = tel.esp, ver = tel.ver;
+    const lastTelemetry = Object.values(tel).map(t => t.timestamp).sort().pop();
+    const row = el("tr", isStale(d.last_seen) ? {class: "old"} : {});
+    row.append(
+      el("td", {}, name(d)),
+      el("td", {}, fmtLevel(d.level)),
+      el("td", {}, fmtTime(d.last_seen)),
+      el("td", {}, esp ? esp.value + " B" : "–"),
+      el("td", {}, ver ? ver.value : "–"),
+      el("td", {}, fmtTime(lastTelemetry)),
+    );
+    row.addEventListener("click", () => select(d.device));
+    body.append(row);
+  }
+}
+
+async function loadAlerts() {
+  const alerts = await getJSON("api/alerts?limit=20");
+  const body = document.getElementById("alerts");
+  body.replaceChildren();
+  if (alerts.length === 0) {
+    const row = el("tr");
+    row.append(el("td", {colspan: 4}, "No alerts sent recently."));
+    body.append(row);
+  }
+  for (const a of alerts) {
+    const d = devices.get(a.device);
+    const row = el("tr");
+    row.append(
+      el("td", {}, fmtTime(a.timestamp)),
+      el("td", {}, d ? name(d) : a.device),
+      el("td", {class: "message"}, a.message),
+      el("td", {}, a.status),
+    );
+    body.append(row);
+  }
+}
+
+async function loadDevices() {
+  const list = await getJSON("api/devices");
+  devices.clear();
+  for (const d of list) {
+    devices.set(d.device, d);
+  }
+  renderMap();
+  renderHealth();
+}
+
+// Live events
+
+function connect() {
+  const status = document.getElementById("status");
+  const events = new EventSource("api/events");
+  events.onopen = () => {
+    status.textContent = "live";
+    status.className = "status live";
+  };
+  events.onerror = () => {
+    status.textContent = "reconnecting…";
+    status.className = "status error";
+  };
+  events.addEventListener("stats", e => {
+    const s = JSON.parse(e.data);
+    const d = devices.get(s.device);
+    if (!d) {
+      loadDevices().catch(showError);
+      return;
+    }
+    d.level = s.average;
+    d.max = s.max;
+    d.last_seen = s.timestamp;
+    if (s.device === selected) {
+      series.push({t: new Date(s.timestamp), average: s.average, max: s.max});
+      renderChart();
+    }
+    renderMap();
+    renderHealth();
+  });
+  events.addEventListener("telemetry", e => {
+    const t = JSON.parse(e.data);
+    const d = devices.get(t.device);
+    if (d) {
+      d.telemetry = d.telemetry || {};
+      d.telemetry[t.type] = {name: t.name, value: String(t.value), timestamp: t.timestamp};
+      renderHealth();
+    }
+  });
+  events.addEventListener("alert_state", e => {
+    const a = JSON.parse(e.data);
+    const d = devices.get(a.device);
+    if (d) {
+      d.alert_state = a.state;
+      renderMap();
+    }
+  });
+  events.addEventListener("alert", () => loadAlerts().catch(showError));
+}
+
+function showError(err) {
+  const status = document.getElementById("status");
+  status.textContent = err.message;
+  status.className = "status error";
+}
+
+document.getElementById("hours").addEventListener("change", () => loadSeries().catch(showError));
+loadDevices()
+  .then(() => {
+    const first = [...devices.values()].find(d => !isStale(d.last_seen)) || devices.values().next().value;
+    if (first) {
+      select(first.device);
+    }
+    return loadAlerts();
+  })
+  .catch(showError);
+connect();
+setInterval(() => loadDevices().catch(showError), DEVICES_INTERVAL_MS);